@@ -0,0 +1,186 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/subtle"
+	"embed"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+//go:embed ui
+var ui_files embed.FS
+
+var ui_templates = template.Must(
+	template.New("").Funcs(template.FuncMap{
+		"bytes":   format_bytes,
+		"percent": percent_used,
+	}).ParseFS(ui_files, "ui/*.html"),
+)
+
+const KFS_UI_LIST_LIMIT = 100
+
+type dashboard struct {
+	Version  string
+	Search   string
+	ReadOnly read_only_state
+	Disks    []disk_usage
+	Scrubs   []disk_scrub
+	Files    []file_entry
+	Failures []archive_failure
+	Backups  []backup_status
+}
+
+func format_bytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func percent_used(disk disk_usage) float64 {
+	if disk.Total == 0 {
+		return 0
+	}
+	used := float64(disk.Total) - float64(disk.Available)
+	return 100 * used / float64(disk.Total)
+}
+
+/**
+ * Render the admin dashboard: disk utilization, how the scrub of each disk
+ * went, recently uploaded (or searched for) files, archive jobs that failed
+ * to reach storage, and when each machine last backed up.
+ */
+func handle_admin(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	var err error
+	page := dashboard{
+		Version:  KFS_VERSION,
+		Search:   request.URL.Query().Get("q"),
+		ReadOnly: read_only_get(),
+	}
+
+	page.Disks, err = db_list_disks()
+	if err != nil {
+		log.Println(err)
+		write_error(writer, "could not list disks", http.StatusInternalServerError)
+		return
+	}
+	page.Scrubs, err = db_list_scrubs()
+	if err != nil {
+		log.Println(err)
+		write_error(writer, "could not list scrubs", http.StatusInternalServerError)
+		return
+	}
+	page.Files, err = db_list_files(page.Search, KFS_UI_LIST_LIMIT)
+	if err != nil {
+		log.Println(err)
+		write_error(writer, "could not list files", http.StatusInternalServerError)
+		return
+	}
+	page.Failures, err = db_list_archive_failures(KFS_UI_LIST_LIMIT)
+	if err != nil {
+		log.Println(err)
+		write_error(writer, "could not list failures", http.StatusInternalServerError)
+		return
+	}
+	page.Backups, err = db_list_backups()
+	if err != nil {
+		log.Println(err)
+		write_error(writer, "could not list backups", http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = ui_templates.ExecuteTemplate(writer, "dashboard.html", page)
+	if err != nil {
+		log.Printf("failed to render dashboard: %v", err)
+	}
+}
+
+/**
+ * The dashboard and the endpoints under /admin, apart from reading whether
+ * the server is read-only, take the admin token from the config file, as
+ * do the few elsewhere that lift protections or report backups. It is sent
+ * as
+ *     curl -H "Authorization: Bearer $TOKEN" -X POST localhost:8080/admin/reload
+ * or as the password of basic auth, with any user name, so that a browser
+ * can ask for it:
+ *     curl -u admin:$TOKEN localhost:8080/admin
+ * With no token configured they are only served to requests made on this
+ * machine, and not to those a proxy passed on, since a proxy in front of
+ * kfs connects from this machine for everyone.
+ */
+var KFS_ADMIN_TOKEN = ""
+
+func admin_allowed(request *http.Request) bool {
+	admin_token := settings().admin_token
+	if admin_token == "" {
+		if request.Header.Get("X-Forwarded-For") != "" || request.Header.Get("Forwarded") != "" {
+			return false
+		}
+		host, _, err := net.SplitHostPort(request.RemoteAddr)
+		if err != nil {
+			return false
+		}
+		ip := net.ParseIP(host)
+		return ip != nil && ip.IsLoopback()
+	}
+	token := ""
+	if _, password, ok := request.BasicAuth(); ok {
+		token = password
+	} else if auth := request.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	} else {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(admin_token)) == 1
+}
+
+/**
+ * Only let requests with the admin token through to the handler.
+ */
+func admin_auth(handle httprouter.Handle) httprouter.Handle {
+	return func(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+		if !admin_allowed(request) {
+			log.Printf(
+				"rejected admin request %s %s from %s",
+				request.Method,
+				request.URL.Path,
+				request.RemoteAddr,
+			)
+			writer.Header().Add("WWW-Authenticate", `Bearer realm="kfs admin"`)
+			writer.Header().Add("WWW-Authenticate", `Basic realm="kfs admin"`)
+			write_error(writer, "admin token required", http.StatusUnauthorized)
+			return
+		}
+		handle(writer, request, p)
+	}
+}
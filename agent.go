@@ -0,0 +1,830 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+ * kfs agent backs up directories on a schedule, and reports each run to
+ * POST /backups/report, so the dashboard shows when each machine last
+ * backed up successfully:
+ *     kfs agent -config ~/.config/kfs/agent.json
+ * with a config such as
+ *     {
+ *         "url": "http://kfs:8080",
+ *         "machine": "laptop",
+ *         "token": "...",
+ *         "sources": [{
+ *             "dir": "/home/kyle",
+ *             "namespace": "laptop",
+ *             "schedule": "30 2 * * *",
+ *             "exclude": ["node_modules/", "*.tmp"]
+ *         }],
+ *         "bandwidth": [
+ *             {"days": "1-5", "from": "08:00", "to": "18:00", "rate": 1048576},
+ *             {"from": "18:00", "to": "08:00"}
+ *         ]
+ *     }
+ * A schedule is a cron expression, minute hour day-of-month month
+ * day-of-week, or one of @hourly, @daily, @weekly and @monthly. Each run
+ * is a manifest-first sync of the directory, stored under "path" in the
+ * namespace, or the directory's own path. Only the blobs the server does
+ * not have are sent, and files are only hashed again when their size or
+ * mtime changed, so a run after the first costs little more than walking
+ * the tree. A run that finds the tree just as the last one left it
+ * commits no new snapshot. The "exclude" rules are written as those of
+ * the sync filters, and leave files out before they are hashed.
+ *
+ * With "bandwidth" set, uploads are only sent within one of its windows,
+ * and no faster than its rate in bytes a second, if it has one. A window
+ * that ends before it starts runs over midnight. Outside every window,
+ * sending waits for one to open.
+ *
+ * A run that fails because the server cannot be reached is tried again
+ * every KFS_AGENT_RETRY until the next run is due. "token" is the admin
+ * token the server asks reports for. With -once, every source is backed
+ * up once, right away, and the agent exits, failing if any run failed.
+ */
+
+var KFS_AGENT_RETRY = 5 * time.Minute
+
+type agent_config struct {
+	URL       string         `json:"url"`
+	Machine   string         `json:"machine"`
+	Token     string         `json:"token"`
+	HashAlgo  string         `json:"hash_algo"`
+	Sources   []agent_source `json:"sources"`
+	Bandwidth []agent_window `json:"bandwidth"`
+}
+
+type agent_source struct {
+	Dir       string   `json:"dir"`
+	Namespace string   `json:"namespace"`
+	Path      string   `json:"path"`
+	Class     string   `json:"class"`
+	Schedule  string   `json:"schedule"`
+	Exclude   []string `json:"exclude"`
+
+	schedule *cron_schedule
+	rules    []filter_rule
+}
+
+type agent_window struct {
+	Days string `json:"days"`
+	From string `json:"from"`
+	To   string `json:"to"`
+	Rate int64  `json:"rate"`
+
+	days [8]bool
+	from int
+	to   int
+}
+
+func agent_default_path(name string) string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "kfs-" + name
+	}
+	return filepath.Join(dir, "kfs", name)
+}
+
+func agent_main(args []string) {
+	flags := flag.NewFlagSet("agent", flag.ExitOnError)
+	config_path := flags.String("config", agent_default_path("agent.json"), "agent config")
+	db_path := flags.String("db", agent_default_path("agent.sqlite3"), "database of hashes and syncs")
+	once := flags.Bool("once", false, "back up every source now, and exit")
+	client_flags(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: kfs agent [flags]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	config, err := agent_load(*config_path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kfs agent: %v\n", err)
+		os.Exit(2)
+	}
+	agent_db, err := agent_open(*db_path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kfs agent: %v\n", err)
+		os.Exit(1)
+	}
+	defer agent_db.Close()
+	limiter := &agent_limiter{windows: config.Bandwidth}
+	http.DefaultClient.Transport = agent_transport{limiter, http.DefaultTransport}
+
+	if *once {
+		failed := false
+		for _, source := range config.Sources {
+			if err := agent_backup(config, agent_db, source); err != nil {
+				failed = true
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+		return
+	}
+	var wg sync.WaitGroup
+	for _, source := range config.Sources {
+		wg.Add(1)
+		go func(source agent_source) {
+			defer wg.Done()
+			agent_loop(config, agent_db, source)
+		}(source)
+	}
+	wg.Wait()
+}
+
+func agent_load(config_path string) (agent_config, error) {
+	var config agent_config
+	data, err := os.ReadFile(config_path)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("%s: %v", config_path, err)
+	}
+	config.URL = strings.TrimSuffix(config.URL, "/")
+	if config.URL == "" {
+		return config, fmt.Errorf("%s: no url", config_path)
+	}
+	if config.Machine == "" {
+		config.Machine, err = os.Hostname()
+		if err != nil {
+			return config, err
+		}
+	}
+	if config.HashAlgo == "" {
+		config.HashAlgo = KFS_DEFAULT_HASH_ALGO
+	}
+	if !valid_hash_algo(config.HashAlgo) {
+		return config, fmt.Errorf("unsupported hash algorithm: '%s'", config.HashAlgo)
+	}
+	if len(config.Sources) == 0 {
+		return config, fmt.Errorf("%s: no sources", config_path)
+	}
+	for i := range config.Sources {
+		source := &config.Sources[i]
+		if source.Dir == "" {
+			return config, fmt.Errorf("source %d has no dir", i)
+		}
+		source.Dir, err = filepath.Abs(source.Dir)
+		if err != nil {
+			return config, err
+		}
+		if source.Path == "" {
+			source.Path = filepath.ToSlash(source.Dir)
+		}
+		source.Path = path.Clean("/" + source.Path)
+		source.schedule, err = cron_parse(source.Schedule)
+		if err != nil {
+			return config, fmt.Errorf("schedule of '%s': %v", source.Dir, err)
+		}
+		source.rules, err = parse_filter_rules(source.Exclude)
+		if err != nil {
+			return config, fmt.Errorf("exclude rules of '%s': %v", source.Dir, err)
+		}
+	}
+	for i := range config.Bandwidth {
+		if err := config.Bandwidth[i].parse(); err != nil {
+			return config, fmt.Errorf("bandwidth window %d: %v", i, err)
+		}
+	}
+	return config, nil
+}
+
+func agent_open(db_path string) (*sql.DB, error) {
+	if err := os.MkdirAll(filepath.Dir(db_path), 0755); err != nil {
+		return nil, err
+	}
+	agent_db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_busy_timeout=5000", db_path))
+	if err != nil {
+		return nil, err
+	}
+	agent_db.SetMaxOpenConns(1)
+	schema := `
+		CREATE TABLE IF NOT EXISTS hashes(
+			filename TEXT NOT NULL,
+			hash_algo TEXT NOT NULL,
+			size INTEGER NOT NULL,
+			mtime INTEGER NOT NULL,
+			hash TEXT NOT NULL,
+			PRIMARY KEY(filename, hash_algo)
+		);
+		CREATE TABLE IF NOT EXISTS syncs(
+			dir TEXT PRIMARY KEY,
+			manifest TEXT NOT NULL,
+			sync_id TEXT NOT NULL,
+			committed_at INTEGER NOT NULL
+		);
+	`
+	if _, err := agent_db.Exec(schema); err != nil {
+		agent_db.Close()
+		return nil, err
+	}
+	return agent_db, nil
+}
+
+/**
+ * Back up the source each time its schedule comes around, for as long as
+ * the agent runs.
+ */
+func agent_loop(config agent_config, agent_db *sql.DB, source agent_source) {
+	next := source.schedule.next(time.Now())
+	for !next.IsZero() {
+		fmt.Fprintf(os.Stderr, "next backup of '%s' at %s\n", source.Dir, next.Format(time.RFC3339))
+		time.Sleep(time.Until(next))
+		for {
+			err := agent_backup(config, agent_db, source)
+			next = source.schedule.next(time.Now())
+			retry := time.Now().Add(KFS_AGENT_RETRY)
+			if err == nil || !client_retryable(err) || next.Before(retry) {
+				break
+			}
+			time.Sleep(KFS_AGENT_RETRY)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "schedule of '%s' never comes around\n", source.Dir)
+}
+
+/**
+ * Back up the source once, and report how it went.
+ */
+func agent_backup(config agent_config, agent_db *sql.DB, source agent_source) error {
+	started := time.Now()
+	files, sent, err := agent_sync(config, agent_db, source)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "backup of '%s' failed: %v\n", source.Dir, err)
+	} else {
+		fmt.Fprintf(
+			os.Stderr,
+			"backed up '%s', %d files, %d bytes sent in %v\n",
+			source.Dir,
+			files,
+			sent,
+			time.Since(started).Round(time.Second),
+		)
+	}
+	form := url.Values{}
+	form.Set("machine", config.Machine)
+	form.Set("source", source.Dir)
+	form.Set("ok", strconv.FormatBool(err == nil))
+	form.Set("files", strconv.Itoa(files))
+	form.Set("bytes", strconv.FormatInt(sent, 10))
+	form.Set("started_at", strconv.FormatInt(started.Unix(), 10))
+	if err != nil {
+		form.Set("error", err.Error())
+	}
+	report_err := client_retry("report", func() error {
+		request, err := http.NewRequest(
+			http.MethodPost,
+			config.URL+"/v1/backups/report",
+			strings.NewReader(form.Encode()),
+		)
+		if err != nil {
+			return err
+		}
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if config.Token != "" {
+			request.Header.Set("Authorization", "Bearer "+config.Token)
+		}
+		response, err := client_do(request)
+		if err != nil {
+			return err
+		}
+		return response.Body.Close()
+	})
+	if report_err != nil {
+		fmt.Fprintf(os.Stderr, "could not report backup of '%s': %v\n", source.Dir, report_err)
+	}
+	return err
+}
+
+/**
+ * Sync the source to the server, returning the number of files it holds
+ * and the bytes that had to be sent.
+ */
+func agent_sync(config agent_config, agent_db *sql.DB, source agent_source) (int, int64, error) {
+	manifest := sync_manifest{
+		Namespace: source.Namespace,
+		HashAlgo:  config.HashAlgo,
+		Class:     source.Class,
+		Entries:   []sync_entry{},
+	}
+	local := map[string]string{}
+	err := filepath.WalkDir(source.Dir, func(filename string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(source.Dir, filename)
+		if err != nil {
+			return err
+		}
+		server_path := path.Join(source.Path, filepath.ToSlash(rel))
+		if entry.IsDir() {
+			if rel != "." && filter_match(source.rules, strings.Trim(server_path, "/"), true) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() || filter_excluded(source.rules, server_path) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		hash, err := agent_hash(agent_db, filename, info, config.HashAlgo)
+		if err != nil {
+			return err
+		}
+		local[hash] = filename
+		manifest.Entries = append(manifest.Entries, sync_entry{
+			Path:    server_path,
+			Hash:    hash,
+			Size:    info.Size(),
+			Mode:    uint32(info.Mode().Perm()),
+			ModTime: info.ModTime().Unix(),
+		})
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	files := len(manifest.Entries)
+	if files == 0 {
+		return 0, 0, nil
+	}
+
+	// a tree just as the last sync left it needs no new snapshot
+	sort.Slice(manifest.Entries, func(i, j int) bool {
+		return manifest.Entries[i].Path < manifest.Entries[j].Path
+	})
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return files, 0, err
+	}
+	digest := sha256.Sum256(data)
+	manifest_hash := hex.EncodeToString(digest[:])
+	var last string
+	err = agent_db.QueryRow(`select manifest from syncs where dir = ?`, source.Dir).Scan(&last)
+	if err == nil && last == manifest_hash {
+		return files, 0, nil
+	}
+
+	var session sync_session
+	err = client_retry("start of sync", func() error {
+		request, err := http.NewRequest(http.MethodPost, config.URL+"/v1/sync", strings.NewReader(string(data)))
+		if err != nil {
+			return err
+		}
+		request.Header.Set("Content-Type", "application/json")
+		return client_json(request, &session)
+	})
+	if err != nil {
+		return files, 0, err
+	}
+
+	var sent int64
+	err = client_parallel(len(session.Need), func(i int) error {
+		hash := session.Need[i]
+		filename, ok := local[hash]
+		if !ok {
+			return fmt.Errorf("server needs %s, which is not in the manifest", hash)
+		}
+		return client_retry("upload of '"+filename+"'", func() error {
+			n, err := agent_send_blob(config.URL, session.ID, hash, filename)
+			if err == nil {
+				atomic.AddInt64(&sent, n)
+			}
+			return err
+		})
+	})
+	if err != nil {
+		return files, sent, err
+	}
+	err = client_retry("commit of sync", func() error {
+		request, err := http.NewRequest(http.MethodPost, config.URL+"/v1/sync/"+session.ID+"/commit", nil)
+		if err != nil {
+			return err
+		}
+		return client_json(request, &session)
+	})
+	if err != nil {
+		return files, sent, err
+	}
+	_, err = agent_db.Exec(
+		`insert or replace into syncs(dir, manifest, sync_id, committed_at) values(?, ?, ?, ?)`,
+		source.Dir,
+		manifest_hash,
+		session.ID,
+		session.CommittedAt,
+	)
+	return session.Files, sent, err
+}
+
+/**
+ * The hash of the file, hashed again only if its size or mtime changed
+ * since it last was.
+ */
+func agent_hash(agent_db *sql.DB, filename string, info fs.FileInfo, algo string) (string, error) {
+	var hash string
+	err := agent_db.QueryRow(
+		`select hash from hashes where filename = ? and hash_algo = ? and size = ? and mtime = ?`,
+		filename,
+		algo,
+		info.Size(),
+		info.ModTime().UnixNano(),
+	).Scan(&hash)
+	if err == nil {
+		return hash, nil
+	}
+	if err != sql.ErrNoRows {
+		return "", err
+	}
+	hash, err = hash_file_algo(filename, algo)
+	if err != nil {
+		return "", err
+	}
+	_, err = agent_db.Exec(
+		`insert or replace into hashes(filename, hash_algo, size, mtime, hash) values(?, ?, ?, ?, ?)`,
+		filename,
+		algo,
+		info.Size(),
+		info.ModTime().UnixNano(),
+		hash,
+	)
+	return hash, err
+}
+
+/**
+ * Send the file as the blob of the sync, returning its size.
+ */
+func agent_send_blob(base string, id string, hash string, filename string) (int64, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	pipe_reader, pipe_writer := io.Pipe()
+	form := multipart.NewWriter(pipe_writer)
+	go func() {
+		err := form.WriteField("hash", hash)
+		if err == nil {
+			var part io.Writer
+			part, err = form.CreateFormFile("blob", filepath.Base(filename))
+			if err == nil {
+				_, err = io.Copy(part, f)
+			}
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		pipe_writer.CloseWithError(err)
+	}()
+	request, err := http.NewRequest(http.MethodPost, base+"/v1/sync/"+id+"/blob", pipe_reader)
+	if err != nil {
+		pipe_reader.Close()
+		return 0, err
+	}
+	request.Header.Set("Content-Type", form.FormDataContentType())
+	var reply upload_response
+	if err := client_json(request, &reply); err != nil {
+		pipe_reader.CloseWithError(err)
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+/**
+ * Cron expressions, as agent schedules are written.
+ */
+type cron_schedule struct {
+	minute  [60]bool
+	hour    [24]bool
+	dom     [32]bool
+	month   [13]bool
+	dow     [8]bool
+	any_dom bool
+	any_dow bool
+}
+
+var cron_macros = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+func cron_parse(expr string) (*cron_schedule, error) {
+	if macro, ok := cron_macros[strings.TrimSpace(expr)]; ok {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("'%s' does not have 5 fields", expr)
+	}
+	schedule := &cron_schedule{
+		any_dom: fields[2] == "*",
+		any_dow: fields[4] == "*",
+	}
+	for i, field := range []struct {
+		set []bool
+		min int
+	}{
+		{schedule.minute[:], 0},
+		{schedule.hour[:], 0},
+		{schedule.dom[:], 1},
+		{schedule.month[:], 1},
+		{schedule.dow[:], 0},
+	} {
+		if err := cron_field(fields[i], field.min, field.set); err != nil {
+			return nil, err
+		}
+	}
+	// 7 is Sunday as well as 0
+	if schedule.dow[7] {
+		schedule.dow[0] = true
+	}
+	return schedule, nil
+}
+
+/**
+ * Mark the values the field of the expression matches, between min and
+ * the last value of set: a list of *, a value or a range, each with an
+ * optional /step.
+ */
+func cron_field(field string, min int, set []bool) error {
+	max := len(set) - 1
+	for _, item := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			n, err := strconv.Atoi(item[i+1:])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid step in '%s'", field)
+			}
+			step = n
+			item = item[:i]
+		}
+		low, high := min, max
+		if item != "*" {
+			bounds := strings.SplitN(item, "-", 2)
+			var err error
+			low, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return fmt.Errorf("invalid value in '%s'", field)
+			}
+			high = low
+			if len(bounds) == 2 {
+				high, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return fmt.Errorf("invalid range in '%s'", field)
+				}
+			} else if step > 1 {
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return fmt.Errorf("'%s' is out of range %d-%d", field, min, max)
+		}
+		for v := low; v <= high; v += step {
+			set[v] = true
+		}
+	}
+	return nil
+}
+
+/**
+ * Whether the schedule runs on the day, which when both the day of the
+ * month and of the week are given, is either of them.
+ */
+func (schedule *cron_schedule) day(t time.Time) bool {
+	dom := schedule.dom[t.Day()]
+	dow := schedule.dow[t.Weekday()]
+	if schedule.any_dom || schedule.any_dow {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+/**
+ * The first minute after t the schedule runs at, or the zero time if it
+ * does not within five years, as for the 31st of February.
+ */
+func (schedule *cron_schedule) next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		year, month, day := t.Date()
+		switch {
+		case !schedule.month[month]:
+			t = time.Date(year, month+1, 1, 0, 0, 0, 0, t.Location())
+		case !schedule.day(t):
+			t = time.Date(year, month, day+1, 0, 0, 0, 0, t.Location())
+		case !schedule.hour[t.Hour()]:
+			t = time.Date(year, month, day, t.Hour()+1, 0, 0, 0, t.Location())
+		case !schedule.minute[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func agent_clock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time '%s'", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (window *agent_window) parse() error {
+	days := window.Days
+	if days == "" {
+		days = "*"
+	}
+	if err := cron_field(days, 0, window.days[:]); err != nil {
+		return err
+	}
+	if window.days[7] {
+		window.days[0] = true
+	}
+	var err error
+	if window.from, err = agent_clock(window.From); err != nil {
+		return err
+	}
+	if window.to, err = agent_clock(window.To); err != nil {
+		return err
+	}
+	if window.Rate < 0 {
+		return fmt.Errorf("negative rate")
+	}
+	return nil
+}
+
+/**
+ * Whether t falls in the window. A window that runs over midnight belongs
+ * to the day it started on.
+ */
+func (window agent_window) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	day := int(t.Weekday())
+	switch {
+	case window.from == window.to:
+		return window.days[day]
+	case window.from < window.to:
+		return window.days[day] && minute >= window.from && minute < window.to
+	case minute >= window.from:
+		return window.days[day]
+	case minute < window.to:
+		return window.days[(day+6)%7]
+	}
+	return false
+}
+
+/**
+ * Holds uploads to the bandwidth windows, shared by every source so that
+ * together they keep to the rate.
+ */
+type agent_limiter struct {
+	windows []agent_window
+	mutex   sync.Mutex
+	free    time.Time
+}
+
+/**
+ * Whether sending is allowed at t, and the rate it is held to, 0 for
+ * none. Without windows, it always is.
+ */
+func (limiter *agent_limiter) at(t time.Time) (bool, int64) {
+	if len(limiter.windows) == 0 {
+		return true, 0
+	}
+	for _, window := range limiter.windows {
+		if window.contains(t) {
+			return true, window.Rate
+		}
+	}
+	return false, 0
+}
+
+/**
+ * Wait for a window to be open, and return its rate.
+ */
+func (limiter *agent_limiter) wait() int64 {
+	waiting := false
+	for {
+		open, rate := limiter.at(time.Now())
+		if open {
+			return rate
+		}
+		if !waiting {
+			fmt.Fprintln(os.Stderr, "waiting for a bandwidth window to open")
+			waiting = true
+		}
+		time.Sleep(time.Minute - time.Duration(time.Now().Second())*time.Second)
+	}
+}
+
+/**
+ * Wait until n bytes more can be sent at the rate.
+ */
+func (limiter *agent_limiter) take(n int, rate int64) {
+	if rate <= 0 || n <= 0 {
+		return
+	}
+	limiter.mutex.Lock()
+	now := time.Now()
+	if limiter.free.Before(now) {
+		limiter.free = now
+	}
+	limiter.free = limiter.free.Add(time.Duration(int64(n) * int64(time.Second) / rate))
+	until := limiter.free
+	limiter.mutex.Unlock()
+	time.Sleep(time.Until(until))
+}
+
+type agent_reader struct {
+	limiter *agent_limiter
+	reader  io.ReadCloser
+}
+
+func (r *agent_reader) Read(p []byte) (int, error) {
+	rate := r.limiter.wait()
+	// at most a second's worth at once, so a window closing is noticed
+	if rate > 0 && int64(len(p)) > rate {
+		p = p[:rate]
+	}
+	n, err := r.reader.Read(p)
+	r.limiter.take(n, rate)
+	return n, err
+}
+
+func (r *agent_reader) Close() error {
+	return r.reader.Close()
+}
+
+/**
+ * Sends the body of each request through the limiter.
+ */
+type agent_transport struct {
+	limiter *agent_limiter
+	base    http.RoundTripper
+}
+
+func (transport agent_transport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if request.Body == nil || request.Body == http.NoBody {
+		return transport.base.RoundTrip(request)
+	}
+	limited := request.Clone(request.Context())
+	limited.Body = &agent_reader{transport.limiter, request.Body}
+	return transport.base.RoundTrip(limited)
+}
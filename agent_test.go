@@ -0,0 +1,79 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	// a Friday
+	after := time.Date(2026, 10, 16, 17, 50, 0, 0, time.UTC)
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"@hourly", time.Date(2026, 10, 16, 18, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC)},
+		{"*/15 9-17 * * 1-5", time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC)},
+		{"55 17 * * *", time.Date(2026, 10, 16, 17, 55, 0, 0, time.UTC)},
+		{"0 3 * * 7", time.Date(2026, 10, 18, 3, 0, 0, 0, time.UTC)},
+		{"0 0 1,15 * *", time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 13 * 5", time.Date(2026, 10, 23, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 2 *", time.Time{}},
+	}
+	for _, test := range tests {
+		schedule, err := cron_parse(test.expr)
+		if err != nil {
+			t.Fatalf("%s: %v", test.expr, err)
+		}
+		if got := schedule.next(after); !got.Equal(test.want) {
+			t.Errorf("%s: next is %v, want %v", test.expr, got, test.want)
+		}
+	}
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *"} {
+		if _, err := cron_parse(expr); err == nil {
+			t.Errorf("'%s' parsed", expr)
+		}
+	}
+}
+
+func TestAgentWindow(t *testing.T) {
+	tests := []struct {
+		window agent_window
+		at     time.Time
+		open   bool
+	}{
+		{agent_window{From: "08:00", To: "18:00"}, time.Date(2026, 10, 16, 8, 0, 0, 0, time.UTC), true},
+		{agent_window{From: "08:00", To: "18:00"}, time.Date(2026, 10, 16, 18, 0, 0, 0, time.UTC), false},
+		{agent_window{Days: "1-5", From: "08:00", To: "18:00"}, time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC), false},
+		{agent_window{Days: "5", From: "22:00", To: "06:00"}, time.Date(2026, 10, 16, 23, 0, 0, 0, time.UTC), true},
+		{agent_window{Days: "5", From: "22:00", To: "06:00"}, time.Date(2026, 10, 17, 5, 59, 0, 0, time.UTC), true},
+		{agent_window{Days: "5", From: "22:00", To: "06:00"}, time.Date(2026, 10, 16, 5, 0, 0, 0, time.UTC), false},
+		{agent_window{Days: "0", From: "00:00", To: "00:00"}, time.Date(2026, 10, 18, 13, 0, 0, 0, time.UTC), true},
+	}
+	for _, test := range tests {
+		if err := test.window.parse(); err != nil {
+			t.Fatal(err)
+		}
+		if got := test.window.contains(test.at); got != test.open {
+			t.Errorf("%+v at %v: open %v, want %v", test.window, test.at, got, test.open)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+/**
+ * The HTTP API is versioned, with every route served under /v1, e.g.
+ *     curl localhost:8080/v1/exists/<hash>
+ * and at its old path too, so that clients written before the version
+ * keep working. At their old paths, /, /exists and /upload answer with
+ * the plain text they always did: the version, "yes" or "no", and "ok".
+ * Otherwise, responses are JSON, apart from blobs, the dashboard and
+ * metrics, and every error has the same shape:
+ *     {"error": {"code": "not_found", "message": "no such hash"}}
+ * where the code is one of those below, and does not change, unlike the
+ * message, which is only meant for people.
+ */
+
+const API_VERSION = "/v1"
+
+var api_error_codes = map[int]string{
+	http.StatusBadRequest:                   "bad_request",
+	http.StatusUnauthorized:                 "unauthorized",
+	http.StatusForbidden:                    "forbidden",
+	http.StatusNotFound:                     "not_found",
+	http.StatusMethodNotAllowed:             "method_not_allowed",
+	http.StatusNotAcceptable:                "not_acceptable",
+	http.StatusConflict:                     "conflict",
+	http.StatusGone:                         "gone",
+	http.StatusLengthRequired:               "length_required",
+	http.StatusPreconditionFailed:           "precondition_failed",
+	http.StatusRequestEntityTooLarge:        "too_large",
+	http.StatusUnsupportedMediaType:         "unsupported_media_type",
+	http.StatusRequestedRangeNotSatisfiable: "range_not_satisfiable",
+	http.StatusUnprocessableEntity:          "unprocessable",
+	http.StatusLocked:                       "locked",
+	http.StatusTooManyRequests:              "too_many_requests",
+	http.StatusInternalServerError:          "internal",
+	http.StatusBadGateway:                   "bad_gateway",
+	http.StatusServiceUnavailable:           "unavailable",
+	http.StatusGatewayTimeout:               "gateway_timeout",
+	http.StatusInsufficientStorage:          "insufficient_storage",
+}
+
+// codes for errors that the status alone does not tell apart
+const (
+	API_HASH_MISMATCH = "hash_mismatch"
+	API_READ_ONLY     = "read_only"
+	API_NOT_DURABLE   = "not_durable"
+	API_IN_FLIGHT     = "upload_in_flight"
+)
+
+type api_error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type api_error_response struct {
+	Error api_error `json:"error"`
+}
+
+/**
+ * Reply with the error, as http.Error does, but in JSON.
+ */
+func write_error(writer http.ResponseWriter, msg string, status int) {
+	code, ok := api_error_codes[status]
+	if !ok {
+		code = "error"
+	}
+	write_error_code(writer, msg, status, code)
+}
+
+func write_error_code(writer http.ResponseWriter, msg string, status int, code string) {
+	writer.Header().Del("Content-Length")
+	writer.Header().Del("Content-Disposition")
+	writer.Header().Set("X-Content-Type-Options", "nosniff")
+	write_json(writer, status, api_error_response{api_error{code, msg}})
+}
+
+/**
+ * Whether the request came in at the old path of its route, rather than
+ * under API_VERSION.
+ */
+func api_unversioned(request *http.Request) bool {
+	return !strings.HasPrefix(request.URL.Path, API_VERSION+"/")
+}
+
+/**
+ * Registers each route under API_VERSION and at its old path.
+ */
+type api_router struct {
+	router *httprouter.Router
+}
+
+func (api api_router) handle(method string, path string, handle httprouter.Handle) {
+	api.router.Handle(method, API_VERSION+path, handle)
+	api.router.Handle(method, path, handle)
+}
+
+func (api api_router) GET(path string, handle httprouter.Handle) {
+	api.handle(http.MethodGet, path, handle)
+}
+
+func (api api_router) HEAD(path string, handle httprouter.Handle) {
+	api.handle(http.MethodHead, path, handle)
+}
+
+func (api api_router) POST(path string, handle httprouter.Handle) {
+	api.handle(http.MethodPost, path, handle)
+}
+
+func (api api_router) PUT(path string, handle httprouter.Handle) {
+	api.handle(http.MethodPut, path, handle)
+}
+
+func (api api_router) DELETE(path string, handle httprouter.Handle) {
+	api.handle(http.MethodDelete, path, handle)
+}
+
+/**
+ * A router whose own replies, for routes that do not exist or methods they
+ * do not take, are errors like any other.
+ */
+func api_new_router() (*httprouter.Router, api_router) {
+	mux := httprouter.New()
+	mux.NotFound = http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		write_error(writer, "no such route", http.StatusNotFound)
+	})
+	mux.MethodNotAllowed = http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		write_error(writer, "method not allowed", http.StatusMethodNotAllowed)
+	})
+	return mux, api_router{mux}
+}
@@ -0,0 +1,296 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+/**
+ * Append-only objects, for journals and logs that are backed up as they
+ * grow. Each append is stored as a blob of its own, a segment, and the
+ * object is the segments in order, e.g.
+ *     curl -X POST \
+ *         -F segment=@chunk \
+ *         -F hash=`b2sum chunk | awk '{ print $1 }'` \
+ *         -F offset=1048576 \
+ *         localhost:8080/append/default/var/log/syslog
+ *     curl localhost:8080/append/default/var/log/syslog
+ * With offset=, the append only happens if the object is that long, so a
+ * client that retries an append it is unsure of cannot add it twice.
+ * Segments are never changed or removed. ?manifest=true lists them.
+ */
+
+var errAppendOffset = errors.New("offset does not match the object")
+
+type append_segment struct {
+	Seq       int64  `json:"seq"`
+	Offset    int64  `json:"offset"`
+	Hash      string `json:"hash"`
+	HashAlgo  string `json:"hash_algo"`
+	Size      int64  `json:"size"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type append_manifest struct {
+	Namespace string           `json:"namespace"`
+	Name      string           `json:"name"`
+	Size      int64            `json:"size"`
+	Segments  []append_segment `json:"segments"`
+}
+
+func db_append_length(tx db_querier, namespace string, name string) (int64, int64, error) {
+	query := `
+		select coalesce(sum(append_segments.size), 0), coalesce(max(append_segments.seq), 0)
+		from append_objects
+		join append_segments on append_segments.object_id = append_objects.id
+		where append_objects.namespace = ? and append_objects.name = ?
+	`
+	var length, seq int64
+	err := tx.QueryRow(query, namespace, name).Scan(&length, &seq)
+	return length, seq, err
+}
+
+/**
+ * Add the segment to the end of the object, creating it if need be. When
+ * offset is not negative, the object has to be exactly that long.
+ */
+func db_append_segment(namespace string, name string, offset int64, hash string, algo string, size int64) (append_segment, error) {
+	segment := append_segment{
+		Hash:      hash,
+		HashAlgo:  algo,
+		Size:      size,
+		CreatedAt: time.Now().Unix(),
+	}
+	err := db_transaction(func(tx *sql.Tx) error {
+		length, seq, err := db_append_length(tx, namespace, name)
+		if err != nil {
+			return err
+		}
+		if offset >= 0 && offset != length {
+			return errAppendOffset
+		}
+		segment.Seq = seq + 1
+		segment.Offset = length
+		_, err = tx.Exec(
+			`
+			insert into append_objects(namespace, name, created_at)
+			values(?, ?, ?)
+			on conflict(namespace, name) do nothing
+			`,
+			namespace,
+			name,
+			segment.CreatedAt,
+		)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(
+			`
+			insert into append_segments(
+				object_id,
+				seq,
+				hash,
+				hash_algo,
+				size,
+				created_at
+			)
+			select id, ?, ?, ?, ?, ?
+			from append_objects
+			where namespace = ? and name = ?
+			`,
+			segment.Seq,
+			hash,
+			algo,
+			size,
+			segment.CreatedAt,
+			namespace,
+			name,
+		)
+		return err
+	})
+	return segment, err
+}
+
+func db_get_append_manifest(namespace string, name string) (append_manifest, error) {
+	manifest := append_manifest{
+		Namespace: namespace,
+		Name:      name,
+		Segments:  []append_segment{},
+	}
+	query := `
+		select
+			append_segments.seq,
+			append_segments.hash,
+			append_segments.hash_algo,
+			append_segments.size,
+			append_segments.created_at
+		from append_objects
+		join append_segments on append_segments.object_id = append_objects.id
+		where append_objects.namespace = ? and append_objects.name = ?
+		order by append_segments.seq
+	`
+	rows, err := db.Query(query, namespace, name)
+	if err != nil {
+		return manifest, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var segment append_segment
+		err := rows.Scan(
+			&segment.Seq,
+			&segment.Hash,
+			&segment.HashAlgo,
+			&segment.Size,
+			&segment.CreatedAt,
+		)
+		if err != nil {
+			return manifest, err
+		}
+		segment.Offset = manifest.Size
+		manifest.Size += segment.Size
+		manifest.Segments = append(manifest.Segments, segment)
+	}
+	return manifest, rows.Err()
+}
+
+func handle_append(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	if !space_check_upload(writer) {
+		return
+	}
+	namespace, name := p.ByName("namespace"), p.ByName("name")
+	file, header, err := request.FormFile("segment")
+	if err != nil {
+		write_error(writer, "append requires key of 'segment'", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	hash := request.FormValue("hash")
+	if hash == "" {
+		write_error(writer, "append requires 'hash'", http.StatusBadRequest)
+		return
+	}
+	algo := request.FormValue("hash_algo")
+	if algo == "" {
+		algo = KFS_DEFAULT_HASH_ALGO
+	}
+	if !valid_hash_algo(algo) {
+		write_error(writer, fmt.Sprintf("unsupported hash algorithm: '%s'", algo), http.StatusBadRequest)
+		return
+	}
+	offset := int64(-1)
+	if s := request.FormValue("offset"); s != "" {
+		offset, err = strconv.ParseInt(s, 10, 64)
+		if err != nil || offset < 0 {
+			write_error(writer, "invalid offset", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// turn a stale append away before storing anything
+	length, _, err := db_append_length(db, namespace, name)
+	if err != nil {
+		log.Printf("could not append to '%s': %v", name, err)
+		write_error(writer, "could not append", http.StatusInternalServerError)
+		return
+	}
+	if offset >= 0 && offset != length {
+		write_error(writer, fmt.Sprintf("object is %d bytes long", length), http.StatusConflict)
+		return
+	}
+
+	// a segment is let in, scanned and archived the way an upload is
+	ctx := request.Context()
+	entry := catalog_entry{
+		Namespace: namespace,
+		Path:      catalog_clean_path(filepath.Dir(name)),
+		Filename:  filepath.Base(name),
+		HashAlgo:  algo,
+		Size:      header.Size,
+	}
+	if !accept_upload(ctx, writer, nil, entry, file) {
+		return
+	}
+	blob, err := stage_blob(ctx, writer, nil, entry, hash, file, "")
+	if err != nil {
+		log.Printf("could not store segment of '%s': %v", name, err)
+		return
+	}
+	hash, algo = blob.hash, blob.algo
+	if !blob.dedup {
+		go blob.archive()
+	}
+	segment, err := db_append_segment(namespace, name, offset, hash, algo, header.Size)
+	if err == errAppendOffset {
+		write_error(writer, "object was appended to by another client", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("could not append to '%s': %v", name, err)
+		write_error(writer, "could not append", http.StatusInternalServerError)
+		return
+	}
+	log_debug("appended %d bytes to '%s' as segment %d", segment.Size, name, segment.Seq)
+	write_json(writer, http.StatusOK, segment)
+}
+
+/**
+ * Stream the whole object, or with ?manifest=true, list its segments.
+ */
+func handle_append_get(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	manifest, err := db_get_append_manifest(p.ByName("namespace"), p.ByName("name"))
+	if err != nil {
+		log.Printf("could not get '%s': %v", p.ByName("name"), err)
+		write_error(writer, "could not get object", http.StatusInternalServerError)
+		return
+	}
+	if len(manifest.Segments) == 0 {
+		write_error(writer, "no such object", http.StatusNotFound)
+		return
+	}
+	if request.URL.Query().Get("manifest") == "true" {
+		write_json(writer, http.StatusOK, manifest)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/octet-stream")
+	writer.Header().Set("Content-Length", fmt.Sprintf("%d", manifest.Size))
+	for _, segment := range manifest.Segments {
+		f, _, _, err := open_replica(segment.Hash)
+		if err != nil {
+			log.Printf("segment %d of '%s' is not readable: %v", segment.Seq, manifest.Name, err)
+			panic(http.ErrAbortHandler)
+		}
+		_, err = io.Copy(writer, f)
+		f.Close()
+		if err != nil {
+			log.Printf("failed to send '%s': %v", manifest.Name, err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
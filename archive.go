@@ -0,0 +1,261 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+/**
+ * Download many files at once, as a tar or zip built as it is sent, e.g.
+ * a whole folder as it was at a point in time,
+ *     curl -X POST \
+ *         -d namespace=default \
+ *         -d prefix=/home/kyle/taxes \
+ *         -d at=1700000000 \
+ *         localhost:8080/download/archive > taxes.tar
+ * or a list of blobs, with format=zip for a zip:
+ *     curl -X POST -d hash=<hash> -d hash=<hash> -d format=zip \
+ *         localhost:8080/download/archive > files.zip
+ * Each file is named by the path it was uploaded with, and for a prefix,
+ * only the newest version of each file is included. A blob that has no
+ * catalog entry is named by its hash.
+ */
+
+type archive_writer interface {
+	add(entry catalog_entry, file io.Reader) error
+	Close() error
+}
+
+type tar_archive struct {
+	*tar.Writer
+}
+
+func (archive tar_archive) add(entry catalog_entry, file io.Reader) error {
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     archive_name(entry),
+		Size:     entry.Size,
+		Mode:     0644,
+		ModTime:  time.Unix(entry.CreatedAt, 0),
+	}
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := io.Copy(archive, file)
+	return err
+}
+
+type zip_archive struct {
+	*zip.Writer
+}
+
+func (archive zip_archive) add(entry catalog_entry, file io.Reader) error {
+	header := &zip.FileHeader{
+		Name:     archive_name(entry),
+		Method:   zip.Store,
+		Modified: time.Unix(entry.CreatedAt, 0),
+	}
+	header.SetMode(0644)
+	w, err := archive.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, file)
+	return err
+}
+
+/**
+ * The name of the entry within the archive, its full path without the
+ * leading slash, so that it unpacks under the current directory.
+ */
+func archive_name(entry catalog_entry) string {
+	name := strings.TrimLeft(path.Join("/", entry.Path, entry.Filename), "/")
+	if name == "" {
+		return entry.Hash
+	}
+	return name
+}
+
+/**
+ * The newest version of each file under the prefix, as of at, or now when
+ * at is 0.
+ */
+func archive_entries_under(namespace string, prefix string, at int64) ([]catalog_entry, error) {
+	all, err := db_list_catalog_under(namespace, prefix)
+	if err != nil {
+		return nil, err
+	}
+	newest := map[string]int{}
+	var entries []catalog_entry
+	for _, entry := range all {
+		if at != 0 && entry.CreatedAt > at {
+			continue
+		}
+		key := entry.Path + "/" + entry.Filename
+		i, ok := newest[key]
+		if !ok {
+			newest[key] = len(entries)
+			entries = append(entries, entry)
+			continue
+		}
+		old := entries[i]
+		if entry.CreatedAt > old.CreatedAt ||
+			(entry.CreatedAt == old.CreatedAt && entry.ID > old.ID) {
+			entries[i] = entry
+		}
+	}
+	return entries, nil
+}
+
+/**
+ * The entry to name each blob by: its newest catalog entry in the
+ * namespace, or in any namespace when namespace is "".
+ */
+func archive_entries_for(namespace string, hashes []string) ([]catalog_entry, error) {
+	query := `
+		select ` + catalog_columns + `
+		from catalog
+		where hash = ? and (? = '' or namespace = ?)
+		order by created_at desc, id desc
+		limit 1
+	`
+	entries := make([]catalog_entry, 0, len(hashes))
+	for _, hash := range hashes {
+		entry, err := scan_catalog_entry(db.QueryRow(query, hash, namespace, namespace))
+		if err == sql.ErrNoRows {
+			entry = catalog_entry{Hash: hash, Size: -1}
+		} else if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func handle_download_archive(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	format := request.FormValue("format")
+	if format == "" {
+		format = "tar"
+	}
+	if format != "tar" && format != "zip" {
+		write_error(writer, "format must be 'tar' or 'zip'", http.StatusBadRequest)
+		return
+	}
+	var at int64
+	if s := request.FormValue("at"); s != "" {
+		var err error
+		at, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			write_error(writer, "invalid 'at' timestamp", http.StatusBadRequest)
+			return
+		}
+	}
+	namespace := request.FormValue("namespace")
+	prefix := request.FormValue("prefix")
+	hashes := request.Form["hash"]
+	if (prefix == "") == (len(hashes) == 0) {
+		write_error(writer, "archive requires either 'prefix' or 'hash'", http.StatusBadRequest)
+		return
+	}
+
+	var entries []catalog_entry
+	var err error
+	if prefix != "" {
+		if namespace == "" {
+			namespace = KFS_DEFAULT_NAMESPACE
+		}
+		entries, err = archive_entries_under(namespace, path.Clean("/"+prefix), at)
+	} else {
+		entries, err = archive_entries_for(namespace, hashes)
+	}
+	if err != nil {
+		log.Printf("could not list files to archive: %v", err)
+		write_error(writer, "could not list files", http.StatusInternalServerError)
+		return
+	}
+	if len(entries) == 0 {
+		write_error(writer, "no such files", http.StatusNotFound)
+		return
+	}
+	// once the archive has started, a missing blob can only abort it
+	for _, entry := range entries {
+		_, roots, err := db_get_replicas(entry.Hash)
+		if err != nil {
+			log.Println(err)
+			write_error(writer, "could not look up hash", http.StatusInternalServerError)
+			return
+		}
+		if len(roots) == 0 {
+			write_error(writer, fmt.Sprintf("no such hash: %s", entry.Hash), http.StatusNotFound)
+			return
+		}
+	}
+
+	var archive archive_writer
+	if format == "zip" {
+		writer.Header().Set("Content-Type", "application/zip")
+		archive = zip_archive{zip.NewWriter(writer)}
+	} else {
+		writer.Header().Set("Content-Type", "application/x-tar")
+		archive = tar_archive{tar.NewWriter(writer)}
+	}
+	writer.Header().Set(
+		"Content-Disposition",
+		fmt.Sprintf("attachment; filename=\"kfs.%s\"", format),
+	)
+	for _, entry := range entries {
+		f, _, _, err := open_replica(entry.Hash)
+		if err != nil {
+			log.Printf("could not archive '%s': %v", archive_name(entry), err)
+			panic(http.ErrAbortHandler)
+		}
+		if entry.Size < 0 {
+			info, err := f.Stat()
+			if err != nil {
+				f.Close()
+				log.Printf("could not archive '%s': %v", archive_name(entry), err)
+				panic(http.ErrAbortHandler)
+			}
+			entry.Size = info.Size()
+			entry.CreatedAt = info.ModTime().Unix()
+		}
+		err = archive.add(entry, f)
+		f.Close()
+		if err != nil {
+			log.Printf("could not archive '%s': %v", archive_name(entry), err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		log.Printf("could not finish archive: %v", err)
+		panic(http.ErrAbortHandler)
+	}
+}
@@ -0,0 +1,197 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"io/fs"
+	"log"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+/**
+ * A report of where the disks and the database disagree, which changes
+ * nothing, e.g.
+ *     curl 'localhost:8080/admin/audit?root=/mnt/disk2' > audit.json
+ * Orphans are blobs in a disk's storage directory, in their shard or
+ * not, with no record of being on that disk. known says whether the
+ * database has the blob at all. Ghosts are records of a replica whose
+ * file is not on the disk. Uploads and copies in flight are left out,
+ * since their records are written before their files. Without root=,
+ * every local disk is checked.
+ */
+
+type audit_blob struct {
+	Root     string `json:"root"`
+	Hash     string `json:"hash"`
+	HashAlgo string `json:"hash_algo"`
+	Size     int64  `json:"size"`
+
+	// only for orphans
+	Path  string `json:"path,omitempty"`
+	Known bool   `json:"known,omitempty"`
+}
+
+type audit_disk struct {
+	Root    string `json:"root"`
+	Failed  bool   `json:"failed,omitempty"`
+	Files   int    `json:"files"`
+	Records int    `json:"records"`
+	Orphans int    `json:"orphans"`
+	Ghosts  int    `json:"ghosts"`
+	Error   string `json:"error,omitempty"`
+}
+
+type audit_report struct {
+	CheckedAt int64        `json:"checked_at"`
+	Disks     []audit_disk `json:"disks"`
+	Orphans   []audit_blob `json:"orphans"`
+	Ghosts    []audit_blob `json:"ghosts"`
+}
+
+/**
+ * The size of each replica the database has on the local disk, by
+ * hash.algo.
+ */
+func db_get_disk_records(root string) (map[string]audit_blob, error) {
+	rows, err := db.Query(
+		`
+		select hash, hash_algo, coalesce(size, 0) from files
+		where node = '' and storage_root = ?
+		`,
+		root,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := map[string]audit_blob{}
+	for rows.Next() {
+		blob := audit_blob{Root: root}
+		if err := rows.Scan(&blob.Hash, &blob.HashAlgo, &blob.Size); err != nil {
+			return nil, err
+		}
+		records[blob.Hash+"."+blob.HashAlgo] = blob
+	}
+	return records, rows.Err()
+}
+
+/**
+ * Whether the blob is being uploaded or archived, so that its record may
+ * be there before its file.
+ */
+func audit_in_flight(hash string, algo string) bool {
+	space_mutex.Lock()
+	_, reserved := space_reservations[hash+"."+algo]
+	space_mutex.Unlock()
+	if reserved {
+		return true
+	}
+	n, err := db_count_intents(hash, algo)
+	return err != nil || n > 0
+}
+
+/**
+ * Compare what is in the disk's storage directory with what the database
+ * says is there.
+ */
+func audit_disk_blobs(root string, report *audit_report) audit_disk {
+	disk := audit_disk{Root: root}
+	records, err := db_get_disk_records(root)
+	if err != nil {
+		disk.Error = err.Error()
+		return disk
+	}
+	disk.Records = len(records)
+
+	seen := map[string]bool{}
+	err = filepath.WalkDir(get_storage_path(root), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		match := staging_blob_name.FindStringSubmatch(entry.Name())
+		if match == nil || !entry.Type().IsRegular() {
+			return nil
+		}
+		disk.Files++
+		key := match[1] + "." + match[2]
+		seen[key] = true
+		if _, ok := records[key]; ok || audit_in_flight(match[1], match[2]) {
+			return nil
+		}
+		orphan := audit_blob{
+			Root:     root,
+			Hash:     match[1],
+			HashAlgo: match[2],
+			Path:     path,
+			Known:    known_hash_has(match[1], match[2]),
+		}
+		if info, err := entry.Info(); err == nil {
+			orphan.Size = info.Size()
+		}
+		report.Orphans = append(report.Orphans, orphan)
+		disk.Orphans++
+		return nil
+	})
+	if err != nil {
+		// what could not be walked says nothing about ghosts
+		disk.Error = err.Error()
+		return disk
+	}
+
+	for key, record := range records {
+		if seen[key] || audit_in_flight(record.Hash, record.HashAlgo) {
+			continue
+		}
+		report.Ghosts = append(report.Ghosts, record)
+		disk.Ghosts++
+	}
+	return disk
+}
+
+func handle_audit(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	disks, err := db_list_disks()
+	if err != nil {
+		log.Println(err)
+		write_error(writer, "could not list disks", http.StatusInternalServerError)
+		return
+	}
+	only := request.URL.Query().Get("root")
+	report := audit_report{
+		CheckedAt: time.Now().Unix(),
+		Disks:     []audit_disk{},
+		Orphans:   []audit_blob{},
+		Ghosts:    []audit_blob{},
+	}
+	for _, disk := range disks {
+		if only != "" && disk.Root != only {
+			continue
+		}
+		result := audit_disk_blobs(disk.Root, &report)
+		result.Failed = disk.Failed
+		report.Disks = append(report.Disks, result)
+	}
+	if only != "" && len(report.Disks) == 0 {
+		write_error(writer, "no such disk", http.StatusNotFound)
+		return
+	}
+	write_json(writer, http.StatusOK, report)
+}
@@ -0,0 +1,237 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+/**
+ * Reports from the machines that back up to kfs, so the dashboard can show
+ * when each of them last backed up successfully. kfs agent reports each
+ * run when it finishes, and so can any other backup tool, e.g.
+ *     curl -X POST \
+ *         -H "Authorization: Bearer $TOKEN" \
+ *         -d machine=laptop \
+ *         -d source=/home/kyle \
+ *         -d ok=true \
+ *         -d files=1234 \
+ *         -d bytes=56789 \
+ *         -d started_at=1700000000 \
+ *         localhost:8080/backups/report
+ * with ok=false and error= when the run failed. Reports take the admin
+ * token, so that only the agents can make them. Reports older than
+ * KFS_BACKUP_REPORT_RETENTION are forgotten as new ones come in.
+ */
+
+var KFS_BACKUP_REPORT_RETENTION = 90 * 24 * time.Hour
+
+const EVENT_BACKUP_FAILED = "backup.failed"
+
+type backup_report struct {
+	Machine    string `json:"machine"`
+	Source     string `json:"source"`
+	OK         bool   `json:"ok"`
+	Files      int64  `json:"files"`
+	Bytes      int64  `json:"bytes"`
+	Error      string `json:"error,omitempty"`
+	StartedAt  int64  `json:"started_at,omitempty"`
+	FinishedAt int64  `json:"finished_at"`
+}
+
+/**
+ * The last run of a backup, and when it last succeeded, which is 0 if it
+ * never has.
+ */
+type backup_status struct {
+	backup_report
+	LastSuccessAt int64 `json:"last_success_at"`
+}
+
+func (status backup_status) LastSuccess() time.Time {
+	return time.Unix(status.LastSuccessAt, 0)
+}
+
+func (status backup_status) Finished() time.Time {
+	return time.Unix(status.FinishedAt, 0)
+}
+
+func db_add_backup_report(report backup_report) error {
+	cutoff := time.Now().Add(-KFS_BACKUP_REPORT_RETENTION).Unix()
+	return db_transaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			`
+			insert into backup_reports(
+				machine,
+				source,
+				ok,
+				files,
+				bytes,
+				error,
+				started_at,
+				finished_at
+			)
+			values(?, ?, ?, ?, ?, ?, ?, ?)
+			`,
+			report.Machine,
+			report.Source,
+			report.OK,
+			report.Files,
+			report.Bytes,
+			report.Error,
+			report.StartedAt,
+			report.FinishedAt,
+		)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`delete from backup_reports where finished_at < ?`, cutoff)
+		return err
+	})
+}
+
+func db_list_backups() ([]backup_status, error) {
+	query := `
+		select
+			r.machine,
+			r.source,
+			r.ok,
+			r.files,
+			r.bytes,
+			r.error,
+			r.started_at,
+			r.finished_at,
+			coalesce((
+				select max(s.finished_at) from backup_reports as s
+				where s.machine = r.machine and s.source = r.source and s.ok
+			), 0)
+		from backup_reports as r
+		where r.rowid = (
+			select t.rowid from backup_reports as t
+			where t.machine = r.machine and t.source = r.source
+			order by t.finished_at desc, t.rowid desc
+			limit 1
+		)
+		order by r.machine, r.source
+	`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("could not list backups: %v", err)
+	}
+	defer rows.Close()
+	backups := []backup_status{}
+	for rows.Next() {
+		var status backup_status
+		err := rows.Scan(
+			&status.Machine,
+			&status.Source,
+			&status.OK,
+			&status.Files,
+			&status.Bytes,
+			&status.Error,
+			&status.StartedAt,
+			&status.FinishedAt,
+			&status.LastSuccessAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, status)
+	}
+	return backups, rows.Err()
+}
+
+func handle_backup_report(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	report := backup_report{
+		Machine:    request.FormValue("machine"),
+		Source:     request.FormValue("source"),
+		Error:      request.FormValue("error"),
+		FinishedAt: time.Now().Unix(),
+	}
+	if report.Machine == "" {
+		write_error(writer, "report requires 'machine'", http.StatusBadRequest)
+		return
+	}
+	var err error
+	report.OK, err = strconv.ParseBool(request.FormValue("ok"))
+	if err != nil {
+		write_error(writer, "report requires 'ok' to be true or false", http.StatusBadRequest)
+		return
+	}
+	for name, value := range map[string]*int64{
+		"files":      &report.Files,
+		"bytes":      &report.Bytes,
+		"started_at": &report.StartedAt,
+	} {
+		s := request.FormValue(name)
+		if s == "" {
+			continue
+		}
+		*value, err = strconv.ParseInt(s, 10, 64)
+		if err != nil || *value < 0 {
+			write_error(writer, fmt.Sprintf("invalid '%s'", name), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := db_add_backup_report(report); err != nil {
+		log.Printf("could not add backup report: %v", err)
+		write_error(writer, "could not add backup report", http.StatusInternalServerError)
+		return
+	}
+	labels := fmt.Sprintf("machine=%q,source=%q", report.Machine, report.Source)
+	if report.OK {
+		metric_set(
+			"kfs_backup_last_success_timestamp_seconds",
+			"When each machine last backed up successfully.",
+			labels,
+			float64(report.FinishedAt),
+		)
+	} else {
+		log.Printf("backup of '%s' on %s failed: %s", report.Source, report.Machine, report.Error)
+		emit_event(event{
+			Type:   EVENT_BACKUP_FAILED,
+			Error:  report.Error,
+			Backup: &report,
+		})
+	}
+	metric_add(
+		"kfs_backup_reports_total",
+		"Backup runs reported by machines.",
+		fmt.Sprintf("ok=%q", strconv.FormatBool(report.OK)),
+		1,
+	)
+	write_json(writer, http.StatusOK, report)
+}
+
+func handle_backups(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	backups, err := db_list_backups()
+	if err != nil {
+		log.Println(err)
+		write_error(writer, "could not list backups", http.StatusInternalServerError)
+		return
+	}
+	write_json(writer, http.StatusOK, backups)
+}
@@ -0,0 +1,402 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * Load generation, to measure what a change to allocation or to the disks
+ * does to a running server, e.g.
+ *     kfs bench -url http://localhost:8080 -n 1000 -c 16 \
+ *         -sizes 4K:60,1M:30,64M:10 -dedup 0.2
+ * Files are made up with sizes picked by weight from -sizes, and uploaded
+ * with PUT /blob, a share of them repeating earlier files so that the dedup
+ * path is timed as well. Once each is archived, they are all downloaded
+ * again. Everything goes to the bench namespace, under a directory for the
+ * run, and is hashed with sha256, which the client can compute itself.
+ */
+
+type bench_size struct {
+	size   int64
+	weight int
+}
+
+type bench_file struct {
+	seed int64
+	size int64
+	hash string
+}
+
+type bench_result struct {
+	op       string
+	bytes    int64
+	duration time.Duration
+	err      error
+}
+
+const (
+	BENCH_UPLOAD_NEW   = "upload (new)"
+	BENCH_UPLOAD_DEDUP = "upload (dedup)"
+	BENCH_ARCHIVE      = "archive"
+	BENCH_DOWNLOAD     = "download"
+)
+
+/**
+ * Parse a size such as 4096, 4K, 1M or 2G.
+ */
+func parse_size(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	shift := uint(0)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K':
+			shift = 10
+		case 'M':
+			shift = 20
+		case 'G':
+			shift = 30
+		}
+		if shift > 0 {
+			s = s[:n-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+	return n << shift, nil
+}
+
+/**
+ * Parse a size distribution, e.g. 4K:60,1M:30,64M:10, where each size is
+ * picked in proportion to its weight. A size without a weight has weight 1.
+ */
+func parse_bench_sizes(s string) ([]bench_size, error) {
+	var sizes []bench_size
+	for _, field := range strings.Split(s, ",") {
+		parts := strings.SplitN(field, ":", 2)
+		size, err := parse_size(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		weight := 1
+		if len(parts) == 2 {
+			weight, err = strconv.Atoi(parts[1])
+			if err != nil || weight < 0 {
+				return nil, fmt.Errorf("invalid weight in '%s'", field)
+			}
+		}
+		sizes = append(sizes, bench_size{size, weight})
+	}
+	return sizes, nil
+}
+
+func pick_bench_size(rng *rand.Rand, sizes []bench_size) int64 {
+	total := 0
+	for _, s := range sizes {
+		total += s.weight
+	}
+	if total == 0 {
+		return sizes[0].size
+	}
+	n := rng.Intn(total)
+	for _, s := range sizes {
+		if n < s.weight {
+			return s.size
+		}
+		n -= s.weight
+	}
+	return sizes[len(sizes)-1].size
+}
+
+/**
+ * The made up contents of the file, which are the same for the same seed.
+ */
+func bench_content(file bench_file) []byte {
+	data := make([]byte, file.size)
+	rand.New(rand.NewSource(file.seed)).Read(data)
+	return data
+}
+
+type bench_client struct {
+	url    string
+	dir    string
+	client *http.Client
+}
+
+func (b *bench_client) upload(file bench_file, name string) bench_result {
+	data := bench_content(file)
+	request, err := http.NewRequest(
+		http.MethodPut,
+		b.url+"/v1/blob/"+file.hash+"?session="+name,
+		bytes.NewReader(data),
+	)
+	if err != nil {
+		return bench_result{op: BENCH_UPLOAD_NEW, err: err}
+	}
+	request.Header.Set("X-Kfs-Hash-Algo", "sha256")
+	request.Header.Set("X-Kfs-Namespace", "bench")
+	request.Header.Set("X-Kfs-Path", b.dir)
+	request.Header.Set("X-Kfs-Filename", name)
+
+	start := time.Now()
+	response, err := b.client.Do(request)
+	if err != nil {
+		return bench_result{op: BENCH_UPLOAD_NEW, err: err}
+	}
+	defer response.Body.Close()
+	var reply upload_response
+	decode_err := json.NewDecoder(response.Body).Decode(&reply)
+	result := bench_result{
+		op:       BENCH_UPLOAD_NEW,
+		bytes:    file.size,
+		duration: time.Since(start),
+	}
+	if reply.Dedup {
+		result.op = BENCH_UPLOAD_DEDUP
+	}
+	if response.StatusCode != http.StatusOK {
+		result.err = fmt.Errorf("upload of %s: %s", name, response.Status)
+	} else if decode_err != nil {
+		result.err = fmt.Errorf("upload of %s: %v", name, decode_err)
+	}
+	return result
+}
+
+/**
+ * Wait for the upload to be archived, by following its progress until the
+ * server closes the stream.
+ */
+func (b *bench_client) wait(name string, uploaded time.Time) bench_result {
+	response, err := b.client.Get(b.url + "/v1/progress/" + name)
+	if err != nil {
+		return bench_result{op: BENCH_ARCHIVE, err: err}
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		// the session is gone, so the upload was done with long ago
+		return bench_result{op: BENCH_ARCHIVE, duration: time.Since(uploaded)}
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	result := bench_result{op: BENCH_ARCHIVE, duration: time.Since(uploaded), err: err}
+	if err == nil && !strings.Contains(string(body), "event: "+STAGE_DONE) {
+		result.err = fmt.Errorf("archive of %s did not finish", name)
+	}
+	return result
+}
+
+func (b *bench_client) download(file bench_file) bench_result {
+	start := time.Now()
+	response, err := b.client.Get(b.url + "/v1/download/" + file.hash)
+	if err != nil {
+		return bench_result{op: BENCH_DOWNLOAD, err: err}
+	}
+	defer response.Body.Close()
+	hasher := sha256.New()
+	n, err := io.Copy(hasher, response.Body)
+	result := bench_result{
+		op:       BENCH_DOWNLOAD,
+		bytes:    n,
+		duration: time.Since(start),
+		err:      err,
+	}
+	if response.StatusCode != http.StatusOK {
+		result.err = fmt.Errorf("download of %s: %s", file.hash, response.Status)
+	} else if err == nil && hex.EncodeToString(hasher.Sum(nil)) != file.hash {
+		result.err = fmt.Errorf("download of %s: wrong content", file.hash)
+	}
+	return result
+}
+
+/**
+ * Run fn for every index below n, on up to concurrency goroutines, and
+ * collect the results.
+ */
+func bench_run(n int, concurrency int, fn func(i int) bench_result) ([]bench_result, time.Duration) {
+	results := make([]bench_result, n)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i] = fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return results, time.Since(start)
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p * float64(len(sorted)-1))
+	return sorted[i]
+}
+
+/**
+ * Print the throughput and latency of each kind of operation.
+ */
+func bench_report(results []bench_result, elapsed time.Duration) {
+	ops := map[string][]bench_result{}
+	for _, result := range results {
+		ops[result.op] = append(ops[result.op], result)
+	}
+	for _, op := range []string{BENCH_UPLOAD_NEW, BENCH_UPLOAD_DEDUP, BENCH_ARCHIVE, BENCH_DOWNLOAD} {
+		if len(ops[op]) == 0 {
+			continue
+		}
+		var durations []time.Duration
+		var total int64
+		failed := 0
+		for _, result := range ops[op] {
+			if result.err != nil {
+				failed++
+				continue
+			}
+			durations = append(durations, result.duration)
+			total += result.bytes
+		}
+		sort.Slice(durations, func(i, j int) bool {
+			return durations[i] < durations[j]
+		})
+		fmt.Printf("%s: %d ok, %d failed", op, len(durations), failed)
+		if total > 0 {
+			fmt.Printf(
+				", %s in %s, %s/s, %.1f ops/s",
+				format_bytes(total),
+				elapsed.Round(time.Millisecond),
+				format_bytes(int64(float64(total)/elapsed.Seconds())),
+				float64(len(durations))/elapsed.Seconds(),
+			)
+		}
+		fmt.Println()
+		if len(durations) > 0 {
+			fmt.Printf(
+				"    latency p50 %s, p90 %s, p99 %s, max %s\n",
+				percentile(durations, 0.50).Round(time.Microsecond),
+				percentile(durations, 0.90).Round(time.Microsecond),
+				percentile(durations, 0.99).Round(time.Microsecond),
+				durations[len(durations)-1].Round(time.Microsecond),
+			)
+		}
+	}
+}
+
+func bench_main(args []string) {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	url := flags.String("url", "http://localhost:8080", "server to benchmark")
+	n := flags.Int("n", 100, "number of files to upload")
+	concurrency := flags.Int("c", 8, "number of requests in flight at once")
+	sizes_flag := flags.String("sizes", "4K:60,1M:30,16M:10", "sizes of the files, with weights")
+	dedup := flags.Float64("dedup", 0.1, "share of uploads that repeat an earlier file")
+	seed := flags.Int64("seed", time.Now().UnixNano(), "seed for the made up files")
+	downloads := flags.Bool("download", true, "download every file once it is archived")
+	flags.Parse(args)
+
+	sizes, err := parse_bench_sizes(*sizes_flag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kfs bench: %v\n", err)
+		os.Exit(2)
+	}
+	if *n <= 0 || *concurrency <= 0 {
+		fmt.Fprintln(os.Stderr, "kfs bench: -n and -c must be positive")
+		os.Exit(2)
+	}
+
+	rng := rand.New(rand.NewSource(*seed))
+	files := make([]bench_file, *n)
+	for i := range files {
+		if i > 0 && rng.Float64() < *dedup {
+			files[i] = files[rng.Intn(i)]
+			continue
+		}
+		files[i] = bench_file{seed: rng.Int63(), size: pick_bench_size(rng, sizes)}
+		sum := sha256.Sum256(bench_content(files[i]))
+		files[i].hash = hex.EncodeToString(sum[:])
+	}
+
+	b := &bench_client{
+		url:    strings.TrimSuffix(*url, "/"),
+		dir:    fmt.Sprintf("/run-%d", *seed),
+		client: &http.Client{},
+	}
+	names := make([]string, *n)
+	for i := range names {
+		names[i] = fmt.Sprintf("bench-%d-%d", *seed, i)
+	}
+	fmt.Printf("benchmarking %s with %d files, %d at a time\n", b.url, *n, *concurrency)
+
+	uploaded := make([]time.Time, *n)
+	results, elapsed := bench_run(*n, *concurrency, func(i int) bench_result {
+		result := b.upload(files[i], names[i])
+		uploaded[i] = time.Now().Add(-result.duration)
+		return result
+	})
+	archived, _ := bench_run(*n, *concurrency, func(i int) bench_result {
+		if results[i].err != nil || results[i].op != BENCH_UPLOAD_NEW {
+			return bench_result{op: ""}
+		}
+		return b.wait(names[i], uploaded[i])
+	})
+	bench_report(append(results, archived...), elapsed)
+	all := append(results, archived...)
+
+	if *downloads {
+		results, elapsed = bench_run(*n, *concurrency, func(i int) bench_result {
+			return b.download(files[i])
+		})
+		bench_report(results, elapsed)
+		all = append(all, results...)
+	}
+	failed := false
+	for _, result := range all {
+		if result.err != nil {
+			fmt.Fprintf(os.Stderr, "kfs bench: %v\n", result.err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,290 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+/**
+ * Uploads with the file as the raw request body, for scripts and devices
+ * that would rather not build a multipart form, e.g.
+ *     curl -T taxes-2023.pdf \
+ *         -H "X-Kfs-Filename: taxes-2023.pdf" \
+ *         -H "X-Kfs-Path: `pwd`" \
+ *         localhost:8080/blob/`b2sum taxes-2023.pdf | awk '{ print $1 }'`
+ * The fields /upload takes as form values are given as headers:
+ * X-Kfs-Hash-Algo, X-Kfs-Namespace, X-Kfs-Path, X-Kfs-Filename and
+ * X-Kfs-Class. Without a filename, the file is named after its hash.
+ *
+ * The body may be sent chunked, when its length is not known up front, as
+ * from a pipe. It is then kept on the disk with the most space until it
+ * has all arrived, and space is reserved once its size is known. Such
+ * uploads are cut off at KFS_MAX_CHUNKED_UPLOAD bytes, unless the blob is
+ * already stored, in which case the body is not waited for.
+ */
+
+var KFS_MAX_CHUNKED_UPLOAD int64 = 64 << 30
+
+// how much of the body is kept so that it can be read again from the start
+const KFS_REWIND_LIMIT = 4096
+
+var errNoRewind = errors.New("cannot rewind past the start of the body")
+
+/**
+ * A reader that can go back to the start, as long as no more than
+ * KFS_REWIND_LIMIT bytes have been read, which is enough to sniff the type
+ * of a request body that cannot be seeked.
+ */
+type rewind_reader struct {
+	reader io.Reader
+	head   []byte
+	offset int
+	done   bool
+}
+
+func (r *rewind_reader) Read(buf []byte) (int, error) {
+	if r.offset < len(r.head) {
+		n := copy(buf, r.head[r.offset:])
+		r.offset += n
+		return n, nil
+	}
+	n, err := r.reader.Read(buf)
+	if !r.done {
+		r.head = append(r.head, buf[:n]...)
+		r.offset += n
+		if len(r.head) > KFS_REWIND_LIMIT {
+			r.head = nil
+			r.offset = 0
+			r.done = true
+		}
+	}
+	return n, err
+}
+
+func (r *rewind_reader) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekStart || r.done {
+		return 0, errNoRewind
+	}
+	r.offset = 0
+	return 0, nil
+}
+
+func handle_blob_put(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	store_blob_body(writer, request, p.ByName("hash"))
+}
+
+/**
+ * PUT /blob, for a client that streams what it produces, and so only knows
+ * the hash once it is done. The body is sent chunked, with the hash as the
+ * X-Kfs-Hash trailer, and X-Kfs-Hash-Algo may be sent as a trailer too,
+ * e.g. in Go:
+ *     request.Trailer = http.Header{"X-Kfs-Hash": nil}
+ *     // ... write the body, then, before closing it,
+ *     request.Trailer.Set("X-Kfs-Hash", hex.EncodeToString(h.Sum(nil)))
+ * The body is kept until it has all arrived, as chunked bodies are, and
+ * then checked against the hash.
+ */
+func handle_blob_put_trailer(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	store_blob_body(writer, request, "")
+}
+
+/**
+ * Store the body of a PUT, with the hash given, or from the trailer when
+ * the hash is "".
+ */
+func store_blob_body(writer http.ResponseWriter, request *http.Request, hash string) {
+	if !space_check_upload(writer) {
+		return
+	}
+	tracker, ok := progress_start_request(writer, request)
+	if !ok {
+		return
+	}
+	request.Body = &progress_reader{request.Body, tracker}
+	fields := upload_fields{
+		Hash:      hash,
+		HashAlgo:  request.Header.Get("X-Kfs-Hash-Algo"),
+		Namespace: request.Header.Get("X-Kfs-Namespace"),
+		Path:      request.Header.Get("X-Kfs-Path"),
+		Class:     request.Header.Get("X-Kfs-Class"),
+		Durable:   request.URL.Query().Get("durable") == "true",
+	}
+	if hash != "" {
+		filename := blob_filename(request, hash)
+		if request.ContentLength >= 0 {
+			file := &rewind_reader{reader: request.Body}
+			store_upload(request.Context(), writer, tracker, fields, file, filename, request.ContentLength)
+			return
+		}
+		if size := stored_upload_size(fields); size > 0 {
+			// the blob is stored, so there is no need to wait for the body
+			writer.Header().Set("Connection", "close")
+			file := &rewind_reader{reader: request.Body}
+			store_upload(request.Context(), writer, tracker, fields, file, filename, size)
+			return
+		}
+	}
+
+	file, size, status, err := spill_body(request)
+	if err != nil {
+		log.Printf("upload of '%s' failed: %v", blob_filename(request, hash), err)
+		tracker.fail(err)
+		write_error(writer, err.Error(), status)
+		return
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	tracker.update(func(state *progress_state) {
+		state.BytesTotal = size
+	})
+
+	// the trailers are only there once the body has all been read
+	if hash == "" {
+		fields.Hash = request.Trailer.Get("X-Kfs-Hash")
+		if algo := request.Trailer.Get("X-Kfs-Hash-Algo"); algo != "" {
+			fields.HashAlgo = algo
+		}
+	}
+	if fields.Hash == "" {
+		msg := "the hash must be sent as the X-Kfs-Hash trailer"
+		tracker.fail(fmt.Errorf("%s", msg))
+		write_error(writer, msg, http.StatusBadRequest)
+		return
+	}
+	filename := blob_filename(request, fields.Hash)
+	store_upload(request.Context(), writer, tracker, fields, file, filename, size)
+}
+
+/**
+ * The name the upload is stored under, which is the hash when the client
+ * gives none.
+ */
+func blob_filename(request *http.Request, hash string) string {
+	filename := filepath.Base(request.Header.Get("X-Kfs-Filename"))
+	if filename == "." || filename == "/" {
+		return hash
+	}
+	return filename
+}
+
+/**
+ * Keep a body of unknown length in a file until it has all arrived.
+ * Returns the file, at its start, and its size, or the status to answer
+ * with when it cannot be kept.
+ */
+func spill_body(request *http.Request) (*os.File, int64, int, error) {
+	root, err := db_roomiest_disk()
+	if err != nil {
+		return nil, 0, http.StatusInternalServerError, err
+	}
+	if root == "" {
+		return nil, 0, http.StatusInsufficientStorage, fmt.Errorf("no disk to hold the upload")
+	}
+	file, err := os.CreateTemp(filepath.Join(root, ".kfs", "staging"), "chunked-")
+	if err != nil {
+		return nil, 0, http.StatusInternalServerError, err
+	}
+	fail := func(status int, err error) (*os.File, int64, int, error) {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, 0, status, err
+	}
+	body := io.LimitReader(&ctx_reader{request.Context(), request.Body}, KFS_MAX_CHUNKED_UPLOAD+1)
+	size, err := io.Copy(file, body)
+	if err != nil {
+		return fail(http.StatusInternalServerError, err)
+	}
+	if size > KFS_MAX_CHUNKED_UPLOAD {
+		return fail(
+			http.StatusRequestEntityTooLarge,
+			fmt.Errorf("uploads without Content-Length are limited to %d bytes", KFS_MAX_CHUNKED_UPLOAD),
+		)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fail(http.StatusInternalServerError, err)
+	}
+	return file, size, 0, nil
+}
+
+/**
+ * Report whether the blob is stored, without sending it, e.g.
+ *     curl -I localhost:8080/blob/`b2sum taxes-2023.pdf | awk '{ print $1 }'`
+ * Answers 200 with the size and digests in the headers, as a download
+ * would, or 404. The hash may be a secondary digest, with its algorithm
+ * given as hash_algo or X-Kfs-Hash-Algo.
+ */
+func handle_blob_head(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	algo := request.URL.Query().Get("hash_algo")
+	if algo == "" {
+		algo = request.Header.Get("X-Kfs-Hash-Algo")
+	}
+	if algo == "" {
+		algo = KFS_DEFAULT_HASH_ALGO
+	}
+	if !valid_hash_algo(algo) {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	hash, algo, err := db_resolve_hash(p.ByName("hash"), algo)
+	if err == sql.ErrNoRows {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("could not look up %s: %v", p.ByName("hash"), err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	size, err := db_get_blob_size(hash, algo)
+	if err != nil {
+		log.Printf("could not look up the size of %s: %v", hash, err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	header := writer.Header()
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set("Content-Length", fmt.Sprintf("%d", size))
+	header.Set("Accept-Ranges", "bytes")
+	header.Set("X-Kfs-Hash", hash)
+	header.Set("X-Kfs-Hash-Algo", algo)
+	if digests, err := db_get_digests(hash, algo); err == nil {
+		header.Set("Repr-Digest", format_repr_digest(digests))
+	}
+	writer.WriteHeader(http.StatusOK)
+}
+
+func db_get_blob_size(hash string, algo string) (int64, error) {
+	query := `
+		select coalesce(max(size), 0) from files
+		where hash = ? and hash_algo = ?
+	`
+	var size int64
+	err := db.QueryRow(query, hash, algo).Scan(&size)
+	return size, err
+}
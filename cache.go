@@ -0,0 +1,214 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"container/list"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// directory on a fast device to cache hot blobs in, empty to disable,
+	// cache_path in the config
+	KFS_CACHE_PATH = ""
+
+	// total size of the cache, in bytes
+	KFS_CACHE_SIZE int64 = 64 << 30
+
+	// downloads of a blob before it is copied into the cache
+	KFS_CACHE_ADMIT_READS = 2
+)
+
+type cache_entry struct {
+	name string
+	size int64
+}
+
+/**
+ * Least recently used blobs are at the back of cache_lru, and are evicted
+ * first once the cache is over KFS_CACHE_SIZE.
+ */
+var (
+	cache_mutex   = &sync.Mutex{}
+	cache_lru     = list.New()
+	cache_entries = map[string]*list.Element{}
+	cache_used    int64
+	cache_reads   = map[string]int{}
+	cache_adding  = map[string]bool{}
+)
+
+func cache_name(hash string, algo string) string {
+	return hash + "." + algo
+}
+
+/**
+ * Index blobs already in the cache directory, oldest first, so that the
+ * cache survives restarts.
+ */
+func cache_init() {
+	if KFS_CACHE_PATH == "" {
+		return
+	}
+	if err := os.MkdirAll(KFS_CACHE_PATH, 0755); err != nil {
+		log.Printf("could not create cache directory: %v", err)
+		KFS_CACHE_PATH = ""
+		return
+	}
+	entries, err := os.ReadDir(KFS_CACHE_PATH)
+	if err != nil {
+		log.Printf("could not read cache directory: %v", err)
+		return
+	}
+
+	var infos []os.FileInfo
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if strings.HasPrefix(info.Name(), ".") {
+			// left over from an interrupted copy
+			os.Remove(filepath.Join(KFS_CACHE_PATH, info.Name()))
+			continue
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+
+	cache_mutex.Lock()
+	defer cache_mutex.Unlock()
+	for _, info := range infos {
+		entry := cache_entry{info.Name(), info.Size()}
+		cache_entries[entry.name] = cache_lru.PushFront(entry)
+		cache_used += entry.size
+	}
+	cache_evict()
+	log.Printf("cache holds %d blobs, %d bytes", cache_lru.Len(), cache_used)
+}
+
+func cache_lookup(hash string, algo string) (string, bool) {
+	if KFS_CACHE_PATH == "" {
+		return "", false
+	}
+	name := cache_name(hash, algo)
+	cache_mutex.Lock()
+	defer cache_mutex.Unlock()
+	elem, ok := cache_entries[name]
+	if !ok {
+		return "", false
+	}
+	cache_lru.MoveToFront(elem)
+	return filepath.Join(KFS_CACHE_PATH, name), true
+}
+
+func cache_remove(hash string, algo string) {
+	name := cache_name(hash, algo)
+	cache_mutex.Lock()
+	defer cache_mutex.Unlock()
+	if elem, ok := cache_entries[name]; ok {
+		cache_drop(elem)
+	}
+}
+
+/**
+ * Must be called with cache_mutex held.
+ */
+func cache_drop(elem *list.Element) {
+	entry := cache_lru.Remove(elem).(cache_entry)
+	delete(cache_entries, entry.name)
+	cache_used -= entry.size
+	if err := os.Remove(filepath.Join(KFS_CACHE_PATH, entry.name)); err != nil {
+		log.Printf("could not remove '%s' from cache: %v", entry.name, err)
+	}
+}
+
+/**
+ * Must be called with cache_mutex held.
+ */
+func cache_evict() {
+	for cache_used > KFS_CACHE_SIZE && cache_lru.Len() > 0 {
+		cache_drop(cache_lru.Back())
+	}
+}
+
+/**
+ * Count a download of a blob that was served from a replica, and copy it
+ * into the cache once it has been read often enough.
+ */
+func cache_note_read(hash string, algo string, filename string) {
+	if KFS_CACHE_PATH == "" {
+		return
+	}
+	name := cache_name(hash, algo)
+	cache_mutex.Lock()
+	defer cache_mutex.Unlock()
+	if _, ok := cache_entries[name]; ok || cache_adding[name] {
+		return
+	}
+	cache_reads[name]++
+	if cache_reads[name] < KFS_CACHE_ADMIT_READS {
+		return
+	}
+	delete(cache_reads, name)
+	cache_adding[name] = true
+	go cache_add(name, filename)
+}
+
+func cache_add(name string, filename string) {
+	defer func() {
+		cache_mutex.Lock()
+		delete(cache_adding, name)
+		cache_mutex.Unlock()
+	}()
+
+	info, err := os.Stat(filename)
+	if err != nil || info.Size() > KFS_CACHE_SIZE {
+		return
+	}
+
+	// copy under a temporary name, so a partial copy is never served
+	tmp := filepath.Join(KFS_CACHE_PATH, "."+name+".tmp")
+	if err := copy_file(filename, tmp); err != nil {
+		log.Printf("could not cache '%s': %v", filename, err)
+		os.Remove(tmp)
+		return
+	}
+	dst := filepath.Join(KFS_CACHE_PATH, name)
+	if err := os.Rename(tmp, dst); err != nil {
+		log.Printf("could not cache '%s': %v", filename, err)
+		os.Remove(tmp)
+		return
+	}
+	now := time.Now()
+	os.Chtimes(dst, now, now)
+
+	cache_mutex.Lock()
+	defer cache_mutex.Unlock()
+	cache_entries[name] = cache_lru.PushFront(cache_entry{name, info.Size()})
+	cache_used += info.Size()
+	cache_evict()
+	log.Printf("cached '%s'", name)
+}
@@ -0,0 +1,204 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+/**
+ * How much more can be stored, for planning disk purchases, e.g.
+ *     curl localhost:8080/capacity?days=30
+ * Usable bytes are what fits with every blob on as many disks as the
+ * default replica policy asks for, which is less than the free bytes, and
+ * much less when one disk has most of them. The ingest rate is the unique
+ * bytes added per day over the last ?days=, and the pool is projected to be
+ * full when that rate has used up the usable bytes.
+ */
+
+type class_capacity struct {
+	Disks          int   `json:"disks"`
+	AvailableBytes int64 `json:"available_bytes"`
+	UsableBytes    int64 `json:"usable_bytes"`
+}
+
+type capacity_response struct {
+	class_capacity
+	Redundancy   int                       `json:"redundancy"`
+	IngestDays   int                       `json:"ingest_days"`
+	IngestPerDay int64                     `json:"ingest_bytes_per_day"`
+	DaysLeft     *float64                  `json:"days_left,omitempty"`
+	FullAt       string                    `json:"full_at,omitempty"`
+	Classes      map[string]class_capacity `json:"classes,omitempty"`
+	Namespaces   map[string]usage_stats    `json:"namespaces"`
+}
+
+/**
+ * The space left on each live disk, by storage class, as in
+ * db_get_live_disks.
+ */
+func db_get_live_disk_space() (map[string][]int64, error) {
+	query := `
+		select class, available
+		from disks
+		where not failed
+			and (
+				node = ''
+				or node in (select name from nodes where last_seen >= ?)
+			)
+	`
+	live := time.Now().Add(-KFS_CLUSTER_NODE_TIMEOUT).Unix()
+	rows, err := db.Query(query, live)
+	if err != nil {
+		return nil, fmt.Errorf("could not query for disk space: %v", err)
+	}
+	defer rows.Close()
+
+	space := map[string][]int64{}
+	for rows.Next() {
+		var class string
+		var available sql.NullInt64
+		if err := rows.Scan(&class, &available); err != nil {
+			return nil, err
+		}
+		space[class] = append(space[class], available.Int64)
+	}
+	return space, rows.Err()
+}
+
+/**
+ * The space left on the disks of the class, or on every disk when the class
+ * is "".
+ */
+func class_space(space map[string][]int64, class string) []int64 {
+	if class != "" {
+		return space[class]
+	}
+	var all []int64
+	for _, disks := range space {
+		all = append(all, disks...)
+	}
+	return all
+}
+
+/**
+ * The most data that fits on the disks with each byte on redundancy of
+ * them. x bytes fit when the disks can give sum(min(free, x)) to them,
+ * since no disk holds two replicas of the same blob.
+ */
+func usable_space(free []int64, redundancy int) int64 {
+	if redundancy < 1 || len(free) < redundancy {
+		return 0
+	}
+	var total int64
+	for _, f := range free {
+		if f > 0 {
+			total += f
+		}
+	}
+	fits := func(x int64) bool {
+		var given int64
+		for _, f := range free {
+			if f > x {
+				given += x
+			} else if f > 0 {
+				given += f
+			}
+		}
+		return given >= x*int64(redundancy)
+	}
+	low, high := int64(0), total/int64(redundancy)
+	for low < high {
+		mid := low + (high-low+1)/2
+		if fits(mid) {
+			low = mid
+		} else {
+			high = mid - 1
+		}
+	}
+	return low
+}
+
+func capacity_of(free []int64, redundancy int) class_capacity {
+	c := class_capacity{Disks: len(free), UsableBytes: usable_space(free, redundancy)}
+	for _, f := range free {
+		c.AvailableBytes += f
+	}
+	return c
+}
+
+func handle_capacity(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	days := KFS_STATS_DAYS
+	if s := request.URL.Query().Get("days"); s != "" {
+		var err error
+		if days, err = strconv.Atoi(s); err != nil || days < 1 {
+			write_error(writer, "invalid days", http.StatusBadRequest)
+			return
+		}
+	}
+	policies, err := db_get_replica_policies()
+	if err != nil {
+		log.Println(err)
+		write_error(writer, "could not get replica policies", http.StatusInternalServerError)
+		return
+	}
+	space, err := db_get_live_disk_space()
+	if err != nil {
+		log.Println(err)
+		write_error(writer, "could not look up disk space", http.StatusInternalServerError)
+		return
+	}
+	stats, err := db_get_stats(days)
+	if err != nil {
+		log.Println(err)
+		write_error(writer, "could not get stats", http.StatusInternalServerError)
+		return
+	}
+
+	response := capacity_response{
+		class_capacity: capacity_of(class_space(space, ""), policies.Default),
+		Redundancy:     policies.Default,
+		IngestDays:     days,
+		Namespaces:     stats.Namespaces,
+	}
+	if len(space) > 1 {
+		response.Classes = map[string]class_capacity{}
+		for class, free := range space {
+			response.Classes[class] = capacity_of(free, policies.Default)
+		}
+	}
+
+	var ingested int64
+	for _, day := range stats.Ingest {
+		ingested += day.UniqueBytes
+	}
+	response.IngestPerDay = ingested / int64(days)
+	if response.IngestPerDay > 0 {
+		left := float64(response.UsableBytes) / float64(response.IngestPerDay)
+		response.DaysLeft = &left
+		response.FullAt = time.Now().AddDate(0, 0, int(left)).Format("2006-01-02")
+	}
+	write_json(writer, http.StatusOK, response)
+}
@@ -0,0 +1,606 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const KFS_DEFAULT_NAMESPACE = "default"
+
+/**
+ * A logical entry in the catalog. Several entries may point at the same
+ * blob, so renaming, moving and copying entries never touches the data.
+ */
+type catalog_entry struct {
+	ID        int64  `json:"id"`
+	Namespace string `json:"namespace"`
+	Path      string `json:"path"`
+	Filename  string `json:"filename"`
+	Hash      string `json:"hash"`
+	HashAlgo  string `json:"hash_algo"`
+	Size      int64  `json:"size"`
+	CreatedAt int64  `json:"created_at"`
+
+	// pinned entries are never purged by retention, and so neither is
+	// their blob collected
+	Pinned bool `json:"pinned"`
+
+	// held entries are write-once until retain_until, or forever if it is 0
+	Held        bool  `json:"held"`
+	RetainUntil int64 `json:"retain_until,omitempty"`
+}
+
+/**
+ * Add the entry, created now unless it already has a creation time, as it
+ * does when it is replicated from another node.
+ */
+func db_add_catalog_entry(entry catalog_entry) (int64, error) {
+	var id int64
+	err := db_transaction(func(tx *sql.Tx) error {
+		var err error
+		id, err = db_insert_catalog_entry(tx, entry)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("could not add catalog entry: %v", err)
+	}
+	return id, nil
+}
+
+/**
+ * The form every path is kept in: absolute, with no trailing slash, so
+ * "photos/", "/photos" and "/photos/" are the same directory and files
+ * uploaded without a path are in "/".
+ */
+func catalog_clean_path(p string) string {
+	return path.Clean("/" + p)
+}
+
+/**
+ * Add the entry as part of a transaction, so several can be added at once.
+ */
+func db_insert_catalog_entry(tx db_execer, entry catalog_entry) (int64, error) {
+	id, err := db_insert_catalog_row(tx, entry)
+	if err != nil {
+		return 0, err
+	}
+	return id, db_log_catalog_change(tx, id)
+}
+
+/**
+ * Add the entry without logging the change, for callers that log it
+ * themselves.
+ */
+func db_insert_catalog_row(tx db_execer, entry catalog_entry) (int64, error) {
+	entry.Path = catalog_clean_path(entry.Path)
+	created_at := entry.CreatedAt
+	if created_at == 0 {
+		created_at = time.Now().Unix()
+	}
+	stmt := `
+		insert into catalog(
+			namespace,
+			path,
+			filename,
+			hash,
+			hash_algo,
+			size,
+			created_at,
+			pinned,
+			held,
+			retain_until
+		)
+		values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	result, err := tx.Exec(
+		stmt,
+		entry.Namespace,
+		entry.Path,
+		entry.Filename,
+		entry.Hash,
+		entry.HashAlgo,
+		entry.Size,
+		created_at,
+		entry.Pinned,
+		entry.Held,
+		entry.RetainUntil,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+/**
+ * Note that the entry changed, so mirrors know to fetch it again.
+ */
+func db_log_catalog_change(tx db_execer, id int64) error {
+	_, err := tx.Exec(`insert into catalog_log(catalog_id) values(?)`, id)
+	return err
+}
+
+/**
+ * Note a change that was made on another node and replicated here, which
+ * the rest of the cluster does not need from this node's log.
+ */
+func db_log_replicated_change(tx db_execer, id int64) error {
+	_, err := tx.Exec(`insert into catalog_log(catalog_id, replicated) values(?, 1)`, id)
+	return err
+}
+
+const catalog_columns = `
+	id,
+	namespace,
+	path,
+	filename,
+	hash,
+	hash_algo,
+	size,
+	created_at,
+	pinned,
+	held,
+	retain_until
+`
+
+type row_scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scan_catalog_entry(row row_scanner) (catalog_entry, error) {
+	var entry catalog_entry
+	err := row.Scan(
+		&entry.ID,
+		&entry.Namespace,
+		&entry.Path,
+		&entry.Filename,
+		&entry.Hash,
+		&entry.HashAlgo,
+		&entry.Size,
+		&entry.CreatedAt,
+		&entry.Pinned,
+		&entry.Held,
+		&entry.RetainUntil,
+	)
+	return entry, err
+}
+
+func db_get_catalog_entry(id int64) (catalog_entry, error) {
+	query := `select ` + catalog_columns + ` from catalog where id = ?`
+	return scan_catalog_entry(db.QueryRow(query, id))
+}
+
+/**
+ * The newest entry for the file, or, when at is non-zero, the newest entry
+ * that was created no later than at.
+ */
+func db_find_catalog_entry(namespace string, dir string, filename string, at int64) (catalog_entry, error) {
+	dir = catalog_clean_path(dir)
+	query := `
+		select ` + catalog_columns + `
+		from catalog
+		where namespace = ?
+			and path = ?
+			and filename = ?
+			and (? = 0 or created_at <= ?)
+		order by created_at desc, id desc
+		limit 1
+	`
+	row := db.QueryRow(query, namespace, dir, filename, at, at)
+	return scan_catalog_entry(row)
+}
+
+/**
+ * The name the blob was most recently uploaded as, from the catalog, or
+ * from the file records of blobs stored before there was one.
+ */
+func db_get_filename(hash string) (string, error) {
+	query := `
+		select filename from (
+			select filename, 0 as rank, created_at
+			from catalog where hash = ?
+			union all
+			select filename, 1 as rank, 0
+			from files where hash = ? and filename != ''
+		)
+		order by rank, created_at desc
+		limit 1
+	`
+	var filename string
+	err := db.QueryRow(query, hash, hash).Scan(&filename)
+	return filename, err
+}
+
+/**
+ * Every entry in the namespace whose path is dir or is below dir.
+ */
+func db_list_catalog_under(namespace string, dir string) ([]catalog_entry, error) {
+	dir = catalog_clean_path(dir)
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	query := `
+		select ` + catalog_columns + `
+		from catalog
+		where namespace = ?
+			and (path = ? or substr(path, 1, length(?)) = ?)
+		order by path, filename
+	`
+	rows, err := db.Query(query, namespace, dir, prefix, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("could not list catalog: %v", err)
+	}
+	defer rows.Close()
+
+	var entries []catalog_entry
+	for rows.Next() {
+		entry, err := scan_catalog_entry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func db_update_catalog_entry(entry catalog_entry) error {
+	err := db_transaction(func(tx *sql.Tx) error {
+		if err := db_update_catalog_row(tx, entry); err != nil {
+			return err
+		}
+		return db_log_catalog_change(tx, entry.ID)
+	})
+	if err != nil {
+		return fmt.Errorf("could not update catalog entry: %v", err)
+	}
+	return nil
+}
+
+/**
+ * Update the entry without logging the change, for callers that log it
+ * themselves.
+ */
+func db_update_catalog_row(tx db_execer, entry catalog_entry) error {
+	stmt := `
+		update catalog
+		set
+			namespace = ?,
+			path = ?,
+			filename = ?,
+			pinned = ?,
+			held = ?,
+			retain_until = ?
+		where id = ?
+	`
+	_, err := tx.Exec(
+		stmt,
+		entry.Namespace,
+		catalog_clean_path(entry.Path),
+		entry.Filename,
+		entry.Pinned,
+		entry.Held,
+		entry.RetainUntil,
+		entry.ID,
+	)
+	return err
+}
+
+/**
+ * Add the entry, and replicate it to the rest of the cluster and to the
+ * remote site.
+ */
+func catalog_add(entry catalog_entry) (int64, error) {
+	worm_apply(&entry)
+	id, err := db_add_catalog_entry(entry)
+	if err != nil {
+		return 0, err
+	}
+	catalog_added(id)
+	return id, nil
+}
+
+/**
+ * Replicate the entry that was just added, and let sinks know about it.
+ */
+func catalog_added(id int64) {
+	added, err := db_get_catalog_entry(id)
+	if err != nil {
+		log.Printf("could not get catalog entry %d: %v", id, err)
+		return
+	}
+	cluster_replicate_catalog(nil, added)
+	geo_enqueue_catalog(nil, added)
+	emit_event(event{
+		Type:     EVENT_CATALOG_ADDED,
+		Hash:     added.Hash,
+		HashAlgo: added.HashAlgo,
+		Catalog:  &added,
+	})
+}
+
+/**
+ * Update the entry, which was old, and replicate the change to the rest of
+ * the cluster and to the remote site.
+ */
+func catalog_update(old catalog_entry, entry catalog_entry) error {
+	if err := worm_check_update(old, entry); err != nil {
+		return err
+	}
+	if entry.Namespace != old.Namespace {
+		worm_apply(&entry)
+	}
+	if err := db_update_catalog_entry(entry); err != nil {
+		return err
+	}
+	cluster_replicate_catalog(&old, entry)
+	geo_enqueue_catalog(&old, entry)
+	emit_event(event{
+		Type:     EVENT_CATALOG_UPDATED,
+		Hash:     entry.Hash,
+		HashAlgo: entry.HashAlgo,
+		Catalog:  &entry,
+	})
+	return nil
+}
+
+/**
+ * Look up the catalog entry named by the :id route parameter, writing an
+ * error response and returning false if there isn't one.
+ */
+func lookup_catalog_entry(writer http.ResponseWriter, p httprouter.Params) (catalog_entry, bool) {
+	id, err := strconv.ParseInt(p.ByName("id"), 10, 64)
+	if err != nil {
+		write_error(writer, "invalid catalog id", http.StatusBadRequest)
+		return catalog_entry{}, false
+	}
+	entry, err := db_get_catalog_entry(id)
+	if err == sql.ErrNoRows {
+		write_error(writer, "no such catalog entry", http.StatusNotFound)
+		return entry, false
+	}
+	if err != nil {
+		log.Printf("could not get catalog entry %d: %v", id, err)
+		write_error(writer, "could not get catalog entry", http.StatusInternalServerError)
+		return entry, false
+	}
+	return entry, true
+}
+
+func handle_catalog_get(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	entry, ok := lookup_catalog_entry(writer, p)
+	if !ok {
+		return
+	}
+	write_json(writer, http.StatusOK, entry)
+}
+
+/**
+ * Give an entry a new path and/or filename, e.g.
+ *     curl -X POST -F "path=/photos/2023" localhost:8080/catalog/42/rename
+ */
+func handle_catalog_rename(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	entry, ok := lookup_catalog_entry(writer, p)
+	if !ok || !check_mutable(writer, entry) {
+		return
+	}
+	old := entry
+	path := request.FormValue("path")
+	filename := request.FormValue("filename")
+	if path == "" && filename == "" {
+		write_error(writer, "rename requires 'path' or 'filename'", http.StatusBadRequest)
+		return
+	}
+	if path != "" {
+		entry.Path = catalog_clean_path(path)
+	}
+	if filename != "" {
+		entry.Filename = filename
+	}
+	if err := catalog_update(old, entry); err != nil {
+		log.Println(err)
+		write_error(writer, "could not rename", http.StatusInternalServerError)
+		return
+	}
+	write_json(writer, http.StatusOK, entry)
+}
+
+/**
+ * Move an entry to another namespace.
+ */
+func handle_catalog_move(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	entry, ok := lookup_catalog_entry(writer, p)
+	if !ok || !check_mutable(writer, entry) {
+		return
+	}
+	namespace := request.FormValue("namespace")
+	if namespace == "" {
+		write_error(writer, "move requires 'namespace'", http.StatusBadRequest)
+		return
+	}
+	old := entry
+	entry.Namespace = namespace
+	if err := catalog_update(old, entry); err != nil {
+		log.Println(err)
+		write_error(writer, "could not move", http.StatusInternalServerError)
+		return
+	}
+
+	// moving into a write-once namespace holds the entry
+	entry, err := db_get_catalog_entry(entry.ID)
+	if err != nil {
+		log.Println(err)
+		write_error(writer, "could not move", http.StatusInternalServerError)
+		return
+	}
+	write_json(writer, http.StatusOK, entry)
+}
+
+/**
+ * Create a second entry pointing at the same blob. Any of namespace, path
+ * and filename that are not given are kept from the original.
+ */
+func handle_catalog_copy(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	entry, ok := lookup_catalog_entry(writer, p)
+	if !ok {
+		return
+	}
+	if namespace := request.FormValue("namespace"); namespace != "" {
+		entry.Namespace = namespace
+	}
+	if path := request.FormValue("path"); path != "" {
+		entry.Path = catalog_clean_path(path)
+	}
+	if filename := request.FormValue("filename"); filename != "" {
+		entry.Filename = filename
+	}
+	entry.CreatedAt = 0
+	entry.Pinned = false
+	entry.Held = false
+	entry.RetainUntil = 0
+	id, err := catalog_add(entry)
+	if err != nil {
+		log.Println(err)
+		write_error(writer, "could not copy", http.StatusInternalServerError)
+		return
+	}
+	entry, err = db_get_catalog_entry(id)
+	if err != nil {
+		log.Println(err)
+		write_error(writer, "could not copy", http.StatusInternalServerError)
+		return
+	}
+	write_json(writer, http.StatusCreated, entry)
+}
+
+/**
+ * Pin or unpin an entry, e.g.
+ *     curl -X POST localhost:8080/catalog/42/pin
+ *     curl -X POST localhost:8080/catalog/42/unpin
+ * Unpinning lets retention purge the entry, so it takes the admin token.
+ */
+func handle_catalog_pin(pinned bool) httprouter.Handle {
+	return func(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+		entry, ok := lookup_catalog_entry(writer, p)
+		if !ok {
+			return
+		}
+		if entry.Pinned != pinned {
+			old := entry
+			entry.Pinned = pinned
+			if err := catalog_update(old, entry); err != nil {
+				log.Println(err)
+				write_error(writer, "could not update pin", http.StatusInternalServerError)
+				return
+			}
+		}
+		write_json(writer, http.StatusOK, entry)
+	}
+}
+
+type ls_response struct {
+	Namespace   string          `json:"namespace"`
+	Path        string          `json:"path"`
+	Directories []string        `json:"directories"`
+	Files       []catalog_entry `json:"files"`
+}
+
+/**
+ * List the immediate children of a directory, computed from the paths the
+ * files were uploaded with, e.g.
+ *     curl 'localhost:8080/ls?path=/photos/2023&namespace=default'
+ */
+func handle_ls(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	query := request.URL.Query()
+	namespace := query.Get("namespace")
+	if namespace == "" {
+		namespace = KFS_DEFAULT_NAMESPACE
+	}
+	dir := catalog_clean_path(query.Get("path"))
+
+	entries, err := db_list_catalog_under(namespace, dir)
+	if err != nil {
+		log.Println(err)
+		write_error(writer, "could not list directory", http.StatusInternalServerError)
+		return
+	}
+
+	response := ls_response{
+		Namespace:   namespace,
+		Path:        dir,
+		Directories: []string{},
+		Files:       []catalog_entry{},
+	}
+	seen := map[string]bool{}
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	for _, entry := range entries {
+		if entry.Path == dir {
+			response.Files = append(response.Files, entry)
+			continue
+		}
+		child := strings.SplitN(strings.TrimPrefix(entry.Path, prefix), "/", 2)[0]
+		if !seen[child] {
+			seen[child] = true
+			response.Directories = append(response.Directories, child)
+		}
+	}
+	sort.Strings(response.Directories)
+	write_json(writer, http.StatusOK, response)
+}
+
+/**
+ * Download a file by the path it was uploaded with rather than by hash, e.g.
+ *     curl localhost:8080/path/default/home/kyle/taxes-2023.pdf
+ * Use ?at=<unix time> to get the version that was current at that time.
+ */
+func handle_download_path(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	namespace := p.ByName("namespace")
+	full_path := catalog_clean_path(p.ByName("filepath"))
+	dir, filename := path.Split(full_path)
+	dir = catalog_clean_path(dir)
+
+	var at int64
+	if at_str := request.URL.Query().Get("at"); at_str != "" {
+		var err error
+		at, err = strconv.ParseInt(at_str, 10, 64)
+		if err != nil {
+			write_error(writer, "invalid 'at' timestamp", http.StatusBadRequest)
+			return
+		}
+	}
+
+	entry, err := db_find_catalog_entry(namespace, dir, filename, at)
+	if err == sql.ErrNoRows {
+		write_error(writer, "no such file", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("could not look up '%s': %v", full_path, err)
+		write_error(writer, "could not look up file", http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Disposition", content_disposition("inline", entry.Filename))
+	serve_blob(writer, request, entry.Hash)
+}
@@ -0,0 +1,157 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCatalogCleanPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"", "/"},
+		{"/", "/"},
+		{"photos", "/photos"},
+		{"/photos", "/photos"},
+		{"/photos/", "/photos"},
+		{"photos//2024/", "/photos/2024"},
+		{"/photos/./2024", "/photos/2024"},
+		{"/photos/../docs", "/docs"},
+		{"../..", "/"},
+	}
+	for _, test := range tests {
+		if got := catalog_clean_path(test.path); got != test.want {
+			t.Errorf("catalog_clean_path(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}
+
+func TestListCatalogUnder(t *testing.T) {
+	test_db(t, 1, 1000)
+	entries := []catalog_entry{
+		{Namespace: "default", Path: "", Filename: "top"},
+		{Namespace: "default", Path: "photos", Filename: "a"},
+		{Namespace: "default", Path: "/photos/", Filename: "b"},
+		{Namespace: "default", Path: "/photos/2024", Filename: "c"},
+		{Namespace: "default", Path: "/photosx", Filename: "d"},
+		{Namespace: "default", Path: "/pho_os", Filename: "e"},
+		{Namespace: "other", Path: "/photos", Filename: "f"},
+	}
+	for _, entry := range entries {
+		entry.Hash = "h" + entry.Filename
+		entry.HashAlgo = "blake2b"
+		entry.Size = 1
+		if _, err := db_add_catalog_entry(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		namespace string
+		dir       string
+		want      []string
+	}{
+		{"default", "", []string{"top", "e", "a", "b", "c", "d"}},
+		{"default", "/", []string{"top", "e", "a", "b", "c", "d"}},
+		{"default", "photos", []string{"a", "b", "c"}},
+		{"default", "/photos", []string{"a", "b", "c"}},
+		{"default", "/photos/", []string{"a", "b", "c"}},
+		{"default", "photos//", []string{"a", "b", "c"}},
+		{"default", "/photos/2024/", []string{"c"}},
+		{"default", "/photos/../photos/2024", []string{"c"}},
+		{"default", "/phot", nil},
+		{"default", "/pho%", nil},
+		{"other", "photos", []string{"f"}},
+		{"none", "/", nil},
+	}
+	for _, test := range tests {
+		listed, err := db_list_catalog_under(test.namespace, test.dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, entry := range listed {
+			got = append(got, entry.Filename)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s:%q: got %v, want %v", test.namespace, test.dir, got, test.want)
+		}
+	}
+}
+
+func TestMigrateCatalogCleanPaths(t *testing.T) {
+	test_db(t, 1, 1000)
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"", "/"},
+		{"photos/", "/photos"},
+		{"a/./b", "/a/b"},
+		{"/x/../y/", "/y"},
+		{"////////z", "/z"},
+		{"/ok", "/ok"},
+	}
+	for _, test := range tests {
+		_, err := db_exec(
+			`
+			insert into catalog(namespace, path, filename, hash, hash_algo, size, created_at)
+			values('default', ?, 'f', 'h', 'blake2b', 1, 0)
+			`,
+			test.path,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var logged_before int
+	if err := db.QueryRow(`select count(*) from catalog_log`).Scan(&logged_before); err != nil {
+		t.Fatal(err)
+	}
+	if err := db_transaction(migrate_catalog_clean_paths); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := db.Query(`select path from catalog order by id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for _, test := range tests {
+		var got string
+		if !rows.Next() {
+			t.Fatal("entries are missing")
+		}
+		if err := rows.Scan(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("%q became %q, want %q", test.path, got, test.want)
+		}
+	}
+	var logged int
+	if err := db.QueryRow(`select count(*) from catalog_log`).Scan(&logged); err != nil {
+		t.Fatal(err)
+	}
+	if logged-logged_before != 5 {
+		t.Errorf("%d changes logged, want 5", logged-logged_before)
+	}
+}
@@ -0,0 +1,227 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/**
+ * Virus scanning of uploads with clamd. Each upload is streamed to clamd
+ * once it is staged, and an infected one is turned away before it reaches
+ * the disks, either deleted or moved to the quarantine directory. The
+ * result of every scan is kept in the scans table.
+ */
+
+// where clamd listens, e.g. "unix" and "/var/run/clamav/clamd.ctl", or
+// "tcp" and "localhost:3310". Scanning is off while KFS_CLAMD_ADDR is empty.
+var KFS_CLAMD_NETWORK = "unix"
+var KFS_CLAMD_ADDR = ""
+
+// keep infected uploads in KFS_QUARANTINE_DIR, rather than deleting them
+var KFS_CLAMD_QUARANTINE = true
+var KFS_QUARANTINE_DIR = "/home/kyle/.kfs/quarantine"
+
+// turn uploads away when clamd cannot scan them, e.g. because it is down
+var KFS_CLAMD_REQUIRED = true
+
+var KFS_CLAMD_TIMEOUT = 5 * time.Minute
+
+const CLAMD_CHUNK_SIZE = 64 * 1024
+
+const (
+	SCAN_CLEAN    = "clean"
+	SCAN_INFECTED = "infected"
+	SCAN_ERROR    = "error"
+)
+
+/**
+ * Scan the uploads before any other post-staging hook sees them.
+ */
+func clamav_init() {
+	if KFS_CLAMD_ADDR == "" {
+		return
+	}
+	KFS_HOOKS[HOOK_POST_STAGING] = append(
+		[]hook{hook_func(clamav_hook)},
+		KFS_HOOKS[HOOK_POST_STAGING]...,
+	)
+	log.Printf("scanning uploads with clamd at %s:%s", KFS_CLAMD_NETWORK, KFS_CLAMD_ADDR)
+}
+
+/**
+ * Stream the file to clamd with INSTREAM, returning the name of the virus
+ * found, or "" if the file is clean.
+ */
+func clamd_scan(ctx context.Context, filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, KFS_CLAMD_NETWORK, KFS_CLAMD_ADDR)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(KFS_CLAMD_TIMEOUT)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	if _, err := io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 4+CLAMD_CHUNK_SIZE)
+	for {
+		n, err := f.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				return "", err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	binary.BigEndian.PutUint32(buf, 0)
+	if _, err := conn.Write(buf[:4]); err != nil {
+		return "", err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString('\x00')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	reply = strings.TrimSpace(strings.TrimSuffix(reply, "\x00"))
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(reply, " FOUND"), nil
+	default:
+		return "", fmt.Errorf("clamd: %s", reply)
+	}
+}
+
+func db_add_scan(hash string, algo string, result string, signature string, quarantine_path string) {
+	stmt := `
+		INSERT OR REPLACE INTO scans(
+			hash,
+			hash_algo,
+			result,
+			signature,
+			quarantine_path,
+			scanned_at
+		) values(?, ?, ?, ?, ?, ?)
+	`
+	_, err := db_exec(
+		stmt,
+		hash,
+		algo,
+		result,
+		signature,
+		quarantine_path,
+		time.Now().Unix(),
+	)
+	if err != nil {
+		log.Printf("could not record scan of %s: %v", hash, err)
+	}
+}
+
+/**
+ * Move an infected upload out of staging, so that it can be looked at
+ * later without ever being served.
+ */
+func quarantine_file(filename string, hash string, algo string) (string, error) {
+	if err := os.MkdirAll(KFS_QUARANTINE_DIR, 0700); err != nil {
+		return "", err
+	}
+	dst := filepath.Join(KFS_QUARANTINE_DIR, hash+"."+algo)
+	if err := os.Rename(filename, dst); err != nil {
+		if err := copy_file(filename, dst); err != nil {
+			return "", err
+		}
+		os.Remove(filename)
+	}
+	return dst, nil
+}
+
+func clamav_hook(ctx context.Context, call hook_call) error {
+	entry := call.Entry
+	signature, err := clamd_scan(ctx, call.File)
+	result := SCAN_CLEAN
+	if err != nil {
+		result = SCAN_ERROR
+	} else if signature != "" {
+		result = SCAN_INFECTED
+	}
+	metric_add(
+		"kfs_scans_total",
+		"Uploads scanned for viruses, by result.",
+		fmt.Sprintf("result=%q", result),
+		1,
+	)
+
+	switch result {
+	case SCAN_ERROR:
+		log.Printf("could not scan '%s': %v", entry.Filename, err)
+		db_add_scan(entry.Hash, entry.HashAlgo, result, err.Error(), "")
+		if KFS_CLAMD_REQUIRED {
+			return fmt.Errorf("could not scan for viruses")
+		}
+		return nil
+	case SCAN_INFECTED:
+		quarantine_path := ""
+		if KFS_CLAMD_QUARANTINE {
+			quarantine_path, err = quarantine_file(call.File, entry.Hash, entry.HashAlgo)
+			if err != nil {
+				log.Printf("could not quarantine '%s': %v", call.File, err)
+			}
+		}
+		log.Printf(
+			"'%s/%s' is infected with %s",
+			entry.Path,
+			entry.Filename,
+			signature,
+		)
+		db_add_scan(entry.Hash, entry.HashAlgo, result, signature, quarantine_path)
+		return fmt.Errorf("infected with %s", signature)
+	default:
+		db_add_scan(entry.Hash, entry.HashAlgo, result, "", "")
+		return nil
+	}
+}
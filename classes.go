@@ -0,0 +1,56 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+/**
+ * Storage classes, so that bulk archives can land on big, slow disks and
+ * documents that are read often on SSDs. Each disk may be given a class,
+ * and an upload asks for one with class=, or gets the one of its
+ * namespace. Every replica of a blob stored in a class is placed on disks
+ * of that class, including those added later to keep up its replica count.
+ * A blob stored without a class may go on any disk.
+ */
+
+var (
+	// the class of each disk, by root, e.g. "/mnt/ssd1": "ssd"
+	KFS_DISK_CLASSES = map[string]string{}
+
+	// the class uploads to each namespace are stored in, e.g. "logs": "archive"
+	KFS_NAMESPACE_CLASSES = map[string]string{}
+)
+
+/**
+ * The class an upload to the namespace is stored in, when it does not ask
+ * for one itself.
+ */
+func namespace_class(namespace string) string {
+	return settings().namespace_classes[namespace]
+}
+
+/**
+ * Whether any disk in the cluster is in the class.
+ */
+func db_class_exists(class string) (bool, error) {
+	if class == "" {
+		return true, nil
+	}
+	var exists bool
+	query := `select exists(select 1 from disks where class = ?)`
+	err := db.QueryRow(query, class).Scan(&exists)
+	return exists, err
+}
@@ -0,0 +1,258 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/**
+ * How the subcommands that talk to a server, e.g. kfs put and kfs get,
+ * send their requests. A request that failed in a way that may pass by
+ * itself is sent again: when the connection broke or timed out, or the
+ * server answered 429, 500, 502, 503 or 504, as it does with 503 in
+ * read-only mode, or 409 because the same content was being uploaded by
+ * someone else. Before each retry the client waits twice as long as the
+ * time before, from KFS_CLIENT_BACKOFF up to KFS_CLIENT_MAX_BACKOFF, less
+ * a random part of it, so that clients cut off at once do not all come
+ * back at once, or for as long as the server asked in Retry-After. Any
+ * other error is final, e.g. 406 for a hash mismatch, since the same
+ * request would get the same answer.
+ */
+
+var (
+	KFS_CLIENT_RETRIES     = 5
+	KFS_CLIENT_BACKOFF     = time.Second
+	KFS_CLIENT_MAX_BACKOFF = time.Minute
+
+	// parts sent or chunks fetched at once, over as many connections
+	KFS_CLIENT_PARALLEL = 4
+)
+
+/**
+ * An error response from the server.
+ */
+type client_error struct {
+	Status     int
+	Code       string
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *client_error) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("%d %s: %s", e.Status, http.StatusText(e.Status), e.Message)
+	}
+	return fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status))
+}
+
+/**
+ * Add the flags that tune retries to a subcommand.
+ */
+func client_flags(flags *flag.FlagSet) {
+	flags.IntVar(
+		&KFS_CLIENT_RETRIES,
+		"retries",
+		KFS_CLIENT_RETRIES,
+		"times to retry a request that failed in a way that may pass",
+	)
+	flags.DurationVar(
+		&KFS_CLIENT_BACKOFF,
+		"backoff",
+		KFS_CLIENT_BACKOFF,
+		"wait before the first retry, doubled for each after it",
+	)
+	flags.DurationVar(
+		&KFS_CLIENT_MAX_BACKOFF,
+		"max-backoff",
+		KFS_CLIENT_MAX_BACKOFF,
+		"longest wait between retries",
+	)
+	flags.IntVar(
+		&KFS_CLIENT_PARALLEL,
+		"parallel",
+		KFS_CLIENT_PARALLEL,
+		"parts of a file to send or fetch at once",
+	)
+}
+
+/**
+ * Turn a response that is not a 2xx into a client_error, with the message
+ * from the body, if it has one.
+ */
+func client_check(response *http.Response) error {
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return nil
+	}
+	failure := &client_error{Status: response.StatusCode}
+	var body api_error_response
+	if json.NewDecoder(response.Body).Decode(&body) == nil {
+		failure.Code = body.Error.Code
+		failure.Message = body.Error.Message
+	}
+	if seconds, err := strconv.Atoi(response.Header.Get("Retry-After")); err == nil {
+		failure.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return failure
+}
+
+/**
+ * Send the request, and return an error for a response that is not a
+ * 2xx. The caller closes the body of a response it gets.
+ */
+func client_do(request *http.Request) (*http.Response, error) {
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if err := client_check(response); err != nil {
+		response.Body.Close()
+		return nil, err
+	}
+	return response, nil
+}
+
+/**
+ * Send the request, and decode the JSON of its response into reply.
+ */
+func client_json(request *http.Request, reply interface{}) error {
+	response, err := client_do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	return json.NewDecoder(response.Body).Decode(reply)
+}
+
+func client_retryable(err error) bool {
+	var failure *client_error
+	if errors.As(err, &failure) {
+		switch failure.Status {
+		case http.StatusTooManyRequests,
+			http.StatusInternalServerError,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout:
+			return true
+		}
+		return failure.Code == API_IN_FLIGHT
+	}
+	var url_err *url.Error
+	var net_err net.Error
+	return errors.As(err, &url_err) ||
+		errors.As(err, &net_err) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+/**
+ * How long to wait before retry number attempt, counting from 0.
+ */
+func client_backoff(attempt int, err error) time.Duration {
+	backoff := KFS_CLIENT_BACKOFF
+	for i := 0; i < attempt && backoff < KFS_CLIENT_MAX_BACKOFF; i++ {
+		backoff *= 2
+	}
+	if backoff > KFS_CLIENT_MAX_BACKOFF {
+		backoff = KFS_CLIENT_MAX_BACKOFF
+	}
+	if backoff > 1 {
+		backoff -= time.Duration(rand.Int63n(int64(backoff / 2)))
+	}
+	var failure *client_error
+	if errors.As(err, &failure) && failure.RetryAfter > backoff {
+		backoff = failure.RetryAfter
+	}
+	return backoff
+}
+
+/**
+ * Call attempt until it succeeds, fails for good, or has been retried
+ * KFS_CLIENT_RETRIES times. what names the attempt in messages.
+ */
+func client_retry(what string, attempt func() error) error {
+	for i := 0; ; i++ {
+		err := attempt()
+		if err == nil || i >= KFS_CLIENT_RETRIES || !client_retryable(err) {
+			return err
+		}
+		wait := client_backoff(i, err)
+		fmt.Fprintf(
+			os.Stderr,
+			"%s failed, retrying in %v: %v\n",
+			what,
+			wait.Round(time.Millisecond),
+			err,
+		)
+		time.Sleep(wait)
+	}
+}
+
+/**
+ * Run fn for every index below n, on up to KFS_CLIENT_PARALLEL goroutines,
+ * and return the first error. Once one has failed, the indexes not yet
+ * started are left.
+ */
+func client_parallel(n int, fn func(i int) error) error {
+	workers := KFS_CLIENT_PARALLEL
+	if workers < 1 {
+		workers = 1
+	}
+	next := make(chan int)
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var first error
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				if err := fn(i); err != nil {
+					mutex.Lock()
+					if first == nil {
+						first = err
+					}
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		mutex.Lock()
+		failed := first != nil
+		mutex.Unlock()
+		if failed {
+			break
+		}
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return first
+}
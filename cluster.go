@@ -0,0 +1,627 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+/**
+ * Several kfs servers can form a cluster. Each node owns its local disks,
+ * and learns about the disks of the others by polling them, so an upload to
+ * any node can place its replicas on disks anywhere in the cluster. The
+ * catalog is replicated: every change made on one node is sent to all the
+ * others, and each node also follows the catalog log of every peer, so a
+ * change it missed while it was down or unreachable still reaches it. An
+ * entry is known across the cluster by the node it was added on and its id
+ * there. Blobs are only recorded on the node that accepted the upload and
+ * the nodes holding a replica, and other nodes fetch them from their peers.
+ */
+
+// name of this node, node_name in the config, the hostname when empty
+var KFS_NODE_NAME = ""
+
+// base URLs of the other nodes, e.g. "http://nas2:8080", empty to run alone,
+// cluster_peers in the config
+var KFS_CLUSTER_PEERS = []string{}
+
+var KFS_CLUSTER_POLL_INTERVAL = 30 * time.Second
+
+// nodes not heard from for this long are not given new replicas
+var KFS_CLUSTER_NODE_TIMEOUT = 2 * time.Minute
+
+// set on requests between nodes, so that they are never passed on again
+const KFS_CLUSTER_HEADER = "X-Kfs-Cluster-Node"
+
+var cluster_client = &http.Client{Timeout: 30 * time.Second}
+
+/**
+ * A disk that holds, or is to hold, a replica. node is empty for the disks
+ * of this node.
+ */
+type placement struct {
+	node string
+	root string
+}
+
+func (p placement) String() string {
+	if p.node == "" {
+		return p.root
+	}
+	return p.node + ":" + p.root
+}
+
+type cluster_disk struct {
+	Root      string `json:"root"`
+	Available int64  `json:"available"`
+	Class     string `json:"class,omitempty"`
+}
+
+type cluster_state struct {
+	Node  string         `json:"node"`
+	Disks []cluster_disk `json:"disks"`
+}
+
+/**
+ * A catalog change made on another node. Old is nil when the entry was
+ * added, and is the entry as it was before otherwise. Origin and OriginID
+ * are the node the entry was added on and its id there.
+ */
+type cluster_catalog_change struct {
+	Old      *catalog_entry `json:"old"`
+	Entry    catalog_entry  `json:"entry"`
+	Origin   string         `json:"origin,omitempty"`
+	OriginID int64          `json:"origin_id,omitempty"`
+}
+
+func cluster_enabled() bool {
+	return len(KFS_CLUSTER_PEERS) > 0
+}
+
+func cluster_init() {
+	if KFS_NODE_NAME == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			panic(fmt.Errorf("could not get hostname for node name: %v", err))
+		}
+		KFS_NODE_NAME = hostname
+	}
+	if cluster_enabled() {
+		log.Printf("node '%s' joining cluster: %v", KFS_NODE_NAME, KFS_CLUSTER_PEERS)
+		if settings().cluster_secret == "" {
+			log.Printf("cluster_secret is not set, peers will refuse this node")
+		}
+	}
+}
+
+func db_update_node(base_url string, state cluster_state) error {
+	return db_transaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			`
+			insert or replace into nodes(name, url, last_seen)
+			values(?, ?, ?)
+			`,
+			state.Node,
+			base_url,
+			time.Now().Unix(),
+		)
+		if err != nil {
+			return err
+		}
+		for _, disk := range state.Disks {
+			_, err := tx.Exec(
+				`
+				insert or replace into disks(node, root, available, class)
+				values(?, ?, ?, ?)
+				`,
+				state.Node,
+				disk.Root,
+				disk.Available,
+				disk.Class,
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func db_get_node_url(name string) (string, error) {
+	var base_url string
+	err := db.QueryRow(`select url from nodes where name = ?`, name).Scan(&base_url)
+	if err != nil {
+		return "", fmt.Errorf("could not find node '%s': %v", name, err)
+	}
+	return base_url, nil
+}
+
+/**
+ * Base URLs of the nodes recorded as holding a replica of the hash.
+ */
+func db_get_replica_nodes(hash string) ([]string, error) {
+	query := `
+		select distinct nodes.url
+		from files join nodes on nodes.name = files.node
+		where files.hash = ? and not files.pending
+	`
+	rows, err := db.Query(query, hash)
+	if err != nil {
+		return nil, fmt.Errorf("could not query for replica nodes: %v", err)
+	}
+	defer rows.Close()
+
+	var urls []string
+	for rows.Next() {
+		var base_url string
+		if err := rows.Scan(&base_url); err != nil {
+			return nil, err
+		}
+		urls = append(urls, base_url)
+	}
+	return urls, rows.Err()
+}
+
+func db_is_local_disk(root string) bool {
+	var n int
+	query := `select count(*) from disks where node = '' and root = ?`
+	if err := db.QueryRow(query, root).Scan(&n); err != nil {
+		return false
+	}
+	return n > 0
+}
+
+/**
+ * Report this node's disks, so its peers can place replicas on them.
+ */
+func handle_cluster_state(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	disks, err := db_list_disks()
+	if err != nil {
+		log.Println(err)
+		write_error(writer, "could not list disks", http.StatusInternalServerError)
+		return
+	}
+	state := cluster_state{Node: KFS_NODE_NAME, Disks: []cluster_disk{}}
+	for _, disk := range disks {
+		state.Disks = append(state.Disks, cluster_disk{disk.Root, disk.Available, disk.Class})
+	}
+	write_json(writer, http.StatusOK, state)
+}
+
+func cluster_poll(base_url string) error {
+	var state cluster_state
+	if err := cluster_get_json(base_url+"/cluster/state", &state); err != nil {
+		return err
+	}
+	if state.Node == "" || state.Node == KFS_NODE_NAME {
+		return fmt.Errorf("node has invalid name '%s'", state.Node)
+	}
+	return db_update_node(base_url, state)
+}
+
+func cluster_loop() {
+	if !cluster_enabled() {
+		return
+	}
+	for {
+		for _, base_url := range KFS_CLUSTER_PEERS {
+			if err := cluster_poll(base_url); err != nil {
+				log.Printf("could not poll node '%s': %v", base_url, err)
+				continue
+			}
+			if err := cluster_catch_up(base_url); err != nil {
+				log.Printf("could not follow the catalog of node '%s': %v", base_url, err)
+			}
+		}
+		time.Sleep(KFS_CLUSTER_POLL_INTERVAL)
+	}
+}
+
+/**
+ * The node the entry was added on, and its id there.
+ */
+func db_get_catalog_origin(id int64) (string, int64, error) {
+	var node string
+	var origin_id int64
+	query := `select node, origin_id from catalog_origins where catalog_id = ?`
+	err := db.QueryRow(query, id).Scan(&node, &origin_id)
+	if err == sql.ErrNoRows {
+		return KFS_NODE_NAME, id, nil
+	}
+	return node, origin_id, err
+}
+
+func catalog_change_of(old *catalog_entry, entry catalog_entry) cluster_catalog_change {
+	change := cluster_catalog_change{Old: old, Entry: entry}
+	var err error
+	change.Origin, change.OriginID, err = db_get_catalog_origin(entry.ID)
+	if err != nil {
+		log.Printf("could not look up origin of catalog entry %d: %v", entry.ID, err)
+		change.Origin = ""
+		change.OriginID = 0
+	}
+	return change
+}
+
+/**
+ * Send a catalog change to every other node. This happens in the background,
+ * and a node that misses it picks it up from this node's catalog log the
+ * next time it follows it.
+ */
+func cluster_replicate_catalog(old *catalog_entry, entry catalog_entry) {
+	if !cluster_enabled() {
+		return
+	}
+	body, err := json.Marshal(catalog_change_of(old, entry))
+	if err != nil {
+		log.Printf("could not encode catalog change: %v", err)
+		return
+	}
+	for _, base_url := range KFS_CLUSTER_PEERS {
+		go func(base_url string) {
+			request, err := cluster_request(
+				context.Background(),
+				http.MethodPost,
+				base_url+"/cluster/catalog",
+				bytes.NewReader(body),
+			)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			request.Header.Set("Content-Type", "application/json")
+			response, err := cluster_client.Do(request)
+			if err != nil {
+				log.Printf("could not replicate catalog to '%s': %v", base_url, err)
+				return
+			}
+			response.Body.Close()
+			if response.StatusCode != http.StatusOK {
+				log.Printf(
+					"could not replicate catalog to '%s': got status %d",
+					base_url,
+					response.StatusCode,
+				)
+			}
+		}(base_url)
+	}
+}
+
+/**
+ * The entries on this node a replicated change applies to: the one known by
+ * the change's origin or, failing that, those with the contents the entry
+ * had that no other node is known to have added, which is how entries
+ * replicated before origins were kept are found.
+ */
+func db_find_replicated_entries(tx *sql.Tx, change cluster_catalog_change) ([]int64, error) {
+	var id int64
+	var err error
+	switch change.Origin {
+	case "":
+		err = sql.ErrNoRows
+	case KFS_NODE_NAME:
+		err = tx.QueryRow(`select id from catalog where id = ?`, change.OriginID).Scan(&id)
+	default:
+		query := `select catalog_id from catalog_origins where node = ? and origin_id = ?`
+		err = tx.QueryRow(query, change.Origin, change.OriginID).Scan(&id)
+	}
+	if err == nil {
+		return []int64{id}, nil
+	}
+	if err != sql.ErrNoRows || change.Origin == KFS_NODE_NAME {
+		return nil, err
+	}
+
+	match := change.Entry
+	if change.Old != nil {
+		match = *change.Old
+	}
+	query := `
+		select id from catalog
+		where namespace = ?
+			and path = ?
+			and filename = ?
+			and hash = ?
+			and created_at = ?
+			and id not in (select catalog_id from catalog_origins)
+	`
+	rows, err := tx.Query(
+		query,
+		match.Namespace,
+		catalog_clean_path(match.Path),
+		match.Filename,
+		match.Hash,
+		match.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+/**
+ * Apply a change replicated from another node, adding the entry when this
+ * node does not have it, and return whether it was added. An entry that was
+ * added on this node and is not here any more was purged, and is not added
+ * back. The change is logged as replicated, so that the nodes following
+ * this node's log do not take it for one made here.
+ */
+func db_apply_catalog_change(change cluster_catalog_change) (bool, error) {
+	added := false
+	err := db_transaction(func(tx *sql.Tx) error {
+		added = false
+		ids, err := db_find_replicated_entries(tx, change)
+		if err != nil {
+			return err
+		}
+		remote := change.Origin != "" && change.Origin != KFS_NODE_NAME
+		if len(ids) == 0 {
+			if change.Origin == KFS_NODE_NAME || (change.Origin == "" && change.Old != nil) {
+				return nil
+			}
+			id, err := db_insert_catalog_row(tx, change.Entry)
+			if err != nil {
+				return err
+			}
+			ids = []int64{id}
+			added = true
+		}
+		for _, id := range ids {
+			entry := change.Entry
+			entry.ID = id
+			if !added {
+				if err := db_update_catalog_row(tx, entry); err != nil {
+					return err
+				}
+			}
+			if remote {
+				_, err := tx.Exec(
+					`
+					insert or ignore into catalog_origins(catalog_id, node, origin_id)
+					values(?, ?, ?)
+					`,
+					id,
+					change.Origin,
+					change.OriginID,
+				)
+				if err != nil {
+					return err
+				}
+			}
+			if err := db_log_replicated_change(tx, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("could not apply catalog change: %v", err)
+	}
+	return added, nil
+}
+
+/**
+ * Apply a catalog change from another node. A newly added entry's hash is
+ * also claimed here, so that uploading the same content to this node is a
+ * dedup hit rather than a second copy, and the blob is fetched from the
+ * node that has it.
+ */
+func cluster_apply_change(change cluster_catalog_change) error {
+	added, err := db_apply_catalog_change(change)
+	if err != nil || !added {
+		return err
+	}
+	entry := change.Entry
+	_, err = db_exec(
+		`
+		insert or ignore into blobs(hash, hash_algo, created_at)
+		values(?, ?, ?)
+		`,
+		entry.Hash,
+		entry.HashAlgo,
+		entry.CreatedAt,
+	)
+	if err != nil {
+		log.Printf("could not claim %s: %v", entry.Hash, err)
+	}
+	known_hash_add(entry.Hash, entry.HashAlgo)
+	return nil
+}
+
+func handle_cluster_catalog(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	var change cluster_catalog_change
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		log.Printf("could not read catalog change: %v", err)
+		write_error(writer, "could not read catalog change", http.StatusBadRequest)
+		return
+	}
+	if err := json.Unmarshal(body, &change); err != nil {
+		write_error(writer, "invalid catalog change", http.StatusBadRequest)
+		return
+	}
+	if err := cluster_apply_change(change); err != nil {
+		log.Println(err)
+		write_error(writer, "could not update catalog", http.StatusInternalServerError)
+		return
+	}
+	writer.WriteHeader(http.StatusOK)
+}
+
+func db_get_cluster_seq(peer string) (int64, error) {
+	var seq int64
+	err := db.QueryRow(`select seq from cluster_seqs where peer = ?`, peer).Scan(&seq)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return seq, err
+}
+
+func db_set_cluster_seq(peer string, seq int64) error {
+	stmt := `insert or replace into cluster_seqs(peer, seq) values(?, ?)`
+	_, err := db_exec(stmt, peer, seq)
+	return err
+}
+
+/**
+ * Apply the catalog changes made on the peer since this node last followed
+ * its log, which catches up on any that were pushed while this node was
+ * down or could not be reached. Changes the peer only passed on are left
+ * to the node that made them.
+ */
+func cluster_catch_up(base_url string) error {
+	for {
+		seq, err := db_get_cluster_seq(base_url)
+		if err != nil {
+			return err
+		}
+		var batch catalog_changes
+		target := fmt.Sprintf("%s/cluster/changes?after=%d&local=true", base_url, seq)
+		if err := cluster_get_json(target, &batch); err != nil {
+			return err
+		}
+		if len(batch.Changes) == 0 {
+			return nil
+		}
+		for _, change := range batch.Changes {
+			if change.Entry != nil {
+				err := cluster_apply_change(cluster_catalog_change{
+					Entry:    *change.Entry,
+					Origin:   change.Origin,
+					OriginID: change.OriginID,
+				})
+				if err != nil {
+					return fmt.Errorf("could not apply change %d: %v", change.Seq, err)
+				}
+			}
+			if err := db_set_cluster_seq(base_url, change.Seq); err != nil {
+				return err
+			}
+			metric_set(
+				"kfs_cluster_catalog_seq",
+				"The last change of the peer's catalog log applied to this node.",
+				fmt.Sprintf("peer=%q", base_url),
+				float64(change.Seq),
+			)
+		}
+	}
+}
+
+/**
+ * Fetch the blob from another node and pass it on to the client, trying the
+ * nodes known to hold a replica first. The client's Range is passed on, and
+ * a partial answer passed back as it is. Returns false, without writing
+ * anything, if no node could send it. Requests from other nodes are never
+ * passed on, so a blob that is nowhere cannot bounce around the cluster.
+ */
+func cluster_serve_blob(writer http.ResponseWriter, request *http.Request, hash string) bool {
+	if !cluster_enabled() || request.Header.Get(KFS_CLUSTER_HEADER) != "" {
+		return false
+	}
+	candidates, err := db_get_replica_nodes(hash)
+	if err != nil {
+		log.Println(err)
+	}
+	seen := map[string]bool{}
+	for _, base_url := range append(candidates, KFS_CLUSTER_PEERS...) {
+		if seen[base_url] {
+			continue
+		}
+		seen[base_url] = true
+
+		blob_url := fmt.Sprintf("%s/download/%s", base_url, hash)
+		if request.URL.RawQuery != "" {
+			blob_url += "?" + request.URL.RawQuery
+		}
+		peer_request, err := cluster_request(
+			request.Context(),
+			http.MethodGet,
+			blob_url,
+			nil,
+		)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		for _, header := range []string{"Range", "If-Range"} {
+			if value := request.Header.Get(header); value != "" {
+				peer_request.Header.Set(header, value)
+			}
+		}
+		response, err := http.DefaultClient.Do(peer_request)
+		if err != nil {
+			log.Printf("could not fetch %s from '%s': %v", hash, base_url, err)
+			continue
+		}
+		switch response.StatusCode {
+		case http.StatusOK, http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+		default:
+			response.Body.Close()
+			continue
+		}
+
+		for _, header := range []string{
+			"Content-Type",
+			"Content-Length",
+			"Content-Range",
+			"Accept-Ranges",
+			"Last-Modified",
+			"X-Kfs-Hash",
+			"X-Kfs-Hash-Algo",
+			"Repr-Digest",
+		} {
+			if value := response.Header.Get(header); value != "" {
+				writer.Header().Set(header, value)
+			}
+		}
+		writer.WriteHeader(response.StatusCode)
+		n, err := io.Copy(writer, response.Body)
+		response.Body.Close()
+		if err != nil {
+			log.Printf(
+				"failed to pass on %s from '%s' after %d bytes: %v",
+				hash,
+				base_url,
+				n,
+				err,
+			)
+			panic(http.ErrAbortHandler)
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,572 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+/**
+ * The settings that can be changed without a rebuild, read from
+ * KFS_CONFIG_PATH at startup and again on SIGHUP or POST /admin/reload,
+ * e.g.
+ *     {
+ *         "disks": ["/mnt/disk1", "/mnt/disk2", "/mnt/disk3"],
+ *         "redundancy": 2,
+ *         "log_level": "info",
+ *         "upload_policies": {"photos": {"max_size": 1073741824}}
+ *     }
+ * Settings left out of the file keep the value they have. Uploads already
+ * in flight keep the disks they were given, so a reload never interrupts
+ * them. How the node joins others is only read at startup, e.g.
+ *     {
+ *         "node_name": "nas1",
+ *         "cluster_peers": ["http://nas2:8080"],
+ *         "cluster_secret": "...",
+ *         "event_sinks": [{"type": "nats", "addr": "localhost:4222", "subject": "kfs"}]
+ *     }
+ * as are geo_remote, mirror_of and cache_path, and a reload that changes
+ * them only logs that a restart is needed.
+ */
+
+var KFS_CONFIG_PATH = "/home/kyle/.kfs/kfs.json"
+
+// "debug" logs every request, "info" only what is worth keeping
+var KFS_LOG_LEVEL = "debug"
+
+var log_levels = map[string]int{"debug": 0, "info": 1}
+
+/**
+ * Log the routine detail of handling a request, which is only wanted when
+ * debugging.
+ */
+func log_debug(format string, v ...interface{}) {
+	if log_levels[settings().log_level] <= log_levels["debug"] {
+		log.Printf(format, v...)
+	}
+}
+
+type kfs_config struct {
+	Disks            []string                    `json:"disks"`
+	Redundancy       *int                        `json:"redundancy"`
+	LogLevel         *string                     `json:"log_level"`
+	ClusterSecret    *string                     `json:"cluster_secret"`
+	AdminToken       *string                     `json:"admin_token"`
+	GeoMaxRate       *int64                      `json:"geo_max_rate"`
+	UploadPolicies   map[string]upload_policy    `json:"upload_policies"`
+	Cors             map[string]cors_policy      `json:"cors"`
+	WormNamespaces   map[string]worm_policy      `json:"worm_namespaces"`
+	DiskClasses      map[string]string           `json:"disk_classes"`
+	NamespaceClasses map[string]string           `json:"namespace_classes"`
+	SyncFilters      map[string][]string         `json:"sync_filters"`
+	HashTools        map[string]string           `json:"hash_tools"`
+	StagingDir       *string                     `json:"staging_dir"`
+	DirectWrites     *bool                       `json:"direct_writes"`
+	RequireMount     *bool                       `json:"require_mount_point"`
+	Faults           map[string]fault_spec       `json:"faults"`
+	VerifyReplicas   *bool                       `json:"verify_replicas"`
+	ParallelHashMin  *int64                      `json:"parallel_hash_min_size"`
+	GC               *bool                       `json:"gc"`
+	GCGraceDays      *int                        `json:"gc_grace_days"`
+	Retention        map[string]retention_policy `json:"retention"`
+	RetentionEnforce *bool                       `json:"retention_enforce"`
+	TrustedProxies   []string                    `json:"trusted_proxies"`
+	DurableUploads   *bool                       `json:"durable_uploads"`
+	Fsync            *string                     `json:"fsync"`
+	FSIntegration    *bool                       `json:"fs_integration"`
+	FSSnapshotsKeep  *int                        `json:"fs_snapshots_keep"`
+	Hooks            map[string][]hook_spec      `json:"hooks"`
+
+	// only read at startup
+	NodeName     *string     `json:"node_name"`
+	ClusterPeers []string    `json:"cluster_peers"`
+	GeoRemote    *string     `json:"geo_remote"`
+	MirrorOf     *string     `json:"mirror_of"`
+	EventSinks   []sink_spec `json:"event_sinks"`
+	CachePath    *string     `json:"cache_path"`
+}
+
+// the settings only read at startup, as they were then
+var config_startup kfs_config
+
+var config_mutex sync.Mutex
+
+/**
+ * Read the config file. A missing file is not an error, since every
+ * setting has a built-in default.
+ */
+func config_read() (*kfs_config, error) {
+	data, err := os.ReadFile(KFS_CONFIG_PATH)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var config kfs_config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid config '%s': %v", KFS_CONFIG_PATH, err)
+	}
+	disks, redundancy := settings().disks, settings().redundancy
+	if config.Disks != nil {
+		disks = config.Disks
+	}
+	if config.Redundancy != nil {
+		redundancy = *config.Redundancy
+	}
+	if redundancy < 1 {
+		return nil, fmt.Errorf("redundancy must be at least 1")
+	}
+	peers := KFS_CLUSTER_PEERS
+	if config.ClusterPeers != nil {
+		peers = config.ClusterPeers
+	}
+	if len(peers) == 0 && len(disks) < redundancy {
+		return nil, fmt.Errorf("%d disks cannot hold %d replicas", len(disks), redundancy)
+	}
+	if config.LogLevel != nil {
+		if _, ok := log_levels[*config.LogLevel]; !ok {
+			return nil, fmt.Errorf("unknown log level '%s'", *config.LogLevel)
+		}
+	}
+	if config.Fsync != nil {
+		if _, ok := fsync_levels[*config.Fsync]; !ok {
+			return nil, fmt.Errorf("unknown fsync policy '%s'", *config.Fsync)
+		}
+	}
+	if _, err := proxy_parse(config.TrustedProxies); err != nil {
+		return nil, err
+	}
+	for algo := range config.HashTools {
+		if !valid_hash_algo(algo) {
+			return nil, fmt.Errorf("unsupported hash algorithm: '%s'", algo)
+		}
+	}
+	for namespace, lines := range config.SyncFilters {
+		if _, err := parse_filter_rules(lines); err != nil {
+			return nil, fmt.Errorf("invalid sync filter for '%s': %v", namespace, err)
+		}
+	}
+	for name, spec := range config.Faults {
+		if !fault_names[name] {
+			return nil, fmt.Errorf("unknown fault '%s'", name)
+		}
+		if spec.Rate < 0 || spec.Rate > 1 {
+			return nil, fmt.Errorf("rate of %s faults must be from 0 to 1", name)
+		}
+	}
+	if config.FSSnapshotsKeep != nil && *config.FSSnapshotsKeep < 0 {
+		return nil, fmt.Errorf("fs_snapshots_keep must not be negative")
+	}
+	if config.ParallelHashMin != nil && *config.ParallelHashMin < 0 {
+		return nil, fmt.Errorf("parallel_hash_min_size must not be negative")
+	}
+	if config.GCGraceDays != nil && *config.GCGraceDays < 1 {
+		return nil, fmt.Errorf("gc_grace_days must be at least 1")
+	}
+	if _, err := hooks_from_specs(config.Hooks); err != nil {
+		return nil, err
+	}
+	for _, spec := range config.EventSinks {
+		if _, err := spec.sink(); err != nil {
+			return nil, fmt.Errorf("invalid event sink: %v", err)
+		}
+	}
+	for _, peer := range config.ClusterPeers {
+		if err := config_check_url("cluster_peers", peer); err != nil {
+			return nil, err
+		}
+	}
+	if config.GeoRemote != nil && *config.GeoRemote != "" {
+		if err := config_check_url("geo_remote", *config.GeoRemote); err != nil {
+			return nil, err
+		}
+	}
+	if config.MirrorOf != nil && *config.MirrorOf != "" {
+		if err := config_check_url("mirror_of", *config.MirrorOf); err != nil {
+			return nil, err
+		}
+	}
+	for namespace, policy := range config.Retention {
+		if err := policy.validate(); err != nil {
+			return nil, fmt.Errorf("invalid retention for '%s': %v", namespace, err)
+		}
+	}
+	return &config, nil
+}
+
+func config_check_url(key string, raw string) error {
+	parsed, err := url.Parse(raw)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("%s: '%s' is not an http or https URL", key, raw)
+	}
+	return nil
+}
+
+func (config *kfs_config) startup_only() kfs_config {
+	return kfs_config{
+		NodeName:     config.NodeName,
+		ClusterPeers: config.ClusterPeers,
+		GeoRemote:    config.GeoRemote,
+		MirrorOf:     config.MirrorOf,
+		EventSinks:   config.EventSinks,
+		CachePath:    config.CachePath,
+	}
+}
+
+/**
+ * Apply the settings that are only read at startup, before anything that
+ * uses them is started.
+ */
+func (config *kfs_config) apply_startup() {
+	config_startup = config.startup_only()
+	if config.NodeName != nil {
+		KFS_NODE_NAME = *config.NodeName
+	}
+	if config.ClusterPeers != nil {
+		KFS_CLUSTER_PEERS = config.ClusterPeers
+	}
+	if config.GeoRemote != nil {
+		KFS_GEO_REMOTE = *config.GeoRemote
+	}
+	if config.MirrorOf != nil {
+		KFS_MIRROR_OF = *config.MirrorOf
+	}
+	if config.EventSinks != nil {
+		// checked by config_read
+		sinks := []event_sink{}
+		for _, spec := range config.EventSinks {
+			sink, _ := spec.sink()
+			sinks = append(sinks, sink)
+		}
+		KFS_EVENT_SINKS = sinks
+	}
+	if config.CachePath != nil {
+		KFS_CACHE_PATH = *config.CachePath
+	}
+}
+
+/**
+ * The settings a reload can change, as they are running. A reload builds a
+ * new one and publishes it whole, so whatever reads settings() once sees
+ * every setting as of one reload, never some from before it and some from
+ * after, and readers take no lock. The KFS_* variables of each setting are
+ * its built-in default.
+ */
+type kfs_settings struct {
+	disks                  []string
+	redundancy             int
+	log_level              string
+	cluster_secret         string
+	admin_token            string
+	geo_max_rate           int64
+	upload_policies        map[string]upload_policy
+	cors                   map[string]cors_policy
+	worm_namespaces        map[string]worm_policy
+	disk_classes           map[string]string
+	namespace_classes      map[string]string
+	sync_filters           map[string][]string
+	hash_algos             map[string]string
+	staging_dir            string
+	direct_writes          bool
+	require_mount_point    bool
+	verify_replicas        bool
+	parallel_hash_min_size int64
+	gc_enabled             bool
+	gc_grace               time.Duration
+	retention              map[string]retention_policy
+	retention_enforce      bool
+	trusted_proxies        []*net.IPNet
+	durable_uploads        bool
+	fsync                  string
+	fs_integration         bool
+	fs_snapshots_keep      int
+
+	// from the config, run after those in KFS_HOOKS
+	hooks map[string][]hook
+}
+
+var settings_value atomic.Value
+
+/**
+ * The running settings. Until the config is loaded, e.g. in the commands
+ * that do not start the server, they are the built-in defaults.
+ */
+func settings() *kfs_settings {
+	if running, _ := settings_value.Load().(*kfs_settings); running != nil {
+		return running
+	}
+	return settings_defaults()
+}
+
+func settings_defaults() *kfs_settings {
+	return &kfs_settings{
+		disks:                  KFS_DISKS,
+		redundancy:             KFS_REDUNDANCY,
+		log_level:              KFS_LOG_LEVEL,
+		cluster_secret:         KFS_CLUSTER_SECRET,
+		admin_token:            KFS_ADMIN_TOKEN,
+		geo_max_rate:           KFS_GEO_MAX_RATE,
+		upload_policies:        KFS_UPLOAD_POLICIES,
+		cors:                   KFS_CORS,
+		worm_namespaces:        KFS_WORM_NAMESPACES,
+		disk_classes:           KFS_DISK_CLASSES,
+		namespace_classes:      KFS_NAMESPACE_CLASSES,
+		sync_filters:           KFS_SYNC_FILTERS,
+		hash_algos:             KFS_HASH_ALGOS,
+		staging_dir:            KFS_STAGING_DIR,
+		direct_writes:          KFS_DIRECT_WRITES,
+		require_mount_point:    KFS_REQUIRE_MOUNT_POINT,
+		verify_replicas:        KFS_VERIFY_REPLICAS,
+		parallel_hash_min_size: KFS_PARALLEL_HASH_MIN_SIZE,
+		gc_enabled:             KFS_GC_ENABLED,
+		gc_grace:               KFS_GC_GRACE,
+		retention:              KFS_RETENTION,
+		retention_enforce:      KFS_RETENTION_ENFORCE,
+		trusted_proxies:        KFS_TRUSTED_PROXIES,
+		durable_uploads:        KFS_DURABLE_UPLOADS,
+		fsync:                  KFS_FSYNC,
+		fs_integration:         KFS_FS_INTEGRATION,
+		fs_snapshots_keep:      KFS_FS_SNAPSHOTS_KEEP,
+		hooks:                  map[string][]hook{},
+	}
+}
+
+/**
+ * The settings with those in the config laid over them. The config has
+ * been checked by config_read, so nothing here fails.
+ */
+func (config *kfs_config) settings(running *kfs_settings) *kfs_settings {
+	next := *running
+	if config.Disks != nil {
+		next.disks = config.Disks
+	}
+	if config.Redundancy != nil {
+		next.redundancy = *config.Redundancy
+	}
+	if config.LogLevel != nil {
+		next.log_level = *config.LogLevel
+	}
+	if config.ClusterSecret != nil {
+		next.cluster_secret = *config.ClusterSecret
+	}
+	if config.AdminToken != nil {
+		next.admin_token = *config.AdminToken
+	}
+	if config.GeoMaxRate != nil {
+		next.geo_max_rate = *config.GeoMaxRate
+	}
+	if config.UploadPolicies != nil {
+		next.upload_policies = config.UploadPolicies
+	}
+	if config.Cors != nil {
+		next.cors = config.Cors
+	}
+	if config.WormNamespaces != nil {
+		next.worm_namespaces = config.WormNamespaces
+	}
+	if config.DiskClasses != nil {
+		next.disk_classes = config.DiskClasses
+	}
+	if config.NamespaceClasses != nil {
+		next.namespace_classes = config.NamespaceClasses
+	}
+	if config.SyncFilters != nil {
+		next.sync_filters = config.SyncFilters
+	}
+	if config.HashTools != nil {
+		algos := map[string]string{}
+		for algo, tool := range running.hash_algos {
+			algos[algo] = tool
+		}
+		for algo, tool := range config.HashTools {
+			algos[algo] = tool
+		}
+		next.hash_algos = algos
+	}
+	if config.StagingDir != nil {
+		next.staging_dir = *config.StagingDir
+	}
+	if config.DirectWrites != nil {
+		next.direct_writes = *config.DirectWrites
+	}
+	if config.RequireMount != nil {
+		next.require_mount_point = *config.RequireMount
+	}
+	if config.VerifyReplicas != nil {
+		next.verify_replicas = *config.VerifyReplicas
+	}
+	if config.ParallelHashMin != nil {
+		next.parallel_hash_min_size = *config.ParallelHashMin
+	}
+	if config.GC != nil {
+		next.gc_enabled = *config.GC
+	}
+	if config.GCGraceDays != nil {
+		next.gc_grace = time.Duration(*config.GCGraceDays) * 24 * time.Hour
+	}
+	if config.Retention != nil {
+		next.retention = config.Retention
+	}
+	if config.RetentionEnforce != nil {
+		next.retention_enforce = *config.RetentionEnforce
+	}
+	if config.TrustedProxies != nil {
+		next.trusted_proxies, _ = proxy_parse(config.TrustedProxies)
+	}
+	if config.DurableUploads != nil {
+		next.durable_uploads = *config.DurableUploads
+	}
+	if config.Fsync != nil {
+		next.fsync = *config.Fsync
+	}
+	if config.FSIntegration != nil {
+		next.fs_integration = *config.FSIntegration
+	}
+	if config.FSSnapshotsKeep != nil {
+		next.fs_snapshots_keep = *config.FSSnapshotsKeep
+	}
+	if config.Hooks != nil {
+		next.hooks, _ = hooks_from_specs(config.Hooks)
+	}
+	return &next
+}
+
+/**
+ * Apply the config file at startup, before anything reads the settings.
+ * The disks are checked later, by db_init.
+ */
+func config_load() {
+	config, err := config_read()
+	if err != nil {
+		panic(err)
+	}
+	next := settings_defaults()
+	if config == nil {
+		log.Printf("no config at '%s', using defaults", KFS_CONFIG_PATH)
+	} else {
+		config.apply_startup()
+		next = config.settings(next)
+	}
+	if next.staging_dir != "" {
+		next.staging_dir, err = staging_prepare(next.staging_dir)
+		if err != nil {
+			log.Printf("could not create staging directory, staging on the disks: %v", err)
+			next.staging_dir = ""
+		}
+	}
+	settings_value.Store(next)
+	if config != nil {
+		if config.Faults != nil {
+			faults_set(config.Faults)
+		}
+		log.Printf("loaded config from '%s'", KFS_CONFIG_PATH)
+	}
+}
+
+/**
+ * Apply the config file again. Everything the new settings need is checked
+ * and made ready first, the disks and the staging directory included, and
+ * only then are they published, all at once. A config that cannot be read
+ * or made ready is rejected whole, and the running settings are kept.
+ */
+func config_reload() error {
+	config_mutex.Lock()
+	defer config_mutex.Unlock()
+	config, err := config_read()
+	if err != nil {
+		return err
+	}
+	if config == nil {
+		return fmt.Errorf("no config at '%s'", KFS_CONFIG_PATH)
+	}
+	if !reflect.DeepEqual(config.startup_only(), config_startup) {
+		log.Printf(
+			"node_name, cluster_peers, geo_remote, mirror_of, event_sinks " +
+				"and cache_path changed, restart for them to take effect",
+		)
+	}
+	running := settings()
+	next := config.settings(running)
+
+	if next.staging_dir != "" && next.staging_dir != running.staging_dir {
+		next.staging_dir, err = staging_prepare(next.staging_dir)
+		if err != nil {
+			return fmt.Errorf("could not create staging directory: %v", err)
+		}
+	}
+	disks_changed := config.Disks != nil || config.DiskClasses != nil
+	if disks_changed {
+		if err := db_sync_disks(next, false); err != nil {
+			return fmt.Errorf("could not update disks: %v", err)
+		}
+	}
+
+	settings_value.Store(next)
+	if config.Faults != nil {
+		faults_set(config.Faults)
+	}
+	if disks_changed {
+		layout_migrate()
+	}
+	if next.fsync != running.fsync {
+		fsync_apply_db()
+	}
+	if next.fs_integration && !running.fs_integration {
+		go fs_check()
+	}
+	log.Printf("reloaded config from '%s'", KFS_CONFIG_PATH)
+	return nil
+}
+
+func config_signal_loop() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if err := config_reload(); err != nil {
+			log.Printf("could not reload config: %v", err)
+		}
+	}
+}
+
+/**
+ * Reload the config, e.g.
+ *     curl -X POST localhost:8080/admin/reload
+ */
+func handle_admin_reload(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	if err := config_reload(); err != nil {
+		log.Printf("could not reload config: %v", err)
+		write_error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	write_json(writer, http.StatusOK, map[string]bool{"reloaded": true})
+}
@@ -0,0 +1,85 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigReload(t *testing.T) {
+	disks := test_db(t, 2, 1000)
+	KFS_REDUNDANCY = 1
+	saved_path := KFS_CONFIG_PATH
+	KFS_CONFIG_PATH = filepath.Join(t.TempDir(), "kfs.json")
+	defer func() {
+		KFS_CONFIG_PATH = saved_path
+		settings_value.Store((*kfs_settings)(nil))
+	}()
+	settings_value.Store(settings_defaults())
+
+	tests := []struct {
+		name   string
+		config string
+		fails  bool
+		token  string
+	}{
+		{"applied", `{"admin_token": "one", "redundancy": 2}`, false, "one"},
+		{"invalid", `{"admin_token": "two", "redundancy": 0}`, true, "one"},
+		{
+			"disk cannot be used",
+			`{"admin_token": "three", "disks": ["` + disks[0] + `", "/no/such/disk"]}`,
+			true,
+			"one",
+		},
+		{
+			"staging cannot be made",
+			`{"admin_token": "four", "staging_dir": "` + disks[0] + `/file/staging"}`,
+			true,
+			"one",
+		},
+		{"retention keeps nothing", `{"admin_token": "five", "retention": {"laptop": {}}}`, true, "one"},
+		{"left out", `{"log_level": "info"}`, false, "one"},
+	}
+	if err := os.WriteFile(disks[0]+"/file", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		if err := os.WriteFile(KFS_CONFIG_PATH, []byte(test.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		before := settings()
+		err := config_reload()
+		if (err != nil) != test.fails {
+			t.Fatalf("%s: got %v", test.name, err)
+		}
+		if test.fails && settings() != before {
+			t.Errorf("%s: settings changed by a rejected config", test.name)
+		}
+		if got := settings().admin_token; got != test.token {
+			t.Errorf("%s: admin token %q, want %q", test.name, got, test.token)
+		}
+	}
+	if settings().redundancy != 2 || settings().log_level != "info" {
+		t.Errorf("redundancy %d, log level %q", settings().redundancy, settings().log_level)
+	}
+	if len(test_available(t)) != 2 {
+		t.Errorf("disks changed by a rejected config: %v", test_available(t))
+	}
+}
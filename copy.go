@@ -0,0 +1,143 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+/**
+ * Copy a file, or everything under a directory, to another namespace or
+ * directory without touching any blobs, e.g.
+ *     curl -X POST localhost:8080/copy \
+ *         -F namespace=inbox -F path=/scans/2023 -F to_namespace=archive
+ *     curl -X POST localhost:8080/copy \
+ *         -F namespace=inbox -F path=/scans -F filename=w2.pdf \
+ *         -F to_namespace=archive -F to_path=/taxes/2023
+ * The newest version of each file gets a new entry at the same place under
+ * to_path, which defaults to path. Files whose newest version at the
+ * destination already has the same blob are skipped. If any destination is
+ * held, nothing is copied.
+ */
+
+type copy_response struct {
+	Copied  []catalog_entry `json:"copied"`
+	Skipped int             `json:"skipped"`
+}
+
+/**
+ * Where dir, at or under from, ends up when from is copied to to.
+ */
+func copy_rebase(dir string, from string, to string) string {
+	rest := strings.TrimPrefix(dir, strings.TrimSuffix(from, "/"))
+	return path.Clean(to + "/" + rest)
+}
+
+func handle_copy(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	namespace := request.FormValue("namespace")
+	if namespace == "" {
+		namespace = KFS_DEFAULT_NAMESPACE
+	}
+	if request.FormValue("path") == "" {
+		write_error(writer, "path is required", http.StatusBadRequest)
+		return
+	}
+	from := path.Clean("/" + request.FormValue("path"))
+	filename := request.FormValue("filename")
+	to_namespace := request.FormValue("to_namespace")
+	if to_namespace == "" {
+		to_namespace = namespace
+	}
+	to := from
+	if to_path := request.FormValue("to_path"); to_path != "" {
+		to = path.Clean("/" + to_path)
+	}
+	if to_namespace == namespace && to == from {
+		write_error(writer, "the destination is the source", http.StatusBadRequest)
+		return
+	}
+
+	var sources []catalog_entry
+	if filename != "" {
+		entry, err := db_find_catalog_entry(namespace, from, filename, 0)
+		if err != nil {
+			write_error(writer, "no such file", http.StatusNotFound)
+			return
+		}
+		sources = append(sources, entry)
+	} else {
+		var err error
+		sources, err = archive_entries_under(namespace, from, 0)
+		if err != nil {
+			log.Println(err)
+			write_error(writer, "could not list directory", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	response := copy_response{Copied: []catalog_entry{}}
+	var copies []catalog_entry
+	for _, source := range sources {
+		entry := source
+		entry.Namespace = to_namespace
+		entry.Path = copy_rebase(source.Path, from, to)
+		existing, err := db_find_catalog_entry(entry.Namespace, entry.Path, entry.Filename, 0)
+		if err == nil && existing.Hash == entry.Hash && existing.HashAlgo == entry.HashAlgo {
+			response.Skipped++
+			continue
+		}
+		if err == nil && existing.immutable() {
+			msg := fmt.Sprintf(
+				"'%s/%s' is %s",
+				entry.Path,
+				entry.Filename,
+				existing.hold_description(),
+			)
+			write_error(writer, msg, http.StatusConflict)
+			return
+		}
+		entry.CreatedAt = 0
+		entry.Pinned = false
+		entry.Held = false
+		entry.RetainUntil = 0
+		copies = append(copies, entry)
+	}
+
+	for _, entry := range copies {
+		id, err := catalog_add(entry)
+		if err != nil {
+			log.Println(err)
+			write_error(writer, "could not copy", http.StatusInternalServerError)
+			return
+		}
+		copied, err := db_get_catalog_entry(id)
+		if err != nil {
+			log.Println(err)
+			write_error(writer, "could not copy", http.StatusInternalServerError)
+			return
+		}
+		response.Copied = append(response.Copied, copied)
+	}
+	write_json(writer, http.StatusOK, response)
+}
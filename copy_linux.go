@@ -0,0 +1,75 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+/**
+ * The errors that mean the filesystem cannot do a kind of copy, rather than
+ * that the copy went wrong.
+ */
+func copy_unsupported(err error) bool {
+	return errors.Is(err, unix.EXDEV) ||
+		errors.Is(err, unix.EOPNOTSUPP) ||
+		errors.Is(err, unix.ENOTTY) ||
+		errors.Is(err, unix.EINVAL) ||
+		errors.Is(err, unix.ENOSYS)
+}
+
+/**
+ * Copy the file without reading it into kfs, which is only possible within
+ * a filesystem. A reflink, on btrfs, XFS and the like, shares the blocks of
+ * the source until either copy is changed, so it takes neither time nor
+ * space. Otherwise, copy_file_range lets the kernel copy the data, or the
+ * filesystem copy it on the server side, in the case of NFS. Returns how
+ * it copied the file, or COPY_STREAM if neither can be used, and the
+ * caller must copy it.
+ */
+func copy_fast(out *os.File, in *os.File, size int64) (string, error) {
+	err := unix.IoctlFileClone(int(out.Fd()), int(in.Fd()))
+	if err == nil {
+		return COPY_REFLINK, nil
+	}
+	if !copy_unsupported(err) {
+		return "", err
+	}
+
+	var copied int64
+	for copied < size {
+		n, err := unix.CopyFileRange(int(in.Fd()), nil, int(out.Fd()), nil, int(size-copied), 0)
+		if err != nil {
+			if copied == 0 && copy_unsupported(err) {
+				return COPY_STREAM, nil
+			}
+			return "", err
+		}
+		if n == 0 {
+			break
+		}
+		copied += int64(n)
+	}
+	if copied == 0 && size > 0 {
+		return COPY_STREAM, nil
+	}
+	return COPY_FILE_RANGE, nil
+}
@@ -0,0 +1,177 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+/**
+ * Cross-origin access, so that a web frontend served from another origin
+ * can call kfs directly from the browser.
+ */
+
+type cors_policy struct {
+	// e.g. "https://photos.example.com", or "*" for any origin
+	Origins []string `json:"origins"`
+
+	Methods []string `json:"methods"`
+
+	// request headers the browser may send, e.g. "Content-Type"
+	Headers []string `json:"headers"`
+
+	// response headers the browser may read, e.g. "X-Kfs-Hash"
+	Expose []string `json:"expose"`
+
+	// send cookies and HTTP auth, which needs Origins to be listed, not "*"
+	Credentials bool `json:"credentials"`
+
+	// how long, in seconds, the browser may cache a preflight
+	MaxAge int `json:"max_age"`
+}
+
+/**
+ * The CORS policy for each route, keyed by the route as it is given to the
+ * router, with "*" for every route without its own policy, e.g.
+ *     "/upload": {
+ *         Origins: []string{"https://photos.example.com"},
+ *         Methods: []string{"POST"},
+ *         Headers: []string{"Content-Type"},
+ *     },
+ * Routes without a policy send no CORS headers, so browsers keep other
+ * origins out.
+ */
+var KFS_CORS = map[string]cors_policy{}
+
+/**
+ * Whether the request path matches the route, e.g. /download/abc matches
+ * /download/:hash, and /path/default/a/b matches /path/:namespace/*filepath.
+ */
+func route_matches(route string, path string) bool {
+	route_parts := strings.Split(route, "/")
+	path_parts := strings.Split(path, "/")
+	for i, part := range route_parts {
+		if strings.HasPrefix(part, "*") {
+			return true
+		}
+		if i >= len(path_parts) {
+			return false
+		}
+		if strings.HasPrefix(part, ":") {
+			if path_parts[i] == "" {
+				return false
+			}
+			continue
+		}
+		if part != path_parts[i] {
+			return false
+		}
+	}
+	return len(route_parts) == len(path_parts)
+}
+
+func cors_lookup(path string) (cors_policy, bool) {
+	// a route's policy covers it under API_VERSION too
+	if strings.HasPrefix(path, API_VERSION+"/") {
+		path = strings.TrimPrefix(path, API_VERSION)
+	}
+	policies := settings().cors
+	for route, policy := range policies {
+		if route != "*" && route_matches(route, path) {
+			return policy, true
+		}
+	}
+	policy, ok := policies["*"]
+	return policy, ok
+}
+
+func (policy cors_policy) allows(origin string) bool {
+	for _, allowed := range policy.Origins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+func (policy cors_policy) allows_method(method string) bool {
+	for _, allowed := range policy.Methods {
+		if strings.EqualFold(allowed, method) {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * Add the CORS headers to the responses of routes with a policy, and
+ * answer their preflight requests.
+ */
+func cors_handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		origin := request.Header.Get("Origin")
+		if origin == "" || len(settings().cors) == 0 {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		policy, ok := cors_lookup(request.URL.Path)
+		if !ok || !policy.allows(origin) {
+			next.ServeHTTP(writer, request)
+			return
+		}
+
+		header := writer.Header()
+		header.Add("Vary", "Origin")
+		if policy.Credentials {
+			header.Set("Access-Control-Allow-Origin", origin)
+			header.Set("Access-Control-Allow-Credentials", "true")
+		} else if policy.allows("*") {
+			header.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			header.Set("Access-Control-Allow-Origin", origin)
+		}
+
+		method := request.Header.Get("Access-Control-Request-Method")
+		if request.Method != http.MethodOptions || method == "" {
+			if len(policy.Expose) > 0 {
+				header.Set("Access-Control-Expose-Headers", strings.Join(policy.Expose, ", "))
+			}
+			next.ServeHTTP(writer, request)
+			return
+		}
+
+		if !policy.allows_method(method) {
+			write_error(
+				writer,
+				fmt.Sprintf("%s is not allowed from %s", method, origin),
+				http.StatusForbidden,
+			)
+			return
+		}
+		header.Set("Access-Control-Allow-Methods", strings.Join(policy.Methods, ", "))
+		if len(policy.Headers) > 0 {
+			header.Set("Access-Control-Allow-Headers", strings.Join(policy.Headers, ", "))
+		}
+		if policy.MaxAge > 0 {
+			header.Set("Access-Control-Max-Age", fmt.Sprintf("%d", policy.MaxAge))
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -18,57 +18,422 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
-	"sync"
+	"path/filepath"
+	"strings"
+	"time"
 
-	_ "github.com/mattn/go-sqlite3"
-	"golang.org/x/sys/unix"
+	sqlite3 "github.com/mattn/go-sqlite3"
 )
 
 var (
-	mutex          = &sync.Mutex{}
 	db             *sql.DB
+	db_writer      *sql.DB
 	KFS_DB_PATH    = "/home/kyle/.kfs/db/db.sqlite3"
 	KFS_REDUNDANCY = 2
+
+	// the storage roots of this node, which can be changed in the config
+	KFS_DISKS = []string{
+		"/mnt/disk1",
+		"/mnt/disk2",
+		"/mnt/disk3",
+		"/mnt/disk4",
+	}
+)
+
+const (
+	KFS_DB_BUSY_RETRIES = 10
+	KFS_DB_BUSY_BACKOFF = 50 * time.Millisecond
 )
 
-func db_reduce_space(root string, size int64) {
-	stmt := `update disks set available = available - ? where root = ?`
-	_, err := db.Exec(stmt, size, root)
+func is_busy(err error) bool {
+	var sqlite_err sqlite3.Error
+	if errors.As(err, &sqlite_err) {
+		return sqlite_err.Code == sqlite3.ErrBusy ||
+			sqlite_err.Code == sqlite3.ErrLocked
+	}
+	return false
+}
+
+/**
+ * Run a write against the database, retrying while sqlite reports that it
+ * is busy. All writes go through db_writer, which has a single connection,
+ * so they queue up in database/sql instead of fighting over the lock, and
+ * the time spent waiting for that connection is exported as a metric.
+ */
+func db_retry(fn func() error) error {
+	var err error
+	for attempt := 0; attempt <= KFS_DB_BUSY_RETRIES; attempt++ {
+		if attempt > 0 {
+			metric_add(
+				"kfs_db_busy_retries_total",
+				"Writes retried because sqlite was busy",
+				"",
+				1,
+			)
+			time.Sleep(time.Duration(attempt) * KFS_DB_BUSY_BACKOFF)
+		}
+		err = fault_error(FAULT_DB_BUSY, "")
+		if err == nil {
+			err = fn()
+		}
+		if !is_busy(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func db_observe_wait(start time.Time) {
+	wait := time.Since(start).Seconds()
+	metric_add(
+		"kfs_db_write_wait_seconds_sum",
+		"Time spent waiting for the database writer",
+		"",
+		wait,
+	)
+	metric_add(
+		"kfs_db_write_wait_seconds_count",
+		"Number of writes that waited for the database writer",
+		"",
+		1,
+	)
+}
+
+func db_exec(query string, args ...interface{}) (sql.Result, error) {
+	var result sql.Result
+	err := db_retry(func() error {
+		start := time.Now()
+		conn, err := db_writer.Conn(context.Background())
+		db_observe_wait(start)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		result, err = conn.ExecContext(context.Background(), query, args...)
+		return err
+	})
+	return result, err
+}
+
+/**
+ * Run fn inside a write transaction, committing if it returns nil. The
+ * transaction takes the write lock up front (BEGIN IMMEDIATE), so it fails
+ * fast with SQLITE_BUSY, and is retried, rather than deadlocking with another
+ * writer halfway through. fn may run more than once.
+ */
+func db_transaction(fn func(tx *sql.Tx) error) error {
+	return db_retry(func() error {
+		start := time.Now()
+		tx, err := db_writer.Begin()
+		db_observe_wait(start)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if err := fn(tx); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+/**
+ * Anything statements can be run on: the database itself, or a transaction.
+ */
+type db_execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+type db_querier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+/**
+ * Take size bytes from the disk's available space, but only if it has that
+ * much left. The check and the update are a single statement, so concurrent
+ * uploads can never reserve more than a disk holds, without having to hold
+ * a lock while picking disks.
+ */
+func db_reserve_space(tx db_execer, disk placement, size int64) (bool, error) {
+	stmt := `
+		update disks
+		set available = available - ?
+		where node = ? and root = ? and available >= ?
+	`
+	result, err := tx.Exec(stmt, size, disk.node, disk.root, size)
 	if err != nil {
-		panic(fmt.Errorf("could not update available storage record: %v", err))
+		return false, fmt.Errorf("could not update available storage record: %v", err)
 	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
 }
 
-func db_add_file_records(hash string, storage_dirs []string, path string) {
+/**
+ * Add a record for each disk, all in a single multi-row insert. A pending
+ * record is for a replica that has not been written yet, and is not read
+ * from until db_replica_stored says it has.
+ */
+func db_add_file_records(tx db_execer, hash string, algo string, disks []placement, path string, filename string, size int64, pending bool) error {
+	if len(disks) == 0 {
+		return nil
+	}
+	extension := filepath.Ext(filename)
+	now := time.Now().Unix()
+	var placeholders []string
+	var args []interface{}
+	for _, disk := range disks {
+		placeholders = append(placeholders, "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+		args = append(
+			args,
+			hash,
+			algo,
+			disk.node,
+			disk.root,
+			path,
+			filename,
+			extension,
+			size,
+			now,
+			pending,
+		)
+	}
 	stmt := `
-		insert into files(hash, hash_algo, storage_root, path)
-		values(?, 'blake2b', ?, ?)
+		insert into files(
+			hash,
+			hash_algo,
+			node,
+			storage_root,
+			path,
+			filename,
+			extension,
+			size,
+			created_at,
+			pending
+		)
+		values ` + strings.Join(placeholders, ", ")
+	if _, err := tx.Exec(stmt, args...); err != nil {
+		return fmt.Errorf("could not add new file records: %v", err)
+	}
+	return nil
+}
+
+func db_add_digest(hash string, algo string, digest string) {
+	stmt := `
+		insert or replace into digests(hash, algo, digest)
+		values(?, ?, ?)
 	`
-	for _, storage_dir := range storage_dirs {
-		_, err := db.Exec(stmt, hash, storage_dir, path)
-		if err != nil {
-			panic(fmt.Errorf("could not add new file record: %v", err))
+	_, err := db_exec(stmt, hash, algo, digest)
+	if err != nil {
+		log.Printf("could not add %s digest for %s: %v", algo, hash, err)
+		return
+	}
+	known_hash_add(digest, algo)
+}
+
+/**
+ * All known digests of the stored file, keyed by algorithm, including the
+ * primary hash it is stored under.
+ */
+func db_get_digests(hash string, algo string) (map[string]string, error) {
+	digests := map[string]string{algo: hash}
+	query := `select algo, digest from digests where hash = ?`
+	rows, err := db.Query(query, hash)
+	if err != nil {
+		return nil, fmt.Errorf("could not query for digests: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var other, digest string
+		if err := rows.Scan(&other, &digest); err != nil {
+			return nil, err
 		}
+		digests[other] = digest
 	}
+	return digests, rows.Err()
 }
 
-func db_has_hash(hash string) bool {
-	var n_records int64
-	query := `select count(*) from files where hash = ?`
-	err := db.QueryRow(query, hash).Scan(&n_records)
+/**
+ * Check for the hash either as the primary hash of a stored file, or as a
+ * secondary digest computed after the file was archived.
+ */
+func db_has_hash(hash string, algo string) bool {
+	return known_hash_has(hash, algo)
+}
+
+/**
+ * Whether a replica of the blob has been written, or the blob was claimed
+ * for content stored on another node, which has no replica records here.
+ * A blob whose every record is still pending is being written.
+ */
+func db_blob_stored(hash string, algo string) (bool, error) {
+	var total, stored int
+	err := db.QueryRow(
+		`
+		select count(*), coalesce(sum(not pending), 0)
+		from files where hash = ? and hash_algo = ?
+		`,
+		hash,
+		algo,
+	).Scan(&total, &stored)
 	if err != nil {
-		new_err := fmt.Errorf("could not select from 'files' table: %v", err)
-		log.Println(new_err)
-		return false
+		return false, fmt.Errorf("could not count replicas of %s: %v", hash, err)
 	}
-	return n_records > 0
+	return total == 0 || stored > 0, nil
 }
 
-func db_alloc_storage(hash string, size int64, path string) (bool, string, []string, error) {
+/**
+ * Translate a hash, which may be a secondary digest, into the primary hash
+ * and algorithm the blob is stored under.
+ */
+func db_resolve_hash(hash string, algo string) (string, string, error) {
+	query := `
+		select hash, hash_algo from files where hash = ? and hash_algo = ?
+		union all
+		select digests.hash, files.hash_algo
+		from digests join files on files.hash = digests.hash
+		where digests.digest = ? and digests.algo = ?
+		limit 1
+	`
+	var primary, primary_algo string
+	err := db.QueryRow(query, hash, algo, hash, algo).Scan(&primary, &primary_algo)
+	return primary, primary_algo, err
+}
+
+/**
+ * Find every storage root on this node holding a replica of the hash, along
+ * with the hash algorithm the blob is stored under.
+ */
+func db_get_replicas(hash string) (string, []string, error) {
+	query := `
+		select hash_algo, storage_root from files
+		where hash = ? and node = '' and not pending
+	`
+	rows, err := db.Query(query, hash)
+	if err != nil {
+		return "", nil, fmt.Errorf("could not query for replicas: %v", err)
+	}
+	defer rows.Close()
+
+	var algo string
+	var roots []string
+	for rows.Next() {
+		var root string
+		if err := rows.Scan(&algo, &root); err != nil {
+			return "", nil, err
+		}
+		roots = append(roots, root)
+	}
+	return algo, roots, rows.Err()
+}
+
+/**
+ * Claim the hash for the upload that is about to store it. The primary key
+ * on blobs makes this atomic, so of several uploads of the same hash
+ * exactly one gets true.
+ */
+func db_claim_hash(tx *sql.Tx, hash string, algo string) (bool, error) {
+	result, err := tx.Exec(
+		`
+		insert into blobs(hash, hash_algo, created_at)
+		values(?, ?, ?)
+		on conflict(hash, hash_algo) do nothing
+		`,
+		hash,
+		algo,
+		time.Now().Unix(),
+	)
+	if err != nil {
+		return false, fmt.Errorf("could not claim %s: %v", hash, err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+/**
+ * The disks with more than min_available bytes free that have not failed,
+ * and are in the class, unless it is empty. Disks on other nodes of the
+ * cluster are included, as long as the node has been heard from recently.
+ */
+func db_get_live_disks(ctx context.Context, min_available int64, class string) ([]placement, error) {
+	query := `
+		select node, root
+		from disks
+		where available > ?
+			and not failed
+			and (? = '' or class = ?)
+			and (
+				node = ''
+				or node in (select name from nodes where last_seen >= ?)
+			)
+		order by node, root
+	`
+	live := time.Now().Add(-KFS_CLUSTER_NODE_TIMEOUT).Unix()
+	rows, err := db.QueryContext(ctx, query, min_available, class, class, live)
+	if err != nil {
+		return nil, fmt.Errorf("could not query for available disk: %v", err)
+	}
+	defer rows.Close()
+
+	var disks []placement
+	for rows.Next() {
+		var disk placement
+		if err := rows.Scan(&disk.node, &disk.root); err != nil {
+			return nil, err
+		}
+		disks = append(disks, disk)
+	}
+	return disks, rows.Err()
+}
+
+var errHashInFlight = errors.New("the same content is being uploaded by another request")
+
+var (
+	// how long an upload waits for another upload of the same content to
+	// be stored, or to fail, before it is turned away with errHashInFlight
+	KFS_IN_FLIGHT_WAIT = 30 * time.Second
+
+	KFS_IN_FLIGHT_POLL = 250 * time.Millisecond
+)
+
+func db_alloc_storage(ctx context.Context, hash string, algo string, size int64, path string, filename string, class string) (bool, string, []placement, error) {
+	return db_alloc_storage_mode(ctx, hash, algo, size, path, filename, class, default_staging_mode())
+}
+
+/**
+ * Claim the hash and reserve space for it, staged as the mode says. The
+ * staging path returned is empty when the upload is not staged at all.
+ * While another upload holds the claim, this waits for it: once that one
+ * is stored this is skipped as a duplicate, and if it fails this one
+ * claims the hash in its place.
+ */
+func db_alloc_storage_mode(ctx context.Context, hash string, algo string, size int64, path string, filename string, class string, mode staging_mode) (bool, string, []placement, error) {
+	deadline := time.Now().Add(KFS_IN_FLIGHT_WAIT)
+	for {
+		skip, staging, disks, err := db_alloc_storage_once(ctx, hash, algo, size, path, filename, class, mode)
+		if !errors.Is(err, errHashInFlight) || !time.Now().Before(deadline) {
+			return skip, staging, disks, err
+		}
+		select {
+		case <-ctx.Done():
+			return false, "", nil, ctx.Err()
+		case <-time.After(KFS_IN_FLIGHT_POLL):
+		}
+	}
+}
+
+func db_alloc_storage_once(ctx context.Context, hash string, algo string, size int64, path string, filename string, class string, mode staging_mode) (bool, string, []placement, error) {
 	// TODO: store file metadata in table
 
 	/*
@@ -76,82 +441,676 @@ func db_alloc_storage(hash string, size int64, path string) (bool, string, []str
 	 * |storage root|uuid|path|filename|hash|hash algo (blake2b)|extension
 	 * |file type|permissions|access time|modify time|change time|creation time
 	 */
-	mutex.Lock()
-	defer mutex.Unlock()
-
 	skip := false
 
-	// if hash already exists, then don't do anything
-	if db_has_hash(hash) {
+	// if hash already exists, then don't do anything, as long as it is
+	// not still being written
+	if db_has_hash(hash, algo) {
+		stored, err := db_blob_stored(hash, algo)
+		if err != nil {
+			return skip, "", nil, err
+		}
+		if !stored {
+			return skip, "", nil, errHashInFlight
+		}
 		skip = true
-		return skip, "", []string{""}, nil
+		return skip, "", nil, nil
 	}
 
-	query := `
-		select root
+	staged_on_disk := mode == STAGING_ON_DISK
+	min_free := size
+	if staged_on_disk {
+		min_free = 2 * size
+	}
+	disks, err := db_get_live_disks(ctx, min_free, class)
+	if err != nil {
+		return skip, "", nil, err
+	}
+	redundancy := settings().redundancy
+	if len(disks) < redundancy {
+		new_err := fmt.Errorf(
+			"not enough disks to meet redundancy requirements",
+		)
+		return skip, "", nil, new_err
+	}
+	if cluster_enabled() {
+		disks = ring_order(ring_build(disks), hash)
+	} else {
+		rand.Shuffle(len(disks), func(i, j int) {
+			disks[i], disks[j] = disks[j], disks[i]
+		})
+	}
+
+	// without a staging directory, the upload is staged on the first disk,
+	// so it has to be a local one
+	for i, disk := range disks {
+		if staged_on_disk && disk.node == "" {
+			copy(disks[1:i+1], disks[:i])
+			disks[0] = disk
+			break
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return skip, "", nil, err
+	}
+
+	var storage_dirs []placement
+	staging := ""
+	space_reconcile_lock.RLock()
+	defer space_reconcile_lock.RUnlock()
+	err = db_transaction(func(tx *sql.Tx) error {
+		/*
+		 * Two uploads of the same new hash can both get past the check
+		 * above, so only the one that claims the hash stores it. The
+		 * other cannot count on data that has not arrived yet, so it is
+		 * turned away, to try again once the first one is done.
+		 */
+		claimed, err := db_claim_hash(tx, hash, algo)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			return errHashInFlight
+		}
+		if class != "" {
+			_, err := tx.Exec(
+				`update blobs set class = ? where hash = ? and hash_algo = ?`,
+				class,
+				hash,
+				algo,
+			)
+			if err != nil {
+				return err
+			}
+		}
+
+		if mode == STAGING_IN_DIR && staging == "" {
+			staging, err = staging_reserve(hash, algo, size)
+			if err != nil {
+				return err
+			}
+		}
+
+		/*
+		 * Another upload may have taken the space since the query above,
+		 * so reserve it disk by disk, moving on to the next disk when one
+		 * has filled up. The first disk also holds the staging copy, if
+		 * the upload is staged on it.
+		 */
+		storage_dirs = nil
+		for _, disk := range disks {
+			need := size
+			if len(storage_dirs) == 0 && staged_on_disk {
+				if disk.node != "" {
+					continue
+				}
+				need = 2 * size
+			}
+			ok, err := db_reserve_space(tx, disk, need)
+			if err != nil {
+				return err
+			}
+			if ok {
+				storage_dirs = append(storage_dirs, disk)
+			}
+			if len(storage_dirs) == redundancy {
+				break
+			}
+		}
+		if len(storage_dirs) < redundancy {
+			return fmt.Errorf(
+				"not enough disks to meet redundancy requirements",
+			)
+		}
+
+		// add file to 'files' table
+		return db_add_file_records(
+			tx,
+			hash,
+			algo,
+			storage_dirs,
+			path,
+			filename,
+			size,
+			true,
+		)
+	})
+	if err != nil {
+		if staging != "" {
+			space_release(hash, algo)
+		}
+		return false, "", nil, err
+	}
+	space_reserve(hash, algo, size, storage_dirs, mode)
+
+	switch mode {
+	case STAGING_IN_DIR:
+		return skip, staging + "/", storage_dirs, nil
+	case STAGING_NONE:
+		return skip, "", storage_dirs, nil
+	}
+	staging_path := fmt.Sprintf("%s/.kfs/staging/", storage_dirs[0].root)
+	return skip, staging_path, storage_dirs, nil
+}
+
+/**
+ * Undo db_alloc_storage for an upload that did not make it to archiving:
+ * give the reserved space back to each disk and remove the file records.
+ */
+func db_release_storage(hash string, algo string, size int64, disks []placement) {
+	space_mutex.Lock()
+	staged_on_disk := space_reservations[hash+"."+algo].mode == STAGING_ON_DISK
+	space_mutex.Unlock()
+	space_release(hash, algo)
+	err := db_transaction(func(tx *sql.Tx) error {
+		for i, disk := range disks {
+			reserved := size
+			if i == 0 && staged_on_disk {
+				reserved = 2 * size
+			}
+			_, err := tx.Exec(
+				`
+				update disks set available = available + ?
+				where node = ? and root = ?
+				`,
+				reserved,
+				disk.node,
+				disk.root,
+			)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(
+				`
+				delete from files
+				where hash = ?
+					and hash_algo = ?
+					and node = ?
+					and storage_root = ?
+				`,
+				hash,
+				algo,
+				disk.node,
+				disk.root,
+			)
+			if err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(
+			`delete from blobs where hash = ? and hash_algo = ?`,
+			hash,
+			algo,
+		)
+		return err
+	})
+	if err != nil {
+		log.Printf("could not release storage for %s: %v", hash, err)
+		return
+	}
+	known_hash_remove(hash, algo)
+	log.Printf("released storage reserved for %s", hash)
+}
+
+type disk_usage struct {
+	Root      string       `json:"root"`
+	Available int64        `json:"available"`
+	Total     int64        `json:"total"`
+	Failed    bool         `json:"failed"`
+	Class     string       `json:"class,omitempty"`
+	Health    *disk_health `json:"health,omitempty"`
+}
+
+func db_list_disks() ([]disk_usage, error) {
+	rows, err := db.Query(`
+		select
+			disks.root,
+			disks.available,
+			disks.failed,
+			disks.class,
+			disk_health.device,
+			coalesce(disk_health.passed, 0),
+			coalesce(disk_health.reallocated, 0),
+			coalesce(disk_health.pending, 0),
+			coalesce(disk_health.temperature, 0),
+			coalesce(disk_health.checked_at, 0)
 		from disks
-		where available > ?
-	`
-	rows, err := db.Query(query, 2*size)
+		left join disk_health on disk_health.root = disks.root
+		where disks.node = ''
+		order by disks.root
+	`)
 	if err != nil {
-		new_err := fmt.Errorf("could not query for available disk: %v", err)
-		return skip, "", []string{""}, new_err
+		return nil, fmt.Errorf("could not query disks: %v", err)
 	}
 	defer rows.Close()
 
-	var disks []string
-
+	var disks []disk_usage
 	for rows.Next() {
-		var root string
-		if err := rows.Scan(&root); err != nil {
-			log.Fatal(err)
+		var disk disk_usage
+		var device sql.NullString
+		var health disk_health
+		var checked_at int64
+		err := rows.Scan(
+			&disk.Root,
+			&disk.Available,
+			&disk.Failed,
+			&disk.Class,
+			&device,
+			&health.Passed,
+			&health.Reallocated,
+			&health.Pending,
+			&health.Temperature,
+			&checked_at,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if device.Valid {
+			health.Device = device.String
+			health.CheckedAt = time.Unix(checked_at, 0)
+			disk.Health = &health
 		}
-		disks = append(disks, root)
+		disk.Total = int64(get_disk_size(disk.Root))
+		disks = append(disks, disk)
 	}
-	if len(disks) < KFS_REDUNDANCY {
-		new_err := fmt.Errorf(
-			"not enough disks to meet redundancy requirements",
+	return disks, rows.Err()
+}
+
+/**
+ * The healthy local disk with the most space, to keep a file on until it
+ * can be stored, or "" if there is none.
+ */
+func db_roomiest_disk() (string, error) {
+	disks, err := db_list_disks()
+	if err != nil {
+		return "", err
+	}
+	root := ""
+	best := int64(-1)
+	for _, disk := range disks {
+		if !disk.Failed && disk.Available > best {
+			root = disk.Root
+			best = disk.Available
+		}
+	}
+	return root, nil
+}
+
+type file_entry struct {
+	ID        int64
+	Namespace string
+	Hash      string
+	HashAlgo  string
+	Path      string
+	Filename  string
+	Size      int64
+	Replicas  int
+	CreatedAt time.Time
+}
+
+/**
+ * List catalog entries, newest first. When search is not empty, only entries
+ * whose path, filename or hash contain it are returned.
+ */
+func db_list_files(search string, limit int) ([]file_entry, error) {
+	query := `
+		select
+			id,
+			namespace,
+			hash,
+			hash_algo,
+			path,
+			filename,
+			size,
+			(select count(*) from files where files.hash = catalog.hash),
+			created_at
+		from catalog
+		where ? = ''
+			or path like ?
+			or filename like ?
+			or hash like ?
+		order by created_at desc, id desc
+		limit ?
+	`
+	pattern := "%" + search + "%"
+	rows, err := db.Query(query, search, pattern, pattern, pattern, limit)
+	if err != nil {
+		return nil, fmt.Errorf("could not query files: %v", err)
+	}
+	defer rows.Close()
+
+	var files []file_entry
+	for rows.Next() {
+		var file file_entry
+		var created_at int64
+		err := rows.Scan(
+			&file.ID,
+			&file.Namespace,
+			&file.Hash,
+			&file.HashAlgo,
+			&file.Path,
+			&file.Filename,
+			&file.Size,
+			&file.Replicas,
+			&created_at,
 		)
-		return skip, "", []string{""}, new_err
+		if err != nil {
+			return nil, err
+		}
+		file.CreatedAt = time.Unix(created_at, 0)
+		files = append(files, file)
 	}
-	rand.Shuffle(len(disks), func(i, j int) {
-		disks[i], disks[j] = disks[j], disks[i]
+	return files, rows.Err()
+}
+
+func db_add_archive_failure(hash string, storage_root string, failure error) {
+	stmt := `
+		insert into archive_failures(hash, storage_root, error, created_at)
+		values(?, ?, ?, ?)
+	`
+	_, err := db_exec(stmt, hash, storage_root, failure.Error(), time.Now().Unix())
+	if err != nil {
+		log.Printf("could not record archive failure: %v", err)
+	}
+	emit_event(event{
+		Type:  EVENT_ARCHIVE_FAILED,
+		Hash:  hash,
+		Root:  storage_root,
+		Error: failure.Error(),
 	})
+}
+
+type archive_failure struct {
+	Hash        string
+	StorageRoot string
+	Error       string
+	CreatedAt   time.Time
+}
 
-	staging_dir := disks[0]
-	var storage_dirs []string
-	for i := 0; i < KFS_REDUNDANCY; i++ {
-		storage_dirs = append(storage_dirs, disks[i])
+func db_list_archive_failures(limit int) ([]archive_failure, error) {
+	query := `
+		select hash, storage_root, error, created_at
+		from archive_failures
+		order by created_at desc
+		limit ?
+	`
+	rows, err := db.Query(query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("could not query archive failures: %v", err)
 	}
+	defer rows.Close()
 
-	// reduce disk space
-	db_reduce_space(staging_dir, size)
-	for _, storage := range storage_dirs {
-		db_reduce_space(storage, size)
+	var failures []archive_failure
+	for rows.Next() {
+		var failure archive_failure
+		var created_at int64
+		err := rows.Scan(
+			&failure.Hash,
+			&failure.StorageRoot,
+			&failure.Error,
+			&created_at,
+		)
+		if err != nil {
+			return nil, err
+		}
+		failure.CreatedAt = time.Unix(created_at, 0)
+		failures = append(failures, failure)
 	}
+	return failures, rows.Err()
+}
+
+/**
+ * Schema changes to tables that already exist in deployed databases. They
+ * are applied in order, each in a transaction along with the count applied
+ * so far, which is kept in sqlite's user_version, so only append to this
+ * list.
+ */
+var migrations = []string{
+	`ALTER TABLE files ADD COLUMN size INTEGER`,
+	`ALTER TABLE files ADD COLUMN created_at INTEGER`,
+	`
+	INSERT INTO catalog(
+		namespace,
+		path,
+		filename,
+		hash,
+		hash_algo,
+		size,
+		created_at
+	)
+	SELECT
+		'default',
+		coalesce(path, ''),
+		coalesce(filename, ''),
+		hash,
+		hash_algo,
+		coalesce(size, 0),
+		coalesce(min(created_at), 0)
+	FROM files
+	GROUP BY hash, path, filename
+	`,
+	`CREATE INDEX IF NOT EXISTS files_hash ON files(hash, hash_algo)`,
+	`CREATE INDEX IF NOT EXISTS files_path ON files(path, filename)`,
+	`CREATE INDEX IF NOT EXISTS files_root ON files(storage_root)`,
+	`CREATE INDEX IF NOT EXISTS digests_digest ON digests(digest, algo)`,
+	`CREATE INDEX IF NOT EXISTS catalog_hash ON catalog(hash)`,
+	`
+	CREATE INDEX IF NOT EXISTS catalog_path
+	ON catalog(namespace, path, filename, created_at)
+	`,
+	`CREATE INDEX IF NOT EXISTS catalog_created ON catalog(created_at)`,
+	`ANALYZE`,
+
+	// auto_vacuum only takes effect on an existing database after a VACUUM
+	`PRAGMA auto_vacuum = INCREMENTAL`,
+	`VACUUM`,
+	`
+	INSERT OR IGNORE INTO blobs(hash, hash_algo, created_at)
+	SELECT hash, hash_algo, coalesce(min(created_at), 0)
+	FROM files
+	GROUP BY hash, hash_algo
+	`,
+
+	// disks on other nodes of a cluster can share a root with local ones
+	`
+	CREATE TABLE disks_by_node(
+		node TEXT NOT NULL DEFAULT '',
+		root TEXT NOT NULL,
+		available INTEGER,
+		PRIMARY KEY (node, root)
+	);
+	INSERT INTO disks_by_node(root, available) SELECT root, available FROM disks;
+	DROP TABLE disks;
+	ALTER TABLE disks_by_node RENAME TO disks;
+	`,
+	`ALTER TABLE files ADD COLUMN node TEXT NOT NULL DEFAULT ''`,
+	`INSERT INTO catalog_log(catalog_id) SELECT id FROM catalog ORDER BY id`,
+	`
+	CREATE INDEX IF NOT EXISTS thumbnails_thumb
+	ON thumbnails(thumb_hash, thumb_algo)
+	`,
+	`CREATE INDEX IF NOT EXISTS media_taken ON media(taken_at)`,
+	`ALTER TABLE catalog ADD COLUMN pinned INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE catalog ADD COLUMN held INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE catalog ADD COLUMN retain_until INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE blobs ADD COLUMN replicas INTEGER`,
+	`ALTER TABLE disks ADD COLUMN failed INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE files ADD COLUMN verified_at INTEGER`,
+	`ALTER TABLE files ADD COLUMN verify_ok INTEGER`,
+	`ALTER TABLE disks ADD COLUMN class TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE blobs ADD COLUMN class TEXT NOT NULL DEFAULT ''`,
+	`
+	CREATE INDEX IF NOT EXISTS backup_reports_source
+	ON backup_reports(machine, source, finished_at)
+	`,
+	`ALTER TABLE disks ADD COLUMN uuid TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE files ADD COLUMN pending INTEGER NOT NULL DEFAULT 0`,
+
+	// catalog paths are kept in the form catalog_clean_path gives them
+	"go:catalog_clean_paths",
+	`ALTER TABLE catalog_log ADD COLUMN replicated INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE geo_queue ADD COLUMN retry_at INTEGER NOT NULL DEFAULT 0`,
+	`CREATE INDEX IF NOT EXISTS geo_queue_hash ON geo_queue(hash, hash_algo)`,
+	`ALTER TABLE sync_entries ADD COLUMN mode INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE sync_entries ADD COLUMN mtime INTEGER NOT NULL DEFAULT 0`,
+
+	// again, for databases that ran it when it was still done in SQL
+	"go:catalog_clean_paths",
+
+	// each change to files, for standby_stream to send to the peers
+	`
+	CREATE TRIGGER IF NOT EXISTS files_log_insert AFTER INSERT ON files
+	BEGIN
+		INSERT INTO files_log(hash, hash_algo, node, storage_root)
+		VALUES(
+			coalesce(NEW.hash, ''),
+			coalesce(NEW.hash_algo, ''),
+			NEW.node,
+			coalesce(NEW.storage_root, '')
+		);
+	END;
+	CREATE TRIGGER IF NOT EXISTS files_log_update AFTER UPDATE ON files
+	BEGIN
+		INSERT INTO files_log(hash, hash_algo, node, storage_root)
+		VALUES(
+			coalesce(OLD.hash, ''),
+			coalesce(OLD.hash_algo, ''),
+			OLD.node,
+			coalesce(OLD.storage_root, '')
+		);
+		INSERT INTO files_log(hash, hash_algo, node, storage_root)
+		VALUES(
+			coalesce(NEW.hash, ''),
+			coalesce(NEW.hash_algo, ''),
+			NEW.node,
+			coalesce(NEW.storage_root, '')
+		);
+	END;
+	CREATE TRIGGER IF NOT EXISTS files_log_delete AFTER DELETE ON files
+	BEGIN
+		INSERT INTO files_log(hash, hash_algo, node, storage_root)
+		VALUES(
+			coalesce(OLD.hash, ''),
+			coalesce(OLD.hash_algo, ''),
+			OLD.node,
+			coalesce(OLD.storage_root, '')
+		);
+	END;
+	`,
+}
+
+/**
+ * Migrations that SQL alone cannot express, named in migrations as
+ * "go:" and the key here.
+ */
+var migration_funcs = map[string]func(tx *sql.Tx) error{
+	"catalog_clean_paths": migrate_catalog_clean_paths,
+}
 
-	// add file to 'files' table
-	db_add_file_records(hash, storage_dirs, path)
+/**
+ * Put every catalog path in the form catalog_clean_path gives it, logging
+ * each entry changed so the rest of the cluster gets it too.
+ */
+func migrate_catalog_clean_paths(tx *sql.Tx) error {
+	rows, err := tx.Query(`select id, path from catalog order by id`)
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	var paths []string
+	for rows.Next() {
+		var id int64
+		var p string
+		if err := rows.Scan(&id, &p); err != nil {
+			rows.Close()
+			return err
+		}
+		if clean := catalog_clean_path(p); clean != p {
+			ids = append(ids, id)
+			paths = append(paths, clean)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for i, id := range ids {
+		if _, err := tx.Exec(`update catalog set path = ? where id = ?`, paths[i], id); err != nil {
+			return err
+		}
+		if err := db_log_catalog_change(tx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	staging_path := fmt.Sprintf("%s/.kfs/staging/", staging_dir)
-	var storage_paths []string
-	for _, dir := range storage_dirs {
-		full_path := fmt.Sprintf("%s/.kfs/storage/", dir)
-		storage_paths = append(storage_paths, full_path)
+func db_migrate() {
+	var version int
+	err := db.QueryRow(`PRAGMA user_version`).Scan(&version)
+	if err != nil {
+		panic(fmt.Errorf("could not read schema version: %v", err))
+	}
+	for i := version; i < len(migrations); i++ {
+		log.Printf("applying migration %d", i+1)
+		migration := migrations[i]
+		bump := fmt.Sprintf(`PRAGMA user_version = %d`, i+1)
+		if strings.TrimSpace(migration) == "VACUUM" {
+			// cannot run in a transaction, but is harmless to run twice
+			_, err = db_exec(migration)
+			if err == nil {
+				_, err = db_exec(bump)
+			}
+		} else {
+			// a migration that fails part way leaves nothing behind, and
+			// is tried again whole on the next start
+			err = db_transaction(func(tx *sql.Tx) error {
+				var err error
+				if strings.HasPrefix(migration, "go:") {
+					err = migration_funcs[strings.TrimPrefix(migration, "go:")](tx)
+				} else {
+					_, err = tx.Exec(migration)
+				}
+				if err != nil {
+					return err
+				}
+				_, err = tx.Exec(bump)
+				return err
+			})
+		}
+		if err != nil {
+			panic(fmt.Errorf("migration %d failed: %v", i+1, err))
+		}
 	}
-	return skip, staging_path, storage_paths, nil
 }
 
 func db_close() {
 	db.Close()
+	db_writer.Close()
 }
 
+/**
+ * Reads go through db, which may use several connections at once, since
+ * WAL mode lets readers run alongside the writer. Writes go through
+ * db_writer, which has exactly one connection.
+ */
 func db_init() {
 	var err error
-	db, err = sql.Open("sqlite3", KFS_DB_PATH)
+	dsn := fmt.Sprintf(
+		"file:%s?_busy_timeout=5000&_journal_mode=WAL&_synchronous=%s",
+		KFS_DB_PATH,
+		fsync_sqlite_modes[settings().fsync],
+	)
+	db, err = sql.Open("sqlite3", dsn)
 	if err != nil {
 		panic(fmt.Errorf("failed to open database file: %v", err))
 	}
+	db_writer, err = sql.Open("sqlite3", dsn+"&_txlock=immediate")
+	if err != nil {
+		panic(fmt.Errorf("failed to open database file: %v", err))
+	}
+	db_writer.SetMaxOpenConns(1)
 	schemas := []string{
 		`
 		CREATE TABLE IF NOT EXISTS files(
@@ -170,44 +1129,483 @@ func db_init() {
 			available INTEGER
 		);
 		`,
+
+		`
+		CREATE TABLE IF NOT EXISTS digests(
+			hash TEXT NOT NULL,
+			algo TEXT NOT NULL,
+			digest TEXT NOT NULL,
+			PRIMARY KEY (hash, algo)
+		);
+		`,
+
+		`
+		CREATE TABLE IF NOT EXISTS catalog(
+			id INTEGER PRIMARY KEY,
+			namespace TEXT NOT NULL,
+			path TEXT NOT NULL,
+			filename TEXT NOT NULL,
+			hash TEXT NOT NULL,
+			hash_algo TEXT NOT NULL,
+			size INTEGER NOT NULL,
+			created_at INTEGER NOT NULL
+		);
+		`,
+
+		`
+		CREATE TABLE IF NOT EXISTS nodes(
+			name TEXT NOT NULL PRIMARY KEY,
+			url TEXT NOT NULL,
+			last_seen INTEGER NOT NULL
+		);
+		`,
+
+		`
+		CREATE TABLE IF NOT EXISTS catalog_log(
+			seq INTEGER PRIMARY KEY,
+			catalog_id INTEGER NOT NULL
+		);
+		`,
+
+		`
+		CREATE TABLE IF NOT EXISTS files_log(
+			seq INTEGER PRIMARY KEY AUTOINCREMENT,
+			hash TEXT NOT NULL,
+			hash_algo TEXT NOT NULL,
+			node TEXT NOT NULL,
+			storage_root TEXT NOT NULL
+		);
+		`,
+
+		`
+		CREATE TABLE IF NOT EXISTS standby_cursors(
+			peer TEXT NOT NULL PRIMARY KEY,
+			seq INTEGER NOT NULL
+		);
+		`,
+
+		`
+		CREATE TABLE IF NOT EXISTS catalog_origins(
+			catalog_id INTEGER NOT NULL PRIMARY KEY,
+			node TEXT NOT NULL,
+			origin_id INTEGER NOT NULL,
+			UNIQUE (node, origin_id)
+		);
+		`,
+
+		`
+		CREATE TABLE IF NOT EXISTS cluster_seqs(
+			peer TEXT NOT NULL PRIMARY KEY,
+			seq INTEGER NOT NULL
+		);
+		`,
+
+		`
+		CREATE TABLE IF NOT EXISTS mirror_state(
+			primary_url TEXT NOT NULL PRIMARY KEY,
+			seq INTEGER NOT NULL
+		);
+		`,
+
+		`
+		CREATE TABLE IF NOT EXISTS geo_queue(
+			id INTEGER PRIMARY KEY,
+			kind TEXT NOT NULL,
+			hash TEXT NOT NULL,
+			hash_algo TEXT NOT NULL,
+			payload TEXT NOT NULL,
+			created_at INTEGER NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			last_error TEXT
+		);
+		`,
+
+		`
+		CREATE TABLE IF NOT EXISTS blobs(
+			hash TEXT NOT NULL,
+			hash_algo TEXT NOT NULL,
+			created_at INTEGER NOT NULL,
+			PRIMARY KEY (hash, hash_algo)
+		);
+		`,
+
+		`
+		CREATE TABLE IF NOT EXISTS scans(
+			hash TEXT NOT NULL,
+			hash_algo TEXT NOT NULL,
+			result TEXT NOT NULL,
+			signature TEXT,
+			quarantine_path TEXT,
+			scanned_at INTEGER NOT NULL,
+			PRIMARY KEY (hash, hash_algo)
+		);
+		`,
+
+		`
+		CREATE TABLE IF NOT EXISTS disk_health(
+			root TEXT NOT NULL PRIMARY KEY,
+			device TEXT NOT NULL,
+			passed INTEGER NOT NULL,
+			reallocated INTEGER NOT NULL,
+			pending INTEGER NOT NULL,
+			temperature INTEGER NOT NULL,
+			checked_at INTEGER NOT NULL
+		);
+		`,
+
+		`
+		CREATE TABLE IF NOT EXISTS thumbnails(
+			hash TEXT NOT NULL,
+			hash_algo TEXT NOT NULL,
+			size INTEGER NOT NULL,
+			thumb_hash TEXT NOT NULL,
+			thumb_algo TEXT NOT NULL,
+			width INTEGER NOT NULL,
+			height INTEGER NOT NULL,
+			PRIMARY KEY (hash, hash_algo, size)
+		);
+		`,
+
+		`
+		CREATE TABLE IF NOT EXISTS media(
+			hash TEXT NOT NULL,
+			hash_algo TEXT NOT NULL,
+			mime_type TEXT NOT NULL,
+			taken_at INTEGER,
+			make TEXT NOT NULL,
+			model TEXT NOT NULL,
+			latitude REAL,
+			longitude REAL,
+			width INTEGER NOT NULL,
+			height INTEGER NOT NULL,
+			duration REAL NOT NULL,
+			codecs TEXT NOT NULL,
+			PRIMARY KEY (hash, hash_algo)
+		);
+		`,
+
+		`
+		CREATE TABLE IF NOT EXISTS content_docs(
+			doc_id INTEGER PRIMARY KEY,
+			hash TEXT NOT NULL,
+			hash_algo TEXT NOT NULL,
+			UNIQUE (hash, hash_algo)
+		);
+		`,
+
+		`
+		CREATE TABLE IF NOT EXISTS archive_intents(
+			hash TEXT NOT NULL,
+			hash_algo TEXT NOT NULL,
+			staging_file TEXT NOT NULL,
+			node TEXT NOT NULL,
+			root TEXT NOT NULL,
+			created_at INTEGER NOT NULL,
+			PRIMARY KEY (hash, hash_algo, node, root)
+		);
+		`,
+
+		`
+		CREATE TABLE IF NOT EXISTS replica_policies(
+			namespace TEXT NOT NULL PRIMARY KEY,
+			replicas INTEGER NOT NULL
+		);
+		`,
+
+		`
+		CREATE TABLE IF NOT EXISTS append_objects(
+			id INTEGER PRIMARY KEY,
+			namespace TEXT NOT NULL,
+			name TEXT NOT NULL,
+			created_at INTEGER NOT NULL,
+			UNIQUE (namespace, name)
+		);
+		`,
+
+		`
+		CREATE TABLE IF NOT EXISTS append_segments(
+			object_id INTEGER NOT NULL,
+			seq INTEGER NOT NULL,
+			hash TEXT NOT NULL,
+			hash_algo TEXT NOT NULL,
+			size INTEGER NOT NULL,
+			created_at INTEGER NOT NULL,
+			PRIMARY KEY (object_id, seq)
+		);
+		`,
+
+		`
+		CREATE TABLE IF NOT EXISTS multipart_uploads(
+			id TEXT NOT NULL PRIMARY KEY,
+			root TEXT NOT NULL,
+			filename TEXT NOT NULL,
+			hash TEXT NOT NULL,
+			hash_algo TEXT NOT NULL,
+			namespace TEXT NOT NULL,
+			path TEXT NOT NULL,
+			class TEXT NOT NULL,
+			created_at INTEGER NOT NULL
+		);
+		`,
+
+		`
+		CREATE TABLE IF NOT EXISTS multipart_parts(
+			upload_id TEXT NOT NULL,
+			part INTEGER NOT NULL,
+			hash TEXT NOT NULL,
+			size INTEGER NOT NULL,
+			PRIMARY KEY (upload_id, part)
+		);
+		`,
+
+		`
+		CREATE TABLE IF NOT EXISTS sync_sessions(
+			id TEXT NOT NULL PRIMARY KEY,
+			namespace TEXT NOT NULL,
+			hash_algo TEXT NOT NULL,
+			class TEXT NOT NULL,
+			created_at INTEGER NOT NULL,
+			committed_at INTEGER
+		);
+		`,
+
+		`
+		CREATE TABLE IF NOT EXISTS sync_entries(
+			session_id TEXT NOT NULL,
+			path TEXT NOT NULL,
+			filename TEXT NOT NULL,
+			hash TEXT NOT NULL,
+			size INTEGER NOT NULL,
+			catalog_id INTEGER,
+			PRIMARY KEY (session_id, path, filename)
+		);
+		`,
+
+		`
+		CREATE TABLE IF NOT EXISTS backup_reports(
+			machine TEXT NOT NULL,
+			source TEXT NOT NULL,
+			ok INTEGER NOT NULL,
+			files INTEGER NOT NULL,
+			bytes INTEGER NOT NULL,
+			error TEXT NOT NULL,
+			started_at INTEGER NOT NULL,
+			finished_at INTEGER NOT NULL
+		);
+		`,
+
+		`
+		CREATE TABLE IF NOT EXISTS archive_failures(
+			hash TEXT NOT NULL,
+			storage_root TEXT NOT NULL,
+			error TEXT,
+			created_at INTEGER
+		);
+		`,
+
+		`
+		CREATE TABLE IF NOT EXISTS gc_marks(
+			hash TEXT NOT NULL,
+			hash_algo TEXT NOT NULL,
+			marked_at INTEGER NOT NULL,
+			PRIMARY KEY (hash, hash_algo)
+		);
+		`,
+
+		`
+		CREATE TABLE IF NOT EXISTS stats_hourly(
+			hour INTEGER NOT NULL PRIMARY KEY,
+			files INTEGER NOT NULL,
+			blobs INTEGER NOT NULL,
+			logical_bytes INTEGER NOT NULL,
+			unique_bytes INTEGER NOT NULL,
+			physical_bytes INTEGER NOT NULL,
+			ingest_files INTEGER NOT NULL,
+			ingest_logical_bytes INTEGER NOT NULL,
+			ingest_unique_bytes INTEGER NOT NULL
+		);
+		`,
+
+		`
+		CREATE TABLE IF NOT EXISTS disk_stats_hourly(
+			hour INTEGER NOT NULL,
+			root TEXT NOT NULL,
+			stored_bytes INTEGER NOT NULL,
+			available INTEGER NOT NULL,
+			total INTEGER NOT NULL,
+			PRIMARY KEY (hour, root)
+		);
+		`,
+
+		`
+		CREATE TABLE IF NOT EXISTS uploads(
+			id TEXT NOT NULL PRIMARY KEY,
+			state TEXT NOT NULL,
+			hash TEXT NOT NULL DEFAULT '',
+			hash_algo TEXT NOT NULL DEFAULT '',
+			size INTEGER NOT NULL DEFAULT 0,
+			replicas INTEGER NOT NULL DEFAULT 0,
+			replicas_written INTEGER NOT NULL DEFAULT 0,
+			error TEXT NOT NULL DEFAULT '',
+			created_at INTEGER NOT NULL,
+			updated_at INTEGER NOT NULL
+		);
+		`,
+
+		`
+		CREATE INDEX IF NOT EXISTS uploads_hash_idx
+		ON uploads(hash, hash_algo);
+		`,
+
+		`
+		CREATE TABLE IF NOT EXISTS disk_replacements(
+			root TEXT NOT NULL PRIMARY KEY,
+			old_uuid TEXT NOT NULL,
+			new_uuid TEXT NOT NULL,
+			started_at INTEGER NOT NULL,
+			finished_at INTEGER
+		);
+		`,
+
+		`
+		CREATE TABLE IF NOT EXISTS disk_restores(
+			root TEXT NOT NULL,
+			hash TEXT NOT NULL,
+			hash_algo TEXT NOT NULL,
+			size INTEGER NOT NULL,
+			state TEXT NOT NULL,
+			error TEXT NOT NULL DEFAULT '',
+			PRIMARY KEY (root, hash, hash_algo)
+		);
+		`,
 	}
 
 	for _, schema := range schemas {
-		_, err = db.Exec(schema)
+		_, err = db_exec(schema)
 		if err != nil {
 			panic(err)
 		}
 	}
+	db_migrate()
+	search_init()
+	known_hashes_load()
+	if err := db_sync_disks(settings(), true); err != nil {
+		panic(err)
+	}
+}
 
-	// TODO: allow user to configure disk locations
-	disks := []string{
-		"/mnt/disk1",
-		"/mnt/disk2",
-		"/mnt/disk3",
-		"/mnt/disk4",
+/**
+ * Make the local disks in the database match those of the settings, which
+ * need not be running yet. Disks that are no longer listed get no new
+ * blobs, but the replicas already on them are still read. With reset, the
+ * space available on every disk is read again, which must only happen
+ * while no space is reserved, i.e. at startup. Each disk is checked and
+ * set up with disk_prepare first.
+ */
+func db_sync_disks(s *kfs_settings, reset bool) error {
+	disks := s.disks
+	// the uuid of each disk in use, by root
+	known := map[string]string{}
+	rows, err := db.Query(`select root, uuid from disks where node = ''`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var root, id string
+		if err := rows.Scan(&root, &id); err != nil {
+			rows.Close()
+			return err
+		}
+		known[root] = id
 	}
+	rows.Close()
 
-	disk_insert := `
-		INSERT OR REPLACE INTO disks(
-			root,
-			available
-		) values(?, ?)
-	`
+	/*
+	 * A new disk that cannot be used is refused outright, but one already
+	 * in use is only failed, so that its replicas are copied elsewhere
+	 * rather than a single dead drive keeping the server down.
+	 */
+	failed := map[string]string{}
+	identities := map[string]string{}
 	for _, disk := range disks {
-		space := get_disk_space(disk)
-		_, err = db.Exec(disk_insert, disk, space)
+		identity, err := disk_prepare(disk, s.require_mount_point)
 		if err != nil {
-			panic(err)
+			if _, ok := known[disk]; !ok {
+				return err
+			}
+			failed[disk] = err.Error()
+			continue
 		}
+		identities[disk] = identity.UUID
 	}
-}
+	moves, err := disk_moves(known, identities)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for disk, reason := range failed {
+			if err := disk_fail(disk, reason); err != nil {
+				log.Printf("could not fail disk '%s': %v", disk, err)
+			}
+		}
+	}()
 
-func get_disk_space(path string) uint64 {
-	var stat unix.Statfs_t
+	return db_transaction(func(tx *sql.Tx) error {
+		if err := db_move_disks(tx, moves); err != nil {
+			return err
+		}
+		keep := map[string]bool{}
+		for _, disk := range disks {
+			keep[disk] = true
+			stmt := `
+				INSERT INTO disks(node, root, available, class, uuid)
+				values('', ?, ?, ?, ?)
+				ON CONFLICT(node, root) DO UPDATE
+				SET
+					available = case when ? then excluded.available else available end,
+					class = excluded.class,
+					uuid = case when excluded.uuid != '' then excluded.uuid else uuid end
+			`
+			space := get_disk_space(disk)
+			class := s.disk_classes[disk]
+			_, err := tx.Exec(stmt, disk, space, class, identities[disk], reset)
+			if err != nil {
+				return err
+			}
+		}
+		rows, err := tx.Query(`select root from disks where node = ''`)
+		if err != nil {
+			return err
+		}
+		var removed []string
+		for rows.Next() {
+			var root string
+			if err := rows.Scan(&root); err != nil {
+				rows.Close()
+				return err
+			}
+			if !keep[root] {
+				removed = append(removed, root)
+			}
+		}
+		rows.Close()
+		for _, root := range removed {
+			log.Printf("disk '%s' is no longer in use", root)
+			_, err := tx.Exec(`delete from disks where node = '' and root = ?`, root)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
 
-	unix.Statfs(path, &stat)
+func get_disk_size(path string) uint64 {
+	total, _, _ := disk_statfs(path)
+	return total
+}
 
-	// Available blocks * size per block = available space in bytes
-	available_space := stat.Bavail * uint64(stat.Bsize)
-	return available_space
+func get_disk_space(path string) uint64 {
+	_, available, _ := disk_statfs(path)
+	return available
 }
@@ -0,0 +1,463 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+/**
+ * Point the database at a fresh file with n empty disks, each with
+ * available bytes free, and put everything back when the test is done.
+ */
+func test_db(t *testing.T, n int, available int64) []string {
+	t.Helper()
+	saved_path := KFS_DB_PATH
+	saved_disks := KFS_DISKS
+	saved_mount := KFS_REQUIRE_MOUNT_POINT
+	saved_redundancy := KFS_REDUNDANCY
+
+	dir := t.TempDir()
+	var disks []string
+	for i := 0; i < n; i++ {
+		disks = append(disks, t.TempDir())
+	}
+	KFS_DB_PATH = filepath.Join(dir, "kfs.sqlite3")
+	KFS_DISKS = disks
+	KFS_REQUIRE_MOUNT_POINT = false
+	// the settings are the defaults set here, not any a test published
+	settings_value.Store((*kfs_settings)(nil))
+	db_init()
+	t.Cleanup(func() {
+		db_close()
+		KFS_DB_PATH = saved_path
+		KFS_DISKS = saved_disks
+		KFS_REQUIRE_MOUNT_POINT = saved_mount
+		KFS_REDUNDANCY = saved_redundancy
+	})
+
+	if _, err := db_exec(`update disks set available = ?`, available); err != nil {
+		t.Fatal(err)
+	}
+	return disks
+}
+
+func test_available(t *testing.T) map[string]int64 {
+	t.Helper()
+	disks, err := db_list_disks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	available := map[string]int64{}
+	for _, disk := range disks {
+		available[disk.Root] = disk.Available
+	}
+	return available
+}
+
+func TestReserveSpace(t *testing.T) {
+	tests := []struct {
+		name      string
+		available int64
+		size      int64
+		ok        bool
+		left      int64
+	}{
+		{"fits", 100, 40, true, 60},
+		{"exactly fits", 100, 100, true, 0},
+		{"too big", 100, 101, false, 100},
+		{"empty", 0, 1, false, 0},
+		{"nothing", 0, 0, true, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			disks := test_db(t, 1, test.available)
+			disk := placement{root: disks[0]}
+			ok, err := db_reserve_space(db_writer, disk, test.size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != test.ok {
+				t.Errorf("reserved %d of %d: got %v, want %v", test.size, test.available, ok, test.ok)
+			}
+			if left := test_available(t)[disk.root]; left != test.left {
+				t.Errorf("%d bytes left, want %d", left, test.left)
+			}
+		})
+	}
+}
+
+func TestReserveSpaceUnknownDisk(t *testing.T) {
+	test_db(t, 1, 100)
+	ok, err := db_reserve_space(db_writer, placement{root: "/nope"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("reserved space on a disk that does not exist")
+	}
+}
+
+func TestAllocReleaseStorage(t *testing.T) {
+	tests := []struct {
+		name      string
+		mode      staging_mode
+		disks     int
+		available int64
+		size      int64
+		staging   int64
+		fails     bool
+	}{
+		{"not staged", STAGING_NONE, 3, 1000, 100, 0, false},
+		{"staged on disk", STAGING_ON_DISK, 3, 1000, 100, 100, false},
+		{"staging needs room", STAGING_ON_DISK, 2, 150, 100, 0, true},
+		{"too few disks", STAGING_NONE, 1, 1000, 100, 0, true},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test_db(t, test.disks, test.available)
+			KFS_REDUNDANCY = 2
+			hash := "alloc" + string(rune('a'+i))
+			algo := "blake2b"
+			before := test_available(t)
+
+			skip, _, placed, err := db_alloc_storage_mode(
+				context.Background(),
+				hash,
+				algo,
+				test.size,
+				"/",
+				"file",
+				"",
+				test.mode,
+			)
+			if test.fails {
+				if err == nil {
+					t.Fatal("allocated storage that is not there")
+				}
+				if db_has_hash(hash, algo) {
+					t.Error("hash is known after a failed allocation")
+				}
+				for root, left := range test_available(t) {
+					if left != before[root] {
+						t.Errorf("'%s' has %d bytes, was %d", root, left, before[root])
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if skip || len(placed) != KFS_REDUNDANCY {
+				t.Fatalf("skip %v, placed on %v", skip, placed)
+			}
+
+			want := map[string]int64{}
+			for root, left := range before {
+				want[root] = left
+			}
+			for i, disk := range placed {
+				want[disk.root] -= test.size
+				if i == 0 {
+					want[disk.root] -= test.staging
+				}
+			}
+			after := test_available(t)
+			pending := space_pending()
+			for root := range before {
+				if after[root] != want[root] {
+					t.Errorf("'%s' has %d bytes, want %d", root, after[root], want[root])
+				}
+				if before[root]-after[root] != pending[root] {
+					t.Errorf(
+						"'%s' has %d bytes reserved, %d pending",
+						root,
+						before[root]-after[root],
+						pending[root],
+					)
+				}
+			}
+
+			db_release_storage(hash, algo, test.size, placed)
+			for root, left := range test_available(t) {
+				if left != before[root] {
+					t.Errorf("'%s' has %d bytes after release, was %d", root, left, before[root])
+				}
+			}
+			if len(space_pending()) != 0 {
+				t.Errorf("still pending after release: %v", space_pending())
+			}
+			if db_has_hash(hash, algo) {
+				t.Error("hash is still known after release")
+			}
+			var files int
+			err = db.QueryRow(`select count(*) from files where hash = ?`, hash).Scan(&files)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if files != 0 {
+				t.Errorf("%d file records left after release", files)
+			}
+		})
+	}
+}
+
+func TestAllocStorageInFlight(t *testing.T) {
+	test_db(t, 2, 1000)
+	KFS_REDUNDANCY = 2
+	saved_wait, saved_poll := KFS_IN_FLIGHT_WAIT, KFS_IN_FLIGHT_POLL
+	KFS_IN_FLIGHT_WAIT, KFS_IN_FLIGHT_POLL = 200*time.Millisecond, 10*time.Millisecond
+	defer func() { KFS_IN_FLIGHT_WAIT, KFS_IN_FLIGHT_POLL = saved_wait, saved_poll }()
+
+	tests := []struct {
+		name string
+
+		// what the upload holding the claim does while this one waits
+		settle func(hash string, algo string)
+
+		skip bool
+		err  error
+	}{
+		{"still in flight", nil, false, errHashInFlight},
+		{
+			"failed",
+			func(hash string, algo string) {
+				db_exec(`delete from blobs where hash = ? and hash_algo = ?`, hash, algo)
+			},
+			false,
+			nil,
+		},
+		{
+			"stored",
+			func(hash string, algo string) {
+				known_hash_add(hash, algo)
+			},
+			true,
+			nil,
+		},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hash := "inflight" + string(rune('a'+i))
+			algo := "blake2b"
+			_, err := db_exec(
+				`insert into blobs(hash, hash_algo, created_at) values(?, ?, 0)`,
+				hash,
+				algo,
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.settle != nil {
+				go func() {
+					time.Sleep(50 * time.Millisecond)
+					test.settle(hash, algo)
+				}()
+			}
+			skip, _, placed, err := db_alloc_storage_mode(
+				context.Background(),
+				hash,
+				algo,
+				1,
+				"/",
+				"file",
+				"",
+				STAGING_NONE,
+			)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("got %v, want %v", err, test.err)
+			}
+			if skip != test.skip {
+				t.Errorf("skip %v, want %v", skip, test.skip)
+			}
+			if err == nil && !skip {
+				if len(placed) != KFS_REDUNDANCY {
+					t.Errorf("placed on %v", placed)
+				}
+				db_release_storage(hash, algo, 1, placed)
+			}
+			known_hash_remove(hash, algo)
+		})
+	}
+}
+
+func TestDuplicateUploadWaitsForReplica(t *testing.T) {
+	test_db(t, 2, 1000)
+	KFS_REDUNDANCY = 2
+	hash, algo := "duplicate", "blake2b"
+	ctx := context.Background()
+	_, _, placed, err := db_alloc_storage_mode(ctx, hash, algo, 1, "/", "a", "", STAGING_NONE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db_has_hash(hash, algo) {
+		t.Fatal("hash is known before any of it was written")
+	}
+
+	type result struct {
+		skip bool
+		err  error
+	}
+	done := make(chan result)
+	go func() {
+		skip, _, _, err := db_alloc_storage_mode(ctx, hash, algo, 1, "/", "b", "", STAGING_NONE)
+		done <- result{skip, err}
+	}()
+	select {
+	case r := <-done:
+		t.Fatalf("duplicate went ahead before the first was stored: %+v", r)
+	case <-time.After(2 * KFS_IN_FLIGHT_POLL):
+	}
+
+	db_replica_stored(hash, algo, placed[0])
+	r := <-done
+	if r.err != nil || !r.skip {
+		t.Fatalf("duplicate after the first was stored: %+v", r)
+	}
+	if !db_has_hash(hash, algo) {
+		t.Error("hash is not known once a replica is written")
+	}
+	known_hash_remove(hash, algo)
+}
+
+func TestKnownHashesLoad(t *testing.T) {
+	disks := test_db(t, 1, 1000)
+	tests := []struct {
+		hash    string
+		pending []bool
+		blob    bool
+		known   bool
+	}{
+		{"stored", []bool{false}, true, true},
+		{"partly stored", []bool{false, true}, true, true},
+		{"in flight", []bool{true}, true, false},
+		{"on another node", nil, true, true},
+	}
+	for _, test := range tests {
+		if test.blob {
+			_, err := db_exec(
+				`insert into blobs(hash, hash_algo, created_at) values(?, 'blake2b', 0)`,
+				test.hash,
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i, pending := range test.pending {
+			_, err := db_exec(
+				`
+				insert into files(hash, hash_algo, storage_root, node, pending)
+				values(?, 'blake2b', ?, ?, ?)
+				`,
+				test.hash,
+				disks[0],
+				string(rune('a'+i)),
+				pending,
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	known_hashes_load()
+	for _, test := range tests {
+		if got := db_has_hash(test.hash, "blake2b"); got != test.known {
+			t.Errorf("%s: known %v, want %v", test.hash, got, test.known)
+		}
+	}
+}
+
+func TestMigrateAtomic(t *testing.T) {
+	test_db(t, 1, 1000)
+	saved := migrations
+	defer func() { migrations = saved }()
+
+	// fails on its second statement, after the first has run
+	migrations = append(append([]string{}, saved...), `
+		CREATE TABLE half_done(a INTEGER);
+		INSERT INTO no_such_table VALUES(1);
+	`)
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("a failed migration went unnoticed")
+			}
+		}()
+		db_migrate()
+	}()
+
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version != len(saved) {
+		t.Errorf("user_version is %d after a failed migration, want %d", version, len(saved))
+	}
+	var tables int
+	err := db.QueryRow(`select count(*) from sqlite_master where name = 'half_done'`).Scan(&tables)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tables != 0 {
+		t.Error("a failed migration left part of itself behind")
+	}
+}
+
+func TestBlobTarget(t *testing.T) {
+	test_db(t, 1, 1000)
+	KFS_REDUNDANCY = 2
+	tests := []struct {
+		name      string
+		namespace int
+		blob      int
+		want      int
+	}{
+		{"default", 0, 0, 2},
+		{"namespace", 3, 0, 3},
+		{"blob", 3, 1, 1},
+	}
+	for i, test := range tests {
+		hash := "target" + string(rune('a'+i))
+		namespace := "ns" + string(rune('a'+i))
+		_, err := db_exec(`insert into blobs(hash, hash_algo, created_at) values(?, 'blake2b', 0)`, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry := catalog_entry{Namespace: namespace, Path: "/", Filename: "f", Hash: hash, HashAlgo: "blake2b"}
+		if _, err := db_add_catalog_entry(entry); err != nil {
+			t.Fatal(err)
+		}
+		if err := db_set_namespace_replicas(namespace, test.namespace); err != nil {
+			t.Fatal(err)
+		}
+		if err := db_set_blob_replicas(hash, "blake2b", test.blob); err != nil {
+			t.Fatal(err)
+		}
+		target, err := db_get_blob_target(hash, "blake2b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if target != test.want {
+			t.Errorf("%s: target %d, want %d", test.name, target, test.want)
+		}
+	}
+}
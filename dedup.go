@@ -0,0 +1,156 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+)
+
+/**
+ * An upload of a blob that is already stored is answered as soon as the
+ * server can tell, instead of once the whole body has arrived. For
+ * PUT /blob/:hash that is before the body is read at all, so a client that
+ * sends "Expect: 100-continue", as curl does for big files, never sends
+ * it. For /upload, the form is read up to the file, so the hash has to
+ * come before it, e.g.
+ *     curl -F "hash=..." -F "file=@big.iso" localhost:8080/upload
+ * or be given in the query. The rest of the body is then left unread and
+ * the connection is closed, which stops the client sending it.
+ */
+
+// the most of a form that is read looking for the hash before the file
+const KFS_UPLOAD_FIELDS_LIMIT = 1 << 20
+
+var errFieldsTooLong = errors.New("form fields before the file are too long")
+
+/**
+ * A reader that keeps what is read from it, until done is set, so that it
+ * can be put back.
+ */
+type form_head struct {
+	reader io.Reader
+	head   bytes.Buffer
+	done   bool
+}
+
+func (f *form_head) Read(buf []byte) (int, error) {
+	n, err := f.reader.Read(buf)
+	if !f.done {
+		f.head.Write(buf[:n])
+		if f.head.Len() > KFS_UPLOAD_FIELDS_LIMIT {
+			return n, errFieldsTooLong
+		}
+	}
+	return n, err
+}
+
+/**
+ * The size of the blob the fields name, or 0 when it is not stored.
+ */
+func stored_upload_size(fields upload_fields) int64 {
+	algo := fields.HashAlgo
+	if algo == "" {
+		algo = KFS_DEFAULT_HASH_ALGO
+	}
+	if fields.Hash == "" || !valid_hash_algo(algo) || !db_has_hash(fields.Hash, algo) {
+		return 0
+	}
+	hash, algo, err := db_resolve_hash(fields.Hash, algo)
+	if err != nil {
+		return 0
+	}
+	size, err := db_get_blob_size(hash, algo)
+	if err != nil {
+		return 0
+	}
+	return size
+}
+
+/**
+ * Read the form up to the file. If the blob it names is stored, return
+ * the fields, the file as it is still to be read, its name, and the size
+ * of the stored blob. Otherwise put back what was read, so that the form
+ * is parsed as usual.
+ */
+func upload_form_dedup(request *http.Request) (upload_fields, io.Reader, string, int64, bool) {
+	var fields upload_fields
+	media_type, params, err := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	if err != nil || media_type != "multipart/form-data" || params["boundary"] == "" {
+		return fields, nil, "", 0, false
+	}
+	body := request.Body
+	recorder := &form_head{reader: body}
+	reader := multipart.NewReader(recorder, params["boundary"])
+
+	values := url.Values{}
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			break
+		}
+		if part.FormName() != "file" {
+			value, err := io.ReadAll(part)
+			if err != nil {
+				break
+			}
+			values.Add(part.FormName(), string(value))
+			continue
+		}
+
+		// as with FormValue, the form comes first, then the query
+		query := request.URL.Query()
+		get := func(key string) string {
+			if value, ok := values[key]; ok {
+				return value[0]
+			}
+			return query.Get(key)
+		}
+		fields = upload_fields{
+			Hash:      get("hash"),
+			HashAlgo:  get("hash_algo"),
+			Namespace: get("namespace"),
+			Path:      get("path"),
+			Class:     get("class"),
+			Durable:   get("durable") == "true",
+		}
+		size := stored_upload_size(fields)
+		if size <= 0 {
+			break
+		}
+		recorder.done = true
+		metric_add(
+			"kfs_upload_early_dedup_total",
+			"Uploads of stored blobs answered before the file was read.",
+			"",
+			1,
+		)
+		return fields, part, part.FileName(), size, true
+	}
+
+	request.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(&recorder.head, body), body}
+	return upload_fields{}, nil, "", 0, false
+}
@@ -0,0 +1,227 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+/**
+ * Failed disks and missing replicas. A disk is failed when it is marked so
+ * with POST /admin/disks/fail, when it fails its SMART health check, or
+ * when its storage directory disappears. Nothing new is placed on a failed
+ * disk, and its replicas no longer count, so replicas_loop copies the blobs
+ * it held onto healthy disks, those with the fewest copies left first.
+ *
+ * Replicas on healthy disks are checked a batch at a time, and any that are
+ * gone are forgotten, so they are replaced the same way.
+ */
+
+// replicas checked for on each pass
+var KFS_REPLICAS_CHECK_BATCH = 10000
+
+const (
+	EVENT_DISK_FAILED     = "disk.failed"
+	EVENT_REPLICA_MISSING = "replica.missing"
+)
+
+// where the check for missing replicas got to, by files rowid
+var replicas_check_cursor int64
+
+func db_set_disk_failed(root string, failed bool) (bool, error) {
+	result, err := db_exec(
+		`update disks set failed = ? where node = '' and root = ? and failed != ?`,
+		failed,
+		root,
+		failed,
+	)
+	if err != nil {
+		return false, fmt.Errorf("could not mark disk: %v", err)
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+/**
+ * Stop using the disk, and re-replicate what it held.
+ */
+func disk_fail(root string, reason string) error {
+	changed, err := db_set_disk_failed(root, true)
+	if err != nil || !changed {
+		return err
+	}
+	log.Printf("disk '%s' has failed: %s", root, reason)
+	emit_event(event{Type: EVENT_DISK_FAILED, Root: root, Error: reason})
+	metric_add("kfs_disks_failed_total", "Disks marked as failed.", "", 1)
+	replicas_trigger()
+	return nil
+}
+
+func db_healthy_disks() (map[placement]bool, error) {
+	rows, err := db.Query(`select node, root from disks where not failed`)
+	if err != nil {
+		return nil, fmt.Errorf("could not query disks: %v", err)
+	}
+	defer rows.Close()
+	healthy := map[placement]bool{}
+	for rows.Next() {
+		var disk placement
+		if err := rows.Scan(&disk.node, &disk.root); err != nil {
+			return nil, err
+		}
+		healthy[disk] = true
+	}
+	return healthy, rows.Err()
+}
+
+/**
+ * Fail the local disks whose storage has gone, which is usually an unmounted
+ * or dead drive rather than every blob going missing at once, then forget
+ * the next batch of replicas that are not on disk. Replicas that are still
+ * being archived are skipped.
+ */
+func replicas_check_missing() error {
+	healthy, err := db_healthy_disks()
+	if err != nil {
+		return err
+	}
+	for disk := range healthy {
+		if disk.node != "" {
+			continue
+		}
+		if _, err := os.Stat(get_storage_path(disk.root)); err != nil {
+			if err := disk_fail(disk.root, err.Error()); err != nil {
+				return err
+			}
+			delete(healthy, disk)
+		}
+	}
+
+	query := `
+		select files.rowid, files.hash, files.hash_algo, files.storage_root, files.size
+		from files
+		where files.node = ''
+			and not files.pending
+			and files.rowid > ?
+			and files.created_at < ?
+			and not exists (
+				select 1 from archive_intents
+				where archive_intents.hash = files.hash
+					and archive_intents.hash_algo = files.hash_algo
+			)
+		order by files.rowid
+		limit ?
+	`
+	settled := time.Now().Add(-KFS_REPLICAS_INTERVAL).Unix()
+	rows, err := db.Query(query, replicas_check_cursor, settled, KFS_REPLICAS_CHECK_BATCH)
+	if err != nil {
+		return fmt.Errorf("could not query replicas: %v", err)
+	}
+	var missing []replica_change
+	var roots []string
+	n := 0
+	for rows.Next() {
+		var change replica_change
+		var root string
+		var size *int64
+		err := rows.Scan(&replicas_check_cursor, &change.hash, &change.algo, &root, &size)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		n++
+		if size != nil {
+			change.size = *size
+		}
+		if !healthy[placement{root: root}] {
+			continue
+		}
+		path := get_blob_path(root, change.hash, change.algo)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			missing = append(missing, change)
+			roots = append(roots, root)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if n < KFS_REPLICAS_CHECK_BATCH {
+		replicas_check_cursor = 0
+	}
+
+	for i, change := range missing {
+		disk := placement{root: roots[i]}
+		log.Printf("replica of %s on '%s' is missing", change.hash, disk)
+		if err := db_remove_replica(change.hash, change.algo, disk, change.size); err != nil {
+			return err
+		}
+		emit_event(event{
+			Type:     EVENT_REPLICA_MISSING,
+			Hash:     change.hash,
+			HashAlgo: change.algo,
+			Root:     disk.root,
+		})
+		metric_add("kfs_replicas_missing_total", "Replicas found missing from disk.", "", 1)
+	}
+	return nil
+}
+
+/**
+ * Mark a disk as failed, or back in service once it has been replaced, e.g.
+ *     curl -X POST -F root=/mnt/disk2 localhost:8080/admin/disks/fail
+ */
+func handle_disk_failed(failed bool) httprouter.Handle {
+	return func(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+		root := request.FormValue("root")
+		var err error
+		if failed {
+			err = disk_fail(root, "marked as failed")
+		} else {
+			var changed bool
+			changed, err = db_set_disk_failed(root, false)
+			if changed {
+				log.Printf("disk '%s' is back in service", root)
+			}
+		}
+		if err != nil {
+			log.Println(err)
+			write_error(writer, "could not mark disk", http.StatusInternalServerError)
+			return
+		}
+		disks, err := db_list_disks()
+		if err != nil {
+			log.Println(err)
+			write_error(writer, "could not list disks", http.StatusInternalServerError)
+			return
+		}
+		for _, disk := range disks {
+			if disk.Root == root {
+				write_json(writer, http.StatusOK, disk)
+				return
+			}
+		}
+		write_error(writer, "no such disk", http.StatusNotFound)
+	}
+}
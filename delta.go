@@ -0,0 +1,330 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+/**
+ * Delta uploads, as rsync does them, for large files that change a little
+ * at a time, such as mbox files and disk images. The client fetches the
+ * signature of the version the server already has,
+ *     curl 'localhost:8080/signature/<old hash>?block_size=65536'
+ * finds the blocks of the new version that match one of them, by rolling
+ * the weak checksum over the new file and confirming with the strong one,
+ * and uploads only instructions for the rest:
+ *     curl -X POST \
+ *         -F delta=@file.delta \
+ *         -F block_size=65536 \
+ *         -F filename=file \
+ *         -F size=<new size> \
+ *         -F hash=<new hash> \
+ *         -F path=`pwd` \
+ *         localhost:8080/delta/<old hash>
+ * The server rebuilds the new version from the old one, and stores it just
+ * as if it had been uploaded whole.
+ *
+ * The weak checksum of a block is rsync's, a + b<<16, where a is the sum of
+ * its bytes and b the sum of each byte times the number of bytes from it to
+ * the end of the block, both mod 2^16. The strong checksum is the first 16
+ * bytes of the block's sha256, in hex.
+ *
+ * The delta is a series of big-endian instructions:
+ *     'C' uint64 first block, uint32 number of blocks: copy from the old
+ *     'D' uint32 length, then that many bytes: data that is new
+ */
+
+var (
+	KFS_DELTA_BLOCK_SIZE     = 64 * 1024
+	KFS_DELTA_MIN_BLOCK_SIZE = 512
+	KFS_DELTA_MAX_BLOCK_SIZE = 16 * 1024 * 1024
+
+	// the longest run of new data in one instruction
+	KFS_DELTA_MAX_LITERAL = 64 * 1024 * 1024
+)
+
+const (
+	DELTA_COPY = 'C'
+	DELTA_DATA = 'D'
+)
+
+type delta_block struct {
+	Weak   uint32 `json:"weak"`
+	Strong string `json:"strong"`
+}
+
+type delta_signature struct {
+	Hash      string        `json:"hash"`
+	HashAlgo  string        `json:"hash_algo"`
+	Size      int64         `json:"size"`
+	BlockSize int           `json:"block_size"`
+	Blocks    []delta_block `json:"blocks"`
+}
+
+func delta_weak(block []byte) uint32 {
+	var a, b uint32
+	n := uint32(len(block))
+	for i, c := range block {
+		a += uint32(c)
+		b += (n - uint32(i)) * uint32(c)
+	}
+	return (a & 0xffff) | (b&0xffff)<<16
+}
+
+func delta_strong(block []byte) string {
+	sum := sha256.Sum256(block)
+	return hex.EncodeToString(sum[:16])
+}
+
+func delta_block_size(s string) (int, error) {
+	if s == "" {
+		return KFS_DELTA_BLOCK_SIZE, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < KFS_DELTA_MIN_BLOCK_SIZE || n > KFS_DELTA_MAX_BLOCK_SIZE {
+		return 0, fmt.Errorf(
+			"block_size must be from %d to %d",
+			KFS_DELTA_MIN_BLOCK_SIZE,
+			KFS_DELTA_MAX_BLOCK_SIZE,
+		)
+	}
+	return n, nil
+}
+
+/**
+ * Open the first replica of the blob on this node that can be read.
+ */
+func open_replica(hash string) (*os.File, string, string, error) {
+	algo, roots, err := db_get_replicas(hash)
+	if err != nil {
+		return nil, "", "", err
+	}
+	for _, root := range order_replicas(roots) {
+		f, err := os.Open(get_blob_path(root, hash, algo))
+		if err == nil {
+			return f, algo, root, nil
+		}
+		log.Printf("replica not usable: %v", err)
+	}
+	return nil, "", "", os.ErrNotExist
+}
+
+func handle_signature(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	block_size, err := delta_block_size(request.URL.Query().Get("block_size"))
+	if err != nil {
+		write_error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hash := p.ByName("hash")
+	f, algo, _, err := open_replica(hash)
+	if err != nil {
+		write_error(writer, "no such hash", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	signature := delta_signature{
+		Hash:      hash,
+		HashAlgo:  algo,
+		BlockSize: block_size,
+		Blocks:    []delta_block{},
+	}
+	reader := bufio.NewReaderSize(f, block_size)
+	block := make([]byte, block_size)
+	for {
+		n, err := io.ReadFull(reader, block)
+		if n > 0 {
+			signature.Size += int64(n)
+			signature.Blocks = append(signature.Blocks, delta_block{
+				Weak:   delta_weak(block[:n]),
+				Strong: delta_strong(block[:n]),
+			})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			log.Printf("could not read %s: %v", hash, err)
+			write_error(writer, "could not read blob", http.StatusInternalServerError)
+			return
+		}
+	}
+	write_json(writer, http.StatusOK, signature)
+}
+
+/**
+ * Write the file the delta describes, copying blocks from base, stopping
+ * once it is longer than size.
+ */
+func delta_apply(base *os.File, block_size int, delta io.Reader, out io.Writer, size int64) (int64, int64, error) {
+	reader := bufio.NewReader(delta)
+	var reused, literal int64
+	for {
+		if reused+literal > size {
+			return reused, literal, fmt.Errorf("rebuilt more than %d bytes", size)
+		}
+		op, err := reader.ReadByte()
+		if err == io.EOF {
+			return reused, literal, nil
+		}
+		if err != nil {
+			return reused, literal, err
+		}
+		switch op {
+		case DELTA_COPY:
+			var first uint64
+			var count uint32
+			if err := binary.Read(reader, binary.BigEndian, &first); err != nil {
+				return reused, literal, err
+			}
+			if err := binary.Read(reader, binary.BigEndian, &count); err != nil {
+				return reused, literal, err
+			}
+			offset := int64(first) * int64(block_size)
+			length := int64(count) * int64(block_size)
+			section := io.NewSectionReader(base, offset, length)
+			n, err := io.Copy(out, section)
+			if err != nil {
+				return reused, literal, err
+			}
+			if n == 0 && count > 0 {
+				return reused, literal, fmt.Errorf("block %d is past the end of the old version", first)
+			}
+			reused += n
+		case DELTA_DATA:
+			var length uint32
+			if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+				return reused, literal, err
+			}
+			if int(length) > KFS_DELTA_MAX_LITERAL {
+				return reused, literal, fmt.Errorf("%d bytes of data is too long", length)
+			}
+			n, err := io.CopyN(out, reader, int64(length))
+			literal += n
+			if err != nil {
+				return reused, literal, err
+			}
+		default:
+			return reused, literal, fmt.Errorf("unknown instruction '%c'", op)
+		}
+	}
+}
+
+/**
+ * Rebuild the new version of a file from the old one and a delta, and
+ * store it as an upload.
+ */
+func handle_delta(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	if !space_check_upload(writer) {
+		return
+	}
+	tracker, ok := progress_start_request(writer, request)
+	if !ok {
+		return
+	}
+	request.Body = &progress_reader{request.Body, tracker}
+	fail := func(status int, msg string) {
+		tracker.fail(fmt.Errorf("%s", msg))
+		write_error(writer, msg, status)
+	}
+
+	delta, _, err := request.FormFile("delta")
+	if err != nil {
+		fail(http.StatusBadRequest, "delta upload requires key of 'delta'")
+		return
+	}
+	defer delta.Close()
+	block_size, err := delta_block_size(request.FormValue("block_size"))
+	if err != nil {
+		fail(http.StatusBadRequest, err.Error())
+		return
+	}
+	filename := request.FormValue("filename")
+	if filename == "" {
+		fail(http.StatusBadRequest, "delta upload requires 'filename'")
+		return
+	}
+	size, err := strconv.ParseInt(request.FormValue("size"), 10, 64)
+	if err != nil || size < 0 {
+		fail(http.StatusBadRequest, "delta upload requires 'size'")
+		return
+	}
+
+	base_hash := p.ByName("hash")
+	base, _, root, err := open_replica(base_hash)
+	if err != nil {
+		fail(http.StatusNotFound, "no such hash")
+		return
+	}
+	defer base.Close()
+
+	// rebuilt next to the old version, where staging will likely be
+	rebuilt, err := os.CreateTemp(filepath.Join(root, ".kfs", "staging"), "delta-")
+	if err != nil {
+		log.Printf("could not rebuild from %s: %v", base_hash, err)
+		fail(http.StatusInternalServerError, "could not rebuild file")
+		return
+	}
+	defer os.Remove(rebuilt.Name())
+	defer rebuilt.Close()
+
+	out := bufio.NewWriter(rebuilt)
+	reused, literal, err := delta_apply(base, block_size, delta, out, size)
+	if err == nil {
+		err = out.Flush()
+	}
+	if err != nil {
+		fail(http.StatusBadRequest, fmt.Sprintf("invalid delta: %v", err))
+		return
+	}
+	if reused+literal != size {
+		fail(
+			http.StatusBadRequest,
+			fmt.Sprintf("delta rebuilt %d bytes, expected %d", reused+literal, size),
+		)
+		return
+	}
+	if _, err := rebuilt.Seek(0, io.SeekStart); err != nil {
+		fail(http.StatusInternalServerError, "could not rebuild file")
+		return
+	}
+	log.Printf(
+		"rebuilt '%s' from %s: %d bytes reused, %d bytes sent",
+		filename,
+		base_hash,
+		reused,
+		literal,
+	)
+	metric_add("kfs_delta_reused_bytes_total", "Bytes of delta uploads copied from the old version.", "", float64(reused))
+	metric_add("kfs_delta_literal_bytes_total", "Bytes of delta uploads sent as new data.", "", float64(literal))
+	fields := read_upload_fields(request)
+	store_upload(request.Context(), writer, tracker, fields, rebuilt, filename, size)
+}
@@ -0,0 +1,155 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+/**
+ * Direct writes skip staging: an upload is streamed to every disk it is
+ * stored to at once, and hashed as it streams, so each byte is written once
+ * per replica instead of once more for the staging copy. For a server held
+ * back by disk bandwidth, that halves what is written.
+ *
+ * Each replica is written to the staging directory of its own disk and
+ * renamed into storage once the hash checks out, so a blob never shows up
+ * in storage half written, and the rename costs nothing. Only local disks
+ * can be written to this way, so uploads in a cluster are still staged.
+ */
+
+var KFS_DIRECT_WRITES = false
+
+func direct_writes_enabled() bool {
+	return settings().direct_writes && !cluster_enabled()
+}
+
+/**
+ * Where each replica of a direct upload is written until it is renamed
+ * into storage.
+ */
+func direct_parts(disks []placement, hash string, algo string) []string {
+	parts := make([]string, len(disks))
+	for i, disk := range disks {
+		parts[i] = filepath.Join(disk.root, ".kfs", "staging", hash+"."+algo+".direct")
+	}
+	return parts
+}
+
+/**
+ * Write the upload to every part at once, and return its digest. The parts
+ * are left for the caller to remove when this fails. The body is hashed as
+ * it streams, unless the algorithm hashes in parallel, which it can only
+ * do from a file, so the first part is hashed once it is written.
+ */
+func direct_receive(ctx context.Context, reader io.Reader, parts []string, algo string) (string, error) {
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	var writers []io.Writer
+	for _, part := range parts {
+		f, err := os.Create(part)
+		if err != nil {
+			return "", err
+		}
+		files = append(files, f)
+		writers = append(writers, f)
+	}
+	var digest string
+	var err error
+	if parallel_hash_algo(algo) {
+		_, err = io.Copy(io.MultiWriter(writers...), &ctx_reader{ctx, reader})
+	} else {
+		digest, err = tee_hash(io.MultiWriter(writers...), &ctx_reader{ctx, reader}, algo, parts[0])
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, f := range files {
+		if err := sync_file(f, FSYNC_PARANOID); err != nil {
+			return "", fmt.Errorf("could not sync '%s': %v", f.Name(), err)
+		}
+		if err := f.Close(); err != nil {
+			return "", fmt.Errorf("could not write '%s': %v", f.Name(), err)
+		}
+	}
+	files = nil
+	if parallel_hash_algo(algo) {
+		return hash_file_ctx(ctx, parts[0], algo)
+	}
+	return digest, nil
+}
+
+/**
+ * Move each replica of a direct upload into storage, then do what
+ * archive_file does once the replicas are written.
+ */
+func direct_archive(parts []string, disks []placement, hash string, algo string, size int64, tracker *progress_tracker) {
+	tracker.set_stage(STAGE_ARCHIVING)
+	stored := ""
+	for i, disk := range disks {
+		dst, err := make_blob_path(disk.root, hash, algo)
+		if err == nil {
+			err = os.Rename(parts[i], dst)
+		}
+		if err == nil {
+			// the body was hashed as it was written, but not read back
+			if err = verify_replica(disk.root, hash, algo, size); err == nil {
+				err = replica_sync(disk.root, hash, algo)
+			}
+			if err != nil {
+				os.Remove(dst)
+			}
+		}
+		if err != nil {
+			log.Printf("failed to store '%s' to '%s': %v", parts[i], disk.root, err)
+			db_add_archive_failure(hash, get_storage_path(disk.root), err)
+			os.Remove(parts[i])
+			if err := db_remove_replica(hash, algo, disk, size); err != nil {
+				log.Printf("could not forget %s on '%s': %v", hash, disk, err)
+			}
+			replicas_trigger()
+			continue
+		}
+		db_replica_stored(hash, algo, disk)
+		log.Printf("stored: '%s' to '%s'\n", parts[i], dst)
+		if stored == "" {
+			stored = dst
+		}
+		tracker.update(func(state *progress_state) {
+			state.ReplicasWritten++
+		})
+	}
+
+	if stored != "" {
+		store_secondary_digests(stored, hash, algo)
+	}
+	emit_event(event{Type: EVENT_BLOB_ARCHIVED, Hash: hash, HashAlgo: algo})
+	entry := catalog_entry{Hash: hash, HashAlgo: algo, Size: size}
+	run_post_hooks(HOOK_POST_ARCHIVE, entry, stored)
+	tracker.set_stage(STAGE_DONE)
+	space_release(hash, algo)
+}
@@ -0,0 +1,252 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+/**
+ * Every local disk is checked before it is used, at startup and when a
+ * reload adds it. A root that does not exist, or that no filesystem is
+ * mounted at, is refused, since that usually means the drive failed to
+ * mount, and blobs would otherwise be written to whatever disk holds the
+ * mount point. Then .kfs/staging and .kfs/storage are created, and a file
+ * identifying the disk is written in .kfs/disk.json if it has none.
+ *
+ * Disks are known by the uuid in that file rather than by where they are
+ * mounted, so a drive that comes back at another path is moved there in
+ * the database, replicas and all, instead of being taken for a new, empty
+ * disk. A path that now holds some other disk loses the replicas recorded
+ * there, since they went with the old disk, and they are kept under
+ * "missing:<uuid>" until that disk is seen again.
+ */
+
+// refuse disks that are not mount points, off for disks that are folders
+var KFS_REQUIRE_MOUNT_POINT = true
+
+const KFS_DIR_MODE = 0755
+
+type disk_identity struct {
+	UUID      string `json:"uuid"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+func disk_identity_path(root string) string {
+	return filepath.Join(root, ".kfs", "disk.json")
+}
+
+func disk_read_identity(root string) (*disk_identity, error) {
+	data, err := os.ReadFile(disk_identity_path(root))
+	if err != nil {
+		return nil, err
+	}
+	var identity disk_identity
+	if err := json.Unmarshal(data, &identity); err != nil {
+		return nil, fmt.Errorf("invalid '%s': %v", disk_identity_path(root), err)
+	}
+	if identity.UUID == "" {
+		return nil, fmt.Errorf("'%s' has no uuid", disk_identity_path(root))
+	}
+	return &identity, nil
+}
+
+/**
+ * Write the identity through a temporary file, so that a crash never
+ * leaves a disk with half of one.
+ */
+func disk_write_identity(root string, identity disk_identity) error {
+	data, err := json.MarshalIndent(identity, "", "    ")
+	if err != nil {
+		return err
+	}
+	path := disk_identity_path(root)
+	if err := os.WriteFile(path+".tmp", append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+/**
+ * Check that the disk can be used, set up its directories, and return its
+ * identity. With require_mount, it has to be a mount point.
+ */
+func disk_prepare(root string, require_mount bool) (*disk_identity, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, fmt.Errorf("disk '%s' is missing: %v", root, err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("disk '%s' is not a directory", root)
+	}
+	if require_mount {
+		mounted, err := disk_is_mount_point(root)
+		if err != nil {
+			return nil, fmt.Errorf("could not check disk '%s': %v", root, err)
+		}
+		if !mounted {
+			return nil, fmt.Errorf("disk '%s' is not a mount point", root)
+		}
+	}
+	for _, dir := range []string{"staging", "storage"} {
+		path := filepath.Join(root, ".kfs", dir)
+		if err := os.MkdirAll(path, KFS_DIR_MODE); err != nil {
+			return nil, fmt.Errorf("could not set up disk '%s': %v", root, err)
+		}
+		// MkdirAll leaves directories that already exist as they are
+		if err := os.Chmod(path, KFS_DIR_MODE); err != nil {
+			return nil, fmt.Errorf("could not set up disk '%s': %v", root, err)
+		}
+	}
+
+	identity, err := disk_read_identity(root)
+	if err == nil {
+		return identity, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	identity = &disk_identity{
+		UUID:      uuid.Must(uuid.NewV4(), nil).String(),
+		CreatedAt: time.Now().Unix(),
+	}
+	if err := disk_write_identity(root, *identity); err != nil {
+		return nil, fmt.Errorf("could not write identity of disk '%s': %v", root, err)
+	}
+	return identity, nil
+}
+
+/**
+ * The root a disk's replicas are kept under while it is not mounted.
+ */
+func disk_missing_root(id string) string {
+	return "missing:" + id
+}
+
+/**
+ * Work out which roots in the database now belong elsewhere, from the uuid
+ * recorded for each root and the uuid found on each configured disk.
+ */
+func disk_moves(known map[string]string, identities map[string]string) (map[string]string, error) {
+	by_uuid := map[string]string{}
+	for root, id := range known {
+		if id != "" {
+			by_uuid[id] = root
+		}
+	}
+	found := map[string]string{}
+	for root, id := range identities {
+		if other, ok := found[id]; ok {
+			return nil, fmt.Errorf("disks '%s' and '%s' are the same disk, %s", root, other, id)
+		}
+		found[id] = root
+	}
+
+	moves := map[string]string{}
+	for root, id := range identities {
+		old, ok := by_uuid[id]
+		if !ok {
+			old = disk_missing_root(id)
+		}
+		if old != root {
+			moves[old] = root
+		}
+	}
+	for root, id := range identities {
+		previous, ok := known[root]
+		if !ok || previous == id {
+			continue
+		}
+		if _, moving := moves[root]; moving {
+			continue
+		}
+		_, elsewhere := by_uuid[id]
+		if previous == "" && !elsewhere {
+			// recorded before disks had a uuid, so this is the same disk
+			continue
+		}
+		if previous == "" {
+			previous = root
+		}
+		moves[root] = disk_missing_root(previous)
+	}
+	return moves, nil
+}
+
+/**
+ * Point every record of the disk at its new root. Each root is first moved
+ * out of the way, so that disks which swapped places do not collide.
+ */
+func db_move_disks(tx *sql.Tx, moves map[string]string) error {
+	var roots []string
+	for old := range moves {
+		roots = append(roots, old)
+	}
+	sort.Strings(roots)
+	for _, old := range roots {
+		if err := db_move_disk(tx, old, "moving:"+old); err != nil {
+			return err
+		}
+	}
+	for _, old := range roots {
+		log.Printf("disk '%s' is now at '%s'", old, moves[old])
+		if err := db_move_disk(tx, "moving:"+old, moves[old]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func db_move_disk(tx *sql.Tx, old string, new string) error {
+	stmts := []string{
+		`update disks set root = ? where node = '' and root = ?`,
+		`update files set storage_root = ? where node = '' and storage_root = ?`,
+		`update or replace disk_health set root = ? where root = ?`,
+		`update archive_intents set root = ? where node = '' and root = ?`,
+		`update multipart_uploads set root = ? where root = ?`,
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt, new, old); err != nil {
+			return fmt.Errorf("could not move disk '%s': %v", old, err)
+		}
+	}
+	_, err := tx.Exec(
+		`
+		update archive_intents
+		set staging_file = ? || substr(staging_file, length(?) + 1)
+		where substr(staging_file, 1, length(?) + 1) = ? || '/'
+		`,
+		new,
+		old,
+		old,
+		old,
+	)
+	if err != nil {
+		return fmt.Errorf("could not move disk '%s': %v", old, err)
+	}
+	return nil
+}
@@ -0,0 +1,465 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+/**
+ * Swapping a dead drive for a new one in the same slot:
+ *
+ *     1. curl -X POST -F root=/mnt/disk2 localhost:8080/admin/disks/fail
+ *     2. unmount the drive, put the new one in, and mount it at /mnt/disk2
+ *     3. curl -X POST -F root=/mnt/disk2 localhost:8080/admin/disks/replace
+ *     4. curl localhost:8080/admin/disks/replace
+ *
+ * Replacing the disk sets up the new drive, takes it as the disk at that
+ * root, back in service, and queues every blob the old drive held to be
+ * copied onto it from the surviving replicas, on this node or another.
+ * Step 4 shows how far that has got.
+ *
+ * If kfs was restarted with the new drive in place, the old drive's
+ * replicas were put aside under "missing:<uuid>", so give the old drive's
+ * uuid as old_uuid for them to be restored.
+ *
+ * Meanwhile replicas_loop may already have copied some of those blobs to
+ * other disks. Those are restored anyway, so that the slot ends up holding
+ * what it did, and the extra replicas are trimmed from the fullest disks.
+ */
+
+const (
+	RESTORE_PENDING  = "pending"
+	RESTORE_RESTORED = "restored"
+	RESTORE_FAILED   = "failed"
+)
+
+const EVENT_DISK_REPLACED = "disk.replaced"
+
+var (
+	KFS_RESTORE_INTERVAL = 10 * time.Minute
+
+	// blobs restored on each pass
+	KFS_RESTORE_BATCH = 100
+)
+
+var disk_restore_wake = make(chan struct{}, 1)
+
+type disk_replacement struct {
+	Root          string     `json:"root"`
+	OldUUID       string     `json:"old_uuid"`
+	NewUUID       string     `json:"new_uuid"`
+	StartedAt     time.Time  `json:"started_at"`
+	FinishedAt    *time.Time `json:"finished_at,omitempty"`
+	Blobs         int        `json:"blobs"`
+	Restored      int        `json:"restored"`
+	Failed        int        `json:"failed"`
+	Pending       int        `json:"pending"`
+	Bytes         int64      `json:"bytes"`
+	RestoredBytes int64      `json:"restored_bytes"`
+}
+
+type disk_restore struct {
+	root string
+	hash string
+	algo string
+	size int64
+}
+
+/**
+ * Take the new disk as the one at root, and queue what the old one held,
+ * recorded under any of the given roots, to be restored onto it.
+ */
+func db_replace_disk(root string, old_uuid string, new_uuid string, sources []string) error {
+	return db_transaction(func(tx *sql.Tx) error {
+		marks := strings.TrimSuffix(strings.Repeat("?, ", len(sources)), ", ")
+		args := []interface{}{root}
+		for _, source := range sources {
+			args = append(args, source)
+		}
+		_, err := tx.Exec(
+			`
+			insert or ignore into disk_restores(root, hash, hash_algo, size, state)
+			select ?, hash, hash_algo, coalesce(max(size), 0), '`+RESTORE_PENDING+`'
+			from files
+			where node = '' and not pending and storage_root in (`+marks+`)
+			group by hash, hash_algo
+			`,
+			args...,
+		)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(
+			`delete from files where node = '' and not pending and storage_root in (`+marks+`)`,
+			args[1:]...,
+		)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`delete from disk_health where root = ?`, root); err != nil {
+			return err
+		}
+		_, err = tx.Exec(
+			`
+			update disks set uuid = ?, failed = 0, available = ?
+			where node = '' and root = ?
+			`,
+			new_uuid,
+			get_disk_space(root),
+			root,
+		)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(
+			`
+			insert or replace into disk_replacements(root, old_uuid, new_uuid, started_at)
+			values(?, ?, ?, ?)
+			`,
+			root,
+			old_uuid,
+			new_uuid,
+			time.Now().Unix(),
+		)
+		return err
+	})
+}
+
+func db_list_disk_restores(limit int) ([]disk_restore, error) {
+	rows, err := db.Query(
+		`
+		select root, hash, hash_algo, size from disk_restores
+		where state = ?
+		order by root, hash
+		limit ?
+		`,
+		RESTORE_PENDING,
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var restores []disk_restore
+	for rows.Next() {
+		var restore disk_restore
+		if err := rows.Scan(&restore.root, &restore.hash, &restore.algo, &restore.size); err != nil {
+			return nil, err
+		}
+		restores = append(restores, restore)
+	}
+	return restores, rows.Err()
+}
+
+func db_finish_disk_restore(restore disk_restore, err error) {
+	state, msg := RESTORE_RESTORED, ""
+	if err != nil {
+		state, msg = RESTORE_FAILED, err.Error()
+	}
+	_, err = db_exec(
+		`
+		update disk_restores set state = ?, error = ?
+		where root = ? and hash = ? and hash_algo = ?
+		`,
+		state,
+		msg,
+		restore.root,
+		restore.hash,
+		restore.algo,
+	)
+	if err != nil {
+		log.Printf("could not record restore of %s to '%s': %v", restore.hash, restore.root, err)
+	}
+}
+
+func db_has_replica(hash string, algo string, disk placement) (bool, error) {
+	var n int
+	err := db.QueryRow(
+		`
+		select count(*) from files
+		where hash = ? and hash_algo = ? and node = ? and storage_root = ?
+		`,
+		hash,
+		algo,
+		disk.node,
+		disk.root,
+	).Scan(&n)
+	return n > 0, err
+}
+
+/**
+ * Copy the blob onto the new disk from a replica on this node, or failing
+ * that, from another node.
+ */
+func disk_restore_blob(restore disk_restore) error {
+	disk := placement{"", restore.root}
+	if ok, err := db_has_replica(restore.hash, restore.algo, disk); err != nil || ok {
+		return err
+	}
+	_, roots, err := db_get_replicas(restore.hash)
+	if err != nil {
+		return err
+	}
+	var have []placement
+	for _, root := range roots {
+		if root != restore.root {
+			have = append(have, placement{"", root})
+		}
+	}
+	ok, err := db_add_replica(restore.hash, restore.algo, disk, restore.size)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("blob is no longer stored")
+	}
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("not enough space on '%s'", restore.root)
+	}
+	if src, ok := replica_source(restore.hash, restore.algo, have); ok {
+		err = store_file(src, restore.hash, restore.algo, restore.root)
+	} else {
+		err = disk_restore_from_cluster(restore)
+	}
+	if err != nil {
+		if err := db_remove_replica(restore.hash, restore.algo, disk, restore.size); err != nil {
+			log.Printf("could not forget replica of %s on '%s': %v", restore.hash, restore.root, err)
+		}
+		return err
+	}
+	db_replica_stored(restore.hash, restore.algo, disk)
+	return nil
+}
+
+func disk_restore_from_cluster(restore disk_restore) error {
+	dst, err := make_blob_path(restore.root, restore.hash, restore.algo)
+	if err != nil {
+		return err
+	}
+	if !repair_from_cluster(restore.hash, restore.algo, dst) {
+		return fmt.Errorf("no surviving replica to restore from")
+	}
+	if err := verify_replica(restore.root, restore.hash, restore.algo, restore.size); err != nil {
+		return err
+	}
+	return replica_sync(restore.root, restore.hash, restore.algo)
+}
+
+/**
+ * Restore the next batch of blobs onto replaced disks, returning how many
+ * were tried.
+ */
+func disk_restore_sync() (int, error) {
+	restores, err := db_list_disk_restores(KFS_RESTORE_BATCH)
+	if err != nil {
+		return 0, err
+	}
+	for _, restore := range restores {
+		err := disk_restore_blob(restore)
+		if err != nil {
+			log.Printf("could not restore %s to '%s': %v", restore.hash, restore.root, err)
+		} else {
+			metric_add("kfs_disk_restored_total", "Blobs restored onto a replaced disk.", fmt.Sprintf("root=%q", restore.root), 1)
+		}
+		db_finish_disk_restore(restore, err)
+	}
+	_, err = db_exec(
+		`
+		update disk_replacements set finished_at = ?
+		where finished_at is null and not exists (
+			select 1 from disk_restores
+			where disk_restores.root = disk_replacements.root and state = ?
+		)
+		`,
+		time.Now().Unix(),
+		RESTORE_PENDING,
+	)
+	return len(restores), err
+}
+
+func disk_restore_loop() {
+	for {
+		n, err := disk_restore_sync()
+		if err != nil {
+			log.Printf("could not restore replaced disks: %v", err)
+		}
+		if n == KFS_RESTORE_BATCH && err == nil {
+			continue
+		}
+		select {
+		case <-disk_restore_wake:
+		case <-time.After(KFS_RESTORE_INTERVAL):
+		}
+	}
+}
+
+func disk_restore_trigger() {
+	select {
+	case disk_restore_wake <- struct{}{}:
+	default:
+	}
+}
+
+func db_list_disk_replacements(root string) ([]disk_replacement, error) {
+	rows, err := db.Query(
+		`
+		select
+			disk_replacements.root,
+			old_uuid,
+			new_uuid,
+			started_at,
+			finished_at,
+			count(disk_restores.hash),
+			coalesce(sum(state = ?), 0),
+			coalesce(sum(state = ?), 0),
+			coalesce(sum(state = ?), 0),
+			coalesce(sum(size), 0),
+			coalesce(sum(case when state = ? then size else 0 end), 0)
+		from disk_replacements
+		left join disk_restores on disk_restores.root = disk_replacements.root
+		where ? = '' or disk_replacements.root = ?
+		group by disk_replacements.root
+		order by disk_replacements.root
+		`,
+		RESTORE_RESTORED,
+		RESTORE_FAILED,
+		RESTORE_PENDING,
+		RESTORE_RESTORED,
+		root,
+		root,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	replacements := []disk_replacement{}
+	for rows.Next() {
+		var r disk_replacement
+		var started_at int64
+		var finished_at sql.NullInt64
+		err := rows.Scan(
+			&r.Root,
+			&r.OldUUID,
+			&r.NewUUID,
+			&started_at,
+			&finished_at,
+			&r.Blobs,
+			&r.Restored,
+			&r.Failed,
+			&r.Pending,
+			&r.Bytes,
+			&r.RestoredBytes,
+		)
+		if err != nil {
+			return nil, err
+		}
+		r.StartedAt = time.Unix(started_at, 0)
+		if finished_at.Valid {
+			t := time.Unix(finished_at.Int64, 0)
+			r.FinishedAt = &t
+		}
+		replacements = append(replacements, r)
+	}
+	return replacements, rows.Err()
+}
+
+/**
+ * Take the drive now mounted at root as the replacement for the one that
+ * was there, and start restoring what it held.
+ */
+func handle_disk_replace(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	root := request.FormValue("root")
+	old_uuid := request.FormValue("old_uuid")
+	var current string
+	err := db.QueryRow(`select uuid from disks where node = '' and root = ?`, root).Scan(&current)
+	if err == sql.ErrNoRows {
+		write_error(writer, "no such disk", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("could not look up disk '%s': %v", root, err)
+		write_error(writer, "could not look up disk", http.StatusInternalServerError)
+		return
+	}
+	identity, err := disk_prepare(root, settings().require_mount_point)
+	if err != nil {
+		write_error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var sources []string
+	if current != identity.UUID {
+		sources = append(sources, root)
+	}
+	if old_uuid != "" && old_uuid != current {
+		sources = append(sources, disk_missing_root(old_uuid))
+	}
+	if len(sources) == 0 {
+		write_error(
+			writer,
+			fmt.Sprintf("the disk at '%s' has not been replaced; give old_uuid if kfs was restarted since", root),
+			http.StatusConflict,
+		)
+		return
+	}
+	if old_uuid == identity.UUID {
+		write_error(writer, "old_uuid is the disk now mounted", http.StatusBadRequest)
+		return
+	}
+	if old_uuid == "" {
+		old_uuid = current
+	}
+
+	if err := db_replace_disk(root, old_uuid, identity.UUID, sources); err != nil {
+		log.Printf("could not replace disk '%s': %v", root, err)
+		write_error(writer, "could not replace disk", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("disk '%s' replaced: %s is now %s", root, old_uuid, identity.UUID)
+	emit_event(event{Type: EVENT_DISK_REPLACED, Root: root})
+	disk_restore_trigger()
+	replacements, err := db_list_disk_replacements(root)
+	if err != nil || len(replacements) != 1 {
+		log.Printf("could not list replacement of '%s': %v", root, err)
+		write_error(writer, "could not report replacement", http.StatusInternalServerError)
+		return
+	}
+	write_json(writer, http.StatusOK, replacements[0])
+}
+
+/**
+ * How far restoring each replaced disk has got, e.g.
+ *     curl localhost:8080/admin/disks/replace?root=/mnt/disk2
+ */
+func handle_disk_replacements(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	replacements, err := db_list_disk_replacements(request.URL.Query().Get("root"))
+	if err != nil {
+		log.Printf("could not list disk replacements: %v", err)
+		write_error(writer, "could not list disk replacements", http.StatusInternalServerError)
+		return
+	}
+	write_json(writer, http.StatusOK, replacements)
+}
@@ -0,0 +1,70 @@
+//go:build !windows
+// +build !windows
+
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+/**
+ * The size of the filesystem that path is on, and how much of it is
+ * available to kfs, in bytes.
+ */
+func disk_statfs(path string) (uint64, uint64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return 0, 0, err
+	}
+	return stat.Blocks * uint64(stat.Bsize), stat.Bavail * uint64(stat.Bsize), nil
+}
+
+/**
+ * How many names the file at path has.
+ */
+func disk_link_count(path string) (uint64, error) {
+	var stat unix.Stat_t
+	if err := unix.Stat(path, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Nlink), nil
+}
+
+/**
+ * Whether a filesystem is mounted at path, which is on a different device
+ * than its parent unless it is the root.
+ */
+func disk_is_mount_point(path string) (bool, error) {
+	path = filepath.Clean(path)
+	parent := filepath.Dir(path)
+	if parent == path {
+		return true, nil
+	}
+	var stat, parent_stat unix.Stat_t
+	if err := unix.Stat(path, &stat); err != nil {
+		return false, err
+	}
+	if err := unix.Stat(parent, &parent_stat); err != nil {
+		return false, err
+	}
+	return stat.Dev != parent_stat.Dev, nil
+}
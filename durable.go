@@ -0,0 +1,98 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+/**
+ * Uploads made with ?durable=true are not answered until every replica is
+ * written and synced to disk, for clients that delete their copy as soon
+ * as an upload succeeds. An upload that cannot be made durable is answered
+ * with 503 and the not_durable code. Its catalog entry is kept and its
+ * missing replicas are still written by recovery, but the client should
+ * keep its copy until /upload/<id>/status says it is durable.
+ *
+ * Replicas on other nodes are only as durable as the peer that wrote them
+ * makes them.
+ */
+
+// make every upload durable, as if it were made with ?durable=true
+var KFS_DURABLE_UPLOADS = false
+
+// how long a durable upload of a blob that is still being archived waits
+var KFS_DURABLE_WAIT = 10 * time.Minute
+
+func db_count_blob_replicas(hash string, algo string) (stored int, pending int, err error) {
+	query := `
+		select
+			coalesce(sum(not pending), 0),
+			coalesce(sum(pending), 0)
+		from files
+		where hash = ? and hash_algo = ?
+	`
+	err = db.QueryRow(query, hash, algo).Scan(&stored, &pending)
+	return stored, pending, err
+}
+
+/**
+ * Make sure at least the given number of replicas of the blob are written,
+ * waiting up to wait for the ones still being written, then sync the ones
+ * on this node.
+ */
+func durable_sync(ctx context.Context, hash string, algo string, replicas int, wait time.Duration) error {
+	deadline := time.Now().Add(wait)
+	for {
+		stored, pending, err := db_count_blob_replicas(hash, algo)
+		if err != nil {
+			return err
+		}
+		if pending == 0 && stored >= replicas {
+			break
+		}
+		if pending == 0 || time.Now().After(deadline) {
+			return fmt.Errorf("only %d of %d replicas are written", stored, replicas)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	_, roots, err := db_get_replicas(hash)
+	if err != nil {
+		return err
+	}
+	for _, root := range roots {
+		if err := blob_sync(root, hash, algo); err != nil {
+			return fmt.Errorf("could not sync replica on '%s': %v", root, err)
+		}
+	}
+	return nil
+}
+
+func write_not_durable(writer http.ResponseWriter, tracker *progress_tracker, err error) {
+	msg := fmt.Sprintf("upload %s is not durable: %v", tracker.upload_id(), err)
+	log.Println(msg)
+	write_error_code(writer, msg, http.StatusServiceUnavailable, API_NOT_DURABLE)
+}
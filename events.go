@@ -0,0 +1,129 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+/**
+ * Storage events, published to every configured event sink so that other
+ * systems can react to new content without polling kfs.
+ */
+
+const (
+	EVENT_BLOB_ARCHIVED   = "blob.archived"
+	EVENT_ARCHIVE_FAILED  = "archive.failed"
+	EVENT_REPLICA_REPAIR  = "replica.repaired"
+	EVENT_CATALOG_ADDED   = "catalog.added"
+	EVENT_CATALOG_UPDATED = "catalog.updated"
+	EVENT_BLOB_COLLECTED  = "blob.collected"
+	EVENT_CATALOG_PURGED  = "catalog.purged"
+)
+
+type event struct {
+	Type     string         `json:"type"`
+	Time     int64          `json:"time"`
+	Node     string         `json:"node"`
+	Hash     string         `json:"hash"`
+	HashAlgo string         `json:"hash_algo,omitempty"`
+	Root     string         `json:"root,omitempty"`
+	Error    string         `json:"error,omitempty"`
+	Catalog  *catalog_entry `json:"catalog,omitempty"`
+	Backup   *backup_report `json:"backup,omitempty"`
+}
+
+/**
+ * Somewhere events are published to, e.g. a NATS subject or a Kafka topic.
+ * Each sink is fed from its own queue, so a slow or unreachable sink holds
+ * up neither uploads nor the other sinks.
+ */
+type event_sink interface {
+	name() string
+	publish(e event, payload []byte) error
+}
+
+// the sinks to publish to, e.g. &nats_sink{addr: "localhost:4222", subject: "kfs"},
+// event_sinks in the config
+var KFS_EVENT_SINKS = []event_sink{}
+
+var KFS_EVENT_QUEUE_SIZE = 1024
+
+var event_queues []chan event
+
+func events_init() {
+	for _, sink := range KFS_EVENT_SINKS {
+		queue := make(chan event, KFS_EVENT_QUEUE_SIZE)
+		event_queues = append(event_queues, queue)
+		go event_worker(sink, queue)
+	}
+}
+
+func event_worker(sink event_sink, queue chan event) {
+	labels := fmt.Sprintf("sink=%q", sink.name())
+	for e := range queue {
+		payload, err := json.Marshal(e)
+		if err != nil {
+			log.Printf("could not encode %s event: %v", e.Type, err)
+			continue
+		}
+		if err := sink.publish(e, payload); err != nil {
+			log.Printf("could not publish %s event to %s: %v", e.Type, sink.name(), err)
+			metric_add(
+				"kfs_event_failures_total",
+				"Events that could not be published to the sink.",
+				labels,
+				1,
+			)
+			continue
+		}
+		metric_add(
+			"kfs_events_published_total",
+			"Events published to the sink.",
+			labels,
+			1,
+		)
+	}
+}
+
+/**
+ * Queue the event for every sink. Events are dropped, rather than waited
+ * on, when a sink's queue is full.
+ */
+func emit_event(e event) {
+	if len(event_queues) == 0 {
+		return
+	}
+	e.Time = time.Now().Unix()
+	e.Node = KFS_NODE_NAME
+	for i, queue := range event_queues {
+		select {
+		case queue <- e:
+		default:
+			metric_add(
+				"kfs_events_dropped_total",
+				"Events dropped because the sink's queue was full.",
+				fmt.Sprintf("sink=%q", KFS_EVENT_SINKS[i].name()),
+				1,
+			)
+		}
+	}
+}
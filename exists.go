@@ -0,0 +1,97 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+/**
+ * Every hash the server holds, keyed by "algo:hash", covering both primary
+ * hashes and secondary digests. Sync clients probe for hundreds of thousands
+ * of hashes, and this answers each probe without touching sqlite. A hash is
+ * only added once a replica of it is written, not when space is reserved
+ * for it, so that nothing is deduplicated against data that may never
+ * arrive.
+ */
+var (
+	known_mutex  = &sync.RWMutex{}
+	known_hashes = map[string]struct{}{}
+)
+
+func known_key(hash string, algo string) string {
+	return algo + ":" + hash
+}
+
+func known_hash_add(hash string, algo string) {
+	known_mutex.Lock()
+	known_hashes[known_key(hash, algo)] = struct{}{}
+	known_mutex.Unlock()
+}
+
+func known_hash_remove(hash string, algo string) {
+	known_mutex.Lock()
+	delete(known_hashes, known_key(hash, algo))
+	known_mutex.Unlock()
+}
+
+func known_hash_has(hash string, algo string) bool {
+	known_mutex.RLock()
+	_, ok := known_hashes[known_key(hash, algo)]
+	known_mutex.RUnlock()
+	return ok
+}
+
+func known_hashes_load() {
+	// blobs with no records are those claimed for content on other nodes
+	query := `
+		select distinct hash, hash_algo from files where not pending
+		union
+		select hash, hash_algo from blobs b
+		where not exists (
+			select 1 from files f
+			where f.hash = b.hash and f.hash_algo = b.hash_algo
+		)
+		union
+		select digest, algo from digests
+	`
+	rows, err := db.Query(query)
+	if err != nil {
+		panic(fmt.Errorf("could not load known hashes: %v", err))
+	}
+	defer rows.Close()
+
+	known := map[string]struct{}{}
+	for rows.Next() {
+		var hash, algo string
+		if err := rows.Scan(&hash, &algo); err != nil {
+			panic(fmt.Errorf("could not load known hashes: %v", err))
+		}
+		known[known_key(hash, algo)] = struct{}{}
+	}
+	if err := rows.Err(); err != nil {
+		panic(fmt.Errorf("could not load known hashes: %v", err))
+	}
+
+	known_mutex.Lock()
+	known_hashes = known
+	known_mutex.Unlock()
+	log.Printf("loaded %d known hashes", len(known))
+}
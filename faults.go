@@ -0,0 +1,167 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+/**
+ * Fault injection, so that the recovery, retry and repair code can be
+ * exercised on a test server before a real disk misbehaves. Nothing is
+ * injected unless the config has a faults section, e.g.
+ *     "faults": {
+ *         "slow_disk": {"rate": 1, "delay_ms": 500, "disks": ["/mnt/disk2"]},
+ *         "copy_error": {"rate": 0.1},
+ *         "hash_corrupt": {"rate": 0.05, "disks": ["/mnt/disk3"]},
+ *         "db_busy": {"rate": 0.2}
+ *     }
+ * Never turn this on for data you care about.
+ */
+
+const (
+	// reads and writes of blobs stall for delay_ms first
+	FAULT_SLOW_DISK = "slow_disk"
+
+	// copies of blobs between disks fail
+	FAULT_COPY_ERROR = "copy_error"
+
+	// the hash tool reports the wrong digest for a file
+	FAULT_HASH_CORRUPT = "hash_corrupt"
+
+	// database writes find sqlite busy, and are retried
+	FAULT_DB_BUSY = "db_busy"
+)
+
+type fault_spec struct {
+	// the share of operations that fail, from 0 for none to 1 for all
+	Rate float64 `json:"rate"`
+
+	// only for files on these disks, or on any disk when empty
+	Disks []string `json:"disks"`
+
+	DelayMs int `json:"delay_ms"`
+}
+
+var fault_names = map[string]bool{
+	FAULT_SLOW_DISK:    true,
+	FAULT_COPY_ERROR:   true,
+	FAULT_HASH_CORRUPT: true,
+	FAULT_DB_BUSY:      true,
+}
+
+var (
+	KFS_FAULTS  = map[string]fault_spec{}
+	fault_mutex sync.Mutex
+	fault_rand  = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+func faults_set(faults map[string]fault_spec) {
+	fault_mutex.Lock()
+	defer fault_mutex.Unlock()
+	KFS_FAULTS = faults
+	for name, spec := range faults {
+		log.Printf("injecting %s faults at rate %g", name, spec.Rate)
+	}
+}
+
+/**
+ * Whether to inject the fault into an operation on the file, which is ""
+ * for operations that are not on a file.
+ */
+func fault_hit(name string, filename string) (fault_spec, bool) {
+	fault_mutex.Lock()
+	defer fault_mutex.Unlock()
+	spec, ok := KFS_FAULTS[name]
+	if !ok || spec.Rate <= 0 {
+		return spec, false
+	}
+	if len(spec.Disks) > 0 {
+		on_disk := false
+		for _, disk := range spec.Disks {
+			root := filepath.Clean(disk)
+			if filename == root || strings.HasPrefix(filename, root+"/") {
+				on_disk = true
+				break
+			}
+		}
+		if !on_disk {
+			return spec, false
+		}
+	}
+	if fault_rand.Float64() >= spec.Rate {
+		return spec, false
+	}
+	metric_add(
+		"kfs_faults_injected_total",
+		"Faults injected, by kind.",
+		fmt.Sprintf("fault=%q", name),
+		1,
+	)
+	return spec, true
+}
+
+/**
+ * Stall an operation on the file, when the disk it is on is made slow.
+ */
+func fault_delay(filename string) {
+	spec, ok := fault_hit(FAULT_SLOW_DISK, filename)
+	if !ok {
+		return
+	}
+	log_debug("injecting %dms delay for '%s'", spec.DelayMs, filename)
+	time.Sleep(time.Duration(spec.DelayMs) * time.Millisecond)
+}
+
+/**
+ * An error for an operation on the file, when the fault is injected there.
+ */
+func fault_error(name string, filename string) error {
+	if _, ok := fault_hit(name, filename); !ok {
+		return nil
+	}
+	log.Printf("injecting %s fault for '%s'", name, filename)
+	if name == FAULT_DB_BUSY {
+		return sqlite3.Error{Code: sqlite3.ErrBusy}
+	}
+	return fmt.Errorf("injected %s fault", name)
+}
+
+/**
+ * The digest the hash tool reports, which is wrong when the file is made
+ * to look corrupt.
+ */
+func fault_digest(filename string, digest string) string {
+	if _, ok := fault_hit(FAULT_HASH_CORRUPT, filename); !ok || digest == "" {
+		return digest
+	}
+	log.Printf("injecting %s fault for '%s'", FAULT_HASH_CORRUPT, filename)
+	flipped := "0"
+	if digest[0] == '0' {
+		flipped = "1"
+	}
+	return flipped + digest[1:]
+}
@@ -0,0 +1,174 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+/**
+ * Filters that keep files such as node_modules, caches and temp files out
+ * of syncs, so they take neither space nor redundancy on the disks. Rules
+ * are written as lines of a .gitignore:
+ *     node_modules/
+ *     *.tmp
+ *     !keep.tmp
+ *     /home/kyle/.cache/
+ *     target/**
+ * A pattern without a slash matches a file or directory of that name at
+ * any depth, and one with a slash matches from the start of the path. A
+ * trailing slash matches only directories, and a leading ! includes again
+ * what an earlier rule excluded. The last rule to match wins, and nothing
+ * under an excluded directory can be included again.
+ *
+ * The rules for a namespace come from KFS_SYNC_FILTERS, with those for "*"
+ * applying to every namespace, followed by any the sync itself gives.
+ */
+
+// e.g. "laptop": {"node_modules/", "*.tmp"}
+var KFS_SYNC_FILTERS = map[string][]string{}
+
+type filter_rule struct {
+	pattern  *regexp.Regexp
+	negate   bool
+	dir_only bool
+	anchored bool
+}
+
+/**
+ * Translate the glob into a regular expression, where * and ? do not match
+ * a slash, and ** matches across directories.
+ */
+func glob_to_regexp(glob string) (*regexp.Regexp, error) {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case strings.HasPrefix(glob[i:], "**/"):
+			expr.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "/**") && i+3 == len(glob):
+			expr.WriteString("(/.*)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			expr.WriteString(".*")
+			i++
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated '[' in '%s'", glob)
+			}
+			class := glob[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + class + "]")
+			i += end
+		case c == '\\' && i+1 < len(glob):
+			i++
+			expr.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.Compile(expr.String())
+}
+
+func parse_filter_rules(lines []string) ([]filter_rule, error) {
+	var rules []filter_rule
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var rule filter_rule
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dir_only = true
+			line = strings.TrimRight(line, "/")
+		}
+		rule.anchored = strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+		if line == "" {
+			continue
+		}
+		pattern, err := glob_to_regexp(line)
+		if err != nil {
+			return nil, err
+		}
+		rule.pattern = pattern
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+/**
+ * The rules for a sync to the namespace, with the sync's own rules last.
+ */
+func sync_filter_rules(namespace string, extra []string) ([]filter_rule, error) {
+	var lines []string
+	filters := settings().sync_filters
+	lines = append(lines, filters["*"]...)
+	lines = append(lines, filters[namespace]...)
+	lines = append(lines, extra...)
+	return parse_filter_rules(lines)
+}
+
+func filter_match(rules []filter_rule, name string, is_dir bool) bool {
+	excluded := false
+	for _, rule := range rules {
+		if rule.dir_only && !is_dir {
+			continue
+		}
+		target := name
+		if !rule.anchored {
+			target = path.Base(name)
+		}
+		if rule.pattern.MatchString(target) {
+			excluded = !rule.negate
+		}
+	}
+	return excluded
+}
+
+/**
+ * Whether the rules keep the file at full_path out.
+ */
+func filter_excluded(rules []filter_rule, full_path string) bool {
+	if len(rules) == 0 {
+		return false
+	}
+	parts := strings.Split(strings.Trim(path.Clean("/"+full_path), "/"), "/")
+	for i := 1; i < len(parts); i++ {
+		if filter_match(rules, strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+	return filter_match(rules, strings.Join(parts, "/"), false)
+}
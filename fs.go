@@ -0,0 +1,409 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+/**
+ * Disks on ZFS or btrfs, which checksum every block themselves. A read of a
+ * block that rotted fails rather than returning the bad data, and a scrub
+ * finds rot in blocks nobody has read. With fs_integration on, kfs reads
+ * the result of the last scrub of each such disk, and while it is recent
+ * and found no damage it does not hash replicas after writing them, nor
+ * before sending them for ?verify=true, leaving that to the filesystem. A
+ * download is still hashed as it streams. A scrub that finds damage it
+ * could not repair raises a disk.warning event, and kfs goes back to
+ * hashing the disk's replicas itself.
+ *
+ * With fs_snapshots_keep set, kfs also snapshots the dataset, or the
+ * subvolume at the root for btrfs, once a day, keeping that many, so the
+ * blob store can be rolled back to a point in time. Blobs removed by GC or
+ * retention only give their space back once every snapshot holding them
+ * has been pruned.
+ */
+
+const (
+	FS_ZFS   = "zfs"
+	FS_BTRFS = "btrfs"
+)
+
+var (
+	KFS_FS_INTEGRATION = false
+
+	// snapshots kept of each disk, 0 to take none
+	KFS_FS_SNAPSHOTS_KEEP = 0
+
+	KFS_FS_INTERVAL          = time.Hour
+	KFS_FS_SNAPSHOT_INTERVAL = 24 * time.Hour
+	KFS_FS_TIMEOUT           = time.Minute
+
+	// how old the last clean scrub may be for kfs to rely on it
+	KFS_FS_SCRUB_MAX_AGE = 35 * 24 * time.Hour
+
+	KFS_ZFS   = "zfs"
+	KFS_ZPOOL = "zpool"
+	KFS_BTRFS = "btrfs"
+)
+
+const (
+	FS_SNAPSHOT_PREFIX = "kfs-"
+	FS_SNAPSHOT_FORMAT = "20060102T150405Z"
+
+	// where btrfs snapshots of a root are kept, inside the root
+	FS_BTRFS_SNAPSHOT_DIR = ".kfs-snapshots"
+)
+
+type fs_disk_status struct {
+	Root         string     `json:"root"`
+	Filesystem   string     `json:"filesystem,omitempty"`
+	Dataset      string     `json:"dataset,omitempty"`
+	ScrubbedAt   *time.Time `json:"scrubbed_at,omitempty"`
+	ScrubErrors  int64      `json:"scrub_errors"`
+	Trusted      bool       `json:"trusted"`
+	LastSnapshot string     `json:"last_snapshot,omitempty"`
+	Snapshots    int        `json:"snapshots"`
+	CheckedAt    time.Time  `json:"checked_at"`
+	Error        string     `json:"error,omitempty"`
+}
+
+var (
+	fs_mutex    sync.Mutex
+	fs_statuses = map[string]fs_disk_status{}
+)
+
+/**
+ * Whether the disk's own checksums can stand in for kfs hashing its
+ * replicas.
+ */
+func fs_trusts_checksums(root string) bool {
+	if !settings().fs_integration {
+		return false
+	}
+	fs_mutex.Lock()
+	defer fs_mutex.Unlock()
+	return fs_statuses[root].Trusted
+}
+
+/**
+ * What was last found of the filesystem under the disk, if it was checked.
+ */
+func fs_status(root string) (fs_disk_status, bool) {
+	fs_mutex.Lock()
+	defer fs_mutex.Unlock()
+	status, ok := fs_statuses[root]
+	return status, ok
+}
+
+func fs_run(name string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), KFS_FS_TIMEOUT)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return string(output), nil
+}
+
+var (
+	zpool_scrub_re  = regexp.MustCompile(`scan: scrub repaired .* with (\d+) errors on (.+)$`)
+	zpool_errors_re = regexp.MustCompile(`^errors: (\d+) data errors`)
+)
+
+/**
+ * When the pool was last scrubbed, if it has finished a scrub, and how
+ * many blocks it holds that are damaged beyond repair, from the output of
+ * zpool status.
+ */
+func zpool_parse_status(output string) (*time.Time, int64, error) {
+	var scrubbed_at *time.Time
+	var errors int64
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if m := zpool_scrub_re.FindStringSubmatch(line); m != nil {
+			t, err := time.ParseInLocation("Mon Jan _2 15:04:05 2006", strings.TrimSpace(m[2]), time.Local)
+			if err != nil {
+				return nil, 0, fmt.Errorf("could not parse scrub time: %v", err)
+			}
+			scrubbed_at = &t
+			n, _ := strconv.ParseInt(m[1], 10, 64)
+			errors += n
+		}
+		if m := zpool_errors_re.FindStringSubmatch(line); m != nil {
+			n, _ := strconv.ParseInt(m[1], 10, 64)
+			errors += n
+		}
+	}
+	return scrubbed_at, errors, scanner.Err()
+}
+
+var (
+	btrfs_started_re = regexp.MustCompile(`(?i)^scrub started:\s+(.+)$`)
+	btrfs_status_re  = regexp.MustCompile(`(?i)^status:\s+(\S+)`)
+	btrfs_old_re     = regexp.MustCompile(`scrub started at (.+) and finished after`)
+	btrfs_errors_re  = regexp.MustCompile(`^uncorrectable_errors: (\d+)`)
+)
+
+/**
+ * The same, from the output of btrfs scrub status -R, as printed by
+ * btrfs-progs both before and after 5.x.
+ */
+func btrfs_parse_scrub(output string) (*time.Time, int64, error) {
+	var started string
+	finished := false
+	var errors int64
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if m := btrfs_started_re.FindStringSubmatch(line); m != nil {
+			started = m[1]
+		}
+		if m := btrfs_status_re.FindStringSubmatch(line); m != nil {
+			finished = strings.EqualFold(m[1], "finished")
+		}
+		if m := btrfs_old_re.FindStringSubmatch(line); m != nil {
+			started, finished = m[1], true
+		}
+		if m := btrfs_errors_re.FindStringSubmatch(line); m != nil {
+			n, _ := strconv.ParseInt(m[1], 10, 64)
+			errors += n
+		}
+	}
+	if err := scanner.Err(); err != nil || started == "" || !finished {
+		return nil, errors, err
+	}
+	t, err := time.ParseInLocation("Mon Jan _2 15:04:05 2006", strings.TrimSpace(started), time.Local)
+	if err != nil {
+		return nil, errors, fmt.Errorf("could not parse scrub time: %v", err)
+	}
+	return &t, errors, nil
+}
+
+/**
+ * Read the last scrub of the filesystem root is on.
+ */
+func fs_read_scrub(status *fs_disk_status) error {
+	var output string
+	var err error
+	switch status.Filesystem {
+	case FS_ZFS:
+		pool := strings.SplitN(status.Dataset, "/", 2)[0]
+		if output, err = fs_run(KFS_ZPOOL, "status", "-p", pool); err != nil {
+			return err
+		}
+		status.ScrubbedAt, status.ScrubErrors, err = zpool_parse_status(output)
+	case FS_BTRFS:
+		if output, err = fs_run(KFS_BTRFS, "scrub", "status", "-R", status.Root); err != nil {
+			return err
+		}
+		status.ScrubbedAt, status.ScrubErrors, err = btrfs_parse_scrub(output)
+	}
+	return err
+}
+
+/**
+ * The snapshots kfs took of the disk, oldest first, named so that they
+ * sort by when they were taken.
+ */
+func fs_list_snapshots(status fs_disk_status) ([]string, error) {
+	var names []string
+	switch status.Filesystem {
+	case FS_ZFS:
+		output, err := fs_run(KFS_ZFS, "list", "-H", "-t", "snapshot", "-o", "name", "-d", "1", status.Dataset)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(output, "\n") {
+			if strings.HasPrefix(line, status.Dataset+"@"+FS_SNAPSHOT_PREFIX) {
+				names = append(names, line)
+			}
+		}
+	case FS_BTRFS:
+		entries, err := os.ReadDir(filepath.Join(status.Root, FS_BTRFS_SNAPSHOT_DIR))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), FS_SNAPSHOT_PREFIX) {
+				names = append(names, filepath.Join(status.Root, FS_BTRFS_SNAPSHOT_DIR, entry.Name()))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func fs_snapshot_time(name string) (time.Time, error) {
+	i := strings.LastIndex(name, FS_SNAPSHOT_PREFIX)
+	if i < 0 {
+		return time.Time{}, fmt.Errorf("'%s' is not a kfs snapshot", name)
+	}
+	return time.Parse(FS_SNAPSHOT_FORMAT, name[i+len(FS_SNAPSHOT_PREFIX):])
+}
+
+/**
+ * Take a snapshot of the disk if the last one is old enough, then prune
+ * all but the newest fs_snapshots_keep.
+ */
+func fs_snapshot(status *fs_disk_status) error {
+	keep := settings().fs_snapshots_keep
+	names, err := fs_list_snapshots(*status)
+	if err != nil {
+		return err
+	}
+	due := len(names) == 0
+	if !due {
+		last, err := fs_snapshot_time(names[len(names)-1])
+		due = err != nil || time.Since(last) >= KFS_FS_SNAPSHOT_INTERVAL
+	}
+	if due {
+		name := FS_SNAPSHOT_PREFIX + time.Now().UTC().Format(FS_SNAPSHOT_FORMAT)
+		switch status.Filesystem {
+		case FS_ZFS:
+			name = status.Dataset + "@" + name
+			_, err = fs_run(KFS_ZFS, "snapshot", name)
+		case FS_BTRFS:
+			dir := filepath.Join(status.Root, FS_BTRFS_SNAPSHOT_DIR)
+			if err = os.MkdirAll(dir, KFS_DIR_MODE); err == nil {
+				name = filepath.Join(dir, name)
+				_, err = fs_run(KFS_BTRFS, "subvolume", "snapshot", "-r", status.Root, name)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		log.Printf("took snapshot '%s'", name)
+		names = append(names, name)
+	}
+	for len(names) > keep {
+		switch status.Filesystem {
+		case FS_ZFS:
+			_, err = fs_run(KFS_ZFS, "destroy", names[0])
+		case FS_BTRFS:
+			_, err = fs_run(KFS_BTRFS, "subvolume", "delete", names[0])
+		}
+		if err != nil {
+			return err
+		}
+		log.Printf("pruned snapshot '%s'", names[0])
+		names = names[1:]
+	}
+	status.Snapshots = len(names)
+	if len(names) > 0 {
+		status.LastSnapshot = names[len(names)-1]
+	}
+	return nil
+}
+
+/**
+ * Find out what the disk is on, how its last scrub went, and take a
+ * snapshot of it if one is due.
+ */
+func fs_check_disk(root string) fs_disk_status {
+	status := fs_disk_status{Root: root, CheckedAt: time.Now()}
+	fs, err := fs_type(root)
+	if err != nil || fs == "" {
+		if err != nil {
+			status.Error = err.Error()
+		}
+		return status
+	}
+	status.Filesystem = fs
+	if fs == FS_ZFS {
+		output, err := fs_run(KFS_ZFS, "list", "-H", "-o", "name", root)
+		if err != nil {
+			status.Error = err.Error()
+			return status
+		}
+		status.Dataset = strings.TrimSpace(output)
+	}
+	if err := fs_read_scrub(&status); err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	labels := fmt.Sprintf("root=%q", root)
+	metric_set("kfs_fs_scrub_errors", "Damage the last filesystem scrub of the disk could not repair.", labels, float64(status.ScrubErrors))
+	if status.ScrubErrors > 0 {
+		msg := fmt.Sprintf("%s scrub found %d errors it could not repair", fs, status.ScrubErrors)
+		log.Printf("disk '%s': %s", root, msg)
+		emit_event(event{Type: EVENT_DISK_WARNING, Root: root, Error: msg})
+	}
+	status.Trusted = status.ScrubbedAt != nil &&
+		status.ScrubErrors == 0 &&
+		time.Since(*status.ScrubbedAt) < KFS_FS_SCRUB_MAX_AGE
+	if settings().fs_snapshots_keep > 0 {
+		if err := fs_snapshot(&status); err != nil {
+			log.Printf("could not snapshot disk '%s': %v", root, err)
+			status.Error = err.Error()
+		}
+	}
+	return status
+}
+
+func fs_check() {
+	statuses := map[string]fs_disk_status{}
+	for _, root := range settings().disks {
+		statuses[root] = fs_check_disk(root)
+	}
+	fs_mutex.Lock()
+	fs_statuses = statuses
+	fs_mutex.Unlock()
+}
+
+func fs_loop() {
+	for {
+		if settings().fs_integration {
+			fs_check()
+		}
+		time.Sleep(KFS_FS_INTERVAL)
+	}
+}
+
+/**
+ * What kfs knows of the filesystem under each disk, e.g.
+ *     curl localhost:8080/admin/disks/filesystems
+ */
+func handle_fs_status(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	fs_mutex.Lock()
+	statuses := []fs_disk_status{}
+	for _, status := range fs_statuses {
+		statuses = append(statuses, status)
+	}
+	fs_mutex.Unlock()
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Root < statuses[j].Root
+	})
+	write_json(writer, http.StatusOK, statuses)
+}
@@ -0,0 +1,42 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// not in x/sys, since ZFS is not part of the kernel
+const ZFS_SUPER_MAGIC = 0x2fc12fc1
+
+/**
+ * The checksumming filesystem root is on, from the magic number statfs
+ * gives, or "" for any other.
+ */
+func fs_type(root string) (string, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(root, &stat); err != nil {
+		return "", err
+	}
+	// the type is signed and 32 bits wide on some architectures
+	switch uint32(stat.Type) {
+	case ZFS_SUPER_MAGIC:
+		return FS_ZFS, nil
+	case unix.BTRFS_SUPER_MAGIC:
+		return FS_BTRFS, nil
+	}
+	return "", nil
+}
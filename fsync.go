@@ -0,0 +1,154 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/**
+ * How hard kfs works to get what it writes onto the platters, set with the
+ * fsync config key:
+ *
+ *     fast      Nothing is synced, and sqlite runs with synchronous=OFF.
+ *               Survives kfs crashing or being killed, since the kernel
+ *               still has every write. A power loss or kernel panic can
+ *               lose replicas written in the last few seconds, including
+ *               ones the database says are stored, and can corrupt the
+ *               database.
+ *
+ *     normal    Each replica, and the directories leading to it, is synced
+ *               before the database records it as stored, and sqlite runs
+ *               with synchronous=NORMAL. A power loss cannot leave the
+ *               database pointing at a replica that is not there, but can
+ *               lose uploads that were answered while still in staging,
+ *               and the last catalog changes before it.
+ *
+ *     paranoid  As normal, and the staged copy of each upload is synced,
+ *               along with the staging directory, before the upload is
+ *               answered, and sqlite runs with synchronous=FULL. An upload
+ *               that was answered survives a power loss, and is archived
+ *               by recovery if it had not been yet.
+ *
+ * ?durable=true makes a single upload wait for its replicas to be synced,
+ * whatever the policy.
+ */
+
+const (
+	FSYNC_FAST     = "fast"
+	FSYNC_NORMAL   = "normal"
+	FSYNC_PARANOID = "paranoid"
+)
+
+var KFS_FSYNC = FSYNC_NORMAL
+
+var fsync_levels = map[string]int{
+	FSYNC_FAST:     0,
+	FSYNC_NORMAL:   1,
+	FSYNC_PARANOID: 2,
+}
+
+var fsync_sqlite_modes = map[string]string{
+	FSYNC_FAST:     "OFF",
+	FSYNC_NORMAL:   "NORMAL",
+	FSYNC_PARANOID: "FULL",
+}
+
+/**
+ * Whether the policy asks for writes of the given level to be synced.
+ */
+func fsync_wanted(level string) bool {
+	return fsync_levels[settings().fsync] >= fsync_levels[level]
+}
+
+func sync_path(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+/**
+ * Sync the file, if the policy asks for it at this level.
+ */
+func sync_file(f *os.File, level string) error {
+	if !fsync_wanted(level) {
+		return nil
+	}
+	return f.Sync()
+}
+
+/**
+ * Sync the directory holding path, so that a file just created or renamed
+ * in it is not lost with the directory entry.
+ */
+func sync_dir(path string, level string) error {
+	if !fsync_wanted(level) {
+		return nil
+	}
+	return sync_path(filepath.Dir(path))
+}
+
+/**
+ * Sync the blob and every directory from it up to the disk's storage
+ * directory, since its shard directory may have just been made.
+ */
+func blob_sync(root string, hash string, algo string) error {
+	path := get_blob_path(root, hash, algo)
+	if err := sync_path(path); err != nil {
+		return err
+	}
+	storage := filepath.Clean(get_storage_path(root))
+	for dir := filepath.Dir(path); strings.HasPrefix(dir, storage); dir = filepath.Dir(dir) {
+		if err := sync_path(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+ * Sync a replica that has just been written, before it is recorded as
+ * stored.
+ */
+func replica_sync(root string, hash string, algo string) error {
+	if !fsync_wanted(FSYNC_NORMAL) {
+		return nil
+	}
+	if err := blob_sync(root, hash, algo); err != nil {
+		return fmt.Errorf("could not sync replica on '%s': %v", root, err)
+	}
+	return nil
+}
+
+/**
+ * Set sqlite's synchronous mode on the connection that writes, for when
+ * the policy is changed by a reload.
+ */
+func fsync_apply_db() {
+	mode := fsync_sqlite_modes[settings().fsync]
+	if _, err := db_exec(fmt.Sprintf(`PRAGMA synchronous = %s`, mode)); err != nil {
+		log.Printf("could not set sqlite synchronous mode: %v", err)
+	}
+}
@@ -0,0 +1,461 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+/**
+ * Garbage collection of blobs nothing refers to any more, e.g. once the
+ * catalog entries a mirror followed are gone. A blob is referred to by
+ * catalog entries, append segments, thumbnails, the entries of syncs and
+ * multipart uploads not yet finished, archive intents, the geo queue, and
+ * uploads in flight. A run marks each blob it finds with none of these,
+ * and unmarks those that are referred to again. A blob marked at least
+ * KFS_GC_GRACE ago is swept: its local replicas are removed and their
+ * space given back to the disks. A replica hard linked to a staged copy or
+ * to the same content under another hash frees nothing while the other
+ * name is there, so its space is left to the next statfs. Blobs with
+ * replicas on other nodes are left alone.
+ *
+ *     curl localhost:8080/admin/gc             what a run would do
+ *     curl -X POST localhost:8080/admin/gc     run now
+ *
+ * Runs only happen on their own, once a day, with the gc config key set.
+ */
+
+var (
+	KFS_GC_ENABLED  = false
+	KFS_GC_GRACE    = 7 * 24 * time.Hour
+	KFS_GC_INTERVAL = 24 * time.Hour
+)
+
+// b is the blob, which is not referred to when this holds
+const gc_unreferenced = `
+	not exists (
+		select 1 from catalog c
+		where c.hash = b.hash and c.hash_algo = b.hash_algo
+	)
+	and not exists (
+		select 1 from append_segments a
+		where a.hash = b.hash and a.hash_algo = b.hash_algo
+	)
+	and not exists (
+		select 1 from thumbnails t
+		where t.thumb_hash = b.hash and t.thumb_algo = b.hash_algo
+	)
+	and not exists (
+		select 1 from sync_entries e join sync_sessions s on s.id = e.session_id
+		where e.hash = b.hash and s.hash_algo = b.hash_algo
+			and s.committed_at is null
+	)
+	and not exists (
+		select 1 from multipart_uploads m
+		where m.hash = b.hash and m.hash_algo = b.hash_algo
+	)
+	and not exists (
+		select 1 from archive_intents i
+		where i.hash = b.hash and i.hash_algo = b.hash_algo
+	)
+	and not exists (
+		select 1 from geo_queue g
+		where g.hash = b.hash and g.hash_algo = b.hash_algo
+	)
+`
+
+var errGCReferenced = errors.New("blob is referred to again")
+
+type gc_blob struct {
+	Hash     string `json:"hash"`
+	HashAlgo string `json:"hash_algo"`
+	Size     int64  `json:"size"`
+	Replicas int    `json:"replicas"`
+
+	// when it was first found unreferenced, 0 if it is marked by this run
+	MarkedAt int64 `json:"marked_at"`
+}
+
+type gc_report struct {
+	DryRun    bool  `json:"dry_run"`
+	GraceDays int64 `json:"grace_days"`
+
+	// in their grace period, including those this run marked
+	Marked []gc_blob `json:"marked"`
+
+	// referred to again, so no longer marked
+	Unmarked int `json:"unmarked"`
+
+	Swept          []gc_blob `json:"swept"`
+	ReclaimedBytes int64     `json:"reclaimed_bytes"`
+}
+
+/**
+ * Every blob stored only on this node that nothing refers to, with when it
+ * was marked.
+ */
+func db_get_unreferenced_blobs() ([]gc_blob, error) {
+	query := `
+		select b.hash, b.hash_algo, coalesce(max(b.size), 0), count(*),
+			coalesce(max(gc_marks.marked_at), 0)
+		from files b
+		left join gc_marks
+			on gc_marks.hash = b.hash and gc_marks.hash_algo = b.hash_algo
+		where ` + gc_unreferenced + `
+		group by b.hash, b.hash_algo
+		having sum(b.node != '') = 0
+	`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("could not query for unreferenced blobs: %v", err)
+	}
+	defer rows.Close()
+
+	var blobs []gc_blob
+	for rows.Next() {
+		var blob gc_blob
+		err := rows.Scan(&blob.Hash, &blob.HashAlgo, &blob.Size, &blob.Replicas, &blob.MarkedAt)
+		if err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, blob)
+	}
+	return blobs, rows.Err()
+}
+
+/**
+ * The marks of blobs that are not among these, which a run drops.
+ */
+func db_get_stale_gc_marks(blobs []gc_blob) ([][2]string, error) {
+	unreferenced := map[string]bool{}
+	for _, blob := range blobs {
+		unreferenced[blob.Hash+"."+blob.HashAlgo] = true
+	}
+	rows, err := db.Query(`select hash, hash_algo from gc_marks`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var stale [][2]string
+	for rows.Next() {
+		var hash, algo string
+		if err := rows.Scan(&hash, &algo); err != nil {
+			return nil, err
+		}
+		if !unreferenced[hash+"."+algo] {
+			stale = append(stale, [2]string{hash, algo})
+		}
+	}
+	return stale, rows.Err()
+}
+
+/**
+ * Mark the blobs that are not marked yet, and unmark the rest, returning
+ * how many were unmarked.
+ */
+func db_set_gc_marks(blobs []gc_blob, now int64) (int, error) {
+	stale, err := db_get_stale_gc_marks(blobs)
+	if err != nil {
+		return 0, err
+	}
+	err = db_transaction(func(tx *sql.Tx) error {
+		for _, mark := range stale {
+			_, err := tx.Exec(
+				`delete from gc_marks where hash = ? and hash_algo = ?`,
+				mark[0],
+				mark[1],
+			)
+			if err != nil {
+				return err
+			}
+		}
+		for _, blob := range blobs {
+			_, err := tx.Exec(
+				`
+				insert or ignore into gc_marks(hash, hash_algo, marked_at)
+				values(?, ?, ?)
+				`,
+				blob.Hash,
+				blob.HashAlgo,
+				now,
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return len(stale), err
+}
+
+/**
+ * Forget the blob and give the space of its replicas back, unless it has
+ * been referred to since it was listed. Returns the roots it was on, and
+ * the bytes removing them frees.
+ */
+func db_gc_remove_blob(hash string, algo string) ([]string, int64, error) {
+	var roots []string
+	var freed int64
+	err := db_transaction(func(tx *sql.Tx) error {
+		roots = nil
+		freed = 0
+		var referenced bool
+		query := `
+			select not (` + gc_unreferenced + `)
+			from (select ? as hash, ? as hash_algo) b
+		`
+		if err := tx.QueryRow(query, hash, algo).Scan(&referenced); err != nil {
+			return err
+		}
+		if referenced {
+			return errGCReferenced
+		}
+		rows, err := tx.Query(
+			`
+			select storage_root, coalesce(size, 0) from files
+			where hash = ? and hash_algo = ? and node = ''
+			`,
+			hash,
+			algo,
+		)
+		if err != nil {
+			return err
+		}
+		sizes := map[string]int64{}
+		for rows.Next() {
+			var root string
+			var size int64
+			if err := rows.Scan(&root, &size); err != nil {
+				rows.Close()
+				return err
+			}
+			roots = append(roots, root)
+			sizes[root] = size
+		}
+		rows.Close()
+		for _, root := range roots {
+			if blob_shared(get_blob_path(root, hash, algo)) {
+				continue
+			}
+			freed += sizes[root]
+			_, err := tx.Exec(
+				`update disks set available = available + ? where node = '' and root = ?`,
+				sizes[root],
+				root,
+			)
+			if err != nil {
+				return err
+			}
+		}
+		for _, stmt := range []string{
+			`delete from files where hash = ? and hash_algo = ? and node = ''`,
+			`delete from blobs where hash = ? and hash_algo = ?`,
+			`delete from digests where hash = ? and algo = ?`,
+			`delete from thumbnails where hash = ? and hash_algo = ?`,
+			`delete from media where hash = ? and hash_algo = ?`,
+			`delete from scans where hash = ? and hash_algo = ?`,
+			`delete from gc_marks where hash = ? and hash_algo = ?`,
+		} {
+			if _, err := tx.Exec(stmt, hash, algo); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return roots, freed, err
+}
+
+/**
+ * The bytes removing the blob's local replicas would free, leaving out
+ * those whose data has another name.
+ */
+func gc_reclaimable(blob gc_blob) (int64, error) {
+	_, roots, err := db_get_replicas(blob.Hash)
+	if err != nil {
+		return 0, err
+	}
+	var freed int64
+	for _, root := range roots {
+		if !blob_shared(get_blob_path(root, blob.Hash, blob.HashAlgo)) {
+			freed += blob.Size
+		}
+	}
+	return freed, nil
+}
+
+/**
+ * Remove the blob from this node, returning whether it was and the bytes
+ * that freed. A pre-delete hook can keep it, until the next run. It is
+ * forgotten as a known hash first, so that an upload from then on stores
+ * it again rather than relying on the replicas about to be removed.
+ */
+func gc_sweep(blob gc_blob) (bool, int64, error) {
+	_, roots, err := db_get_replicas(blob.Hash)
+	if err != nil {
+		return false, 0, err
+	}
+	var file string
+	if len(roots) > 0 {
+		file = get_blob_path(roots[0], blob.Hash, blob.HashAlgo)
+	}
+	entry := catalog_entry{Hash: blob.Hash, HashAlgo: blob.HashAlgo, Size: blob.Size}
+	if err := run_hooks(context.Background(), HOOK_PRE_DELETE, entry, file); err != nil {
+		log.Printf("kept %s: %v", blob.Hash, err)
+		return false, 0, nil
+	}
+
+	known_hash_remove(blob.Hash, blob.HashAlgo)
+	roots, freed, err := db_gc_remove_blob(blob.Hash, blob.HashAlgo)
+	if err != nil {
+		known_hash_add(blob.Hash, blob.HashAlgo)
+		if err == errGCReferenced {
+			return false, 0, nil
+		}
+		return false, 0, err
+	}
+	for _, root := range roots {
+		path := get_blob_path(root, blob.Hash, blob.HashAlgo)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("could not remove '%s': %v", path, err)
+		}
+	}
+	log.Printf("collected %s from %d disks", blob.Hash, len(roots))
+	emit_event(event{Type: EVENT_BLOB_COLLECTED, Hash: blob.Hash, HashAlgo: blob.HashAlgo})
+	return true, freed, nil
+}
+
+/**
+ * Mark and sweep. A dry run changes nothing, and reports what a run would
+ * do now.
+ */
+func gc_run(dry_run bool) (gc_report, error) {
+	report := gc_report{
+		DryRun:    dry_run,
+		GraceDays: int64(settings().gc_grace / (24 * time.Hour)),
+		Marked:    []gc_blob{},
+		Swept:     []gc_blob{},
+	}
+	blobs, err := db_get_unreferenced_blobs()
+	if err != nil {
+		return report, err
+	}
+
+	// an upload in flight is not in the catalog yet
+	space_mutex.Lock()
+	unreferenced := []gc_blob{}
+	for _, blob := range blobs {
+		if _, ok := space_reservations[blob.Hash+"."+blob.HashAlgo]; !ok {
+			unreferenced = append(unreferenced, blob)
+		}
+	}
+	space_mutex.Unlock()
+
+	now := time.Now().Unix()
+	if dry_run {
+		var stale [][2]string
+		stale, err = db_get_stale_gc_marks(unreferenced)
+		report.Unmarked = len(stale)
+	} else {
+		report.Unmarked, err = db_set_gc_marks(unreferenced, now)
+	}
+	if err != nil {
+		return report, fmt.Errorf("could not mark unreferenced blobs: %v", err)
+	}
+
+	cutoff := time.Now().Add(-settings().gc_grace).Unix()
+	for _, blob := range unreferenced {
+		if blob.MarkedAt == 0 || blob.MarkedAt > cutoff {
+			report.Marked = append(report.Marked, blob)
+			continue
+		}
+		var freed int64
+		if dry_run {
+			freed, err = gc_reclaimable(blob)
+			if err != nil {
+				return report, fmt.Errorf("could not look up replicas of %s: %v", blob.Hash, err)
+			}
+		} else {
+			var swept bool
+			swept, freed, err = gc_sweep(blob)
+			if err != nil {
+				return report, fmt.Errorf("could not collect %s: %v", blob.Hash, err)
+			}
+			if !swept {
+				continue
+			}
+		}
+		report.Swept = append(report.Swept, blob)
+		report.ReclaimedBytes += freed
+	}
+	if !dry_run {
+		metric_add(
+			"kfs_gc_blobs_total",
+			"Unreferenced blobs removed by garbage collection.",
+			"",
+			float64(len(report.Swept)),
+		)
+		metric_add(
+			"kfs_gc_reclaimed_bytes_total",
+			"Bytes given back to the disks by garbage collection.",
+			"",
+			float64(report.ReclaimedBytes),
+		)
+	}
+	return report, nil
+}
+
+func handle_gc(dry_run bool) httprouter.Handle {
+	return func(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+		report, err := gc_run(dry_run)
+		if err != nil {
+			log.Printf("garbage collection failed: %v", err)
+			write_error(writer, "garbage collection failed", http.StatusInternalServerError)
+			return
+		}
+		write_json(writer, http.StatusOK, report)
+	}
+}
+
+func gc_loop() {
+	for {
+		time.Sleep(KFS_GC_INTERVAL)
+		if !settings().gc_enabled {
+			continue
+		}
+		report, err := gc_run(false)
+		if err != nil {
+			log.Printf("garbage collection failed: %v", err)
+			continue
+		}
+		log.Printf(
+			"garbage collection swept %d blobs, reclaiming %d bytes, %d more are marked",
+			len(report.Swept),
+			report.ReclaimedBytes,
+			len(report.Marked),
+		)
+	}
+}
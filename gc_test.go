@@ -0,0 +1,230 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestGCUnreferenced(t *testing.T) {
+	const hash = "cafe"
+	const algo = "blake2b"
+	tests := []struct {
+		name string
+
+		// statements that refer to the blob, or not, given its hash and algo
+		refs []string
+
+		// a replica of the blob on another node
+		remote bool
+
+		unreferenced bool
+	}{
+		{"nothing", nil, false, true},
+		{
+			"catalog entry",
+			[]string{`insert into catalog(namespace, path, filename, hash, hash_algo, size, created_at)
+				values('default', '/', 'f', ?1, ?2, 1, 0)`},
+			false,
+			false,
+		},
+		{
+			"catalog entry of another algo",
+			[]string{`insert into catalog(namespace, path, filename, hash, hash_algo, size, created_at)
+				values('default', '/', 'f', ?1, 'sha256', 1, 0)`},
+			false,
+			true,
+		},
+		{
+			"append segment",
+			[]string{`insert into append_segments(object_id, seq, hash, hash_algo, size, created_at)
+				values(1, 0, ?1, ?2, 1, 0)`},
+			false,
+			false,
+		},
+		{
+			"thumbnail",
+			[]string{`insert into thumbnails(hash, hash_algo, size, thumb_hash, thumb_algo, width, height)
+				values('original', ?2, 256, ?1, ?2, 256, 256)`},
+			false,
+			false,
+		},
+		{
+			"original of a thumbnail",
+			[]string{`insert into thumbnails(hash, hash_algo, size, thumb_hash, thumb_algo, width, height)
+				values(?1, ?2, 256, 'thumb', ?2, 256, 256)`},
+			false,
+			true,
+		},
+		{
+			"sync in progress",
+			[]string{
+				`insert into sync_sessions(id, namespace, hash_algo, class, created_at)
+					values('s', 'default', ?2, '', 0)`,
+				`insert into sync_entries(session_id, path, filename, hash, size)
+					values('s', '/', 'f', ?1, 1)`,
+			},
+			false,
+			false,
+		},
+		{
+			"committed sync",
+			[]string{
+				`insert into sync_sessions(id, namespace, hash_algo, class, created_at, committed_at)
+					values('s', 'default', ?2, '', 0, 1)`,
+				`insert into sync_entries(session_id, path, filename, hash, size)
+					values('s', '/', 'f', ?1, 1)`,
+			},
+			false,
+			true,
+		},
+		{
+			"multipart upload",
+			[]string{`insert into multipart_uploads(id, root, filename, hash, hash_algo, namespace, path, class, created_at)
+				values('m', '/tmp', 'f', ?1, ?2, 'default', '/', '', 0)`},
+			false,
+			false,
+		},
+		{
+			"archive intent",
+			[]string{`insert into archive_intents(hash, hash_algo, staging_file, node, root, created_at)
+				values(?1, ?2, '/tmp/f', '', '/tmp', 0)`},
+			false,
+			false,
+		},
+		{
+			"geo queue",
+			[]string{`insert into geo_queue(kind, hash, hash_algo, payload, created_at)
+				values('blob', ?1, ?2, '', 0)`},
+			false,
+			false,
+		},
+		{"replica on another node", nil, true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			disks := test_db(t, 1, 1000)
+			_, err := db_exec(
+				`
+				insert into files(hash, hash_algo, storage_root, path, filename, size, node)
+				values(?, ?, ?, '/', 'f', 1, '')
+				`,
+				hash,
+				algo,
+				disks[0],
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.remote {
+				_, err := db_exec(
+					`
+					insert into files(hash, hash_algo, storage_root, path, filename, size, node)
+					values(?, ?, '/mnt/disk1', '/', 'f', 1, 'peer')
+					`,
+					hash,
+					algo,
+				)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, ref := range test.refs {
+				if _, err := db_exec(ref, hash, algo); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			blobs, err := db_get_unreferenced_blobs()
+			if err != nil {
+				t.Fatal(err)
+			}
+			found := false
+			for _, blob := range blobs {
+				if blob.Hash == hash && blob.HashAlgo == algo {
+					found = true
+				}
+			}
+			if found != test.unreferenced {
+				t.Errorf("unreferenced: got %v, want %v", found, test.unreferenced)
+			}
+		})
+	}
+}
+
+func TestGCSweepPreDeleteHook(t *testing.T) {
+	saved := KFS_HOOKS[HOOK_PRE_DELETE]
+	defer func() { KFS_HOOKS[HOOK_PRE_DELETE] = saved }()
+	tests := []struct {
+		name  string
+		veto  bool
+		swept bool
+	}{
+		{"allowed", false, true},
+		{"vetoed", true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			disks := test_db(t, 1, 1000)
+			const hash = "cafe"
+			const algo = "blake2b"
+			_, err := db_exec(
+				`
+				insert into files(hash, hash_algo, storage_root, path, filename, size, node)
+				values(?, ?, ?, '/', 'f', 1, '')
+				`,
+				hash,
+				algo,
+				disks[0],
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var called hook_call
+			KFS_HOOKS[HOOK_PRE_DELETE] = []hook{
+				hook_func(func(ctx context.Context, call hook_call) error {
+					called = call
+					if test.veto {
+						return errors.New("keep it")
+					}
+					return nil
+				}),
+			}
+
+			swept, _, err := gc_sweep(gc_blob{Hash: hash, HashAlgo: algo, Size: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if swept != test.swept {
+				t.Errorf("swept %v, want %v", swept, test.swept)
+			}
+			if called.Entry.Hash != hash || called.File != get_blob_path(disks[0], hash, algo) {
+				t.Errorf("hook got %+v", called)
+			}
+			var left int
+			if err := db.QueryRow(`select count(*) from files where hash = ?`, hash).Scan(&left); err != nil {
+				t.Fatal(err)
+			}
+			if (left > 0) != test.veto {
+				t.Errorf("%d replicas left", left)
+			}
+		})
+	}
+}
@@ -0,0 +1,540 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+/**
+ * Geo-replication to a second kfs deployment, e.g. one at another house.
+ * Every new blob and catalog change made on this node is put on a queue in
+ * the database, and shipped to the remote site in order. A job that fails
+ * is retried later, with a growing backoff, and the jobs behind it go on
+ * meanwhile, except those for the same hash, so a blob still reaches the
+ * remote site before the entries that point at it. Blobs are sent in
+ * chunks, each of which the remote site keeps, so a flaky WAN link only
+ * ever costs the chunk that was in flight. The remote site places the blobs
+ * on its own disks, and does not queue them again, so two sites can each
+ * ship to the other.
+ *
+ * The remote site has to share KFS_CLUSTER_SECRET with this one.
+ */
+
+// base URL of a node at the remote site, geo-replication is off when empty,
+// geo_remote in the config
+var KFS_GEO_REMOTE = ""
+
+var KFS_GEO_CHUNK_SIZE int64 = 8 * 1024 * 1024
+
+// limit on the bytes per second sent to the remote site, 0 for none
+var KFS_GEO_MAX_RATE int64 = 0
+
+var KFS_GEO_POLL_INTERVAL = 10 * time.Second
+
+var KFS_GEO_RETRY_BACKOFF = time.Minute
+
+// longest a failing job is put off before it is tried again
+var KFS_GEO_MAX_RETRY_BACKOFF = time.Hour
+
+const (
+	GEO_BLOB    = "blob"
+	GEO_CATALOG = "catalog"
+)
+
+type geo_job struct {
+	id        int64
+	kind      string
+	hash      string
+	hash_algo string
+	payload   string
+	attempts  int64
+}
+
+func geo_enabled() bool {
+	return KFS_GEO_REMOTE != ""
+}
+
+func db_geo_enqueue(kind string, hash string, algo string, payload string) {
+	stmt := `
+		insert into geo_queue(kind, hash, hash_algo, payload, created_at)
+		values(?, ?, ?, ?, ?)
+	`
+	_, err := db_exec(stmt, kind, hash, algo, payload, time.Now().Unix())
+	if err != nil {
+		log.Printf("could not queue %s %s for the remote site: %v", kind, hash, err)
+	}
+}
+
+/**
+ * Queue a new blob to be sent to the remote site.
+ */
+func geo_enqueue_blob(hash string, algo string) {
+	if !geo_enabled() {
+		return
+	}
+	db_geo_enqueue(GEO_BLOB, hash, algo, "")
+}
+
+/**
+ * Queue a catalog change to be sent to the remote site. Blobs are queued
+ * before the entries that point at them, and the jobs for a hash are
+ * shipped in order, so the remote site never has an entry for a blob it
+ * lacks.
+ */
+func geo_enqueue_catalog(old *catalog_entry, entry catalog_entry) {
+	if !geo_enabled() {
+		return
+	}
+	payload, err := json.Marshal(cluster_catalog_change{Old: old, Entry: entry})
+	if err != nil {
+		log.Printf("could not encode catalog change: %v", err)
+		return
+	}
+	db_geo_enqueue(GEO_CATALOG, entry.Hash, entry.HashAlgo, string(payload))
+}
+
+/**
+ * The oldest job that is due, and that no earlier job for the same hash is
+ * still waiting in front of.
+ */
+func db_geo_next() (geo_job, error) {
+	query := `
+		select id, kind, hash, hash_algo, payload, attempts
+		from geo_queue q
+		where retry_at <= ?
+		and not exists (
+			select 1 from geo_queue p
+			where p.hash = q.hash
+			and p.hash_algo = q.hash_algo
+			and p.id < q.id
+		)
+		order by id
+		limit 1
+	`
+	var job geo_job
+	err := db.QueryRow(query, time.Now().Unix()).Scan(
+		&job.id,
+		&job.kind,
+		&job.hash,
+		&job.hash_algo,
+		&job.payload,
+		&job.attempts,
+	)
+	return job, err
+}
+
+func db_geo_done(id int64) error {
+	_, err := db_exec(`delete from geo_queue where id = ?`, id)
+	return err
+}
+
+/**
+ * Put a failed job off, for twice as long as the last time, up to
+ * KFS_GEO_MAX_RETRY_BACKOFF.
+ */
+func db_geo_failed(job geo_job, failure error) {
+	backoff := geo_retry_backoff(job.attempts + 1)
+	stmt := `
+		update geo_queue
+		set attempts = attempts + 1, last_error = ?, retry_at = ?
+		where id = ?
+	`
+	retry_at := time.Now().Add(backoff).Unix()
+	if _, err := db_exec(stmt, failure.Error(), retry_at, job.id); err != nil {
+		log.Println(err)
+	}
+}
+
+func geo_retry_backoff(attempts int64) time.Duration {
+	backoff := KFS_GEO_RETRY_BACKOFF
+	for i := int64(1); i < attempts && backoff < KFS_GEO_MAX_RETRY_BACKOFF; i++ {
+		backoff *= 2
+	}
+	if backoff > KFS_GEO_MAX_RETRY_BACKOFF {
+		backoff = KFS_GEO_MAX_RETRY_BACKOFF
+	}
+	return backoff
+}
+
+/**
+ * Export how far behind the remote site is: the number of queued jobs, how
+ * long the oldest one has been waiting, and the oldest jobs that keep
+ * failing, with how often they have.
+ */
+func geo_update_metrics() {
+	var backlog int64
+	var oldest sql.NullInt64
+	err := db.QueryRow(`select count(*), min(created_at) from geo_queue`).Scan(&backlog, &oldest)
+	if err != nil {
+		log.Printf("could not measure geo-replication backlog: %v", err)
+		return
+	}
+	lag := 0.0
+	if oldest.Valid {
+		lag = time.Since(time.Unix(oldest.Int64, 0)).Seconds()
+	}
+	metric_set(
+		"kfs_geo_backlog",
+		"Blobs and catalog changes waiting to be sent to the remote site.",
+		"",
+		float64(backlog),
+	)
+	metric_set(
+		"kfs_geo_lag_seconds",
+		"How long the oldest queued change has been waiting.",
+		"",
+		lag,
+	)
+
+	query := `
+		select id, kind, hash, attempts
+		from geo_queue
+		where attempts > 0
+		order by id
+		limit 10
+	`
+	rows, err := db.Query(query)
+	if err != nil {
+		log.Printf("could not list failing geo-replication jobs: %v", err)
+		return
+	}
+	defer rows.Close()
+	metric_clear("kfs_geo_stuck_attempts")
+	for rows.Next() {
+		var id, attempts int64
+		var kind, hash string
+		if err := rows.Scan(&id, &kind, &hash, &attempts); err != nil {
+			log.Println(err)
+			return
+		}
+		metric_set(
+			"kfs_geo_stuck_attempts",
+			"Failed attempts of the oldest queued changes that keep failing.",
+			fmt.Sprintf("id=\"%d\",kind=%q,hash=%q", id, kind, hash),
+			float64(attempts),
+		)
+	}
+}
+
+func geo_loop() {
+	if !geo_enabled() {
+		return
+	}
+	for {
+		geo_update_metrics()
+		job, err := db_geo_next()
+		if err == sql.ErrNoRows {
+			time.Sleep(KFS_GEO_POLL_INTERVAL)
+			continue
+		}
+		if err != nil {
+			log.Printf("could not read geo-replication queue: %v", err)
+			time.Sleep(KFS_GEO_RETRY_BACKOFF)
+			continue
+		}
+
+		if err := geo_ship(job); err != nil {
+			log.Printf("could not send %s %s to the remote site: %v", job.kind, job.hash, err)
+			db_geo_failed(job, err)
+			metric_add(
+				"kfs_geo_failures_total",
+				"Attempts to send a change to the remote site that failed.",
+				fmt.Sprintf("kind=%q", job.kind),
+				1,
+			)
+			time.Sleep(KFS_GEO_RETRY_BACKOFF)
+			continue
+		}
+		if err := db_geo_done(job.id); err != nil {
+			log.Println(err)
+		}
+		metric_add(
+			"kfs_geo_shipped_total",
+			"Changes sent to the remote site.",
+			fmt.Sprintf("kind=%q", job.kind),
+			1,
+		)
+	}
+}
+
+func geo_ship(job geo_job) error {
+	switch job.kind {
+	case GEO_BLOB:
+		return geo_ship_blob(job.hash, job.hash_algo)
+	case GEO_CATALOG:
+		return geo_ship_catalog(job.payload)
+	}
+	return fmt.Errorf("unknown job kind '%s'", job.kind)
+}
+
+func geo_ship_catalog(payload string) error {
+	request, err := cluster_request(
+		context.Background(),
+		http.MethodPost,
+		KFS_GEO_REMOTE+"/cluster/catalog",
+		bytes.NewReader([]byte(payload)),
+	)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := cluster_client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("got status %d", response.StatusCode)
+	}
+	return nil
+}
+
+/**
+ * Send the blob a chunk at a time, starting from however much the remote
+ * site already has.
+ */
+func geo_ship_blob(hash string, algo string) error {
+	_, roots, err := db_get_replicas(hash)
+	if err != nil {
+		return err
+	}
+	var f *os.File
+	for _, root := range roots {
+		f, err = os.Open(get_blob_path(root, hash, algo))
+		if err == nil {
+			break
+		}
+	}
+	if f == nil {
+		return fmt.Errorf("no local replica, it may not be archived yet")
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	query := url.Values{}
+	query.Set("algo", algo)
+	var offset cluster_offset
+	offset_url := fmt.Sprintf("%s/cluster/import/%s?%s", KFS_GEO_REMOTE, hash, query.Encode())
+	if err := cluster_get_json(offset_url, &offset); err != nil {
+		return err
+	}
+	if offset.Stored {
+		return nil
+	}
+	if offset.Offset > size {
+		return fmt.Errorf("remote site has %d bytes of a %d byte blob", offset.Offset, size)
+	}
+
+	sent := offset.Offset
+	for {
+		n := size - sent
+		if n > KFS_GEO_CHUNK_SIZE {
+			n = KFS_GEO_CHUNK_SIZE
+		}
+		query.Set("size", strconv.FormatInt(size, 10))
+		query.Set("offset", strconv.FormatInt(sent, 10))
+		chunk := io.NewSectionReader(f, sent, n)
+		status, err := geo_send_chunk(hash, query, chunk, n)
+		if err != nil {
+			return err
+		}
+		sent += n
+		metric_add(
+			"kfs_geo_sent_bytes_total",
+			"Bytes of blobs sent to the remote site.",
+			"",
+			float64(n),
+		)
+		if status == http.StatusCreated {
+			return nil
+		}
+		if sent >= size {
+			return fmt.Errorf("remote site did not store the blob")
+		}
+	}
+}
+
+func geo_send_chunk(hash string, query url.Values, chunk io.ReadSeeker, n int64) (int, error) {
+	blob_url := fmt.Sprintf("%s/cluster/import/%s?%s", KFS_GEO_REMOTE, hash, query.Encode())
+	request, err := cluster_request(context.Background(), http.MethodPut, blob_url, chunk)
+	if err != nil {
+		return 0, err
+	}
+	if max_rate := settings().geo_max_rate; max_rate > 0 {
+		request.Body = io.NopCloser(&rate_reader{chunk, max_rate, time.Now(), 0})
+	}
+	request.ContentLength = n
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusCreated && response.StatusCode != http.StatusAccepted {
+		msg, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return 0, fmt.Errorf("remote site refused chunk: %d %s", response.StatusCode, msg)
+	}
+	return response.StatusCode, nil
+}
+
+/**
+ * A reader that sleeps as needed to stay under rate bytes per second.
+ */
+type rate_reader struct {
+	reader io.Reader
+	rate   int64
+	start  time.Time
+	read   int64
+}
+
+func (r *rate_reader) Read(p []byte) (int, error) {
+	if int64(len(p)) > r.rate {
+		p = p[:r.rate]
+	}
+	n, err := r.reader.Read(p)
+	r.read += int64(n)
+	due := time.Duration(float64(r.read) / float64(r.rate) * float64(time.Second))
+	if wait := due - time.Since(r.start); wait > 0 {
+		time.Sleep(wait)
+	}
+	return n, err
+}
+
+/**
+ * Blobs from the remote site are collected on the first local disk until
+ * they are complete.
+ */
+func geo_import_path(hash string, algo string) (string, error) {
+	disks, err := db_list_disks()
+	if err != nil {
+		return "", err
+	}
+	if len(disks) == 0 {
+		return "", fmt.Errorf("no disks")
+	}
+	return cluster_partial_path(disks[0].Root, hash, algo) + ".import", nil
+}
+
+/**
+ * How much of a blob from the remote site has arrived, or whether this site
+ * already holds it.
+ */
+func handle_cluster_import_offset(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	hash := p.ByName("hash")
+	algo := request.URL.Query().Get("algo")
+	if !valid_hash_algo(algo) {
+		write_error(writer, fmt.Sprintf("unsupported hash algorithm: '%s'", algo), http.StatusBadRequest)
+		return
+	}
+	var offset cluster_offset
+	if _, roots, err := db_get_replicas(hash); err == nil && len(roots) > 0 {
+		offset.Stored = true
+		write_json(writer, http.StatusOK, offset)
+		return
+	}
+	partial_path, err := geo_import_path(hash, algo)
+	if err != nil {
+		log.Println(err)
+		write_error(writer, "could not find import", http.StatusInternalServerError)
+		return
+	}
+	if info, err := os.Stat(partial_path); err == nil {
+		offset.Offset = info.Size()
+	}
+	write_json(writer, http.StatusOK, offset)
+}
+
+/**
+ * Receive a chunk of a blob from the remote site. Once the whole blob is
+ * here, and hashes right, it is placed on this site's disks like an upload.
+ */
+func handle_cluster_import(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	hash := p.ByName("hash")
+	algo := request.URL.Query().Get("algo")
+	if !valid_hash_algo(algo) {
+		write_error(writer, fmt.Sprintf("unsupported hash algorithm: '%s'", algo), http.StatusBadRequest)
+		return
+	}
+	partial_path, err := geo_import_path(hash, algo)
+	if err != nil {
+		log.Println(err)
+		write_error(writer, "could not stage blob", http.StatusInternalServerError)
+		return
+	}
+	size, ok := cluster_receive_part(writer, request, partial_path)
+	if !ok {
+		return
+	}
+	digest, err := hash_file_ctx(request.Context(), partial_path, algo)
+	if err != nil || digest != hash {
+		os.Remove(partial_path)
+		log.Printf("imported %s, but it hashed to '%s': %v", hash, digest, err)
+		write_error(writer, "blob does not match its hash", http.StatusBadRequest)
+		return
+	}
+
+	skip, staging_path, disks, err := db_alloc_storage(request.Context(), hash, algo, size, "", "", "")
+	if errors.Is(err, errHashInFlight) {
+		os.Remove(partial_path)
+		write_error_code(writer, err.Error(), http.StatusConflict, API_IN_FLIGHT)
+		return
+	}
+	if err != nil {
+		log.Printf("could not place imported %s: %v", hash, err)
+		write_error(writer, "could not store blob", http.StatusInsufficientStorage)
+		return
+	}
+	if skip {
+		os.Remove(partial_path)
+		writer.WriteHeader(http.StatusCreated)
+		return
+	}
+	hash_filename := filepath.Join(staging_path, hash+"."+algo)
+	if err := os.Rename(partial_path, hash_filename); err != nil {
+		err = copy_file(partial_path, hash_filename)
+		os.Remove(partial_path)
+		if err != nil {
+			log.Printf("could not stage imported %s: %v", hash, err)
+			db_release_storage(hash, algo, size, disks)
+			write_error(writer, "could not store blob", http.StatusInternalServerError)
+			return
+		}
+	}
+	go archive_file(staging_path, disks, hash_filename, hash, algo, nil)
+	log.Printf("imported %s from the remote site", hash)
+	writer.WriteHeader(http.StatusCreated)
+}
@@ -0,0 +1,322 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/**
+ * kfs get downloads a blob by its hash, e.g.
+ *     kfs get -o taxes-2023.pdf 5f0c...
+ * The blob is fetched in chunks with Range requests into FILE.kfs-partial,
+ * KFS_CLIENT_PARALLEL of them at a time, each at its own offset, and after
+ * each chunk is synced, FILE.kfs-manifest records that it is done. When a
+ * download is interrupted, running the same command again only fetches the
+ * chunks that were not recorded. A chunk that fails in a way that may pass
+ * is fetched again on its own, as client.go describes. The file is only
+ * renamed into place once all of it hashes to what was asked for.
+ */
+
+var KFS_GET_CHUNK_SIZE int64 = 64 << 20
+
+type get_manifest struct {
+	URL       string `json:"url"`
+	Hash      string `json:"hash"`
+	HashAlgo  string `json:"hash_algo"`
+	Size      int64  `json:"size"`
+	ChunkSize int64  `json:"chunk_size"`
+	Done      []bool `json:"done"`
+}
+
+func get_main(args []string) {
+	flags := flag.NewFlagSet("get", flag.ExitOnError)
+	url := flags.String("url", "http://localhost:8080", "server to download from")
+	output := flags.String("o", "", "file to save to, the hash when not given")
+	client_flags(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: kfs get [flags] HASH")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	hash := flags.Arg(0)
+	if *output == "" {
+		*output = hash
+	}
+	blob_url := strings.TrimSuffix(*url, "/") + "/v1/download/" + hash
+	if err := get_blob(blob_url, hash, *output); err != nil {
+		fmt.Fprintf(os.Stderr, "kfs get: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+/**
+ * The manifest of an earlier attempt at the same download, or a new one.
+ */
+func get_manifest_read(manifest_path string, blob_url string, hash string) get_manifest {
+	fresh := get_manifest{URL: blob_url, Hash: hash, Size: -1, ChunkSize: KFS_GET_CHUNK_SIZE}
+	data, err := os.ReadFile(manifest_path)
+	if err != nil {
+		return fresh
+	}
+	var manifest get_manifest
+	if json.Unmarshal(data, &manifest) != nil || manifest.Hash != hash {
+		return fresh
+	}
+	if manifest.ChunkSize <= 0 || manifest.Size < 0 {
+		return fresh
+	}
+	manifest.URL = blob_url
+	return manifest
+}
+
+func get_manifest_write(manifest_path string, manifest get_manifest) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	tmp := manifest_path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, manifest_path)
+}
+
+/**
+ * The number of chunks a blob of the manifest's size is fetched in.
+ */
+func get_chunks(manifest get_manifest) int {
+	return int((manifest.Size + manifest.ChunkSize - 1) / manifest.ChunkSize)
+}
+
+func get_blob(blob_url string, hash string, output string) error {
+	partial_path := output + ".kfs-partial"
+	manifest_path := output + ".kfs-manifest"
+	manifest := get_manifest_read(manifest_path, blob_url, hash)
+
+	outf, err := os.OpenFile(partial_path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer outf.Close()
+
+	// the first chunk tells how big the blob is, and how it was hashed
+	resumed := manifest.Size >= 0
+	if !resumed {
+		var reply get_reply
+		err := client_retry("download", func() error {
+			var err error
+			reply, err = get_chunk(outf, manifest.URL, 0, manifest.ChunkSize)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		manifest.Size = reply.size
+		manifest.HashAlgo = reply.algo
+		manifest.Done = make([]bool, get_chunks(manifest))
+		if len(manifest.Done) > 0 {
+			manifest.Done[0] = true
+		}
+		if reply.whole {
+			for i := range manifest.Done {
+				manifest.Done[i] = true
+			}
+		}
+		if err := outf.Sync(); err != nil {
+			return err
+		}
+		if err := get_manifest_write(manifest_path, manifest); err != nil {
+			return err
+		}
+	}
+	if len(manifest.Done) != get_chunks(manifest) {
+		return fmt.Errorf("manifest %s is damaged, remove it to start over", manifest_path)
+	}
+
+	var missing []int
+	for i, done := range manifest.Done {
+		if !done {
+			missing = append(missing, i)
+		}
+	}
+	if resumed {
+		fmt.Fprintf(
+			os.Stderr,
+			"resuming, %d of %d chunks left\n",
+			len(missing),
+			len(manifest.Done),
+		)
+	}
+	var mutex sync.Mutex
+	err = client_parallel(len(missing), func(i int) error {
+		chunk := missing[i]
+		start := int64(chunk) * manifest.ChunkSize
+		what := fmt.Sprintf("download at byte %d", start)
+		err := client_retry(what, func() error {
+			reply, err := get_chunk(outf, manifest.URL, start, manifest.ChunkSize)
+			if err == nil && reply.whole {
+				err = fmt.Errorf("the server sent all of %s, not the range asked for", hash)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if err := outf.Sync(); err != nil {
+			return err
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		manifest.Done[chunk] = true
+		return get_manifest_write(manifest_path, manifest)
+	})
+	if err != nil {
+		return err
+	}
+	if err := outf.Truncate(manifest.Size); err != nil {
+		return err
+	}
+	if err := outf.Close(); err != nil {
+		return err
+	}
+
+	digest, err := hash_file_algo(partial_path, manifest.HashAlgo)
+	if err != nil {
+		return err
+	}
+	if digest != hash {
+		os.Remove(partial_path)
+		os.Remove(manifest_path)
+		return fmt.Errorf("downloaded %s, but it hashed to %s", hash, digest)
+	}
+	if err := os.Rename(partial_path, output); err != nil {
+		return err
+	}
+	return os.Remove(manifest_path)
+}
+
+/**
+ * What the server said about the blob when it sent a chunk of it.
+ */
+type get_reply struct {
+	size  int64
+	algo  string
+	whole bool
+}
+
+/**
+ * Fetch up to length bytes of the blob from start, into the file at the
+ * same offset. When the server does not serve ranges, all of the blob is
+ * sent, and written from the start of the file.
+ */
+func get_chunk(outf *os.File, blob_url string, start int64, length int64) (get_reply, error) {
+	reply := get_reply{algo: KFS_DEFAULT_HASH_ALGO}
+	request, err := http.NewRequest(http.MethodGet, blob_url, nil)
+	if err != nil {
+		return reply, err
+	}
+	request.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+length-1))
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return reply, err
+	}
+	defer response.Body.Close()
+	if algo := response.Header.Get("X-Kfs-Hash-Algo"); algo != "" {
+		reply.algo = algo
+	}
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		n, err := io.Copy(&offset_writer{outf, 0}, response.Body)
+		if err != nil {
+			return reply, err
+		}
+		reply.size = n
+		reply.whole = true
+		return reply, nil
+	case http.StatusPartialContent:
+		size, err := content_range_size(response.Header.Get("Content-Range"))
+		if err != nil {
+			return reply, err
+		}
+		reply.size = size
+	case http.StatusRequestedRangeNotSatisfiable:
+		// only an empty blob has no first chunk
+		reply.size = 0
+		return reply, nil
+	default:
+		return reply, client_check(response)
+	}
+
+	want := length
+	if reply.size-start < want {
+		want = reply.size - start
+	}
+	n, err := io.Copy(&offset_writer{outf, start}, response.Body)
+	if err != nil {
+		return reply, err
+	}
+	if n != want {
+		return reply, io.ErrUnexpectedEOF
+	}
+	return reply, nil
+}
+
+/**
+ * Writes to the file from an offset on, so that several chunks can be
+ * written to it at once.
+ */
+type offset_writer struct {
+	f      *os.File
+	offset int64
+}
+
+func (w *offset_writer) Write(p []byte) (int, error) {
+	n, err := w.f.WriteAt(p, w.offset)
+	w.offset += int64(n)
+	return n, err
+}
+
+/**
+ * The size of the whole blob from a Content-Range of the form
+ * "bytes 0-99/1000".
+ */
+func content_range_size(content_range string) (int64, error) {
+	i := strings.LastIndex(content_range, "/")
+	if i < 0 {
+		return 0, fmt.Errorf("bad Content-Range: '%s'", content_range)
+	}
+	size, err := strconv.ParseInt(content_range[i+1:], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad Content-Range: '%s'", content_range)
+	}
+	return size, nil
+}
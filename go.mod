@@ -1,6 +1,6 @@
 module github.com/kkloberdanz/kfs
 
-go 1.13
+go 1.16
 
 require (
 	github.com/julienschmidt/httprouter v1.3.0
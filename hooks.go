@@ -0,0 +1,252 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+/**
+ * Hooks let operators plug their own checks and processing into the life of
+ * a file. Hooks at a pre- point can refuse the operation by returning an
+ * error, e.g. to enforce a naming policy. Errors from hooks at a post- point
+ * are only logged, since the file is already stored by then.
+ */
+
+const (
+	// before an upload is accepted, only the catalog entry is known
+	HOOK_PRE_ACCEPT = "pre-accept"
+
+	// once the upload is staged and its hash checked, but not yet archived
+	HOOK_POST_STAGING = "post-staging"
+
+	// once the blob is on its disks, while the staged copy is still there
+	HOOK_POST_ARCHIVE = "post-archive"
+
+	// before retention purges a catalog entry, or garbage collection
+	// removes a blob, when only the hash and size are known
+	HOOK_PRE_DELETE = "pre-delete"
+)
+
+type hook_call struct {
+	Point string        `json:"point"`
+	Entry catalog_entry `json:"entry"`
+
+	// where the file can be read, when there is a local copy
+	File string `json:"file,omitempty"`
+}
+
+type hook interface {
+	run(ctx context.Context, call hook_call) error
+}
+
+/**
+ * A hook written in Go, e.g.
+ *     hook_func(func(ctx context.Context, call hook_call) error {
+ *         if strings.HasPrefix(call.Entry.Filename, ".") {
+ *             return fmt.Errorf("hidden files are not allowed")
+ *         }
+ *         return nil
+ *     })
+ */
+type hook_func func(ctx context.Context, call hook_call) error
+
+func (f hook_func) run(ctx context.Context, call hook_call) error {
+	return f(ctx, call)
+}
+
+/**
+ * Runs a command, with the call as JSON on stdin and in KFS_HOOK_*
+ * environment variables. The hook fails if the command exits non-zero, with
+ * whatever it wrote to stderr as the reason.
+ */
+type command_hook struct {
+	argv []string
+}
+
+func (h *command_hook) run(ctx context.Context, call hook_call) error {
+	payload, err := json.Marshal(call)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, h.argv[0], h.argv[1:]...)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = append(
+		os.Environ(),
+		"KFS_HOOK_POINT="+call.Point,
+		"KFS_HOOK_NAMESPACE="+call.Entry.Namespace,
+		"KFS_HOOK_PATH="+call.Entry.Path,
+		"KFS_HOOK_FILENAME="+call.Entry.Filename,
+		"KFS_HOOK_HASH="+call.Entry.Hash,
+		"KFS_HOOK_HASH_ALGO="+call.Entry.HashAlgo,
+		fmt.Sprintf("KFS_HOOK_SIZE=%d", call.Entry.Size),
+		"KFS_HOOK_FILE="+call.File,
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%s", msg)
+		}
+		return err
+	}
+	return nil
+}
+
+/**
+ * POSTs the call as JSON to url. The hook fails unless it gets a 2xx
+ * response, with the response body as the reason.
+ */
+type http_hook struct {
+	url string
+}
+
+func (h *http_hook) run(ctx context.Context, call hook_call) error {
+	payload, err := json.Marshal(call)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		h.url,
+		bytes.NewReader(payload),
+	)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("got status %d: %s", response.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+/**
+ * The hooks to run at each point, in order, before those in the hooks
+ * config key, e.g.
+ *     HOOK_POST_ARCHIVE: {&command_hook{[]string{"/usr/local/bin/index"}}},
+ * The features built on hooks add theirs here at startup, so a reload of
+ * the config leaves them be.
+ */
+var KFS_HOOKS = map[string][]hook{}
+
+var KFS_HOOK_TIMEOUT = 30 * time.Second
+
+var hook_points = map[string]bool{
+	HOOK_PRE_ACCEPT:   true,
+	HOOK_POST_STAGING: true,
+	HOOK_POST_ARCHIVE: true,
+	HOOK_PRE_DELETE:   true,
+}
+
+/**
+ * A hook as written in the hooks config key, by point, e.g.
+ *     {"post-archive": [{"command": ["/usr/local/bin/index"]}],
+ *      "pre-accept": [{"url": "http://policy.local/check"}]}
+ */
+type hook_spec struct {
+	Command []string `json:"command,omitempty"`
+	URL     string   `json:"url,omitempty"`
+}
+
+func (spec hook_spec) hook() (hook, error) {
+	switch {
+	case len(spec.Command) > 0 && spec.URL != "":
+		return nil, fmt.Errorf("a hook is either a command or a url")
+	case len(spec.Command) > 0:
+		return &command_hook{spec.Command}, nil
+	case spec.URL != "":
+		return &http_hook{spec.URL}, nil
+	}
+	return nil, fmt.Errorf("a hook needs a command or a url")
+}
+
+/**
+ * The hooks for each point, as the config gives them.
+ */
+func hooks_from_specs(specs map[string][]hook_spec) (map[string][]hook, error) {
+	hooks := map[string][]hook{}
+	for point, list := range specs {
+		if !hook_points[point] {
+			return nil, fmt.Errorf("unknown hook point '%s'", point)
+		}
+		for _, spec := range list {
+			h, err := spec.hook()
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s hook: %v", point, err)
+			}
+			hooks[point] = append(hooks[point], h)
+		}
+	}
+	return hooks, nil
+}
+
+/**
+ * Run the hooks for the point, stopping at the first one that fails.
+ */
+func run_hooks(ctx context.Context, point string, entry catalog_entry, file string) error {
+	var hooks []hook
+	hooks = append(hooks, KFS_HOOKS[point]...)
+	hooks = append(hooks, settings().hooks[point]...)
+	if len(hooks) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, KFS_HOOK_TIMEOUT)
+	defer cancel()
+	call := hook_call{point, entry, file}
+	for i, h := range hooks {
+		if err := h.run(ctx, call); err != nil {
+			metric_add(
+				"kfs_hook_failures_total",
+				"Hooks that failed or refused the operation.",
+				fmt.Sprintf("point=%q", point),
+				1,
+			)
+			return fmt.Errorf("%s hook %d: %v", point, i, err)
+		}
+	}
+	return nil
+}
+
+/**
+ * Run the hooks for a post- point, which cannot undo anything, so failures
+ * are only logged.
+ */
+func run_post_hooks(point string, entry catalog_entry, file string) {
+	err := run_hooks(context.Background(), point, entry, file)
+	if err != nil {
+		log.Println(err)
+	}
+}
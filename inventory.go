@@ -0,0 +1,159 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+/**
+ * What lives on one of this node's disks, so that before a drive is pulled
+ * it can be checked that every entry on it has a replica on some other
+ * healthy disk, e.g.
+ *     curl 'localhost:8080/admin/disks/inventory?root=/mnt/disk2'
+ * Entries come in order of id, a page at a time; pass the last id seen as
+ * after= to get the next page.
+ */
+
+type inventory_entry struct {
+	catalog_entry
+
+	// replicas of the blob on healthy disks other than this one
+	OtherReplicas int `json:"other_replicas"`
+}
+
+type disk_inventory struct {
+	Root    string            `json:"root"`
+	Entries []inventory_entry `json:"entries"`
+
+	// entries on the disk, and those of them with no replica elsewhere
+	Total    int `json:"total"`
+	OnlyCopy int `json:"only_copy"`
+
+	// the after= for the next page, 0 on the last
+	NextAfter int64 `json:"next_after,omitempty"`
+}
+
+/**
+ * Scan the catalog_columns and then the rest into extra.
+ */
+type extra_scanner struct {
+	row   row_scanner
+	extra []interface{}
+}
+
+func (s extra_scanner) Scan(dest ...interface{}) error {
+	return s.row.Scan(append(dest, s.extra...)...)
+}
+
+// the healthy replicas of the catalog entry's blob other than the one on ?
+const inventory_other_replicas = `
+	(
+		select count(*)
+		from files
+		join disks
+			on disks.node = files.node
+			and disks.root = files.storage_root
+			and not disks.failed
+		where files.hash = catalog.hash
+			and files.hash_algo = catalog.hash_algo
+			and not files.pending
+			and not (files.node = '' and files.storage_root = ?)
+	)
+`
+
+// the catalog entries whose blob has a replica on ?
+const inventory_on_disk = `
+	exists (
+		select 1 from files
+		where files.hash = catalog.hash
+			and files.hash_algo = catalog.hash_algo
+			and files.node = ''
+			and files.storage_root = ?
+	)
+`
+
+func db_disk_inventory(root string, after int64, limit int) (disk_inventory, error) {
+	inventory := disk_inventory{Root: root, Entries: []inventory_entry{}}
+	query := `
+		select
+			count(*),
+			coalesce(sum(` + inventory_other_replicas + ` = 0), 0)
+		from catalog
+		where ` + inventory_on_disk
+	err := db.QueryRow(query, root, root).Scan(&inventory.Total, &inventory.OnlyCopy)
+	if err != nil {
+		return inventory, err
+	}
+
+	query = `
+		select ` + catalog_columns + `, ` + inventory_other_replicas + `
+		from catalog
+		where id > ? and ` + inventory_on_disk + `
+		order by id
+		limit ?
+	`
+	rows, err := db.Query(query, root, after, root, limit)
+	if err != nil {
+		return inventory, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entry inventory_entry
+		entry.catalog_entry, err = scan_catalog_entry(
+			extra_scanner{rows, []interface{}{&entry.OtherReplicas}},
+		)
+		if err != nil {
+			return inventory, err
+		}
+		inventory.Entries = append(inventory.Entries, entry)
+	}
+	if len(inventory.Entries) == limit {
+		inventory.NextAfter = inventory.Entries[limit-1].ID
+	}
+	return inventory, rows.Err()
+}
+
+func handle_disk_inventory(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	params := request.URL.Query()
+	root := params.Get("root")
+	if root == "" {
+		write_error(writer, "inventory requires 'root'", http.StatusBadRequest)
+		return
+	}
+	after, _ := strconv.ParseInt(params.Get("after"), 10, 64)
+	limit := KFS_UI_LIST_LIMIT
+	if s := params.Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 {
+			write_error(writer, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	inventory, err := db_disk_inventory(root, after, limit)
+	if err != nil {
+		log.Printf("could not list what is on '%s': %v", root, err)
+		write_error(writer, "could not list disk", http.StatusInternalServerError)
+		return
+	}
+	write_json(writer, http.StatusOK, inventory)
+}
@@ -0,0 +1,136 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/**
+ * Blobs are stored two directories deep, by the first four characters of
+ * their hash, e.g.
+ *     .kfs/storage/ab/cd/abcdef....blake2b
+ * so that no directory grows to millions of entries, which slows down
+ * every lookup in it. Disks written before this kept every blob directly
+ * in .kfs/storage, so at startup each disk is moved over to the sharded
+ * layout. Only the blobs move, by renaming them within the disk, and
+ * nothing is copied or changed in the database. Once a disk is done, a
+ * marker is left in .kfs/layout, so it is not looked at again.
+ */
+
+const STORAGE_LAYOUT = "sharded"
+
+func layout_marker_path(root string) string {
+	return filepath.Join(root, ".kfs", "layout")
+}
+
+/**
+ * The directories under .kfs/storage that hold the blob. Hashes too short
+ * to shard are kept at the top.
+ */
+func blob_shard(hash string) string {
+	if len(hash) < 4 {
+		return ""
+	}
+	return filepath.Join(hash[0:2], hash[2:4])
+}
+
+/**
+ * The path of the blob on the disk, creating its shard directory so that
+ * the blob can be written there.
+ */
+func make_blob_path(root string, hash string, algo string) (string, error) {
+	path := get_blob_path(root, hash, algo)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+/**
+ * Move every blob kept directly in the disk's storage directory into its
+ * shard, returning how many were moved.
+ */
+func layout_shard_disk(root string) (int, error) {
+	marker, err := os.ReadFile(layout_marker_path(root))
+	if err == nil && strings.TrimSpace(string(marker)) == STORAGE_LAYOUT {
+		return 0, nil
+	}
+	storage_path := get_storage_path(root)
+	entries, err := os.ReadDir(storage_path)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	moved := 0
+	for _, entry := range entries {
+		match := staging_blob_name.FindStringSubmatch(entry.Name())
+		if match == nil || !entry.Type().IsRegular() {
+			continue
+		}
+		src := filepath.Join(storage_path, entry.Name())
+		dst, err := make_blob_path(root, match[1], match[2])
+		if err != nil {
+			return moved, err
+		}
+		if dst == filepath.Clean(src) {
+			continue
+		}
+		if _, err := os.Stat(dst); err == nil {
+			log.Printf("'%s' is already in its shard, leaving '%s'", dst, src)
+			continue
+		}
+		if err := os.Rename(src, dst); err != nil {
+			return moved, fmt.Errorf("could not move '%s': %v", src, err)
+		}
+		moved++
+		if moved%100000 == 0 {
+			log.Printf("moved %d blobs on '%s' so far", moved, root)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(layout_marker_path(root)), 0755); err != nil {
+		return moved, err
+	}
+	err = os.WriteFile(layout_marker_path(root), []byte(STORAGE_LAYOUT+"\n"), 0644)
+	return moved, err
+}
+
+/**
+ * Move each local disk over to the sharded layout, before anything reads
+ * blobs from it.
+ */
+func layout_migrate() {
+	disks, err := db_list_disks()
+	if err != nil {
+		log.Printf("could not list disks to shard: %v", err)
+		return
+	}
+	for _, disk := range disks {
+		moved, err := layout_shard_disk(disk.Root)
+		if err != nil {
+			log.Printf("could not shard '%s': %v", disk.Root, err)
+			continue
+		}
+		if moved > 0 {
+			log.Printf("moved %d blobs on '%s' into shards", moved, disk.Root)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// weight given to the newest sample in the moving average of read latency
+const KFS_LATENCY_SMOOTHING = 0.2
+
+/**
+ * Recent read load of a single disk: how many reads are in flight right
+ * now, and a moving average of how long reads take per megabyte.
+ */
+type disk_load struct {
+	in_flight    int
+	ns_per_mb    float64
+	have_latency bool
+}
+
+var (
+	load_mutex = &sync.Mutex{}
+	disk_loads = map[string]*disk_load{}
+)
+
+func get_disk_load(root string) *disk_load {
+	load, ok := disk_loads[root]
+	if !ok {
+		load = &disk_load{}
+		disk_loads[root] = load
+	}
+	return load
+}
+
+/**
+ * Record that a read from the disk has started. The returned function must
+ * be called with the number of bytes read once the read is finished.
+ */
+func disk_read_start(root string) func(n int64) {
+	start := time.Now()
+	load_mutex.Lock()
+	get_disk_load(root).in_flight++
+	load_mutex.Unlock()
+
+	return func(n int64) {
+		elapsed := time.Since(start)
+		if n > 0 {
+			metric_add("kfs_disk_read_bytes_total", "Bytes of blobs read from the disk.", fmt.Sprintf("root=%q", root), float64(n))
+		}
+		load_mutex.Lock()
+		defer load_mutex.Unlock()
+		load := get_disk_load(root)
+		load.in_flight--
+		if n <= 0 {
+			return
+		}
+		sample := float64(elapsed.Nanoseconds()) / (float64(n) / (1 << 20))
+		if !load.have_latency {
+			load.ns_per_mb = sample
+			load.have_latency = true
+		} else {
+			load.ns_per_mb = KFS_LATENCY_SMOOTHING*sample +
+				(1-KFS_LATENCY_SMOOTHING)*load.ns_per_mb
+		}
+	}
+}
+
+/**
+ * Order replicas so the least busy disk comes first: fewest reads in flight,
+ * then lowest recent latency. Disks that have not been read from yet sort
+ * before ones with a known latency, so every disk gets measured.
+ */
+func order_replicas(roots []string) []string {
+	ordered := make([]string, len(roots))
+	copy(ordered, roots)
+
+	load_mutex.Lock()
+	defer load_mutex.Unlock()
+	sort.SliceStable(ordered, func(i, j int) bool {
+		a := get_disk_load(ordered[i])
+		b := get_disk_load(ordered[j])
+		if a.in_flight != b.in_flight {
+			return a.in_flight < b.in_flight
+		}
+		if a.have_latency != b.have_latency {
+			return !a.have_latency
+		}
+		return a.ns_per_mb < b.ns_per_mb
+	})
+	return ordered
+}
@@ -0,0 +1,234 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+/**
+ * Where each replica of a blob is, and how it fared the last time it was
+ * hashed, whether for a verified download, a repair, or as the source of a
+ * new replica.
+ */
+
+const (
+	REPLICA_VERIFIED   = "verified"
+	REPLICA_UNVERIFIED = "unverified"
+	REPLICA_CORRUPT    = "corrupt"
+	REPLICA_MISSING    = "missing"
+	REPLICA_REMOTE     = "remote"
+	REPLICA_PENDING    = "pending"
+)
+
+type replica_location struct {
+	Node       string     `json:"node,omitempty"`
+	Root       string     `json:"root"`
+	Size       int64      `json:"size"`
+	Status     string     `json:"status"`
+	DiskFailed bool       `json:"disk_failed"`
+	StoredAt   *time.Time `json:"stored_at,omitempty"`
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+}
+
+type blob_location struct {
+	Hash     string             `json:"hash"`
+	HashAlgo string             `json:"hash_algo"`
+	Replicas []replica_location `json:"replicas"`
+}
+
+/**
+ * Note the outcome of hashing the replica on one of this node's disks.
+ */
+func db_record_verify(hash string, algo string, root string, ok bool) {
+	labels := fmt.Sprintf("root=%q", root)
+	metric_add("kfs_disk_verifications_total", "Replicas on the disk checked against their hash.", labels, 1)
+	if !ok {
+		metric_add("kfs_disk_verify_failures_total", "Replicas on the disk that did not match their hash.", labels, 1)
+	}
+	stmt := `
+		update files set verified_at = ?, verify_ok = ?
+		where hash = ? and hash_algo = ? and node = '' and storage_root = ?
+	`
+	if _, err := db_exec(stmt, time.Now().Unix(), ok, hash, algo, root); err != nil {
+		log.Printf("could not record verification of %s on '%s': %v", hash, root, err)
+	}
+}
+
+type disk_scrub struct {
+	Root       string
+	Replicas   int64
+	Verified   int64
+	Corrupt    int64
+	VerifiedAt *time.Time
+	Filesystem *fs_disk_status
+}
+
+/**
+ * How far hashing has got through each local disk's replicas: when one was
+ * last checked, how many have been, and how many did not match. Disks on a
+ * filesystem kfs relies on also carry that filesystem's last scrub.
+ */
+func db_list_scrubs() ([]disk_scrub, error) {
+	query := `
+		select
+			disks.root,
+			count(files.hash),
+			count(files.verified_at),
+			coalesce(sum(files.verify_ok = 0), 0),
+			max(files.verified_at)
+		from disks
+		left join files
+			on files.node = disks.node
+			and files.storage_root = disks.root
+			and files.pending = 0
+		where disks.node = ''
+		group by disks.root
+		order by disks.root
+	`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("could not query scrubs: %v", err)
+	}
+	defer rows.Close()
+
+	var scrubs []disk_scrub
+	for rows.Next() {
+		var scrub disk_scrub
+		var verified_at sql.NullInt64
+		err := rows.Scan(
+			&scrub.Root,
+			&scrub.Replicas,
+			&scrub.Verified,
+			&scrub.Corrupt,
+			&verified_at,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if verified_at.Valid {
+			t := time.Unix(verified_at.Int64, 0)
+			scrub.VerifiedAt = &t
+		}
+		if status, ok := fs_status(scrub.Root); ok && status.Filesystem != "" {
+			scrub.Filesystem = &status
+		}
+		scrubs = append(scrubs, scrub)
+	}
+	return scrubs, rows.Err()
+}
+
+func db_locate(hash string) (blob_location, error) {
+	query := `
+		select
+			files.hash_algo,
+			files.node,
+			files.storage_root,
+			coalesce(files.size, 0),
+			files.created_at,
+			files.verified_at,
+			files.verify_ok,
+			files.pending,
+			coalesce(disks.failed, 1)
+		from files
+		left join disks
+			on disks.node = files.node
+			and disks.root = files.storage_root
+		where files.hash = ?
+		order by files.node, files.storage_root
+	`
+	location := blob_location{Hash: hash, Replicas: []replica_location{}}
+	rows, err := db.Query(query, hash)
+	if err != nil {
+		return location, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var replica replica_location
+		var created_at, verified_at sql.NullInt64
+		var verify_ok sql.NullBool
+		var pending bool
+		err := rows.Scan(
+			&location.HashAlgo,
+			&replica.Node,
+			&replica.Root,
+			&replica.Size,
+			&created_at,
+			&verified_at,
+			&verify_ok,
+			&pending,
+			&replica.DiskFailed,
+		)
+		if err != nil {
+			return location, err
+		}
+		if created_at.Valid {
+			t := time.Unix(created_at.Int64, 0)
+			replica.StoredAt = &t
+		}
+		if verified_at.Valid {
+			t := time.Unix(verified_at.Int64, 0)
+			replica.VerifiedAt = &t
+		}
+		switch {
+		case pending:
+			replica.Status = REPLICA_PENDING
+		case replica.Node != "":
+			replica.Status = REPLICA_REMOTE
+		case verify_ok.Valid && !verify_ok.Bool:
+			replica.Status = REPLICA_CORRUPT
+		case verify_ok.Valid:
+			replica.Status = REPLICA_VERIFIED
+		default:
+			replica.Status = REPLICA_UNVERIFIED
+		}
+		if replica.Node == "" && !pending {
+			path := get_blob_path(replica.Root, hash, location.HashAlgo)
+			if _, err := os.Stat(path); os.IsNotExist(err) {
+				replica.Status = REPLICA_MISSING
+			}
+		}
+		location.Replicas = append(location.Replicas, replica)
+	}
+	return location, rows.Err()
+}
+
+/**
+ * List every disk holding the blob, e.g.
+ *     curl localhost:8080/locate/<hash>
+ */
+func handle_locate(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	location, err := db_locate(p.ByName("hash"))
+	if err != nil {
+		log.Printf("could not locate %s: %v", p.ByName("hash"), err)
+		write_error(writer, "could not look up hash", http.StatusInternalServerError)
+		return
+	}
+	if len(location.Replicas) == 0 {
+		write_error(writer, "no such hash", http.StatusNotFound)
+		return
+	}
+	write_json(writer, http.StatusOK, location)
+}
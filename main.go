@@ -21,8 +21,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-
-	"github.com/julienschmidt/httprouter"
+	"os"
 )
 
 const (
@@ -30,17 +29,155 @@ const (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		bench_main(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "put" {
+		put_main(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "get" {
+		get_main(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "queue" {
+		queue_main(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		restore_main(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "agent" {
+		agent_main(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "rebuild-catalog" {
+		rebuild_main(os.Args[2:])
+		return
+	}
 	fmt.Println("KFS -- Kyle's File Storage")
 	fmt.Printf("version: %s\n", KFS_VERSION)
+	config_load()
+	cluster_init()
+	events_init()
+	clamav_init()
+	thumbnails_init()
+	media_init()
+	search_hooks_init()
+	standby_restore()
 	db_init()
 	defer db_close()
-	mux := httprouter.New()
-	mux.GET("/", index)
-	mux.POST("/upload", handle_upload)
-	mux.GET("/exists/:hash", handle_exists)
+	layout_migrate()
+	go staging_recover()
+	go repair_worker()
+	cache_init()
+	go db_maintenance_loop()
+	go cluster_loop()
+	go standby_loop()
+	go geo_loop()
+	go mirror_loop()
+	go smart_loop()
+	go fs_loop()
+	go space_loop()
+	go replicas_loop()
+	go disk_restore_loop()
+	go multipart_loop()
+	go gc_loop()
+	go retention_loop()
+	go stats_loop()
+	go upload_state_loop()
+	go catalog_snapshot_loop()
+	go sync_loop()
+	mux, api := api_new_router()
+	api.GET("/", index)
+	api.POST("/upload", writable(handle_upload))
+	api.PUT("/blob/:hash", writable(handle_blob_put))
+	api.PUT("/blob", writable(handle_blob_put_trailer))
+	api.HEAD("/blob/:hash", handle_blob_head)
+	api.GET("/exists/:hash", handle_exists)
+	api.GET("/download/:hash", handle_download)
+	api.POST("/download/archive", handle_download_archive)
+	api.GET("/locate/:hash", handle_locate)
+	api.GET("/signature/:hash", handle_signature)
+	api.POST("/delta/:hash", writable(handle_delta))
+	api.POST("/append/:namespace/*name", writable(handle_append))
+	api.GET("/append/:namespace/*name", handle_append_get)
+	api.POST("/multipart", writable(handle_multipart_start))
+	api.GET("/multipart/:id", handle_multipart_get)
+	api.PUT("/multipart/:id/:part", writable(handle_multipart_part))
+	api.POST("/multipart/:id/complete", writable(handle_multipart_complete))
+	api.DELETE("/multipart/:id", writable(handle_multipart_abort))
+	api.POST("/preview", handle_preview)
+	api.POST("/sync", writable(handle_sync_start))
+	api.GET("/sync/:id", handle_sync_get)
+	api.POST("/sync/:id/blob", writable(handle_sync_blob))
+	api.POST("/sync/:id/commit", writable(handle_sync_commit))
+	api.DELETE("/sync/:id", writable(handle_sync_abort))
+	api.GET("/admin", admin_auth(handle_admin))
+	api.GET("/backups", handle_backups)
+	api.POST("/backups/report", admin_auth(handle_backup_report))
+	api.GET("/progress/:session", handle_progress)
+	api.GET("/upload/:id/status", handle_upload_status)
+	api.GET("/catalog/:id", handle_catalog_get)
+	api.POST("/catalog/:id/rename", writable(handle_catalog_rename))
+	api.POST("/catalog/:id/move", writable(handle_catalog_move))
+	api.POST("/catalog/:id/copy", writable(handle_catalog_copy))
+	api.POST("/catalog/:id/pin", writable(handle_catalog_pin(true)))
+	api.POST("/catalog/:id/unpin", admin_auth(writable(handle_catalog_pin(false))))
+	api.POST("/catalog/:id/hold", admin_auth(writable(handle_catalog_hold)))
+	api.GET("/replicas", handle_replicas_get)
+	api.POST("/replicas", admin_auth(writable(handle_replicas_set)))
+	api.POST("/copy", writable(handle_copy))
+	api.GET("/ls", handle_ls)
+	api.GET("/path/:namespace/*filepath", handle_download_path)
+	api.GET("/metrics", handle_metrics)
+	api.GET("/ring", handle_ring)
+	api.GET("/thumb/:hash", handle_thumb)
+	api.GET("/media", handle_media)
+	api.GET("/search", handle_search)
+	api.GET("/stats", handle_stats)
+	api.GET("/stats/history", handle_stats_history)
+	api.GET("/capacity", handle_capacity)
+	api.POST("/admin/reload", admin_auth(handle_admin_reload))
+	api.GET("/admin/read-only", handle_read_only_get)
+	api.POST("/admin/read-only", admin_auth(handle_read_only_set))
+	api.POST("/admin/disks/fail", admin_auth(handle_disk_failed(true)))
+	api.POST("/admin/disks/restore", admin_auth(handle_disk_failed(false)))
+	api.GET("/admin/disks/inventory", admin_auth(handle_disk_inventory))
+	api.POST("/admin/disks/replace", admin_auth(handle_disk_replace))
+	api.GET("/admin/disks/replace", admin_auth(handle_disk_replacements))
+	api.GET("/admin/disks/filesystems", admin_auth(handle_fs_status))
+	api.GET("/admin/audit", admin_auth(handle_audit))
+	api.POST("/admin/snapshot", admin_auth(handle_catalog_snapshot))
+	api.GET("/admin/gc", admin_auth(handle_gc(true)))
+	api.POST("/admin/gc", admin_auth(writable(handle_gc(false))))
+	api.GET("/admin/retention", admin_auth(handle_retention(true)))
+	api.POST("/admin/retention", admin_auth(writable(handle_retention(false))))
+	api.GET("/cluster/state", cluster_auth(handle_cluster_state))
+	api.POST("/cluster/catalog", cluster_auth(handle_cluster_catalog))
+	api.GET("/cluster/offset/:hash", cluster_auth(handle_cluster_offset))
+	api.PUT("/cluster/blob/:hash", cluster_auth(handle_cluster_put_blob))
+	api.GET("/cluster/blob/:hash", cluster_auth(handle_cluster_get_blob))
+	api.PUT("/cluster/db", cluster_auth(handle_cluster_put_db))
+	api.POST("/cluster/db/changes", cluster_auth(handle_cluster_db_changes))
+	api.GET("/cluster/changes", cluster_auth(handle_cluster_changes))
+	api.GET("/cluster/import/:hash", cluster_auth(handle_cluster_import_offset))
+	api.PUT("/cluster/import/:hash", cluster_auth(handle_cluster_import))
+	api.GET("/cluster/db/:node", cluster_auth(handle_cluster_get_db))
+	api.HEAD("/cluster/db/:node", cluster_auth(handle_cluster_get_db))
 	server := &http.Server{
-		Addr:    "0.0.0.0:8080",
-		Handler: mux,
+		Handler: proxy_handler(cors_handler(mux)),
+	}
+	listener, err := systemd_listener()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := sd_notify("READY=1"); err != nil {
+		log.Printf("could not notify systemd: %v", err)
 	}
-	log.Fatal(server.ListenAndServe())
+	go config_signal_loop()
+	go sd_watchdog_loop()
+	log.Fatal(server.Serve(listener))
 }
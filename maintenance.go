@@ -0,0 +1,130 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+var (
+	// how often to run the database maintenance job
+	KFS_DB_MAINTENANCE_INTERVAL = 24 * time.Hour
+
+	// free pages returned to the filesystem by each maintenance run
+	KFS_DB_VACUUM_PAGES = 10000
+)
+
+func db_maintenance_loop() {
+	for {
+		time.Sleep(KFS_DB_MAINTENANCE_INTERVAL)
+		db_maintenance()
+	}
+}
+
+/**
+ * Refresh the query planner's statistics, give back free pages, and check
+ * the database for corruption. Results are logged and exported as metrics,
+ * so a failed integrity check shows up long before a query hits the bad
+ * page.
+ */
+func db_maintenance() {
+	start := time.Now()
+	log.Println("starting database maintenance")
+
+	if _, err := db_exec(`ANALYZE`); err != nil {
+		log.Printf("ANALYZE failed: %v", err)
+	}
+
+	vacuum := fmt.Sprintf(`PRAGMA incremental_vacuum(%d)`, KFS_DB_VACUUM_PAGES)
+	if _, err := db_exec(vacuum); err != nil {
+		log.Printf("incremental vacuum failed: %v", err)
+	}
+
+	var page_count, freelist_count int64
+	db.QueryRow(`PRAGMA page_count`).Scan(&page_count)
+	db.QueryRow(`PRAGMA freelist_count`).Scan(&freelist_count)
+	metric_set(
+		"kfs_db_pages",
+		"Pages in the metadata database",
+		"",
+		float64(page_count),
+	)
+	metric_set(
+		"kfs_db_free_pages",
+		"Unused pages in the metadata database",
+		"",
+		float64(freelist_count),
+	)
+
+	problems, err := db_integrity_check()
+	healthy := 1.0
+	if err != nil {
+		log.Printf("integrity check failed to run: %v", err)
+		healthy = 0
+	}
+	for _, problem := range problems {
+		log.Printf("integrity check: %s", problem)
+		healthy = 0
+	}
+	metric_set(
+		"kfs_db_integrity_ok",
+		"1 if the last integrity check of the metadata database passed",
+		"",
+		healthy,
+	)
+
+	elapsed := time.Since(start)
+	metric_set(
+		"kfs_db_maintenance_last_run_timestamp_seconds",
+		"When database maintenance last finished",
+		"",
+		float64(time.Now().Unix()),
+	)
+	metric_set(
+		"kfs_db_maintenance_duration_seconds",
+		"How long the last database maintenance took",
+		"",
+		elapsed.Seconds(),
+	)
+	log.Printf("database maintenance finished in %s", elapsed)
+}
+
+/**
+ * Every problem reported by PRAGMA integrity_check, which is empty when the
+ * database is healthy.
+ */
+func db_integrity_check() ([]string, error) {
+	rows, err := db.Query(`PRAGMA integrity_check`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return nil, err
+		}
+		if line != "ok" {
+			problems = append(problems, line)
+		}
+	}
+	return problems, rows.Err()
+}
@@ -0,0 +1,576 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+/**
+ * Metadata about the media in each blob: when and with what a photo was
+ * taken and where, read from its EXIF, and how long a recording is and how
+ * it is encoded, read with ffprobe. It is extracted once the blob is
+ * archived and kept in the media table, which /media searches.
+ *
+ * Capture times are the camera's clock time, stored as if it were UTC, so
+ * that "taken in June 2022" means June 2022 wherever the photo was taken.
+ */
+
+// audio and video are only examined when this is on the PATH
+var KFS_FFPROBE = "ffprobe"
+
+type media_info struct {
+	MimeType  string   `json:"mime_type"`
+	TakenAt   int64    `json:"taken_at,omitempty"`
+	Make      string   `json:"make,omitempty"`
+	Model     string   `json:"model,omitempty"`
+	Latitude  *float64 `json:"latitude,omitempty"`
+	Longitude *float64 `json:"longitude,omitempty"`
+	Width     int      `json:"width,omitempty"`
+	Height    int      `json:"height,omitempty"`
+	Duration  float64  `json:"duration,omitempty"`
+	Codecs    string   `json:"codecs,omitempty"`
+}
+
+func media_init() {
+	KFS_HOOKS[HOOK_POST_ARCHIVE] = append(
+		KFS_HOOKS[HOOK_POST_ARCHIVE],
+		hook_func(media_hook),
+	)
+}
+
+type tiff_entry struct {
+	kind  uint16
+	count uint32
+	value []byte
+}
+
+type tiff struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+/**
+ * The entries of the IFD at offset, keyed by tag, with values that do not
+ * fit in an entry read from where they are pointed to.
+ */
+func (t tiff) ifd(offset uint32) map[uint16]tiff_entry {
+	entries := map[uint16]tiff_entry{}
+	if int(offset)+2 > len(t.data) {
+		return entries
+	}
+	n := int(t.order.Uint16(t.data[offset:]))
+	sizes := map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+	for i := 0; i < n; i++ {
+		start := int(offset) + 2 + 12*i
+		if start+12 > len(t.data) {
+			break
+		}
+		raw := t.data[start : start+12]
+		entry := tiff_entry{
+			kind:  t.order.Uint16(raw[2:]),
+			count: t.order.Uint32(raw[4:]),
+		}
+		size := sizes[entry.kind] * entry.count
+		if size <= 4 {
+			entry.value = raw[8 : 8+size]
+		} else {
+			at := t.order.Uint32(raw[8:])
+			if uint64(at)+uint64(size) > uint64(len(t.data)) {
+				continue
+			}
+			entry.value = t.data[at : at+size]
+		}
+		entries[t.order.Uint16(raw)] = entry
+	}
+	return entries
+}
+
+func (t tiff) ascii(entry tiff_entry) string {
+	return strings.TrimSpace(strings.TrimRight(string(entry.value), "\x00"))
+}
+
+func (t tiff) long(entry tiff_entry) uint32 {
+	switch {
+	case entry.kind == 3 && len(entry.value) >= 2:
+		return uint32(t.order.Uint16(entry.value))
+	case entry.kind == 4 && len(entry.value) >= 4:
+		return t.order.Uint32(entry.value)
+	}
+	return 0
+}
+
+func (t tiff) rationals(entry tiff_entry) []float64 {
+	var values []float64
+	for i := 0; i+8 <= len(entry.value); i += 8 {
+		num := t.order.Uint32(entry.value[i:])
+		den := t.order.Uint32(entry.value[i+4:])
+		if den == 0 {
+			values = append(values, 0)
+			continue
+		}
+		values = append(values, float64(num)/float64(den))
+	}
+	return values
+}
+
+/**
+ * Degrees from the degrees, minutes and seconds GPS coordinates are stored
+ * as, negative when ref is south or west.
+ */
+func gps_degrees(t tiff, gps map[uint16]tiff_entry, tag uint16, ref_tag uint16) *float64 {
+	entry, ok := gps[tag]
+	if !ok {
+		return nil
+	}
+	dms := t.rationals(entry)
+	if len(dms) != 3 {
+		return nil
+	}
+	degrees := dms[0] + dms[1]/60 + dms[2]/3600
+	if ref := t.ascii(gps[ref_tag]); ref == "S" || ref == "W" {
+		degrees = -degrees
+	}
+	return &degrees
+}
+
+/**
+ * Find the EXIF segment of a JPEG, which comes before the image data.
+ */
+func read_exif(f io.Reader) ([]byte, error) {
+	reader := bufio.NewReader(f)
+	var soi [2]byte
+	if _, err := io.ReadFull(reader, soi[:]); err != nil {
+		return nil, err
+	}
+	if soi != [2]byte{0xff, 0xd8} {
+		return nil, fmt.Errorf("not a JPEG")
+	}
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			return nil, err
+		}
+		if header[0] != 0xff || header[1] == 0xda {
+			return nil, nil
+		}
+		length := int(binary.BigEndian.Uint16(header[2:])) - 2
+		if length < 0 {
+			return nil, fmt.Errorf("invalid JPEG segment")
+		}
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(reader, segment); err != nil {
+			return nil, err
+		}
+		if header[1] == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:], nil
+		}
+	}
+}
+
+func parse_exif(data []byte, info *media_info) {
+	if len(data) < 8 {
+		return
+	}
+	t := tiff{data: data}
+	switch string(data[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return
+	}
+	ifd0 := t.ifd(t.order.Uint32(data[4:]))
+	info.Make = t.ascii(ifd0[0x010f])
+	info.Model = t.ascii(ifd0[0x0110])
+	taken := t.ascii(ifd0[0x0132])
+	if pointer, ok := ifd0[0x8769]; ok {
+		exif := t.ifd(t.long(pointer))
+		if original := t.ascii(exif[0x9003]); original != "" {
+			taken = original
+		}
+	}
+	if at, err := time.Parse("2006:01:02 15:04:05", taken); err == nil {
+		info.TakenAt = at.Unix()
+	}
+	if pointer, ok := ifd0[0x8825]; ok {
+		gps := t.ifd(t.long(pointer))
+		info.Latitude = gps_degrees(t, gps, 2, 1)
+		info.Longitude = gps_degrees(t, gps, 4, 3)
+	}
+}
+
+type ffprobe_output struct {
+	Streams []struct {
+		CodecType string `json:"codec_type"`
+		CodecName string `json:"codec_name"`
+		Width     int    `json:"width"`
+		Height    int    `json:"height"`
+	} `json:"streams"`
+	Format struct {
+		Duration string            `json:"duration"`
+		Tags     map[string]string `json:"tags"`
+	} `json:"format"`
+}
+
+func probe_media(ctx context.Context, filename string, info *media_info) error {
+	if _, err := exec.LookPath(KFS_FFPROBE); err != nil {
+		return nil
+	}
+	cmd := exec.CommandContext(
+		ctx,
+		KFS_FFPROBE,
+		"-v", "quiet",
+		"-print_format", "json",
+		"-show_format",
+		"-show_streams",
+		filename,
+	)
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("ffprobe failed: %v", err)
+	}
+	var probe ffprobe_output
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return err
+	}
+	var codecs []string
+	for _, stream := range probe.Streams {
+		codecs = append(codecs, stream.CodecName)
+		if stream.CodecType == "video" && info.Width == 0 {
+			info.Width, info.Height = stream.Width, stream.Height
+		}
+	}
+	info.Codecs = strings.Join(codecs, ",")
+	info.Duration, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	if created := probe.Format.Tags["creation_time"]; created != "" {
+		if at, err := time.Parse(time.RFC3339Nano, created); err == nil {
+			info.TakenAt = at.Unix()
+		}
+	}
+	return nil
+}
+
+func db_add_media(hash string, algo string, info media_info) error {
+	stmt := `
+		INSERT OR REPLACE INTO media(
+			hash,
+			hash_algo,
+			mime_type,
+			taken_at,
+			make,
+			model,
+			latitude,
+			longitude,
+			width,
+			height,
+			duration,
+			codecs
+		) values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	null_int := func(n int64) sql.NullInt64 {
+		return sql.NullInt64{Int64: n, Valid: n != 0}
+	}
+	null_float := func(f *float64) sql.NullFloat64 {
+		if f == nil {
+			return sql.NullFloat64{}
+		}
+		return sql.NullFloat64{Float64: *f, Valid: true}
+	}
+	_, err := db_exec(
+		stmt,
+		hash,
+		algo,
+		info.MimeType,
+		null_int(info.TakenAt),
+		info.Make,
+		info.Model,
+		null_float(info.Latitude),
+		null_float(info.Longitude),
+		info.Width,
+		info.Height,
+		info.Duration,
+		info.Codecs,
+	)
+	return err
+}
+
+func media_hook(ctx context.Context, call hook_call) error {
+	entry := call.Entry
+	if db_is_thumbnail(entry.Hash, entry.HashAlgo) {
+		return nil
+	}
+	f, err := os.Open(call.File)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	mime_type, err := detect_mime_type(f)
+	if err != nil {
+		return err
+	}
+	info := media_info{MimeType: mime_type}
+
+	switch {
+	case strings.HasPrefix(mime_type, "image/"):
+		if config, _, err := image.DecodeConfig(f); err == nil {
+			info.Width, info.Height = config.Width, config.Height
+		}
+		if mime_type == "image/jpeg" {
+			f.Seek(0, io.SeekStart)
+			if data, err := read_exif(f); err == nil && data != nil {
+				parse_exif(data, &info)
+			}
+		}
+	case strings.HasPrefix(mime_type, "audio/"),
+		strings.HasPrefix(mime_type, "video/"),
+		mime_type == "application/ogg":
+		if err := probe_media(ctx, call.File, &info); err != nil {
+			log.Printf("could not probe %s: %v", entry.Hash, err)
+		}
+	default:
+		return nil
+	}
+	return db_add_media(entry.Hash, entry.HashAlgo, info)
+}
+
+type media_entry struct {
+	catalog_entry
+	Media media_info `json:"media"`
+}
+
+type media_query struct {
+	Namespace    string
+	Kind         string
+	TakenAfter   int64
+	TakenBefore  int64
+	Camera       string
+	MinLatitude  float64
+	MinLongitude float64
+	MaxLatitude  float64
+	MaxLongitude float64
+	HasBox       bool
+	Limit        int
+}
+
+func db_search_media(q media_query) ([]media_entry, error) {
+	query := `
+		select ` + catalog_columns + `,
+			media.mime_type,
+			coalesce(media.taken_at, 0),
+			media.make,
+			media.model,
+			media.latitude,
+			media.longitude,
+			media.width,
+			media.height,
+			media.duration,
+			media.codecs
+		from catalog
+		join media using (hash, hash_algo)
+		where catalog.namespace = ?
+			and substr(media.mime_type, 1, length(?)) = ?
+			and (? = 0 or media.taken_at >= ?)
+			and (? = 0 or media.taken_at < ?)
+			and (? = '' or media.make || ' ' || media.model like '%' || ? || '%')
+			and (
+				not ?
+				or media.latitude between ? and ?
+				and media.longitude between ? and ?
+			)
+		order by media.taken_at, catalog.id
+		limit ?
+	`
+	rows, err := db.Query(
+		query,
+		q.Namespace,
+		q.Kind, q.Kind,
+		q.TakenAfter, q.TakenAfter,
+		q.TakenBefore, q.TakenBefore,
+		q.Camera, q.Camera,
+		q.HasBox,
+		q.MinLatitude, q.MaxLatitude,
+		q.MinLongitude, q.MaxLongitude,
+		q.Limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not search media: %v", err)
+	}
+	defer rows.Close()
+
+	results := []media_entry{}
+	for rows.Next() {
+		var result media_entry
+		var latitude, longitude sql.NullFloat64
+		err := rows.Scan(
+			&result.ID,
+			&result.Namespace,
+			&result.Path,
+			&result.Filename,
+			&result.Hash,
+			&result.HashAlgo,
+			&result.Size,
+			&result.CreatedAt,
+			&result.Pinned,
+			&result.Held,
+			&result.RetainUntil,
+			&result.Media.MimeType,
+			&result.Media.TakenAt,
+			&result.Media.Make,
+			&result.Media.Model,
+			&latitude,
+			&longitude,
+			&result.Media.Width,
+			&result.Media.Height,
+			&result.Media.Duration,
+			&result.Media.Codecs,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if latitude.Valid && longitude.Valid {
+			result.Media.Latitude = &latitude.Float64
+			result.Media.Longitude = &longitude.Float64
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+/**
+ * The start and end of the year, month or day given as 2022, 2022-06 or
+ * 2022-06-15.
+ */
+func parse_date_range(s string) (int64, int64, error) {
+	for _, layout := range []string{"2006-01-02", "2006-01", "2006"} {
+		start, err := time.Parse(layout, s)
+		if err != nil {
+			continue
+		}
+		var end time.Time
+		switch layout {
+		case "2006-01-02":
+			end = start.AddDate(0, 0, 1)
+		case "2006-01":
+			end = start.AddDate(0, 1, 0)
+		default:
+			end = start.AddDate(1, 0, 0)
+		}
+		return start.Unix(), end.Unix(), nil
+	}
+	return 0, 0, fmt.Errorf("invalid date: '%s'", s)
+}
+
+/**
+ * Search the media in a namespace, e.g. the photos taken in June 2022:
+ *     curl 'localhost:8080/media?kind=image&taken=2022-06'
+ * kind is a MIME type prefix, taken_after and taken_before are dates or
+ * unix times, camera matches the make and model, and bbox is
+ * min_lat,min_lon,max_lat,max_lon.
+ */
+func handle_media(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	params := request.URL.Query()
+	q := media_query{
+		Namespace: params.Get("namespace"),
+		Kind:      params.Get("kind"),
+		Camera:    params.Get("camera"),
+		Limit:     KFS_UI_LIST_LIMIT,
+	}
+	if q.Namespace == "" {
+		q.Namespace = KFS_DEFAULT_NAMESPACE
+	}
+	bad_request := func(msg string) {
+		write_error(writer, msg, http.StatusBadRequest)
+	}
+	parse_time := func(s string) (int64, error) {
+		// a bare year is a date, not a unix time
+		if t, err := strconv.ParseInt(s, 10, 64); err == nil && len(s) > 4 {
+			return t, nil
+		}
+		start, _, err := parse_date_range(s)
+		return start, err
+	}
+	var err error
+	if taken := params.Get("taken"); taken != "" {
+		if q.TakenAfter, q.TakenBefore, err = parse_date_range(taken); err != nil {
+			bad_request(err.Error())
+			return
+		}
+	}
+	if after := params.Get("taken_after"); after != "" {
+		if q.TakenAfter, err = parse_time(after); err != nil {
+			bad_request(err.Error())
+			return
+		}
+	}
+	if before := params.Get("taken_before"); before != "" {
+		if q.TakenBefore, err = parse_time(before); err != nil {
+			bad_request(err.Error())
+			return
+		}
+	}
+	if bbox := params.Get("bbox"); bbox != "" {
+		var box [4]float64
+		fields := strings.Split(bbox, ",")
+		if len(fields) != 4 {
+			bad_request("bbox must be min_lat,min_lon,max_lat,max_lon")
+			return
+		}
+		for i, field := range fields {
+			if box[i], err = strconv.ParseFloat(field, 64); err != nil {
+				bad_request("bbox must be min_lat,min_lon,max_lat,max_lon")
+				return
+			}
+		}
+		q.HasBox = true
+		q.MinLatitude, q.MinLongitude = box[0], box[1]
+		q.MaxLatitude, q.MaxLongitude = box[2], box[3]
+	}
+	if limit := params.Get("limit"); limit != "" {
+		if q.Limit, err = strconv.Atoi(limit); err != nil || q.Limit < 1 {
+			bad_request("invalid limit")
+			return
+		}
+	}
+
+	results, err := db_search_media(q)
+	if err != nil {
+		log.Println(err)
+		write_error(writer, "could not search media", http.StatusInternalServerError)
+		return
+	}
+	write_json(writer, http.StatusOK, results)
+}
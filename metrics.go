@@ -0,0 +1,107 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+type metric struct {
+	kind   string
+	help   string
+	values map[string]float64
+}
+
+/**
+ * Metrics exported on /metrics in the Prometheus text format. Values are
+ * keyed by their label set, written the way it appears in the output, e.g.
+ * `root="/mnt/disk1"`, or the empty string for a metric without labels.
+ */
+var (
+	metrics_mutex = &sync.Mutex{}
+	metrics       = map[string]*metric{}
+)
+
+func get_metric(name string, kind string, help string) *metric {
+	m, ok := metrics[name]
+	if !ok {
+		m = &metric{kind, help, map[string]float64{}}
+		metrics[name] = m
+	}
+	return m
+}
+
+func metric_add(name string, help string, labels string, value float64) {
+	metrics_mutex.Lock()
+	get_metric(name, "counter", help).values[labels] += value
+	metrics_mutex.Unlock()
+}
+
+func metric_set(name string, help string, labels string, value float64) {
+	metrics_mutex.Lock()
+	get_metric(name, "gauge", help).values[labels] = value
+	metrics_mutex.Unlock()
+}
+
+/**
+ * Drop every value of a gauge, before setting those that still apply, so
+ * label sets that no longer do are not exported.
+ */
+func metric_clear(name string) {
+	metrics_mutex.Lock()
+	if m, ok := metrics[name]; ok {
+		m.values = map[string]float64{}
+	}
+	metrics_mutex.Unlock()
+}
+
+func handle_metrics(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	archive_queue_metrics()
+
+	metrics_mutex.Lock()
+	defer metrics_mutex.Unlock()
+
+	var names []string
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, name := range names {
+		m := metrics[name]
+		fmt.Fprintf(writer, "# HELP %s %s\n", name, m.help)
+		fmt.Fprintf(writer, "# TYPE %s %s\n", name, m.kind)
+		var label_sets []string
+		for labels := range m.values {
+			label_sets = append(label_sets, labels)
+		}
+		sort.Strings(label_sets)
+		for _, labels := range label_sets {
+			if labels == "" {
+				fmt.Fprintf(writer, "%s %g\n", name, m.values[labels])
+			} else {
+				fmt.Fprintf(writer, "%s{%s} %g\n", name, labels, m.values[labels])
+			}
+		}
+	}
+}
@@ -0,0 +1,343 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+/**
+ * A mirror is a read-only copy of another kfs server, the primary. It
+ * follows the primary's catalog log, fetching every blob it does not have
+ * yet, and serves downloads, but turns away uploads and catalog changes.
+ * Catalog entries keep the ids they have on the primary, so a mirror can be
+ * promoted to take over from the primary by clearing KFS_MIRROR_OF.
+ *
+ * The mirror has to share KFS_CLUSTER_SECRET with the primary.
+ */
+
+// base URL of the primary, empty unless this server is a mirror, mirror_of in
+// the config
+var KFS_MIRROR_OF = ""
+
+var KFS_MIRROR_INTERVAL = 30 * time.Second
+
+// how many catalog changes are fetched at a time
+var KFS_MIRROR_BATCH = 500
+
+type catalog_change struct {
+	Seq   int64          `json:"seq"`
+	ID    int64          `json:"id"`
+	Entry *catalog_entry `json:"entry"`
+
+	// the node the entry was added on, and its id there
+	Origin   string `json:"origin,omitempty"`
+	OriginID int64  `json:"origin_id,omitempty"`
+}
+
+type catalog_changes struct {
+	Changes []catalog_change `json:"changes"`
+}
+
+func mirror_enabled() bool {
+	return KFS_MIRROR_OF != ""
+}
+
+/**
+ * Turn away requests that would change anything when this server is a
+ * mirror, or while it is in maintenance mode.
+ */
+func writable(handle httprouter.Handle) httprouter.Handle {
+	return func(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+		if mirror_enabled() {
+			write_error(
+				writer,
+				fmt.Sprintf("read-only mirror of %s", KFS_MIRROR_OF),
+				http.StatusForbidden,
+			)
+			return
+		}
+		if !read_only_check(writer) {
+			return
+		}
+		handle(writer, request, p)
+	}
+}
+
+/**
+ * The catalog changes after seq, each with the entry as it is now, or a nil
+ * entry if it no longer exists. With local, only the changes made on this
+ * node are listed, not those replicated to it.
+ */
+func db_list_catalog_changes(after int64, limit int, local bool) ([]catalog_change, error) {
+	query := `
+		select
+			catalog_log.seq,
+			catalog_log.catalog_id,
+			coalesce(catalog_origins.node, ''),
+			coalesce(catalog_origins.origin_id, 0),
+			` + catalog_columns + `
+		from catalog_log
+		left join catalog on catalog.id = catalog_log.catalog_id
+		left join catalog_origins on catalog_origins.catalog_id = catalog_log.catalog_id
+		where catalog_log.seq > ?
+			and not (? and catalog_log.replicated)
+		order by catalog_log.seq
+		limit ?
+	`
+	rows, err := db.Query(query, after, local, limit)
+	if err != nil {
+		return nil, fmt.Errorf("could not list catalog changes: %v", err)
+	}
+	defer rows.Close()
+
+	changes := []catalog_change{}
+	for rows.Next() {
+		var change catalog_change
+		var id, size, created_at, retain_until sql.NullInt64
+		var pinned, held sql.NullBool
+		var namespace, path, filename, hash, algo sql.NullString
+		err := rows.Scan(
+			&change.Seq,
+			&change.ID,
+			&change.Origin,
+			&change.OriginID,
+			&id,
+			&namespace,
+			&path,
+			&filename,
+			&hash,
+			&algo,
+			&size,
+			&created_at,
+			&pinned,
+			&held,
+			&retain_until,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if change.Origin == "" {
+			change.Origin = KFS_NODE_NAME
+			change.OriginID = change.ID
+		}
+		if id.Valid {
+			change.Entry = &catalog_entry{
+				ID:          id.Int64,
+				Namespace:   namespace.String,
+				Path:        path.String,
+				Filename:    filename.String,
+				Hash:        hash.String,
+				HashAlgo:    algo.String,
+				Size:        size.Int64,
+				CreatedAt:   created_at.Int64,
+				Pinned:      pinned.Bool,
+				Held:        held.Bool,
+				RetainUntil: retain_until.Int64,
+			}
+		}
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
+
+/**
+ * Serve the catalog log to mirrors, and, with local=true, the changes made
+ * on this node to the rest of the cluster, e.g.
+ *     GET /cluster/changes?after=1234
+ *     GET /cluster/changes?after=1234&local=true
+ */
+func handle_cluster_changes(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	query := request.URL.Query()
+	after, _ := strconv.ParseInt(query.Get("after"), 10, 64)
+	local := query.Get("local") == "true"
+	changes, err := db_list_catalog_changes(after, KFS_MIRROR_BATCH, local)
+	if err != nil {
+		log.Println(err)
+		write_error(writer, "could not list changes", http.StatusInternalServerError)
+		return
+	}
+	write_json(writer, http.StatusOK, catalog_changes{changes})
+}
+
+func db_get_mirror_seq() (int64, error) {
+	var seq int64
+	query := `select seq from mirror_state where primary_url = ?`
+	err := db.QueryRow(query, KFS_MIRROR_OF).Scan(&seq)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return seq, err
+}
+
+/**
+ * Make the entry match the primary's, and move the mirror past the change,
+ * in one transaction.
+ */
+func db_apply_mirror_change(change catalog_change) error {
+	return db_transaction(func(tx *sql.Tx) error {
+		var err error
+		if change.Entry == nil {
+			_, err = tx.Exec(`delete from catalog where id = ?`, change.ID)
+		} else {
+			entry := change.Entry
+			_, err = tx.Exec(
+				`
+				insert or replace into catalog(
+					id,
+					namespace,
+					path,
+					filename,
+					hash,
+					hash_algo,
+					size,
+					created_at,
+					pinned,
+					held,
+					retain_until
+				)
+				values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+				`,
+				entry.ID,
+				entry.Namespace,
+				entry.Path,
+				entry.Filename,
+				entry.Hash,
+				entry.HashAlgo,
+				entry.Size,
+				entry.CreatedAt,
+				entry.Pinned,
+				entry.Held,
+				entry.RetainUntil,
+			)
+		}
+		if err != nil {
+			return err
+		}
+		if err := db_log_catalog_change(tx, change.ID); err != nil {
+			return err
+		}
+		_, err = tx.Exec(
+			`
+			insert or replace into mirror_state(primary_url, seq)
+			values(?, ?)
+			`,
+			KFS_MIRROR_OF,
+			change.Seq,
+		)
+		return err
+	})
+}
+
+/**
+ * Copy the blob from the primary onto this server's disks, unless it is
+ * already here.
+ */
+func mirror_fetch_blob(hash string, algo string, size int64) error {
+	if _, roots, err := db_get_replicas(hash); err == nil && len(roots) > 0 {
+		return nil
+	}
+	ctx := context.Background()
+	skip, staging_path, disks, err := db_alloc_storage(ctx, hash, algo, size, "", "", "")
+	if err != nil {
+		return err
+	}
+	if skip {
+		return nil
+	}
+	hash_filename := filepath.Join(staging_path, hash+"."+algo)
+	if err := cluster_pull_blob(KFS_MIRROR_OF, hash, algo, hash_filename); err != nil {
+		db_release_storage(hash, algo, size, disks)
+		return err
+	}
+	archive_file(staging_path, disks, hash_filename, hash, algo, nil)
+	metric_add(
+		"kfs_mirror_fetched_bytes_total",
+		"Bytes of blobs fetched from the primary.",
+		"",
+		float64(size),
+	)
+	return nil
+}
+
+/**
+ * Apply the primary's catalog changes that are new since the last sync,
+ * fetching the blobs they point at first. Stops at the first change that
+ * cannot be applied, which is tried again on the next sync.
+ */
+func mirror_sync() error {
+	for {
+		seq, err := db_get_mirror_seq()
+		if err != nil {
+			return err
+		}
+		var batch catalog_changes
+		target := fmt.Sprintf("%s/cluster/changes?after=%d", KFS_MIRROR_OF, seq)
+		if err := cluster_get_json(target, &batch); err != nil {
+			return err
+		}
+		if len(batch.Changes) == 0 {
+			metric_set(
+				"kfs_mirror_last_sync_timestamp_seconds",
+				"When the mirror last caught up with the primary.",
+				"",
+				float64(time.Now().Unix()),
+			)
+			return nil
+		}
+		for _, change := range batch.Changes {
+			if entry := change.Entry; entry != nil {
+				err := mirror_fetch_blob(entry.Hash, entry.HashAlgo, entry.Size)
+				if err != nil {
+					return fmt.Errorf("could not fetch %s: %v", entry.Hash, err)
+				}
+			}
+			if err := db_apply_mirror_change(change); err != nil {
+				return fmt.Errorf("could not apply change %d: %v", change.Seq, err)
+			}
+			metric_set(
+				"kfs_mirror_seq",
+				"The last change of the primary's catalog applied to the mirror.",
+				"",
+				float64(change.Seq),
+			)
+		}
+	}
+}
+
+func mirror_loop() {
+	if !mirror_enabled() {
+		return
+	}
+	log.Printf("mirroring %s", KFS_MIRROR_OF)
+	for {
+		if err := mirror_sync(); err != nil {
+			log.Printf("could not sync with %s: %v", KFS_MIRROR_OF, err)
+		}
+		time.Sleep(KFS_MIRROR_INTERVAL)
+	}
+}
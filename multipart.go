@@ -0,0 +1,484 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	uuid "github.com/satori/go.uuid"
+)
+
+/**
+ * Multipart uploads, as S3 does them, so that a huge file can be sent as
+ * numbered parts over several connections at once, and a part that fails
+ * is all that has to be sent again:
+ *
+ *     POST   /multipart                     start, with the fields of /upload
+ *     PUT    /multipart/:id/:part?hash=     send a part, checked against hash
+ *     GET    /multipart/:id                 list the parts received so far
+ *     POST   /multipart/:id/complete        join parts 1 to n into the file
+ *     DELETE /multipart/:id                 give up
+ *
+ * Part hashes use the algorithm of the whole file. A client that streams
+ * what it produces may leave out the hash when it starts, and give it to
+ * complete instead, once it has been worked out. Parts are kept under
+ * .kfs/multipart on one of the disks until the upload is completed, and
+ * uploads that are never completed are removed after
+ * KFS_MULTIPART_EXPIRY.
+ */
+
+var (
+	KFS_MULTIPART_MAX_PARTS = 10000
+	KFS_MULTIPART_EXPIRY    = 7 * 24 * time.Hour
+)
+
+type multipart_upload struct {
+	ID       string `json:"id"`
+	Filename string `json:"filename"`
+	upload_fields
+	CreatedAt int64            `json:"created_at"`
+	Parts     []multipart_part `json:"parts"`
+	root      string
+}
+
+type multipart_part struct {
+	Part int    `json:"part"`
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+func multipart_dir(root string, id string) string {
+	return filepath.Join(root, ".kfs", "multipart", id)
+}
+
+func db_add_multipart(upload multipart_upload) error {
+	stmt := `
+		insert into multipart_uploads(
+			id,
+			root,
+			filename,
+			hash,
+			hash_algo,
+			namespace,
+			path,
+			class,
+			created_at
+		) values(?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := db_exec(
+		stmt,
+		upload.ID,
+		upload.root,
+		upload.Filename,
+		upload.Hash,
+		upload.HashAlgo,
+		upload.Namespace,
+		upload.Path,
+		upload.Class,
+		upload.CreatedAt,
+	)
+	return err
+}
+
+func db_get_multipart(id string) (multipart_upload, error) {
+	upload := multipart_upload{ID: id, Parts: []multipart_part{}}
+	query := `
+		select root, filename, hash, hash_algo, namespace, path, class, created_at
+		from multipart_uploads
+		where id = ?
+	`
+	err := db.QueryRow(query, id).Scan(
+		&upload.root,
+		&upload.Filename,
+		&upload.Hash,
+		&upload.HashAlgo,
+		&upload.Namespace,
+		&upload.Path,
+		&upload.Class,
+		&upload.CreatedAt,
+	)
+	if err != nil {
+		return upload, err
+	}
+	rows, err := db.Query(
+		`select part, hash, size from multipart_parts where upload_id = ? order by part`,
+		id,
+	)
+	if err != nil {
+		return upload, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var part multipart_part
+		if err := rows.Scan(&part.Part, &part.Hash, &part.Size); err != nil {
+			return upload, err
+		}
+		upload.Parts = append(upload.Parts, part)
+	}
+	return upload, rows.Err()
+}
+
+func db_set_multipart_part(id string, part multipart_part) error {
+	stmt := `
+		INSERT OR REPLACE INTO multipart_parts(upload_id, part, hash, size)
+		values(?, ?, ?, ?)
+	`
+	_, err := db_exec(stmt, id, part.Part, part.Hash, part.Size)
+	return err
+}
+
+/**
+ * Forget the upload and remove its parts.
+ */
+func multipart_remove(upload multipart_upload) {
+	err := db_transaction(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`delete from multipart_parts where upload_id = ?`, upload.ID); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`delete from multipart_uploads where id = ?`, upload.ID)
+		return err
+	})
+	if err != nil {
+		log.Printf("could not remove multipart upload %s: %v", upload.ID, err)
+		return
+	}
+	if err := os.RemoveAll(multipart_dir(upload.root, upload.ID)); err != nil {
+		log.Printf("could not remove parts of %s: %v", upload.ID, err)
+	}
+}
+
+/**
+ * Look up the upload named in the route, writing an error response and
+ * returning false if there is none.
+ */
+func lookup_multipart(writer http.ResponseWriter, p httprouter.Params) (multipart_upload, bool) {
+	upload, err := db_get_multipart(p.ByName("id"))
+	if err == sql.ErrNoRows {
+		write_error(writer, "no such multipart upload", http.StatusNotFound)
+		return upload, false
+	}
+	if err != nil {
+		log.Printf("could not get multipart upload: %v", err)
+		write_error(writer, "could not get multipart upload", http.StatusInternalServerError)
+		return upload, false
+	}
+	return upload, true
+}
+
+func handle_multipart_start(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	if !space_check_upload(writer) {
+		return
+	}
+	upload := multipart_upload{
+		ID:            uuid.Must(uuid.NewV4(), nil).String(),
+		Filename:      request.FormValue("filename"),
+		upload_fields: read_upload_fields(request),
+		CreatedAt:     time.Now().Unix(),
+		Parts:         []multipart_part{},
+	}
+	if upload.Filename == "" {
+		write_error(writer, "multipart upload requires 'filename'", http.StatusBadRequest)
+		return
+	}
+	if upload.HashAlgo == "" {
+		upload.HashAlgo = KFS_DEFAULT_HASH_ALGO
+	}
+	if !valid_hash_algo(upload.HashAlgo) {
+		msg := fmt.Sprintf("unsupported hash algorithm: '%s'", upload.HashAlgo)
+		write_error(writer, msg, http.StatusBadRequest)
+		return
+	}
+
+	// the parts go on the local disk with the most space
+	root, err := db_roomiest_disk()
+	if err != nil {
+		log.Println(err)
+		write_error(writer, "could not list disks", http.StatusInternalServerError)
+		return
+	}
+	upload.root = root
+	if upload.root == "" {
+		write_error(writer, "no disk to hold parts", http.StatusInsufficientStorage)
+		return
+	}
+	if err := os.MkdirAll(multipart_dir(upload.root, upload.ID), 0755); err != nil {
+		log.Printf("could not start multipart upload: %v", err)
+		write_error(writer, "could not start multipart upload", http.StatusInternalServerError)
+		return
+	}
+	if err := db_add_multipart(upload); err != nil {
+		log.Printf("could not start multipart upload: %v", err)
+		os.RemoveAll(multipart_dir(upload.root, upload.ID))
+		write_error(writer, "could not start multipart upload", http.StatusInternalServerError)
+		return
+	}
+	log_debug("started multipart upload %s of '%s'", upload.ID, upload.Filename)
+	write_json(writer, http.StatusCreated, upload)
+}
+
+func handle_multipart_get(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	upload, ok := lookup_multipart(writer, p)
+	if !ok {
+		return
+	}
+	write_json(writer, http.StatusOK, upload)
+}
+
+/**
+ * Receive one part, replacing any earlier copy of it.
+ */
+func handle_multipart_part(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	upload, ok := lookup_multipart(writer, p)
+	if !ok {
+		return
+	}
+	n, err := strconv.Atoi(p.ByName("part"))
+	if err != nil || n < 1 || n > KFS_MULTIPART_MAX_PARTS {
+		write_error(
+			writer,
+			fmt.Sprintf("part must be from 1 to %d", KFS_MULTIPART_MAX_PARTS),
+			http.StatusBadRequest,
+		)
+		return
+	}
+	hash := request.URL.Query().Get("hash")
+	if hash == "" {
+		write_error(writer, "part requires 'hash'", http.StatusBadRequest)
+		return
+	}
+
+	dir := multipart_dir(upload.root, upload.ID)
+	tmp, err := os.CreateTemp(dir, fmt.Sprintf("%d-", n))
+	if err != nil {
+		log.Printf("could not receive part %d of %s: %v", n, upload.ID, err)
+		write_error(writer, "could not receive part", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	size, err := io.Copy(tmp, &ctx_reader{request.Context(), request.Body})
+	tmp.Close()
+	if err != nil {
+		log.Printf("could not receive part %d of %s: %v", n, upload.ID, err)
+		write_error(writer, "could not receive part", http.StatusInternalServerError)
+		return
+	}
+	digest, err := hash_file_ctx(request.Context(), tmp.Name(), upload.HashAlgo)
+	if err != nil {
+		log.Printf("could not hash part %d of %s: %v", n, upload.ID, err)
+		write_error(writer, "could not hash part", http.StatusInternalServerError)
+		return
+	}
+	if digest != hash {
+		write_error(
+			writer,
+			fmt.Sprintf("hashes do not match: you gave me: %s, but I calculated: %s", hash, digest),
+			http.StatusNotAcceptable,
+		)
+		return
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, strconv.Itoa(n))); err != nil {
+		log.Printf("could not keep part %d of %s: %v", n, upload.ID, err)
+		write_error(writer, "could not receive part", http.StatusInternalServerError)
+		return
+	}
+	part := multipart_part{Part: n, Hash: digest, Size: size}
+	if err := db_set_multipart_part(upload.ID, part); err != nil {
+		log.Printf("could not record part %d of %s: %v", n, upload.ID, err)
+		write_error(writer, "could not record part", http.StatusInternalServerError)
+		return
+	}
+	write_json(writer, http.StatusOK, part)
+}
+
+/**
+ * Join the parts, in order, into the file, and store it as an upload. With
+ * parts=, a comma separated list of the part hashes, the parts have to be
+ * exactly those.
+ */
+func handle_multipart_complete(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	upload, ok := lookup_multipart(writer, p)
+	if !ok {
+		return
+	}
+	if len(upload.Parts) == 0 {
+		write_error(writer, "no parts have been uploaded", http.StatusBadRequest)
+		return
+	}
+	for i, part := range upload.Parts {
+		if part.Part != i+1 {
+			write_error(writer, fmt.Sprintf("part %d is missing", i+1), http.StatusBadRequest)
+			return
+		}
+	}
+	if s := request.FormValue("parts"); s != "" {
+		hashes := strings.Split(s, ",")
+		if len(hashes) != len(upload.Parts) {
+			write_error(
+				writer,
+				fmt.Sprintf("%d parts were uploaded, not %d", len(upload.Parts), len(hashes)),
+				http.StatusBadRequest,
+			)
+			return
+		}
+		for i, part := range upload.Parts {
+			if strings.TrimSpace(hashes[i]) != part.Hash {
+				write_error(writer, fmt.Sprintf("part %d does not match", part.Part), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	if hash := request.FormValue("hash"); upload.Hash == "" {
+		if hash == "" {
+			write_error(writer, "the hash was not given when the upload started, so complete needs it", http.StatusBadRequest)
+			return
+		}
+		upload.Hash = hash
+	} else if hash != "" && hash != upload.Hash {
+		write_error(writer, "the hash does not match the one the upload started with", http.StatusBadRequest)
+		return
+	}
+
+	dir := multipart_dir(upload.root, upload.ID)
+	joined, err := os.Create(filepath.Join(dir, "joined"))
+	if err != nil {
+		log.Printf("could not join parts of %s: %v", upload.ID, err)
+		write_error(writer, "could not join parts", http.StatusInternalServerError)
+		return
+	}
+	defer joined.Close()
+	var size int64
+	for _, part := range upload.Parts {
+		f, err := os.Open(filepath.Join(dir, strconv.Itoa(part.Part)))
+		if err != nil {
+			log.Printf("could not join parts of %s: %v", upload.ID, err)
+			write_error(writer, "could not join parts", http.StatusInternalServerError)
+			return
+		}
+		n, err := io.Copy(joined, f)
+		f.Close()
+		if err != nil {
+			log.Printf("could not join parts of %s: %v", upload.ID, err)
+			write_error(writer, "could not join parts", http.StatusInternalServerError)
+			return
+		}
+		size += n
+	}
+
+	// a mismatch leaves the parts, so that the wrong ones can be sent again
+	digest, err := hash_file_ctx(request.Context(), joined.Name(), upload.HashAlgo)
+	if err != nil {
+		log.Printf("could not hash %s: %v", upload.ID, err)
+		write_error(writer, "could not hash file", http.StatusInternalServerError)
+		return
+	}
+	if digest != upload.Hash {
+		os.Remove(joined.Name())
+		write_error(
+			writer,
+			fmt.Sprintf("hashes do not match: you gave me: %s, but the parts make: %s", upload.Hash, digest),
+			http.StatusNotAcceptable,
+		)
+		return
+	}
+	if _, err := joined.Seek(0, io.SeekStart); err != nil {
+		write_error(writer, "could not read joined file", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("completed multipart upload %s of '%s' from %d parts", upload.ID, upload.Filename, len(upload.Parts))
+	// an earlier attempt to complete it may have failed after it started
+	upload_state_forget_failed(upload.ID)
+	tracker, err := progress_start(upload.ID, size)
+	if err != nil {
+		write_error(writer, "the upload is already being completed", http.StatusConflict)
+		return
+	}
+	tracker.update(func(state *progress_state) {
+		state.BytesReceived = size
+	})
+	fields := upload.upload_fields
+	if request.URL.Query().Get("durable") == "true" {
+		fields.Durable = true
+	}
+	if store_upload(request.Context(), writer, tracker, fields, joined, upload.Filename, size) {
+		multipart_remove(upload)
+	} else {
+		os.Remove(joined.Name())
+	}
+}
+
+func handle_multipart_abort(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	upload, ok := lookup_multipart(writer, p)
+	if !ok {
+		return
+	}
+	multipart_remove(upload)
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+/**
+ * Remove the uploads that were started too long ago to still be wanted.
+ */
+func multipart_expire() error {
+	cutoff := time.Now().Add(-KFS_MULTIPART_EXPIRY).Unix()
+	rows, err := db.Query(`select id from multipart_uploads where created_at < ?`, cutoff)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		upload, err := db_get_multipart(id)
+		if err != nil {
+			return err
+		}
+		log.Printf("removing multipart upload %s of '%s', it was never completed", id, upload.Filename)
+		multipart_remove(upload)
+	}
+	return nil
+}
+
+func multipart_loop() {
+	for {
+		if err := multipart_expire(); err != nil {
+			log.Printf("could not expire multipart uploads: %v", err)
+		}
+		time.Sleep(time.Hour)
+	}
+}
@@ -0,0 +1,168 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+/**
+ * What may be uploaded to a namespace. Extensions are matched without
+ * regard to case, e.g. ".exe", and MIME types are matched by prefix, so
+ * "image/" matches every image. An empty allow list allows everything that
+ * is not denied.
+ */
+type upload_policy struct {
+	AllowExtensions []string `json:"allow_extensions"`
+	DenyExtensions  []string `json:"deny_extensions"`
+	AllowMimeTypes  []string `json:"allow_mime_types"`
+	DenyMimeTypes   []string `json:"deny_mime_types"`
+
+	// in bytes, 0 for no limit
+	MaxSize int64 `json:"max_size"`
+}
+
+/**
+ * The policy for each namespace, with the policy for "*" applying to every
+ * namespace as well, e.g.
+ *     "photos": {
+ *         AllowMimeTypes: []string{"image/", "video/"},
+ *         DenyExtensions: []string{".exe", ".bat", ".sh"},
+ *     },
+ */
+var KFS_UPLOAD_POLICIES = map[string]upload_policy{}
+
+type policy_violation struct {
+	Error     string `json:"error"`
+	Namespace string `json:"namespace"`
+	Rule      string `json:"rule"`
+	Value     string `json:"value"`
+	Message   string `json:"message"`
+}
+
+func match_extension(list []string, extension string) bool {
+	for _, e := range list {
+		if strings.EqualFold(e, extension) {
+			return true
+		}
+	}
+	return false
+}
+
+func match_mime_type(list []string, mime_type string) bool {
+	for _, m := range list {
+		if strings.HasPrefix(mime_type, m) {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * Sniff the MIME type of the upload from its first bytes, leaving the file
+ * where it was.
+ */
+func detect_mime_type(file io.ReadSeeker) (string, error) {
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	mime_type, _, _ := mime.ParseMediaType(http.DetectContentType(buf[:n]))
+	return mime_type, nil
+}
+
+func (policy upload_policy) check(entry catalog_entry, mime_type string) *policy_violation {
+	violation := func(rule string, value string, msg string) *policy_violation {
+		return &policy_violation{
+			Error:     "policy_violation",
+			Namespace: entry.Namespace,
+			Rule:      rule,
+			Value:     value,
+			Message:   msg,
+		}
+	}
+	if policy.MaxSize > 0 && entry.Size > policy.MaxSize {
+		return violation(
+			"max_size",
+			fmt.Sprintf("%d", entry.Size),
+			fmt.Sprintf("files larger than %d bytes are not allowed", policy.MaxSize),
+		)
+	}
+	extension := filepath.Ext(entry.Filename)
+	if match_extension(policy.DenyExtensions, extension) ||
+		(len(policy.AllowExtensions) > 0 &&
+			!match_extension(policy.AllowExtensions, extension)) {
+		return violation(
+			"extension",
+			extension,
+			fmt.Sprintf("'%s' files are not allowed", extension),
+		)
+	}
+	if match_mime_type(policy.DenyMimeTypes, mime_type) ||
+		(len(policy.AllowMimeTypes) > 0 &&
+			!match_mime_type(policy.AllowMimeTypes, mime_type)) {
+		return violation(
+			"mime_type",
+			mime_type,
+			fmt.Sprintf("%s files are not allowed", mime_type),
+		)
+	}
+	return nil
+}
+
+/**
+ * Check the upload against the policies for its namespace, returning the
+ * first rule it breaks, or nil.
+ */
+func check_upload_policy(entry catalog_entry, file io.ReadSeeker) (*policy_violation, error) {
+	configured := settings().upload_policies
+	var policies []upload_policy
+	for _, key := range []string{"*", entry.Namespace} {
+		if policy, ok := configured[key]; ok {
+			policies = append(policies, policy)
+		}
+	}
+	if len(policies) == 0 {
+		return nil, nil
+	}
+	mime_type, err := detect_mime_type(file)
+	if err != nil {
+		return nil, err
+	}
+	for _, policy := range policies {
+		if violation := policy.check(entry, mime_type); violation != nil {
+			metric_add(
+				"kfs_policy_violations_total",
+				"Uploads refused by a namespace's policy.",
+				fmt.Sprintf("namespace=%q,rule=%q", entry.Namespace, violation.Rule),
+				1,
+			)
+			return violation, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,178 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+/**
+ * What a backup would cost, before it is started. The client posts a
+ * manifest, as it would to /sync, though paths are only needed for the
+ * exclude rules,
+ *     curl -X POST -d '{
+ *             "namespace": "laptop",
+ *             "entries": [{"path": "/home/kyle/a.txt", "hash": "...", "size": 12}]
+ *         }' localhost:8080/preview
+ * and is told how many of its bytes the server does not have yet, which is
+ * all that would be sent, and whether the disks have room for them, e.g.
+ *     {"files": 1, "total_bytes": 12, "new_blobs": 1, "transfer_bytes": 12,
+ *      "dedup_bytes": 0, "store_bytes": 24, "available_bytes": 1000, "fits": true}
+ * A hash that is in the manifest more than once is only sent once.
+ */
+
+type preview_result struct {
+	Files    int `json:"files"`
+	Excluded int `json:"excluded,omitempty"`
+
+	// the size of every file in the manifest
+	TotalBytes int64 `json:"total_bytes"`
+
+	// blobs the server does not have, and their size
+	NewBlobs      int   `json:"new_blobs"`
+	TransferBytes int64 `json:"transfer_bytes"`
+
+	// what need not be sent, since it is stored or already in the manifest
+	DedupBytes int64 `json:"dedup_bytes"`
+
+	// the new blobs with every replica
+	StoreBytes int64 `json:"store_bytes"`
+
+	// free on the disks of the storage class
+	AvailableBytes int64 `json:"available_bytes"`
+
+	Fits   bool `json:"fits"`
+	Paused bool `json:"paused,omitempty"`
+}
+
+/**
+ * Whether the blobs fit on the disks with redundancy replicas each, placing
+ * the biggest first, each on the disks with the most space left.
+ */
+func preview_fits(sizes []int64, space []int64, redundancy int) bool {
+	if len(sizes) == 0 {
+		return true
+	}
+	if len(space) < redundancy {
+		return false
+	}
+	free := append([]int64(nil), space...)
+	sorted := append([]int64(nil), sizes...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] > sorted[j] })
+	for _, size := range sorted {
+		sort.Slice(free, func(i, j int) bool { return free[i] > free[j] })
+		if free[redundancy-1] <= size {
+			return false
+		}
+		for i := 0; i < redundancy; i++ {
+			free[i] -= size
+		}
+	}
+	return true
+}
+
+func handle_preview(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	var manifest sync_manifest
+	if err := json.NewDecoder(request.Body).Decode(&manifest); err != nil {
+		write_error(writer, "invalid manifest", http.StatusBadRequest)
+		return
+	}
+	if len(manifest.Entries) > KFS_SYNC_MAX_ENTRIES {
+		msg := fmt.Sprintf("manifest has more than %d entries", KFS_SYNC_MAX_ENTRIES)
+		write_error(writer, msg, http.StatusRequestEntityTooLarge)
+		return
+	}
+	namespace := manifest.Namespace
+	if namespace == "" {
+		namespace = KFS_DEFAULT_NAMESPACE
+	}
+	algo := manifest.HashAlgo
+	if algo == "" {
+		algo = KFS_DEFAULT_HASH_ALGO
+	}
+	if !valid_hash_algo(algo) {
+		msg := fmt.Sprintf("unsupported hash algorithm: '%s'", algo)
+		write_error(writer, msg, http.StatusBadRequest)
+		return
+	}
+	class := manifest.Class
+	if class == "" {
+		class = namespace_class(namespace)
+	}
+	if ok, err := db_class_exists(class); err != nil || !ok {
+		msg := fmt.Sprintf("no disks in storage class '%s'", class)
+		write_error(writer, msg, http.StatusBadRequest)
+		return
+	}
+	rules, err := sync_filter_rules(namespace, manifest.Exclude)
+	if err != nil {
+		write_error(writer, fmt.Sprintf("invalid exclude rule: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var result preview_result
+	var sizes []int64
+	seen := map[string]bool{}
+	for _, entry := range manifest.Entries {
+		if entry.Hash == "" || entry.Size < 0 {
+			msg := fmt.Sprintf("invalid entry for '%s'", entry.Path)
+			write_error(writer, msg, http.StatusBadRequest)
+			return
+		}
+		if entry.Path != "" && filter_excluded(rules, entry.Path) {
+			result.Excluded++
+			continue
+		}
+		result.Files++
+		result.TotalBytes += entry.Size
+		if seen[entry.Hash] {
+			continue
+		}
+		seen[entry.Hash] = true
+		if db_has_hash(entry.Hash, algo) {
+			continue
+		}
+		result.NewBlobs++
+		result.TransferBytes += entry.Size
+		sizes = append(sizes, entry.Size)
+	}
+	result.DedupBytes = result.TotalBytes - result.TransferBytes
+	result.StoreBytes = result.TransferBytes * int64(settings().redundancy)
+
+	by_class, err := db_get_live_disk_space()
+	if err != nil {
+		log.Printf("could not preview upload: %v", err)
+		write_error(writer, "could not look up disk space", http.StatusInternalServerError)
+		return
+	}
+	space := class_space(by_class, class)
+	for _, available := range space {
+		result.AvailableBytes += available
+	}
+	space_mutex.Lock()
+	result.Paused = space_paused
+	space_mutex.Unlock()
+	result.Fits = !result.Paused && preview_fits(sizes, space, settings().redundancy)
+	write_json(writer, http.StatusOK, result)
+}
@@ -0,0 +1,280 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	STAGE_RECEIVING = "receiving"
+	STAGE_HASHING   = "hashing"
+	STAGE_STAGED    = "staged"
+	STAGE_ARCHIVING = "archiving"
+	STAGE_DONE      = "done"
+	STAGE_FAILED    = "failed"
+)
+
+// how long a finished session can still be queried
+const KFS_PROGRESS_TTL = time.Minute
+
+type progress_state struct {
+	Session         string `json:"session"`
+	Stage           string `json:"stage"`
+	BytesReceived   int64  `json:"bytes_received"`
+	BytesTotal      int64  `json:"bytes_total"`
+	ReplicasWritten int    `json:"replicas_written"`
+	Replicas        int    `json:"replicas"`
+	Hash            string `json:"hash,omitempty"`
+	HashAlgo        string `json:"hash_algo,omitempty"`
+	Error           string `json:"error,omitempty"`
+}
+
+/**
+ * Progress of a single upload. Every upload gets one, and its stages are
+ * kept in the uploads table under id, but only uploads started with a
+ * session ID can be watched over /progress. All methods are safe to call on
+ * a nil tracker.
+ */
+type progress_tracker struct {
+	id          string
+	mutex       sync.Mutex
+	save_mutex  sync.Mutex
+	state       progress_state
+	subscribers []chan struct{}
+}
+
+var (
+	progress_mutex    = &sync.Mutex{}
+	progress_sessions = map[string]*progress_tracker{}
+)
+
+/**
+ * Start tracking an upload. The session ID doubles as the upload ID, so a
+ * client can ask for the state of an upload it has not had a response for
+ * yet. Without one, the server makes up the ID, which the client gets back
+ * as upload_id. A session that was already used is refused with
+ * errUploadIDTaken.
+ */
+func progress_start(session string, total int64) (*progress_tracker, error) {
+	tracker := &progress_tracker{
+		id: session,
+		state: progress_state{
+			Session:    session,
+			Stage:      STAGE_RECEIVING,
+			BytesTotal: total,
+		},
+	}
+	if tracker.id == "" {
+		tracker.id = uuid.Must(uuid.NewV4(), nil).String()
+	}
+	if err := upload_state_start(tracker.id, total); err != nil {
+		return nil, err
+	}
+	if session != "" {
+		progress_mutex.Lock()
+		progress_sessions[session] = tracker
+		progress_mutex.Unlock()
+	}
+	return tracker, nil
+}
+
+/**
+ * Start tracking the upload in the request, under the session in its
+ * query, if any, writing an error response and returning false if that
+ * session was already used.
+ */
+func progress_start_request(writer http.ResponseWriter, request *http.Request) (*progress_tracker, bool) {
+	session := request.URL.Query().Get("session")
+	tracker, err := progress_start(session, request.ContentLength)
+	if err != nil {
+		msg := fmt.Sprintf("upload session '%s' is already in use", session)
+		write_error(writer, msg, http.StatusConflict)
+		return nil, false
+	}
+	return tracker, true
+}
+
+func (tracker *progress_tracker) upload_id() string {
+	if tracker == nil {
+		return ""
+	}
+	return tracker.id
+}
+
+func progress_get(session string) *progress_tracker {
+	progress_mutex.Lock()
+	defer progress_mutex.Unlock()
+	return progress_sessions[session]
+}
+
+func (tracker *progress_tracker) update(fn func(state *progress_state)) {
+	if tracker == nil {
+		return
+	}
+	tracker.mutex.Lock()
+	before := tracker.state
+	fn(&tracker.state)
+	after := tracker.state
+	finished := tracker.state.Stage == STAGE_DONE ||
+		tracker.state.Stage == STAGE_FAILED
+	for _, ch := range tracker.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+	tracker.mutex.Unlock()
+
+	if before.Stage != after.Stage || before.ReplicasWritten != after.ReplicasWritten ||
+		before.Replicas != after.Replicas || before.Hash != after.Hash {
+		// saved from a fresh snapshot, so concurrent updates cannot
+		// leave an older state as the last one written
+		tracker.save_mutex.Lock()
+		upload_state_save(tracker.id, tracker.snapshot())
+		tracker.save_mutex.Unlock()
+	}
+	if finished && after.Session != "" {
+		session := after.Session
+		time.AfterFunc(KFS_PROGRESS_TTL, func() {
+			progress_mutex.Lock()
+			if progress_sessions[session] == tracker {
+				delete(progress_sessions, session)
+			}
+			progress_mutex.Unlock()
+		})
+	}
+}
+
+func (tracker *progress_tracker) set_stage(stage string) {
+	tracker.update(func(state *progress_state) {
+		state.Stage = stage
+	})
+}
+
+func (tracker *progress_tracker) fail(err error) {
+	tracker.update(func(state *progress_state) {
+		state.Stage = STAGE_FAILED
+		state.Error = err.Error()
+	})
+}
+
+func (tracker *progress_tracker) snapshot() progress_state {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	return tracker.state
+}
+
+func (tracker *progress_tracker) subscribe() chan struct{} {
+	ch := make(chan struct{}, 1)
+	tracker.mutex.Lock()
+	tracker.subscribers = append(tracker.subscribers, ch)
+	tracker.mutex.Unlock()
+	return ch
+}
+
+func (tracker *progress_tracker) unsubscribe(ch chan struct{}) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	for i, sub := range tracker.subscribers {
+		if sub == ch {
+			tracker.subscribers = append(
+				tracker.subscribers[:i],
+				tracker.subscribers[i+1:]...,
+			)
+			return
+		}
+	}
+}
+
+/**
+ * Counts the bytes of the request body as they are read, so the bytes
+ * received are known before the multipart form has been fully parsed.
+ */
+type progress_reader struct {
+	reader  io.ReadCloser
+	tracker *progress_tracker
+}
+
+func (r *progress_reader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.tracker.update(func(state *progress_state) {
+			state.BytesReceived += int64(n)
+		})
+	}
+	return n, err
+}
+
+func (r *progress_reader) Close() error {
+	return r.reader.Close()
+}
+
+/**
+ * Stream the progress of an upload session as Server-Sent Events. Start an
+ * upload with ?session=<id>, then watch it with:
+ *     curl -N localhost:8080/progress/<id>
+ */
+func handle_progress(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	tracker := progress_get(p.ByName("session"))
+	if tracker == nil {
+		write_error(writer, "no such upload session", http.StatusNotFound)
+		return
+	}
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		write_error(writer, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := tracker.subscribe()
+	defer tracker.unsubscribe(ch)
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.WriteHeader(http.StatusOK)
+
+	for {
+		state := tracker.snapshot()
+		data, err := json.Marshal(state)
+		if err != nil {
+			log.Printf("could not encode progress: %v", err)
+			return
+		}
+		fmt.Fprintf(writer, "event: %s\ndata: %s\n\n", state.Stage, data)
+		flusher.Flush()
+		if state.Stage == STAGE_DONE || state.Stage == STAGE_FAILED {
+			return
+		}
+
+		select {
+		case <-ch:
+		case <-request.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,136 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+/**
+ * Behind a reverse proxy such as nginx or Caddy, every request comes from
+ * the proxy, so the proxies are listed in the config, e.g.
+ *     "trusted_proxies": ["127.0.0.1", "10.0.0.0/8"]
+ * and for requests from them, the client is taken from X-Forwarded-For and
+ * the scheme from X-Forwarded-Proto. RemoteAddr is then the client's, for
+ * everything that logs it, and request.URL.Scheme is "https" when the
+ * client used TLS, for anything that links back to kfs. The headers are
+ * dropped from requests that do not come from a trusted proxy, since
+ * anyone can send them.
+ */
+
+var KFS_TRUSTED_PROXIES = []*net.IPNet{}
+
+/**
+ * The networks of a list of addresses, each an IP or a CIDR.
+ */
+func proxy_parse(proxies []string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy '%s'", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy '%s'", proxy)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func proxy_trusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range settings().trusted_proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * The client a request from a trusted proxy was forwarded for. Each proxy
+ * appends the address it got the request from, so the client is the
+ * rightmost address that is not itself a trusted proxy.
+ */
+func proxy_client(forwarded []string, peer string) string {
+	var hops []string
+	for _, header := range forwarded {
+		for _, hop := range strings.Split(header, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		if net.ParseIP(hops[i]) == nil {
+			break
+		}
+		client = hops[i]
+		if !proxy_trusted(client) {
+			break
+		}
+	}
+	return client
+}
+
+/**
+ * Replace the proxy's address with the client's on requests from trusted
+ * proxies, and log each request.
+ */
+func proxy_handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		peer, port, err := net.SplitHostPort(request.RemoteAddr)
+		if err == nil && proxy_trusted(peer) {
+			client := proxy_client(request.Header.Values("X-Forwarded-For"), peer)
+			request.RemoteAddr = net.JoinHostPort(client, port)
+			proto := strings.ToLower(strings.TrimSpace(request.Header.Get("X-Forwarded-Proto")))
+			if proto == "http" || proto == "https" {
+				request.URL.Scheme = proto
+			}
+		} else {
+			request.Header.Del("X-Forwarded-For")
+			request.Header.Del("X-Forwarded-Proto")
+		}
+		if request.URL.Scheme == "" {
+			request.URL.Scheme = "http"
+			if request.TLS != nil {
+				request.URL.Scheme = "https"
+			}
+		}
+		log_debug("%s %s %s %s", request.RemoteAddr, request.URL.Scheme, request.Method, request.URL.Path)
+		next.ServeHTTP(writer, request)
+	})
+}
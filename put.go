@@ -0,0 +1,380 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/**
+ * kfs put uploads a file, or standard input, and prints its hash, so that
+ * kfs can sit at the end of a pipeline, e.g.
+ *     pg_dump mydb | kfs put -name mydb.sql -path /backups/db -
+ * Standard input is streamed to PUT /blob as it is read, and hashed on the
+ * way, with the hash sent as a trailer once it is known, so nothing is
+ * kept on the client's disk. A file is hashed first and sent to
+ * PUT /blob/:hash, so that one the server already has is not sent again.
+ *
+ * A file bigger than KFS_PUT_PART_SIZE the server lacks is sent as the
+ * parts of a multipart upload instead, KFS_CLIENT_PARALLEL of them at a
+ * time over their own connections, each retried on its own, and the id
+ * of the upload is kept in the user's cache directory until it completes.
+ * Running the same command after it was cut off then only sends the parts
+ * the server has not got yet. A file is sent again from the start when
+ * sending it fails in a way that may pass, but standard input cannot be
+ * read twice, so an upload from it is never retried.
+ */
+
+var KFS_PUT_PART_SIZE int64 = 64 << 20
+
+type put_state struct {
+	URL string `json:"url"`
+	ID  string `json:"id"`
+}
+
+func put_main(args []string) {
+	flags := flag.NewFlagSet("put", flag.ExitOnError)
+	url := flags.String("url", "http://localhost:8080", "server to upload to")
+	name := flags.String("name", "", "name to store the file under")
+	namespace := flags.String("namespace", "", "namespace to store the file in")
+	path := flags.String("path", "", "directory to store the file in")
+	algo := flags.String("hash-algo", KFS_DEFAULT_HASH_ALGO, "hash algorithm")
+	client_flags(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: kfs put [flags] FILE|-")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if !valid_hash_algo(*algo) {
+		fmt.Fprintf(os.Stderr, "kfs put: unsupported hash algorithm: '%s'\n", *algo)
+		os.Exit(2)
+	}
+
+	source := flags.Arg(0)
+	if *name == "" && source != "-" {
+		*name = filepath.Base(source)
+	}
+	header := http.Header{}
+	header.Set("X-Kfs-Hash-Algo", *algo)
+	header.Set("X-Kfs-Filename", *name)
+	header.Set("X-Kfs-Namespace", *namespace)
+	header.Set("X-Kfs-Path", *path)
+
+	var reply upload_response
+	var err error
+	base := strings.TrimSuffix(*url, "/")
+	if source == "-" {
+		reply, err = put_stream(base, header, os.Stdin, *algo)
+	} else {
+		reply, err = put_file(base, header, source, *algo)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kfs put: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(reply.Hash)
+}
+
+/**
+ * Send the reader to PUT /blob, hashing it as it goes, with the hash as
+ * the X-Kfs-Hash trailer.
+ */
+func put_stream(url string, header http.Header, reader io.Reader, algo string) (upload_response, error) {
+	pipe_reader, pipe_writer := io.Pipe()
+	request, err := http.NewRequest(http.MethodPut, url+"/v1/blob", pipe_reader)
+	if err != nil {
+		return upload_response{}, err
+	}
+	request.Header = header
+	request.Trailer = http.Header{"X-Kfs-Hash": nil}
+	go func() {
+		digest, err := tee_hash(pipe_writer, reader, algo, "standard input")
+		if err != nil {
+			pipe_writer.CloseWithError(err)
+			return
+		}
+		request.Trailer.Set("X-Kfs-Hash", digest)
+		pipe_writer.Close()
+	}()
+	return put_send(request)
+}
+
+/**
+ * Send the file to PUT /blob/:hash, or as a multipart upload if it is big
+ * and the server does not have it yet.
+ */
+func put_file(base string, header http.Header, filename string, algo string) (upload_response, error) {
+	var reply upload_response
+	hash, err := hash_file_algo(filename, algo)
+	if err != nil {
+		return reply, err
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return reply, err
+	}
+	if info.Size() > KFS_PUT_PART_SIZE {
+		exists, err := put_exists(base, hash, algo)
+		if err != nil {
+			return reply, err
+		}
+		if !exists {
+			return put_multipart(base, header, filename, hash, algo, info.Size())
+		}
+	}
+	err = client_retry("upload", func() error {
+		f, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		request, err := http.NewRequest(http.MethodPut, base+"/v1/blob/"+hash, f)
+		if err != nil {
+			return err
+		}
+		request.ContentLength = info.Size()
+		request.Header = header.Clone()
+		reply, err = put_send(request)
+		return err
+	})
+	return reply, err
+}
+
+func put_send(request *http.Request) (upload_response, error) {
+	var reply upload_response
+	err := client_json(request, &reply)
+	return reply, err
+}
+
+/**
+ * Whether the server already has the blob.
+ */
+func put_exists(base string, hash string, algo string) (bool, error) {
+	exists := false
+	err := client_retry("lookup", func() error {
+		request, err := http.NewRequest(http.MethodHead, base+"/v1/blob/"+hash, nil)
+		if err != nil {
+			return err
+		}
+		request.Header.Set("X-Kfs-Hash-Algo", algo)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		if response.StatusCode == http.StatusNotFound {
+			exists = false
+			return nil
+		}
+		exists = true
+		return client_check(response)
+	})
+	return exists, err
+}
+
+/**
+ * The size of the parts a file is split into, which is only ever bigger
+ * than KFS_PUT_PART_SIZE when the file would not fit in as many parts as
+ * the server takes.
+ */
+func put_part_size(size int64) int64 {
+	part_size := KFS_PUT_PART_SIZE
+	max_parts := int64(KFS_MULTIPART_MAX_PARTS)
+	if size > part_size*max_parts {
+		part_size = (size + max_parts - 1) / max_parts
+	}
+	return part_size
+}
+
+func put_state_path(hash string) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "kfs", "uploads", hash+".json"), nil
+}
+
+/**
+ * The multipart upload of the file that an earlier run started, if the
+ * server still has it, or a new one.
+ */
+func put_multipart_start(base string, header http.Header, hash string, algo string) (multipart_upload, error) {
+	var upload multipart_upload
+	state_path, err := put_state_path(hash)
+	if err != nil {
+		return upload, err
+	}
+	var state put_state
+	if data, err := os.ReadFile(state_path); err == nil && json.Unmarshal(data, &state) == nil && state.URL == base {
+		err := client_retry("lookup of upload", func() error {
+			request, err := http.NewRequest(http.MethodGet, base+"/v1/multipart/"+state.ID, nil)
+			if err != nil {
+				return err
+			}
+			return client_json(request, &upload)
+		})
+		var failure *client_error
+		if err != nil && !(errors.As(err, &failure) && failure.Status == http.StatusNotFound) {
+			return upload, err
+		}
+		same := upload.Filename == header.Get("X-Kfs-Filename") &&
+			upload.Namespace == header.Get("X-Kfs-Namespace") &&
+			upload.Path == header.Get("X-Kfs-Path")
+		if err == nil && same {
+			fmt.Fprintf(os.Stderr, "resuming upload %s, %d parts already sent\n", upload.ID, len(upload.Parts))
+			return upload, nil
+		}
+	}
+
+	form := url.Values{}
+	form.Set("filename", header.Get("X-Kfs-Filename"))
+	form.Set("namespace", header.Get("X-Kfs-Namespace"))
+	form.Set("path", header.Get("X-Kfs-Path"))
+	form.Set("hash", hash)
+	form.Set("hash_algo", algo)
+	err = client_retry("start of upload", func() error {
+		request, err := http.NewRequest(
+			http.MethodPost,
+			base+"/v1/multipart",
+			strings.NewReader(form.Encode()),
+		)
+		if err != nil {
+			return err
+		}
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return client_json(request, &upload)
+	})
+	if err != nil {
+		return upload, err
+	}
+	data, err := json.Marshal(put_state{URL: base, ID: upload.ID})
+	if err != nil {
+		return upload, err
+	}
+	if err := os.MkdirAll(filepath.Dir(state_path), 0755); err != nil {
+		return upload, err
+	}
+	return upload, os.WriteFile(state_path, data, 0644)
+}
+
+func put_multipart(base string, header http.Header, filename string, hash string, algo string, size int64) (upload_response, error) {
+	var reply upload_response
+	upload, err := put_multipart_start(base, header, hash, algo)
+	if err != nil {
+		return reply, err
+	}
+	received := map[int]string{}
+	for _, part := range upload.Parts {
+		received[part.Part] = part.Hash
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return reply, err
+	}
+	defer f.Close()
+	part_size := put_part_size(size)
+	hashes := make([]string, (size+part_size-1)/part_size)
+	err = client_parallel(len(hashes), func(i int) error {
+		n := i + 1
+		offset := int64(i) * part_size
+		n_bytes := part_size
+		if size-offset < n_bytes {
+			n_bytes = size - offset
+		}
+		section := io.NewSectionReader(f, offset, n_bytes)
+		part_hash, err := tee_hash(io.Discard, section, algo, filename)
+		if err != nil {
+			return err
+		}
+		hashes[i] = part_hash
+		if received[n] == part_hash {
+			return nil
+		}
+		return client_retry(fmt.Sprintf("part %d", n), func() error {
+			return put_part(base, upload.ID, n, part_hash, section)
+		})
+	})
+	if err != nil {
+		return reply, err
+	}
+
+	form := url.Values{}
+	form.Set("parts", strings.Join(hashes, ","))
+	form.Set("hash", hash)
+	tried := false
+	err = client_retry("completion of upload", func() error {
+		request, err := http.NewRequest(
+			http.MethodPost,
+			base+"/v1/multipart/"+upload.ID+"/complete",
+			strings.NewReader(form.Encode()),
+		)
+		if err != nil {
+			return err
+		}
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		reply, err = put_send(request)
+		// an earlier try may have completed it, and only its reply was lost
+		var failure *client_error
+		if tried && errors.As(err, &failure) && failure.Status == http.StatusNotFound {
+			if exists, _ := put_exists(base, hash, algo); exists {
+				reply = upload_response{Hash: hash, HashAlgo: algo, Size: size}
+				return nil
+			}
+		}
+		tried = true
+		return err
+	})
+	if err != nil {
+		return reply, err
+	}
+	if state_path, err := put_state_path(hash); err == nil {
+		os.Remove(state_path)
+	}
+	return reply, nil
+}
+
+func put_part(base string, id string, n int, hash string, section *io.SectionReader) error {
+	if _, err := section.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	part_url := fmt.Sprintf("%s/v1/multipart/%s/%d?hash=%s", base, id, n, hash)
+	request, err := http.NewRequest(http.MethodPut, part_url, section)
+	if err != nil {
+		return err
+	}
+	request.ContentLength = section.Size()
+	response, err := client_do(request)
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
@@ -0,0 +1,410 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+/**
+ * kfs queue keeps a list of files to upload in a database on the client,
+ * so that files found while the server cannot be reached, e.g. on a
+ * laptop that is offline, are sent once it can be:
+ *     kfs queue add -path /photos ~/Pictures/2024
+ *     kfs queue run -watch 1m
+ *     kfs queue
+ * add records files, or every file under a directory, with the server
+ * path under -path following their place in it. run uploads what is
+ * pending, as kfs put does. When the server cannot be reached, or is
+ * read-only, run stops, and leaves the rest pending; with -watch it tries
+ * again after that long, for as long as it runs. A file that fails for
+ * good, e.g. because it is gone or its hash does not match, is marked
+ * failed with the error, and is not tried again until it is added again.
+ * Adding a directory again queues only the files in it that are new, or
+ * changed since they were uploaded.
+ * With no command, the state of each file is listed, and clear forgets
+ * the files that were uploaded.
+ */
+
+const (
+	QUEUE_PENDING = "pending"
+	QUEUE_DONE    = "done"
+	QUEUE_FAILED  = "failed"
+)
+
+type queue_item struct {
+	id        int64
+	filename  string
+	url       string
+	name      string
+	namespace string
+	path      string
+	hash_algo string
+	state     string
+	attempts  int64
+	hash      string
+	err       string
+	updated   int64
+}
+
+func queue_default_path() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "kfs-queue.sqlite3"
+	}
+	return filepath.Join(dir, "kfs", "queue.sqlite3")
+}
+
+func queue_open(db_path string) (*sql.DB, error) {
+	if err := os.MkdirAll(filepath.Dir(db_path), 0755); err != nil {
+		return nil, err
+	}
+	queue_db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_busy_timeout=5000", db_path))
+	if err != nil {
+		return nil, err
+	}
+	queue_db.SetMaxOpenConns(1)
+	schema := `
+		CREATE TABLE IF NOT EXISTS queue(
+			id INTEGER PRIMARY KEY,
+			filename TEXT NOT NULL,
+			url TEXT NOT NULL,
+			name TEXT NOT NULL,
+			namespace TEXT NOT NULL,
+			path TEXT NOT NULL,
+			hash_algo TEXT NOT NULL,
+			size INTEGER NOT NULL,
+			mtime INTEGER NOT NULL,
+			state TEXT NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			hash TEXT NOT NULL DEFAULT '',
+			error TEXT NOT NULL DEFAULT '',
+			updated_at INTEGER NOT NULL
+		);
+	`
+	if _, err := queue_db.Exec(schema); err != nil {
+		queue_db.Close()
+		return nil, err
+	}
+	return queue_db, nil
+}
+
+func queue_main(args []string) {
+	command := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	flags := flag.NewFlagSet("queue", flag.ExitOnError)
+	db_path := flags.String("db", queue_default_path(), "queue database")
+	base_url := flags.String("url", "http://localhost:8080", "server to upload to")
+	namespace := flags.String("namespace", "", "namespace to store the files in")
+	dir := flags.String("path", "", "directory to store the files in")
+	algo := flags.String("hash-algo", KFS_DEFAULT_HASH_ALGO, "hash algorithm")
+	watch := flags.Duration("watch", 0, "with run, keep going, trying again this often")
+	client_flags(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: kfs queue [add FILE|DIR... | run | clear] [flags]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if !valid_hash_algo(*algo) {
+		fmt.Fprintf(os.Stderr, "kfs queue: unsupported hash algorithm: '%s'\n", *algo)
+		os.Exit(2)
+	}
+
+	queue_db, err := queue_open(*db_path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kfs queue: %v\n", err)
+		os.Exit(1)
+	}
+	defer queue_db.Close()
+	base := strings.TrimSuffix(*base_url, "/")
+
+	switch command {
+	case "":
+		err = queue_status(queue_db)
+	case "add":
+		if flags.NArg() == 0 {
+			flags.Usage()
+			os.Exit(2)
+		}
+		item := queue_item{url: base, namespace: *namespace, path: *dir, hash_algo: *algo}
+		err = queue_add(queue_db, item, flags.Args())
+	case "run":
+		for {
+			err = queue_run(queue_db)
+			if *watch <= 0 {
+				break
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "kfs queue: %v\n", err)
+			}
+			time.Sleep(*watch)
+		}
+	case "clear":
+		_, err = queue_db.Exec(`delete from queue where state = ?`, QUEUE_DONE)
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kfs queue: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+/**
+ * Record each file, and every file under each directory, as pending. A
+ * file already queued for the same place on the server is not queued
+ * twice, but made pending again, unless it was uploaded and has not
+ * changed since, so that a directory can be added over and over to pick
+ * up what is new in it.
+ */
+func queue_add(queue_db *sql.DB, item queue_item, sources []string) error {
+	added := 0
+	add := func(filename string, server_path string) error {
+		abs, err := filepath.Abs(filename)
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(abs)
+		if err != nil {
+			return err
+		}
+		now := time.Now().Unix()
+		name := filepath.Base(abs)
+		var id, size, mtime int64
+		var state string
+		err = queue_db.QueryRow(
+			`
+			select id, state, size, mtime from queue
+			where filename = ? and url = ? and namespace = ? and path = ? and name = ?
+			`,
+			abs,
+			item.url,
+			item.namespace,
+			server_path,
+			name,
+		).Scan(&id, &state, &size, &mtime)
+		switch {
+		case err == sql.ErrNoRows:
+			_, err = queue_db.Exec(
+				`
+				insert into queue(
+					filename, url, name, namespace, path, hash_algo,
+					state, size, mtime, updated_at
+				) values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+				`,
+				abs,
+				item.url,
+				name,
+				item.namespace,
+				server_path,
+				item.hash_algo,
+				QUEUE_PENDING,
+				info.Size(),
+				info.ModTime().Unix(),
+				now,
+			)
+		case err != nil:
+			return err
+		case state == QUEUE_DONE && size == info.Size() && mtime == info.ModTime().Unix():
+			return nil
+		default:
+			_, err = queue_db.Exec(
+				`
+				update queue
+				set state = ?, attempts = 0, error = '', size = ?, mtime = ?, updated_at = ?
+				where id = ?
+				`,
+				QUEUE_PENDING,
+				info.Size(),
+				info.ModTime().Unix(),
+				now,
+				id,
+			)
+		}
+		if err != nil {
+			return err
+		}
+		added++
+		return nil
+	}
+
+	for _, source := range sources {
+		info, err := os.Stat(source)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			if err := add(source, item.path); err != nil {
+				return err
+			}
+			continue
+		}
+		err = filepath.WalkDir(source, func(filename string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !entry.Type().IsRegular() {
+				return nil
+			}
+			rel, err := filepath.Rel(source, filepath.Dir(filename))
+			if err != nil {
+				return err
+			}
+			return add(filename, path.Join("/", item.path, filepath.ToSlash(rel)))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(os.Stderr, "queued %d files\n", added)
+	return nil
+}
+
+func queue_list(queue_db *sql.DB, state string) ([]queue_item, error) {
+	query := `
+		select id, filename, url, name, namespace, path, hash_algo,
+			state, attempts, hash, error, updated_at
+		from queue
+		where ? = '' or state = ?
+		order by id
+	`
+	rows, err := queue_db.Query(query, state, state)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []queue_item
+	for rows.Next() {
+		var item queue_item
+		err := rows.Scan(
+			&item.id,
+			&item.filename,
+			&item.url,
+			&item.name,
+			&item.namespace,
+			&item.path,
+			&item.hash_algo,
+			&item.state,
+			&item.attempts,
+			&item.hash,
+			&item.err,
+			&item.updated,
+		)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+/**
+ * Upload the pending files, in the order they were queued. Stops at the
+ * first error that may pass, since the files after it would most likely
+ * fail the same way, and returns it.
+ */
+func queue_run(queue_db *sql.DB) error {
+	items, err := queue_list(queue_db, QUEUE_PENDING)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		header := http.Header{}
+		header.Set("X-Kfs-Hash-Algo", item.hash_algo)
+		header.Set("X-Kfs-Filename", item.name)
+		header.Set("X-Kfs-Namespace", item.namespace)
+		header.Set("X-Kfs-Path", item.path)
+		reply, upload_err := put_file(item.url, header, item.filename, item.hash_algo)
+
+		state := QUEUE_DONE
+		message := ""
+		if upload_err != nil {
+			message = upload_err.Error()
+			state = QUEUE_FAILED
+			if client_retryable(upload_err) {
+				state = QUEUE_PENDING
+			}
+		}
+		_, err := queue_db.Exec(
+			`
+			update queue
+			set state = ?, attempts = attempts + 1, hash = ?, error = ?, updated_at = ?
+			where id = ?
+			`,
+			state,
+			reply.Hash,
+			message,
+			time.Now().Unix(),
+			item.id,
+		)
+		if err != nil {
+			return err
+		}
+		if state == QUEUE_PENDING {
+			return fmt.Errorf("stopped at '%s': %v", item.filename, upload_err)
+		}
+		if state == QUEUE_FAILED {
+			fmt.Fprintf(os.Stderr, "could not upload '%s': %v\n", item.filename, upload_err)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "uploaded '%s' as %s\n", item.filename, reply.Hash)
+	}
+	return nil
+}
+
+/**
+ * Print the state of each queued file.
+ */
+func queue_status(queue_db *sql.DB) error {
+	items, err := queue_list(queue_db, "")
+	if err != nil {
+		return err
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "STATE\tTRIES\tUPDATED\tFILE\tTO\tERROR")
+	for _, item := range items {
+		namespace := item.namespace
+		if namespace == "" {
+			namespace = KFS_DEFAULT_NAMESPACE
+		}
+		fmt.Fprintf(
+			writer,
+			"%s\t%d\t%s\t%s\t%s\t%s\n",
+			item.state,
+			item.attempts,
+			time.Unix(item.updated, 0).Format("2006-01-02 15:04"),
+			item.filename,
+			namespace+":"+path.Join("/", item.path, item.name),
+			item.err,
+		)
+	}
+	return writer.Flush()
+}
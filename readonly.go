@@ -0,0 +1,113 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+/**
+ * Maintenance mode, for repairs, migrations and disk swaps. While it is on,
+ * the server is read-only: downloads and exists still work, but uploads and
+ * catalog changes are turned away with 503, so clients can retry later.
+ */
+
+// how long clients are told to wait before retrying, in seconds
+var KFS_READ_ONLY_RETRY_AFTER = 60
+
+type read_only_state struct {
+	Enabled bool       `json:"enabled"`
+	Reason  string     `json:"reason,omitempty"`
+	Since   *time.Time `json:"since,omitempty"`
+}
+
+var (
+	read_only       read_only_state
+	read_only_mutex sync.Mutex
+)
+
+func read_only_get() read_only_state {
+	read_only_mutex.Lock()
+	defer read_only_mutex.Unlock()
+	return read_only
+}
+
+func read_only_set(enabled bool, reason string) {
+	read_only_mutex.Lock()
+	defer read_only_mutex.Unlock()
+	if enabled == read_only.Enabled && reason == read_only.Reason {
+		return
+	}
+	if enabled {
+		now := time.Now()
+		read_only = read_only_state{true, reason, &now}
+		log.Printf("entering maintenance mode: %s", reason)
+		metric_set("kfs_read_only", "Whether the server is read-only for maintenance.", "", 1)
+	} else {
+		read_only = read_only_state{}
+		log.Printf("leaving maintenance mode")
+		metric_set("kfs_read_only", "Whether the server is read-only for maintenance.", "", 0)
+	}
+}
+
+/**
+ * Turn away requests that would change anything, while in maintenance
+ * mode.
+ */
+func read_only_check(writer http.ResponseWriter) bool {
+	state := read_only_get()
+	if !state.Enabled {
+		return true
+	}
+	msg := "read-only for maintenance"
+	if state.Reason != "" {
+		msg = fmt.Sprintf("%s: %s", msg, state.Reason)
+	}
+	writer.Header().Set("Retry-After", strconv.Itoa(KFS_READ_ONLY_RETRY_AFTER))
+	write_error_code(writer, msg, http.StatusServiceUnavailable, API_READ_ONLY)
+	return false
+}
+
+/**
+ * Report whether the server is in maintenance mode.
+ */
+func handle_read_only_get(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	write_json(writer, http.StatusOK, read_only_get())
+}
+
+/**
+ * Turn maintenance mode on or off, e.g.
+ *     curl -X POST localhost:8080/admin/read-only -d enabled=true -d reason='swapping disk3'
+ *     curl -X POST localhost:8080/admin/read-only -d enabled=false
+ */
+func handle_read_only_set(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	enabled, err := strconv.ParseBool(request.FormValue("enabled"))
+	if err != nil {
+		write_error(writer, "enabled must be true or false", http.StatusBadRequest)
+		return
+	}
+	read_only_set(enabled, request.FormValue("reason"))
+	write_json(writer, http.StatusOK, read_only_get())
+}
@@ -0,0 +1,240 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+/**
+ * kfs rebuild-catalog makes a new database from what is on the disks, for
+ * when the old one is lost or corrupt, e.g.
+ *     kfs rebuild-catalog -verify
+ * Every blob in the storage directory of each configured disk is recorded
+ * as a replica, trusting the hash in its name, or, with -verify, only once
+ * it hashes to it. The names of the files come from the newest catalog
+ * snapshot on any of the disks. Blobs that no snapshot names are put in
+ * the lost+found namespace under their hash, so that they can still be
+ * found, and are not garbage collected. An existing database is moved
+ * aside with -force, and kept.
+ */
+
+const KFS_LOST_AND_FOUND = "lost+found"
+
+type rebuild_report struct {
+	Blobs     int    `json:"blobs"`
+	Replicas  int    `json:"replicas"`
+	Corrupt   int    `json:"corrupt"`
+	Snapshot  string `json:"snapshot,omitempty"`
+	Entries   int    `json:"entries"`
+	Missing   int    `json:"missing"`
+	LostFound int    `json:"lost_found"`
+}
+
+type rebuild_blob struct {
+	hash  string
+	algo  string
+	size  int64
+	disks []placement
+}
+
+func rebuild_main(args []string) {
+	flags := flag.NewFlagSet("rebuild-catalog", flag.ExitOnError)
+	verify := flags.Bool("verify", false, "hash every blob rather than trust its name")
+	force := flags.Bool("force", false, "move an existing database aside")
+	flags.Parse(args)
+
+	config_load()
+	if _, err := os.Stat(KFS_DB_PATH); err == nil {
+		if !*force {
+			fmt.Fprintf(os.Stderr, "kfs rebuild-catalog: '%s' exists, use -force to replace it\n", KFS_DB_PATH)
+			os.Exit(2)
+		}
+		aside := fmt.Sprintf("%s.before-rebuild-%d", KFS_DB_PATH, time.Now().Unix())
+		for _, suffix := range []string{"", "-wal", "-shm"} {
+			err := os.Rename(KFS_DB_PATH+suffix, aside+suffix)
+			if err != nil && !os.IsNotExist(err) {
+				fmt.Fprintf(os.Stderr, "kfs rebuild-catalog: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		log.Printf("moved the old database to '%s'", aside)
+	}
+
+	db_init()
+	defer db_close()
+	report, err := catalog_rebuild(settings().disks, *verify)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kfs rebuild-catalog: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("blobs:      %d, with %d replicas\n", report.Blobs, report.Replicas)
+	fmt.Printf("corrupt:    %d\n", report.Corrupt)
+	if report.Snapshot != "" {
+		fmt.Printf("snapshot:   %s\n", report.Snapshot)
+	}
+	fmt.Printf("entries:    %d restored, %d without a blob\n", report.Entries, report.Missing)
+	fmt.Printf("lost+found: %d\n", report.LostFound)
+}
+
+/**
+ * Every blob in the disk's storage directory.
+ */
+func rebuild_scan_disk(root string, verify bool, blobs map[string]*rebuild_blob, report *rebuild_report) error {
+	return filepath.WalkDir(get_storage_path(root), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		match := staging_blob_name.FindStringSubmatch(entry.Name())
+		if match == nil || !entry.Type().IsRegular() || !valid_hash_algo(match[2]) {
+			return nil
+		}
+		hash, algo := match[1], match[2]
+		if verify {
+			if err := verify_file(path, hash, algo); err != nil {
+				log.Printf("not restoring: %v", err)
+				report.Corrupt++
+				return nil
+			}
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		key := hash + "." + algo
+		blob, ok := blobs[key]
+		if !ok {
+			blob = &rebuild_blob{hash: hash, algo: algo, size: info.Size()}
+			blobs[key] = blob
+		}
+		blob.disks = append(blob.disks, placement{root: root})
+		report.Replicas++
+		return nil
+	})
+}
+
+/**
+ * The newest catalog snapshot on any of the disks.
+ */
+func rebuild_newest_snapshot(roots []string) (catalog_snapshot, string) {
+	var newest catalog_snapshot
+	newest_path := ""
+	for _, root := range roots {
+		path := catalog_snapshot_path(root)
+		snapshot, err := catalog_snapshot_read(path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Println(err)
+			}
+			continue
+		}
+		if newest_path == "" || snapshot.WrittenAt > newest.WrittenAt {
+			newest = snapshot
+			newest_path = path
+		}
+	}
+	return newest, newest_path
+}
+
+/**
+ * Fill the empty database from the disks.
+ */
+func catalog_rebuild(roots []string, verify bool) (rebuild_report, error) {
+	var report rebuild_report
+	blobs := map[string]*rebuild_blob{}
+	for _, root := range roots {
+		log.Printf("scanning '%s'", root)
+		if err := rebuild_scan_disk(root, verify, blobs, &report); err != nil {
+			return report, fmt.Errorf("could not scan '%s': %v", root, err)
+		}
+	}
+	report.Blobs = len(blobs)
+	snapshot, snapshot_path := rebuild_newest_snapshot(roots)
+	report.Snapshot = snapshot_path
+
+	// the name each blob was last stored under, for its file records
+	named := map[string]catalog_entry{}
+	for _, entry := range snapshot.Catalog {
+		named[entry.Hash+"."+entry.HashAlgo] = entry
+	}
+	keys := make([]string, 0, len(blobs))
+	for key := range blobs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	err := db_transaction(func(tx *sql.Tx) error {
+		report.Entries, report.Missing, report.LostFound = 0, 0, 0
+		now := time.Now().Unix()
+		for _, key := range keys {
+			blob := blobs[key]
+			entry, ok := named[key]
+			if !ok {
+				entry = catalog_entry{
+					Namespace: KFS_LOST_AND_FOUND,
+					Path:      "/",
+					Filename:  blob.hash,
+					Hash:      blob.hash,
+					HashAlgo:  blob.algo,
+					Size:      blob.size,
+				}
+				if _, err := db_insert_catalog_entry(tx, entry); err != nil {
+					return err
+				}
+				report.LostFound++
+			}
+			_, err := tx.Exec(
+				`insert into blobs(hash, hash_algo, created_at) values(?, ?, ?)`,
+				blob.hash,
+				blob.algo,
+				now,
+			)
+			if err != nil {
+				return err
+			}
+			err = db_add_file_records(tx, blob.hash, blob.algo, blob.disks, entry.Path, entry.Filename, blob.size, false)
+			if err != nil {
+				return err
+			}
+		}
+		for _, entry := range snapshot.Catalog {
+			if _, ok := blobs[entry.Hash+"."+entry.HashAlgo]; !ok {
+				report.Missing++
+				continue
+			}
+			if _, err := db_insert_catalog_entry(tx, entry); err != nil {
+				return err
+			}
+			report.Entries++
+		}
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("could not rebuild catalog: %v", err)
+	}
+	known_hashes_load()
+	return report, nil
+}
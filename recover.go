@@ -0,0 +1,373 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+/**
+ * Archive jobs that were cut short by a crash or restart. Before a blob is
+ * copied to its disks, an intent is journaled for each of them, and each is
+ * only cleared once that replica is known to be complete, so the journal
+ * says exactly what was in flight. The staged copy is kept until every
+ * intent is cleared.
+ *
+ * An upload is renamed to hash.algo in staging once its hash has been
+ * verified, shortly before it is journaled, so any such file without an
+ * intent is a complete blob that was never archived at all.
+ */
+
+var staging_blob_name = regexp.MustCompile(`^([0-9a-f]+)\.([a-z0-9]+)$`)
+
+// replicas allocated before this are not being written by this process
+var recover_started = time.Now()
+
+type archive_intent struct {
+	hash         string
+	algo         string
+	staging_file string
+	targets      []placement
+}
+
+func db_add_intents(hash string, algo string, staging_file string, disks []placement) error {
+	return db_transaction(func(tx *sql.Tx) error {
+		for _, disk := range disks {
+			stmt := `
+				INSERT OR REPLACE INTO archive_intents(
+					hash,
+					hash_algo,
+					staging_file,
+					node,
+					root,
+					created_at
+				) values(?, ?, ?, ?, ?, ?)
+			`
+			_, err := tx.Exec(
+				stmt,
+				hash,
+				algo,
+				staging_file,
+				disk.node,
+				disk.root,
+				time.Now().Unix(),
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func db_clear_intent(hash string, algo string, disk placement) {
+	stmt := `
+		delete from archive_intents
+		where hash = ? and hash_algo = ? and node = ? and root = ?
+	`
+	if _, err := db_exec(stmt, hash, algo, disk.node, disk.root); err != nil {
+		log.Printf("could not clear intent to archive %s to %s: %v", hash, disk, err)
+	}
+}
+
+/**
+ * The replica is written and checked: clear its intent, and let it be read
+ * from.
+ */
+func db_replica_stored(hash string, algo string, disk placement) {
+	err := db_transaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			`
+			delete from archive_intents
+			where hash = ? and hash_algo = ? and node = ? and root = ?
+			`,
+			hash,
+			algo,
+			disk.node,
+			disk.root,
+		)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(
+			`
+			update files set pending = 0
+			where hash = ? and hash_algo = ? and node = ? and storage_root = ?
+			`,
+			hash,
+			algo,
+			disk.node,
+			disk.root,
+		)
+		return err
+	})
+	if err != nil {
+		log.Printf("could not record replica of %s on %s: %v", hash, disk, err)
+		return
+	}
+	// only now is there something for a duplicate upload to point to
+	known_hash_add(hash, algo)
+	upload_state_settle(hash, algo)
+}
+
+func db_count_intents(hash string, algo string) (int, error) {
+	var n int
+	query := `select count(*) from archive_intents where hash = ? and hash_algo = ?`
+	err := db.QueryRow(query, hash, algo).Scan(&n)
+	return n, err
+}
+
+/**
+ * Export how many replicas are still waiting to be written to each local
+ * disk, so that a disk that falls behind stands out.
+ */
+func archive_queue_metrics() {
+	depths := map[string]int{}
+	for _, root := range settings().disks {
+		depths[root] = 0
+	}
+	rows, err := db.Query(`
+		select root, count(*) from archive_intents
+		where node = ''
+		group by root
+	`)
+	if err != nil {
+		log.Printf("could not count archive intents: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var root string
+		var n int
+		if err := rows.Scan(&root, &n); err != nil {
+			log.Printf("could not count archive intents: %v", err)
+			return
+		}
+		depths[root] = n
+	}
+	for root, n := range depths {
+		metric_set(
+			"kfs_disk_archive_queue",
+			"Replicas waiting to be written to the disk.",
+			fmt.Sprintf("root=%q", root),
+			float64(n),
+		)
+	}
+}
+
+func db_list_intents() ([]archive_intent, error) {
+	rows, err := db.Query(`
+		select hash, hash_algo, staging_file, node, root
+		from archive_intents
+		order by hash, hash_algo, staging_file
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("could not list archive intents: %v", err)
+	}
+	defer rows.Close()
+	var intents []archive_intent
+	for rows.Next() {
+		var intent archive_intent
+		var disk placement
+		err := rows.Scan(
+			&intent.hash,
+			&intent.algo,
+			&intent.staging_file,
+			&disk.node,
+			&disk.root,
+		)
+		if err != nil {
+			return nil, err
+		}
+		n := len(intents)
+		if n > 0 &&
+			intents[n-1].hash == intent.hash &&
+			intents[n-1].algo == intent.algo &&
+			intents[n-1].staging_file == intent.staging_file {
+			intents[n-1].targets = append(intents[n-1].targets, disk)
+			continue
+		}
+		intent.targets = []placement{disk}
+		intents = append(intents, intent)
+	}
+	return intents, rows.Err()
+}
+
+func db_get_placements(hash string, algo string) ([]placement, error) {
+	rows, err := db.Query(
+		`select node, storage_root from files where hash = ? and hash_algo = ?`,
+		hash,
+		algo,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not query placements: %v", err)
+	}
+	defer rows.Close()
+	var disks []placement
+	for rows.Next() {
+		var disk placement
+		if err := rows.Scan(&disk.node, &disk.root); err != nil {
+			return nil, err
+		}
+		disks = append(disks, disk)
+	}
+	return disks, rows.Err()
+}
+
+func replica_complete(root string, hash string, algo string, size int64) bool {
+	info, err := os.Stat(get_blob_path(root, hash, algo))
+	return err == nil && info.Size() == size
+}
+
+/**
+ * Archive the staged blob to those of the disks that do not have it yet.
+ */
+func recover_archive(staging_file string, hash string, algo string, disks []placement) {
+	info, err := os.Stat(staging_file)
+	if err != nil {
+		log.Printf("could not recover archive of %s: %v", hash, err)
+		return
+	}
+	missing := []placement{}
+	for _, disk := range disks {
+		if disk.node == "" && replica_complete(disk.root, hash, algo, info.Size()) {
+			db_replica_stored(hash, algo, disk)
+			continue
+		}
+		missing = append(missing, disk)
+	}
+	log.Printf("resuming archive of '%s' to %v", staging_file, missing)
+	metric_add(
+		"kfs_archives_recovered_total",
+		"Archive jobs resumed at startup.",
+		"",
+		1,
+	)
+	mode := STAGING_ON_DISK
+	if dir := settings().staging_dir; dir != "" && filepath.Dir(staging_file) == dir {
+		mode = STAGING_IN_DIR
+	}
+	space_reserve(hash, algo, info.Size(), missing, mode)
+	archive_file(filepath.Dir(staging_file)+"/", missing, staging_file, hash, algo, nil)
+}
+
+/**
+ * Finish the archive jobs in the journal, then archive the blobs left in
+ * each staging directory that never made it into the journal.
+ */
+func staging_recover() {
+	intents, err := db_list_intents()
+	if err != nil {
+		log.Printf("could not recover archive jobs: %v", err)
+		return
+	}
+	journaled := map[string]bool{}
+	for _, intent := range intents {
+		journaled[intent.staging_file] = true
+		recover_archive(intent.staging_file, intent.hash, intent.algo, intent.targets)
+	}
+
+	dirs, err := staging_dirs()
+	if err != nil {
+		log.Printf("could not recover staged blobs: %v", err)
+		return
+	}
+	for _, staging_path := range dirs {
+		entries, err := os.ReadDir(staging_path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("could not read '%s': %v", staging_path, err)
+			}
+			continue
+		}
+		for _, entry := range entries {
+			match := staging_blob_name.FindStringSubmatch(entry.Name())
+			if match == nil || !valid_hash_algo(match[2]) || !entry.Type().IsRegular() {
+				continue
+			}
+			hash, algo := match[1], match[2]
+			hash_filename := filepath.Join(staging_path, entry.Name())
+			if journaled[hash_filename] {
+				continue
+			}
+			placements, err := db_get_placements(hash, algo)
+			if err != nil {
+				log.Printf("could not recover '%s': %v", hash_filename, err)
+				continue
+			}
+			if len(placements) == 0 {
+				log.Printf("'%s' is not meant for any disk, leaving it", hash_filename)
+				continue
+			}
+			recover_archive(hash_filename, hash, algo, placements)
+		}
+	}
+	db_release_unfinished()
+	upload_state_recover()
+}
+
+/**
+ * Forget the replicas of uploads that were cut short before they were
+ * staged. They are pending, have no intent, and were allocated before this
+ * process started, so nothing is still writing them. The space they took
+ * was read again from the disks at startup, so none is given back.
+ */
+func db_release_unfinished() {
+	var released int64
+	err := db_transaction(func(tx *sql.Tx) error {
+		result, err := tx.Exec(
+			`
+			delete from files
+			where pending
+				and created_at < ?
+				and not exists (
+					select 1 from archive_intents
+					where archive_intents.hash = files.hash
+						and archive_intents.hash_algo = files.hash_algo
+				)
+			`,
+			recover_started.Unix(),
+		)
+		if err != nil {
+			return err
+		}
+		released, _ = result.RowsAffected()
+		_, err = tx.Exec(`
+			delete from blobs
+			where not exists (
+				select 1 from files
+				where files.hash = blobs.hash and files.hash_algo = blobs.hash_algo
+			)
+		`)
+		return err
+	})
+	if err != nil {
+		log.Printf("could not release unfinished uploads: %v", err)
+		return
+	}
+	if released > 0 {
+		log.Printf("released %d replicas of uploads that never finished", released)
+		known_hashes_load()
+	}
+}
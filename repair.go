@@ -0,0 +1,151 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+const KFS_REPAIR_QUEUE_SIZE = 1024
+
+type repair_job struct {
+	hash     string
+	algo     string
+	bad_root string
+	roots    []string
+}
+
+var (
+	repair_queue   = make(chan repair_job, KFS_REPAIR_QUEUE_SIZE)
+	repair_mutex   = &sync.Mutex{}
+	repair_pending = map[string]bool{}
+)
+
+/**
+ * Queue the replica on bad_root to be replaced from one of the other roots.
+ * A replica that is already queued is not queued again, and if the queue is
+ * full the job is dropped, since the next failed read will queue it again.
+ */
+func enqueue_repair(hash string, algo string, bad_root string, roots []string) {
+	if !KFS_READ_REPAIR {
+		return
+	}
+	key := fmt.Sprintf("%s:%s", bad_root, hash)
+	repair_mutex.Lock()
+	defer repair_mutex.Unlock()
+	if repair_pending[key] {
+		return
+	}
+	select {
+	case repair_queue <- repair_job{hash, algo, bad_root, roots}:
+		repair_pending[key] = true
+		log.Printf("queued repair of %s on '%s'", hash, bad_root)
+	default:
+		log.Printf("repair queue is full, dropping repair of %s", hash)
+	}
+}
+
+func repair_worker() {
+	for job := range repair_queue {
+		repair_replica(job.hash, job.algo, job.bad_root, job.roots)
+		key := fmt.Sprintf("%s:%s", job.bad_root, job.hash)
+		repair_mutex.Lock()
+		delete(repair_pending, key)
+		repair_mutex.Unlock()
+	}
+}
+
+/**
+ * Replace a corrupt replica with a copy of the first other replica whose
+ * hash still checks out.
+ */
+func repair_replica(hash string, algo string, bad_root string, roots []string) {
+	// the replica may be missing altogether, shard directory and all
+	bad_path, err := make_blob_path(bad_root, hash, algo)
+	if err != nil {
+		log.Printf("failed to repair %s on '%s': %v", hash, bad_root, err)
+		return
+	}
+	for _, root := range roots {
+		if root == bad_root {
+			continue
+		}
+		good_path := get_blob_path(root, hash, algo)
+		digest, err := hash_file_algo(good_path, algo)
+		if err == nil {
+			db_record_verify(hash, algo, root, digest == hash)
+		}
+		if err != nil || digest != hash {
+			log.Printf("replica '%s' is not usable for repair", good_path)
+			continue
+		}
+		/*
+		 * The copy is made beside the replica and renamed over it, so
+		 * readers of the old file, and the other names of it when it is
+		 * hard linked, are left as they are.
+		 */
+		repair_path := bad_path + ".repair"
+		if err := copy_file(good_path, repair_path); err != nil {
+			os.Remove(repair_path)
+			log.Printf("failed to repair '%s': %v", bad_path, err)
+			return
+		}
+		if err := os.Rename(repair_path, bad_path); err != nil {
+			os.Remove(repair_path)
+			log.Printf("failed to repair '%s': %v", bad_path, err)
+			return
+		}
+		if err := replica_sync(bad_root, hash, algo); err != nil {
+			log.Printf("repaired '%s', but %v", bad_path, err)
+		}
+		log.Printf("repaired '%s' from '%s'", bad_path, good_path)
+		emit_event(event{Type: EVENT_REPLICA_REPAIR, Hash: hash, HashAlgo: algo, Root: bad_root})
+		return
+	}
+	if repair_from_cluster(hash, algo, bad_path) {
+		emit_event(event{Type: EVENT_REPLICA_REPAIR, Hash: hash, HashAlgo: algo, Root: bad_root})
+		return
+	}
+	log.Printf("no healthy replica available to repair '%s'", bad_path)
+}
+
+/**
+ * Replace the corrupt replica with a copy pulled from another node.
+ */
+func repair_from_cluster(hash string, algo string, bad_path string) bool {
+	if !cluster_enabled() {
+		return false
+	}
+	candidates, err := db_get_replica_nodes(hash)
+	if err != nil {
+		log.Println(err)
+	}
+	for _, base_url := range append(candidates, KFS_CLUSTER_PEERS...) {
+		err := cluster_pull_blob(base_url, hash, algo, bad_path)
+		if err != nil {
+			log.Printf("could not pull %s from '%s': %v", hash, base_url, err)
+			continue
+		}
+		log.Printf("repaired '%s' from '%s'", bad_path, base_url)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,521 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+/**
+ * Changing how many replicas already stored blobs have. The number a blob
+ * should have is, from most to least specific:
+ *
+ *     - its own, set through one of its catalog entries
+ *     - the most wanted by the namespaces of its catalog entries
+ *     - the default for every namespace, set with no id or namespace
+ *     - KFS_REDUNDANCY
+ *
+ * e.g.
+ *     curl -X POST -F replicas=3 -F namespace=photos localhost:8080/replicas
+ *
+ * replicas=0 takes the setting away again. Uploads are still placed on
+ * KFS_REDUNDANCY disks, and replicas_loop copies blobs to more disks, or
+ * trims them from the fullest ones, until each has as many as it should.
+ * Only replicas on this node's disks are trimmed.
+ *
+ * Replicas on failed disks, or that have gone missing, do not count, so
+ * the same job copies the blobs they held onto healthy disks.
+ */
+
+var (
+	KFS_REPLICAS_INTERVAL = 10 * time.Minute
+
+	// blobs looked at on each pass
+	KFS_REPLICAS_BATCH = 100
+)
+
+// the namespace that holds the default for all namespaces
+const REPLICAS_DEFAULT = ""
+
+var replicas_wake = make(chan struct{}, 1)
+
+type replica_policies struct {
+	Default    int            `json:"default"`
+	Namespaces map[string]int `json:"namespaces"`
+}
+
+type replica_change struct {
+	hash   string
+	algo   string
+	size   int64
+	target int
+	class  string
+}
+
+func db_set_blob_replicas(hash string, algo string, replicas int) error {
+	var value interface{}
+	if replicas > 0 {
+		value = replicas
+	}
+	_, err := db_exec(
+		`update blobs set replicas = ? where hash = ? and hash_algo = ?`,
+		value,
+		hash,
+		algo,
+	)
+	return err
+}
+
+func db_set_namespace_replicas(namespace string, replicas int) error {
+	if replicas == 0 {
+		_, err := db_exec(`delete from replica_policies where namespace = ?`, namespace)
+		return err
+	}
+	stmt := `
+		INSERT OR REPLACE INTO replica_policies(namespace, replicas)
+		values(?, ?)
+	`
+	_, err := db_exec(stmt, namespace, replicas)
+	return err
+}
+
+func db_get_replica_policies() (replica_policies, error) {
+	policies := replica_policies{
+		Default:    settings().redundancy,
+		Namespaces: map[string]int{},
+	}
+	rows, err := db.Query(`select namespace, replicas from replica_policies`)
+	if err != nil {
+		return policies, fmt.Errorf("could not query replica policies: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var namespace string
+		var replicas int
+		if err := rows.Scan(&namespace, &replicas); err != nil {
+			return policies, err
+		}
+		if namespace == REPLICAS_DEFAULT {
+			policies.Default = replicas
+		} else {
+			policies.Namespaces[namespace] = replicas
+		}
+	}
+	return policies, rows.Err()
+}
+
+/**
+ * The number of replicas each blob should have, as the table targets,
+ * with the default for every namespace as the first parameter.
+ */
+const replica_targets = `
+	default_replicas as (
+		select coalesce(
+			(select replicas from replica_policies where namespace = ''),
+			?
+		) as replicas
+	),
+	targets as (
+		select
+			blobs.hash,
+			blobs.hash_algo,
+			blobs.class,
+			coalesce(
+				blobs.replicas,
+				(
+					select max(coalesce(replica_policies.replicas, default_replicas.replicas))
+					from catalog
+					left join replica_policies
+						on replica_policies.namespace = catalog.namespace
+					where catalog.hash = blobs.hash
+						and catalog.hash_algo = blobs.hash_algo
+				),
+				default_replicas.replicas
+			) as target
+		from blobs, default_replicas
+	)
+`
+
+/**
+ * Blobs with a replica on this node that have more or fewer replicas than
+ * they should, counting only those on healthy disks. Blobs short of
+ * replicas come first, those with the fewest left first of all. Blobs still
+ * being archived are left alone.
+ */
+func db_list_replica_changes(limit int) ([]replica_change, error) {
+	query := `
+		with ` + replica_targets + `
+		select
+			targets.hash,
+			targets.hash_algo,
+			max(files.size),
+			targets.target,
+			targets.class
+		from targets
+		join files
+			on files.hash = targets.hash
+			and files.hash_algo = targets.hash_algo
+		join disks
+			on disks.node = files.node
+			and disks.root = files.storage_root
+			and not disks.failed
+		where not exists (
+			select 1 from archive_intents
+			where archive_intents.hash = targets.hash
+				and archive_intents.hash_algo = targets.hash_algo
+		)
+		group by targets.hash, targets.hash_algo
+		having count(*) != targets.target
+			and sum(files.node = '') > 0
+		order by count(*) < targets.target desc, count(*)
+		limit ?
+	`
+	rows, err := db.Query(query, settings().redundancy, limit)
+	if err != nil {
+		return nil, fmt.Errorf("could not query replica counts: %v", err)
+	}
+	defer rows.Close()
+	var changes []replica_change
+	for rows.Next() {
+		var change replica_change
+		var size sql.NullInt64
+		err := rows.Scan(&change.hash, &change.algo, &size, &change.target, &change.class)
+		if err != nil {
+			return nil, err
+		}
+		change.size = size.Int64
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
+
+/**
+ * The number of replicas the blob should have.
+ */
+func db_get_blob_target(hash string, algo string) (int, error) {
+	query := `
+		with ` + replica_targets + `
+		select target from targets where hash = ? and hash_algo = ?
+	`
+	var target int
+	err := db.QueryRow(query, settings().redundancy, hash, algo).Scan(&target)
+	return target, err
+}
+
+/**
+ * Record the new replica, taking its space from the disk, before anything
+ * is copied, so no other job picks the same disk.
+ */
+func db_add_replica(hash string, algo string, disk placement, size int64) (bool, error) {
+	reserved := false
+	err := db_transaction(func(tx *sql.Tx) error {
+		var path, filename string
+		query := `
+			select path, filename from files
+			where hash = ? and hash_algo = ?
+			limit 1
+		`
+		if err := tx.QueryRow(query, hash, algo).Scan(&path, &filename); err != nil {
+			return err
+		}
+		ok, err := db_reserve_space(tx, disk, size)
+		if err != nil || !ok {
+			return err
+		}
+		reserved = true
+		return db_add_file_records(tx, hash, algo, []placement{disk}, path, filename, size, true)
+	})
+	return reserved && err == nil, err
+}
+
+/**
+ * Forget the replica and give its space back to the disk.
+ */
+func db_remove_replica(hash string, algo string, disk placement, size int64) error {
+	return db_transaction(func(tx *sql.Tx) error {
+		stmt := `
+			delete from files
+			where hash = ? and hash_algo = ? and node = ? and storage_root = ?
+		`
+		if _, err := tx.Exec(stmt, hash, algo, disk.node, disk.root); err != nil {
+			return err
+		}
+		stmt = `
+			update disks set available = available + ?
+			where node = ? and root = ?
+		`
+		_, err := tx.Exec(stmt, size, disk.node, disk.root)
+		return err
+	})
+}
+
+/**
+ * The first replica on this node whose hash still checks out, to copy new
+ * replicas from.
+ */
+func replica_source(hash string, algo string, disks []placement) (string, bool) {
+	for _, disk := range disks {
+		if disk.node != "" {
+			continue
+		}
+		path := get_blob_path(disk.root, hash, algo)
+		digest, err := hash_file_algo(path, algo)
+		if err == nil {
+			db_record_verify(hash, algo, disk.root, digest == hash)
+		}
+		if err == nil && digest == hash {
+			return path, true
+		}
+		log.Printf("replica '%s' is not usable as a source", path)
+	}
+	return "", false
+}
+
+/**
+ * Copy the blob to more disks of its class, never those it was lost from.
+ */
+func replicas_add(change replica_change, have []placement, lost []placement) error {
+	has := map[placement]bool{}
+	for _, disk := range append(have, lost...) {
+		has[disk] = true
+	}
+	candidates, err := db_get_live_disks(context.Background(), change.size, change.class)
+	if err != nil {
+		return err
+	}
+	src, ok := replica_source(change.hash, change.algo, have)
+	if !ok {
+		return fmt.Errorf("no healthy replica to copy from")
+	}
+	added := 0
+	for _, disk := range candidates {
+		if len(have)+added == change.target {
+			break
+		}
+		if has[disk] {
+			continue
+		}
+		ok, err := db_add_replica(change.hash, change.algo, disk, change.size)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if disk.node == "" {
+			err = store_file(src, change.hash, change.algo, disk.root)
+		} else {
+			err = cluster_store_file(src, change.hash, change.algo, disk)
+		}
+		if err != nil {
+			if err := db_remove_replica(change.hash, change.algo, disk, change.size); err != nil {
+				log.Printf("could not forget replica of %s on '%s': %v", change.hash, disk, err)
+			}
+			continue
+		}
+		db_replica_stored(change.hash, change.algo, disk)
+		added++
+		log.Printf("added replica of %s on '%s'", change.hash, disk)
+		metric_add("kfs_replicas_added_total", "Replicas added to meet a replica count.", "", 1)
+	}
+	if len(have)+added < change.target {
+		return fmt.Errorf(
+			"only %d of %d replicas, not enough disks",
+			len(have)+added,
+			change.target,
+		)
+	}
+	return nil
+}
+
+/**
+ * Remove replicas on this node, from the fullest disks first, down to the
+ * target, but never the last one.
+ */
+func replicas_trim(change replica_change, have []placement) error {
+	disks, err := db_list_disks()
+	if err != nil {
+		return err
+	}
+	available := map[string]int64{}
+	for _, disk := range disks {
+		available[disk.Root] = disk.Available
+	}
+	var local []placement
+	for _, disk := range have {
+		if disk.node == "" {
+			local = append(local, disk)
+		}
+	}
+	sort.Slice(local, func(i, j int) bool {
+		return available[local[i].root] < available[local[j].root]
+	})
+
+	remaining := len(have)
+	for _, disk := range local {
+		if remaining <= change.target || remaining <= 1 {
+			break
+		}
+		// a replica with another name frees no space when it is removed
+		path := get_blob_path(disk.root, change.hash, change.algo)
+		freed := change.size
+		if blob_shared(path) {
+			freed = 0
+		}
+		if err := db_remove_replica(change.hash, change.algo, disk, freed); err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("could not remove '%s': %v", path, err)
+		}
+		remaining--
+		log.Printf("trimmed replica of %s from '%s'", change.hash, disk)
+		metric_add("kfs_replicas_trimmed_total", "Replicas removed to meet a replica count.", "", 1)
+	}
+	return nil
+}
+
+/**
+ * Bring each blob that is off to its target number of replicas.
+ */
+func replicas_sync() error {
+	changes, err := db_list_replica_changes(KFS_REPLICAS_BATCH)
+	if err != nil {
+		return err
+	}
+	healthy, err := db_healthy_disks()
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		placements, err := db_get_placements(change.hash, change.algo)
+		if err != nil {
+			return err
+		}
+		var have, lost []placement
+		for _, disk := range placements {
+			if healthy[disk] {
+				have = append(have, disk)
+			} else {
+				lost = append(lost, disk)
+			}
+		}
+		if len(have) < change.target {
+			err = replicas_add(change, have, lost)
+		} else {
+			err = replicas_trim(change, have)
+		}
+		if err != nil {
+			log.Printf("could not change replicas of %s: %v", change.hash, err)
+		}
+	}
+	return nil
+}
+
+func replicas_loop() {
+	for {
+		if err := replicas_check_missing(); err != nil {
+			log.Printf("could not check for missing replicas: %v", err)
+		}
+		if err := replicas_sync(); err != nil {
+			log.Printf("could not sync replica counts: %v", err)
+		}
+		select {
+		case <-replicas_wake:
+		case <-time.After(KFS_REPLICAS_INTERVAL):
+		}
+	}
+}
+
+func replicas_trigger() {
+	select {
+	case replicas_wake <- struct{}{}:
+	default:
+	}
+}
+
+func handle_replicas_get(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	policies, err := db_get_replica_policies()
+	if err != nil {
+		log.Println(err)
+		write_error(writer, "could not get replica policies", http.StatusInternalServerError)
+		return
+	}
+	write_json(writer, http.StatusOK, policies)
+}
+
+/**
+ * Set how many replicas the blob of a catalog entry, the blobs in a
+ * namespace, or all blobs should have, e.g.
+ *     curl -H "Authorization: Bearer $TOKEN" -X POST -F id=42 -F replicas=3 localhost:8080/replicas
+ * Dropping the count removes replicas, so this takes the admin token.
+ */
+func handle_replicas_set(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	replicas, err := strconv.Atoi(request.FormValue("replicas"))
+	if err != nil || replicas < 0 {
+		write_error(writer, "'replicas' must be a number, or 0 to unset", http.StatusBadRequest)
+		return
+	}
+	disks, err := db_get_live_disks(request.Context(), -1, "")
+	if err != nil {
+		log.Println(err)
+		write_error(writer, "could not list disks", http.StatusInternalServerError)
+		return
+	}
+	if replicas > len(disks) {
+		write_error(
+			writer,
+			fmt.Sprintf("%d disks cannot hold %d replicas", len(disks), replicas),
+			http.StatusBadRequest,
+		)
+		return
+	}
+
+	id := request.FormValue("id")
+	namespace := request.FormValue("namespace")
+	switch {
+	case id != "" && namespace != "":
+		write_error(writer, "give either 'id' or 'namespace', not both", http.StatusBadRequest)
+		return
+	case id != "":
+		entry, ok := lookup_catalog_entry(writer, httprouter.Params{{Key: "id", Value: id}})
+		if !ok {
+			return
+		}
+		err = db_set_blob_replicas(entry.Hash, entry.HashAlgo, replicas)
+	default:
+		err = db_set_namespace_replicas(namespace, replicas)
+	}
+	if err != nil {
+		log.Printf("could not set replicas: %v", err)
+		write_error(writer, "could not set replicas", http.StatusInternalServerError)
+		return
+	}
+	replicas_trigger()
+	handle_replicas_get(writer, request, nil)
+}
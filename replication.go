@@ -0,0 +1,577 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+/**
+ * The API nodes use to move blobs between each other. Every request is
+ * signed with the secret the cluster shares, over its method, URI, time,
+ * the name of the node sending it and the SHA-256 of its body, so a
+ * captured request can neither be sent with another body nor as if from
+ * another node. Every blob is hashed before it is kept. Transfers that are cut off are resumed where they
+ * stopped: pushes by asking the receiver how much of the blob it already
+ * has, and pulls with a Range request.
+ *
+ *     GET /cluster/offset/:hash?algo=&root=  how much of a push has arrived
+ *     PUT /cluster/blob/:hash?algo=&root=&size=&offset=  push (part of) a blob
+ *     GET /cluster/blob/:hash  pull a blob from one of the node's own disks
+ */
+
+// shared by every node of the cluster, the internal API is off when empty
+var KFS_CLUSTER_SECRET = ""
+
+// how far a signed request's clock may be from ours
+var KFS_CLUSTER_MAX_SKEW = 5 * time.Minute
+
+var KFS_CLUSTER_TRANSFER_RETRIES = 5
+
+var KFS_CLUSTER_TRANSFER_BACKOFF = 2 * time.Second
+
+const (
+	KFS_CLUSTER_TIME_HEADER      = "X-Kfs-Cluster-Time"
+	KFS_CLUSTER_DIGEST_HEADER    = "X-Kfs-Cluster-Content-Sha256"
+	KFS_CLUSTER_SIGNATURE_HEADER = "X-Kfs-Cluster-Signature"
+)
+
+var errClusterBodyDigest = errors.New("body does not match its signed digest")
+
+func cluster_signature(method string, uri string, timestamp string, node string, digest string) string {
+	mac := hmac.New(sha256.New, []byte(settings().cluster_secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s", method, uri, timestamp, node, digest)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+/**
+ * The SHA-256 of what is left of the body, which is then rewound to where
+ * it was, so it can still be sent.
+ */
+func cluster_body_digest(body io.ReadSeeker) (string, error) {
+	h := sha256.New()
+	if body == nil {
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+	start, err := body.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(h, body); err != nil {
+		return "", err
+	}
+	if _, err := body.Seek(start, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+/**
+ * A request to another node, signed so that it will accept it. The body is
+ * read once to sign its digest before it is sent.
+ */
+func cluster_request(ctx context.Context, method string, target string, body io.ReadSeeker) (*http.Request, error) {
+	digest, err := cluster_body_digest(body)
+	if err != nil {
+		return nil, fmt.Errorf("could not hash request body: %v", err)
+	}
+	var reader io.Reader
+	if body != nil {
+		reader = body
+	}
+	request, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return nil, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set(KFS_CLUSTER_HEADER, KFS_NODE_NAME)
+	request.Header.Set(KFS_CLUSTER_TIME_HEADER, timestamp)
+	request.Header.Set(KFS_CLUSTER_DIGEST_HEADER, digest)
+	request.Header.Set(
+		KFS_CLUSTER_SIGNATURE_HEADER,
+		cluster_signature(method, request.URL.RequestURI(), timestamp, KFS_NODE_NAME, digest),
+	)
+	return request, nil
+}
+
+/**
+ * A signed request's body, which is hashed as the handler reads it, and
+ * fails at its end rather than return io.EOF when it is not what was
+ * signed. Handlers have to read it to the end before acting on it.
+ */
+type cluster_body struct {
+	body   io.ReadCloser
+	hash   hash.Hash
+	digest string
+}
+
+func (b *cluster_body) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	b.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(b.hash.Sum(nil)) != b.digest {
+		return n, errClusterBodyDigest
+	}
+	return n, err
+}
+
+func (b *cluster_body) Close() error {
+	return b.body.Close()
+}
+
+func cluster_verify(request *http.Request) error {
+	if settings().cluster_secret == "" {
+		return fmt.Errorf("no cluster secret is configured")
+	}
+	timestamp := request.Header.Get(KFS_CLUSTER_TIME_HEADER)
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp '%s'", timestamp)
+	}
+	skew := time.Since(time.Unix(sent, 0))
+	if skew > KFS_CLUSTER_MAX_SKEW || skew < -KFS_CLUSTER_MAX_SKEW {
+		return fmt.Errorf("timestamp is %v off", skew)
+	}
+	digest := request.Header.Get(KFS_CLUSTER_DIGEST_HEADER)
+	if len(digest) != sha256.Size*2 {
+		return fmt.Errorf("invalid body digest '%s'", digest)
+	}
+	expected := cluster_signature(
+		request.Method,
+		request.URL.RequestURI(),
+		timestamp,
+		request.Header.Get(KFS_CLUSTER_HEADER),
+		digest,
+	)
+	signature := request.Header.Get(KFS_CLUSTER_SIGNATURE_HEADER)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return fmt.Errorf("bad signature")
+	}
+	request.Body = &cluster_body{request.Body, sha256.New(), digest}
+	return nil
+}
+
+/**
+ * Only let signed requests from other nodes through to the handler.
+ */
+func cluster_auth(handle httprouter.Handle) httprouter.Handle {
+	return func(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+		if err := cluster_verify(request); err != nil {
+			log.Printf(
+				"rejected cluster request from %s: %v",
+				request.RemoteAddr,
+				err,
+			)
+			write_error(writer, "forbidden", http.StatusForbidden)
+			return
+		}
+		handle(writer, request, p)
+	}
+}
+
+func cluster_partial_path(root string, hash string, algo string) string {
+	return filepath.Join(root, ".kfs", "staging", hash+"."+algo+".part")
+}
+
+type cluster_offset struct {
+	Offset int64 `json:"offset"`
+	Stored bool  `json:"stored"`
+}
+
+/**
+ * How much of a pushed blob has arrived so far, so that the sender can pick
+ * up from there, or whether the disk already holds all of it.
+ */
+func handle_cluster_offset(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	hash := p.ByName("hash")
+	query := request.URL.Query()
+	algo := query.Get("algo")
+	root := query.Get("root")
+	if !valid_hash_algo(algo) || !db_is_local_disk(root) {
+		write_error(writer, "invalid algo or root", http.StatusBadRequest)
+		return
+	}
+	var offset cluster_offset
+	if _, err := os.Stat(get_blob_path(root, hash, algo)); err == nil {
+		offset.Stored = true
+	} else if info, err := os.Stat(cluster_partial_path(root, hash, algo)); err == nil {
+		offset.Offset = info.Size()
+	}
+	write_json(writer, http.StatusOK, offset)
+}
+
+/**
+ * Append the request body to the partial file, which has to hold exactly
+ * ?offset= bytes already. Returns the blob's ?size= once all of it has
+ * arrived, and otherwise writes the response and returns false: 202 when
+ * more is to come, or an error.
+ */
+func cluster_receive_part(writer http.ResponseWriter, request *http.Request, partial_path string) (int64, bool) {
+	query := request.URL.Query()
+	size, err := strconv.ParseInt(query.Get("size"), 10, 64)
+	if err != nil || size < 0 {
+		write_error(writer, "invalid size", http.StatusBadRequest)
+		return 0, false
+	}
+	offset, err := strconv.ParseInt(query.Get("offset"), 10, 64)
+	if err != nil {
+		offset = 0
+	}
+
+	outf, err := os.OpenFile(partial_path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		log.Printf("failed to create output file: %s\n", err)
+		write_error(writer, "could not stage blob", http.StatusInternalServerError)
+		return 0, false
+	}
+	defer outf.Close()
+	info, err := outf.Stat()
+	if err != nil || info.Size() != offset {
+		write_error(writer, "offset does not match what has arrived", http.StatusConflict)
+		return 0, false
+	}
+	if _, err := outf.Seek(offset, io.SeekStart); err != nil {
+		write_error(writer, "could not stage blob", http.StatusInternalServerError)
+		return 0, false
+	}
+	n, err := io.Copy(outf, &ctx_reader{request.Context(), request.Body})
+	if errors.Is(err, errClusterBodyDigest) {
+		// what arrived is not what was signed, so none of it is kept
+		outf.Truncate(offset)
+		log.Printf("transfer to '%s' refused: %v", partial_path, err)
+		write_error(writer, "forbidden", http.StatusForbidden)
+		return 0, false
+	}
+	if err != nil {
+		// keep what did arrive, the sender will resume from there
+		log.Printf("transfer to '%s' stopped after %d bytes: %v", partial_path, offset+n, err)
+		write_error(writer, "could not receive blob", http.StatusInternalServerError)
+		return 0, false
+	}
+	if offset+n != size {
+		write_error(
+			writer,
+			fmt.Sprintf("have %d of %d bytes", offset+n, size),
+			http.StatusAccepted,
+		)
+		return 0, false
+	}
+	return size, true
+}
+
+/**
+ * Receive (the rest of) a replica pushed by another node. The bytes are
+ * appended to what has already arrived, which has to be exactly offset
+ * bytes, and once all size bytes are there the blob is hashed before it is
+ * moved into storage, so a transfer that went wrong never becomes a
+ * replica.
+ */
+func handle_cluster_put_blob(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	hash := p.ByName("hash")
+	query := request.URL.Query()
+	algo := query.Get("algo")
+	root := query.Get("root")
+	if !valid_hash_algo(algo) {
+		write_error(writer, fmt.Sprintf("unsupported hash algorithm: '%s'", algo), http.StatusBadRequest)
+		return
+	}
+	if !db_is_local_disk(root) {
+		write_error(writer, fmt.Sprintf("no such disk: '%s'", root), http.StatusBadRequest)
+		return
+	}
+	partial_path := cluster_partial_path(root, hash, algo)
+	size, ok := cluster_receive_part(writer, request, partial_path)
+	if !ok {
+		return
+	}
+
+	digest, err := hash_file_ctx(request.Context(), partial_path, algo)
+	if err != nil || digest != hash {
+		os.Remove(partial_path)
+		log.Printf("received %s, but it hashed to '%s': %v", hash, digest, err)
+		write_error(writer, "blob does not match its hash", http.StatusBadRequest)
+		return
+	}
+
+	err = db_transaction(func(tx *sql.Tx) error {
+		disk := placement{"", root}
+		ok, err := db_reserve_space(tx, disk, size)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("not enough space on '%s'", root)
+		}
+		if _, err := db_claim_hash(tx, hash, algo); err != nil {
+			return err
+		}
+		return db_add_file_records(tx, hash, algo, []placement{disk}, "", "", size, true)
+	})
+	if err != nil {
+		os.Remove(partial_path)
+		log.Printf("could not record %s: %v", hash, err)
+		write_error(writer, "could not store blob", http.StatusInsufficientStorage)
+		return
+	}
+	dst, err := make_blob_path(root, hash, algo)
+	if err == nil {
+		err = os.Rename(partial_path, dst)
+	}
+	if err == nil {
+		err = replica_sync(root, hash, algo)
+	}
+	if err != nil {
+		log.Printf("could not move %s into storage: %v", hash, err)
+		write_error(writer, "could not store blob", http.StatusInternalServerError)
+		return
+	}
+	db_replica_stored(hash, algo, placement{"", root})
+	known_hash_add(hash, algo)
+	log.Printf("stored %s from node '%s' on '%s'", hash, request.Header.Get(KFS_CLUSTER_HEADER), root)
+	writer.WriteHeader(http.StatusCreated)
+}
+
+/**
+ * Send the blob to one of the other nodes' disks, which verifies it and
+ * records the replica. A push that is cut off is retried from wherever the
+ * receiver got to.
+ */
+func cluster_store_file(filename string, hash string, algo string, disk placement) error {
+	var err error
+	for attempt := 0; attempt < KFS_CLUSTER_TRANSFER_RETRIES; attempt++ {
+		if attempt > 0 {
+			time.Sleep(KFS_CLUSTER_TRANSFER_BACKOFF)
+		}
+		var done bool
+		done, err = cluster_push_blob(filename, hash, algo, disk)
+		if done {
+			log.Printf("stored: '%s' to '%s'\n", filename, disk)
+			return nil
+		}
+		log.Printf("push of %s to '%s' did not finish: %v", hash, disk, err)
+	}
+	if err == nil {
+		err = fmt.Errorf("gave up after %d attempts", KFS_CLUSTER_TRANSFER_RETRIES)
+	}
+	db_add_archive_failure(hash, disk.String(), err)
+	return err
+}
+
+/**
+ * Ask the receiver how much of the blob it has, and send it the rest.
+ * Returns true once the receiver has stored the whole blob.
+ */
+func cluster_push_blob(filename string, hash string, algo string, disk placement) (bool, error) {
+	base_url, err := db_get_node_url(disk.node)
+	if err != nil {
+		return false, err
+	}
+	query := url.Values{}
+	query.Set("algo", algo)
+	query.Set("root", disk.root)
+
+	var offset cluster_offset
+	offset_url := fmt.Sprintf("%s/cluster/offset/%s?%s", base_url, hash, query.Encode())
+	if err := cluster_get_json(offset_url, &offset); err != nil {
+		return false, err
+	}
+	if offset.Stored {
+		return true, nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if offset.Offset > info.Size() {
+		offset.Offset = 0
+	}
+	if _, err := f.Seek(offset.Offset, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	query.Set("size", strconv.FormatInt(info.Size(), 10))
+	query.Set("offset", strconv.FormatInt(offset.Offset, 10))
+	blob_url := fmt.Sprintf("%s/cluster/blob/%s?%s", base_url, hash, query.Encode())
+	request, err := cluster_request(context.Background(), http.MethodPut, blob_url, f)
+	if err != nil {
+		return false, err
+	}
+	request.ContentLength = info.Size() - offset.Offset
+
+	// blobs can be large, so this one has no overall timeout
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusCreated {
+		msg, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return false, fmt.Errorf("node '%s' refused blob: %d %s", disk.node, response.StatusCode, msg)
+	}
+	return true, nil
+}
+
+/**
+ * Serve a blob from one of this node's own disks. Range requests are
+ * honoured, which is how an interrupted pull is resumed.
+ */
+func handle_cluster_get_blob(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	hash := p.ByName("hash")
+	algo, roots, err := db_get_replicas(hash)
+	if err != nil {
+		log.Println(err)
+		write_error(writer, "could not look up hash", http.StatusInternalServerError)
+		return
+	}
+	for _, root := range order_replicas(roots) {
+		f, err := os.Open(get_blob_path(root, hash, algo))
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			continue
+		}
+		writer.Header().Set("Content-Type", "application/octet-stream")
+		writer.Header().Set("X-Kfs-Hash-Algo", algo)
+		http.ServeContent(writer, request, "", info.ModTime(), f)
+		return
+	}
+	write_error(writer, "no such hash", http.StatusNotFound)
+}
+
+/**
+ * Copy the blob from another node to dst, resuming from a partial copy left
+ * by an earlier attempt, and only putting it in place if it hashes right.
+ */
+func cluster_pull_blob(base_url string, hash string, algo string, dst string) error {
+	partial_path := dst + ".part"
+	var err error
+	for attempt := 0; attempt < KFS_CLUSTER_TRANSFER_RETRIES; attempt++ {
+		if attempt > 0 {
+			time.Sleep(KFS_CLUSTER_TRANSFER_BACKOFF)
+		}
+		err = cluster_pull_range(base_url, hash, partial_path)
+		if err == nil {
+			break
+		}
+		log.Printf("pull of %s from '%s' did not finish: %v", hash, base_url, err)
+	}
+	if err != nil {
+		return err
+	}
+	digest, err := hash_file_algo(partial_path, algo)
+	if err != nil || digest != hash {
+		os.Remove(partial_path)
+		return fmt.Errorf("pulled %s, but it hashed to '%s': %v", hash, digest, err)
+	}
+	if err := os.Rename(partial_path, dst); err != nil {
+		return err
+	}
+	if !fsync_wanted(FSYNC_NORMAL) {
+		return nil
+	}
+	if err := sync_path(dst); err != nil {
+		return err
+	}
+	return sync_dir(dst, FSYNC_NORMAL)
+}
+
+func cluster_pull_range(base_url string, hash string, partial_path string) error {
+	outf, err := os.OpenFile(partial_path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer outf.Close()
+	info, err := outf.Stat()
+	if err != nil {
+		return err
+	}
+
+	blob_url := fmt.Sprintf("%s/cluster/blob/%s", base_url, hash)
+	request, err := cluster_request(context.Background(), http.MethodGet, blob_url, nil)
+	if err != nil {
+		return err
+	}
+	if info.Size() > 0 {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-", info.Size()))
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	switch response.StatusCode {
+	case http.StatusOK:
+		// the whole blob was sent, so start over
+		if err := outf.Truncate(0); err != nil {
+			return err
+		}
+	case http.StatusPartialContent:
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the partial copy is already complete
+		return nil
+	default:
+		return fmt.Errorf("got status %d", response.StatusCode)
+	}
+	_, err = io.Copy(outf, response.Body)
+	return err
+}
+
+/**
+ * Fetch a JSON document from another node.
+ */
+func cluster_get_json(target string, v interface{}) error {
+	request, err := cluster_request(context.Background(), http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	response, err := cluster_client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("got status %d from '%s'", response.StatusCode, target)
+	}
+	return json.NewDecoder(response.Body).Decode(v)
+}
@@ -0,0 +1,257 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/**
+ * kfs restore downloads every file of a snapshot into a directory, e.g.
+ *     kfs restore 6f1c2b9e-5d0a-4c8e-9a57-0e2d4b7f3a18 /mnt/restore
+ *     kfs restore -at 1700000000 laptop:/home/kyle /mnt/restore
+ * A snapshot is either a committed sync, by its id, or the newest version
+ * of each file under a path of a namespace, as of -at, or now. Each file
+ * is written under the target by its full path, with its directories
+ * made as needed, and fetched with kfs get, so KFS_CLIENT_PARALLEL files
+ * are downloaded at once, each checked against its hash before it is put
+ * in place. A sync keeps the mode and mtime its entries were sent with,
+ * and those are put back. The catalog keeps neither, so files restored
+ * from a namespace get the default mode, and the time they were uploaded
+ * as their mtime.
+ *
+ * Running the same command again after it was cut off skips the files
+ * already in place with the right hash, and resumes the ones that were
+ * part way through.
+ */
+
+type restore_file struct {
+	Path     string
+	Hash     string
+	HashAlgo string
+	Size     int64
+	Mode     uint32
+	ModTime  int64
+}
+
+func restore_main(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	base_url := flags.String("url", "http://localhost:8080", "server to restore from")
+	at := flags.Int64("at", 0, "unix time to restore a namespace as of, now when 0")
+	client_flags(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: kfs restore [flags] SYNC-ID|NAMESPACE:PATH TARGET-DIR")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	base := strings.TrimSuffix(*base_url, "/")
+	snapshot := flags.Arg(0)
+	target := flags.Arg(1)
+
+	var files []restore_file
+	var err error
+	if i := strings.Index(snapshot, ":"); i >= 0 {
+		files, err = restore_list_namespace(base, snapshot[:i], snapshot[i+1:], *at)
+	} else {
+		files, err = restore_list_sync(base, snapshot)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kfs restore: %v\n", err)
+		os.Exit(1)
+	}
+	if err := restore_files(base, files, target); err != nil {
+		fmt.Fprintf(os.Stderr, "kfs restore: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+/**
+ * The files of a committed sync.
+ */
+func restore_list_sync(base string, id string) ([]restore_file, error) {
+	var session sync_session
+	err := client_retry("listing of sync", func() error {
+		request, err := http.NewRequest(
+			http.MethodGet,
+			base+"/v1/sync/"+url.PathEscape(id)+"?entries=true",
+			nil,
+		)
+		if err != nil {
+			return err
+		}
+		return client_json(request, &session)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if session.CommittedAt == 0 {
+		return nil, fmt.Errorf("sync %s was never committed", id)
+	}
+	files := make([]restore_file, 0, len(session.Entries))
+	for _, entry := range session.Entries {
+		files = append(files, restore_file{
+			Path:     entry.Path,
+			Hash:     entry.Hash,
+			HashAlgo: session.HashAlgo,
+			Size:     entry.Size,
+			Mode:     entry.Mode,
+			ModTime:  entry.ModTime,
+		})
+	}
+	return files, nil
+}
+
+/**
+ * The newest version, as of at, of each file under the directory of the
+ * namespace, found by walking it with /ls.
+ */
+func restore_list_namespace(base string, namespace string, dir string, at int64) ([]restore_file, error) {
+	var files []restore_file
+	pending := []string{catalog_clean_path(dir)}
+	for len(pending) > 0 {
+		dir := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		var listing ls_response
+		err := client_retry("listing of "+dir, func() error {
+			query := url.Values{}
+			query.Set("namespace", namespace)
+			query.Set("path", dir)
+			request, err := http.NewRequest(http.MethodGet, base+"/v1/ls?"+query.Encode(), nil)
+			if err != nil {
+				return err
+			}
+			return client_json(request, &listing)
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, child := range listing.Directories {
+			pending = append(pending, path.Join(dir, child))
+		}
+
+		newest := map[string]catalog_entry{}
+		for _, entry := range listing.Files {
+			if at != 0 && entry.CreatedAt > at {
+				continue
+			}
+			old, ok := newest[entry.Filename]
+			if !ok ||
+				entry.CreatedAt > old.CreatedAt ||
+				(entry.CreatedAt == old.CreatedAt && entry.ID > old.ID) {
+				newest[entry.Filename] = entry
+			}
+		}
+		for _, entry := range newest {
+			files = append(files, restore_file{
+				Path:     path.Join(entry.Path, entry.Filename),
+				Hash:     entry.Hash,
+				HashAlgo: entry.HashAlgo,
+				Size:     entry.Size,
+				ModTime:  entry.CreatedAt,
+			})
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("nothing under '%s' in namespace '%s'", dir, namespace)
+	}
+	return files, nil
+}
+
+/**
+ * Download the files under the target, carrying on past the ones that
+ * fail, which are reported together at the end.
+ */
+func restore_files(base string, files []restore_file, target string) error {
+	var restored, skipped, failed int64
+	client_parallel(len(files), func(i int) error {
+		file := files[i]
+		done, err := restore_file_to(base, file, target)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not restore '%s': %v\n", file.Path, err)
+			atomic.AddInt64(&failed, 1)
+		} else if done {
+			atomic.AddInt64(&skipped, 1)
+		} else {
+			atomic.AddInt64(&restored, 1)
+		}
+		return nil
+	})
+	fmt.Fprintf(
+		os.Stderr,
+		"restored %d files, %d were already in place\n",
+		restored,
+		skipped,
+	)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files could not be restored", failed, len(files))
+	}
+	return nil
+}
+
+/**
+ * Restore one file, returning true if it was already in place.
+ */
+func restore_file_to(base string, file restore_file, target string) (bool, error) {
+	rel := strings.TrimLeft(path.Clean("/"+file.Path), "/")
+	if rel == "" {
+		return false, fmt.Errorf("no file name")
+	}
+	output := filepath.Join(target, filepath.FromSlash(rel))
+
+	done := false
+	if info, err := os.Stat(output); err == nil && info.Size() == file.Size {
+		if digest, err := hash_file_algo(output, file.HashAlgo); err == nil && digest == file.Hash {
+			done = true
+		}
+	}
+	if !done {
+		if err := os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+			return false, err
+		}
+		blob_url := base + "/v1/download/" + file.Hash
+		if err := get_blob(blob_url, file.Hash, output); err != nil {
+			return false, err
+		}
+	}
+	if file.Mode != 0 {
+		if err := os.Chmod(output, os.FileMode(file.Mode).Perm()); err != nil {
+			return done, err
+		}
+	}
+	if file.ModTime != 0 {
+		mtime := time.Unix(file.ModTime, 0)
+		if err := os.Chtimes(output, mtime, mtime); err != nil {
+			return done, err
+		}
+	}
+	return done, nil
+}
@@ -0,0 +1,324 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+/**
+ * How many old versions of each file a namespace keeps, e.g.
+ *     "retention": {"laptop": {"keep_last": 3, "keep_daily": 30, "keep_weekly": 52}}
+ * keeps, of each path, the 3 newest versions, the newest of each day for
+ * the last 30 days, and the newest of each week for the last year. Every
+ * other version is purged from the catalog, and its blob is left for
+ * garbage collection once nothing else refers to it. The newest version
+ * of a file is always kept, as are pinned and held versions, which count
+ * towards none of the rules.
+ *
+ *     curl localhost:8080/admin/retention             what would be purged
+ *     curl -X POST localhost:8080/admin/retention     purge now
+ *
+ * Purges only happen on their own, once a day, with retention_enforce set,
+ * so that what a policy would purge can be checked first. They are sent
+ * to mirrors, but not to the other nodes of a cluster or to geo sites,
+ * which apply their own policies.
+ */
+
+type retention_policy struct {
+	KeepLast    int `json:"keep_last,omitempty"`
+	KeepDaily   int `json:"keep_daily,omitempty"`
+	KeepWeekly  int `json:"keep_weekly,omitempty"`
+	KeepMonthly int `json:"keep_monthly,omitempty"`
+}
+
+var (
+	KFS_RETENTION          = map[string]retention_policy{}
+	KFS_RETENTION_ENFORCE  = false
+	KFS_RETENTION_INTERVAL = 24 * time.Hour
+)
+
+func (policy retention_policy) validate() error {
+	if policy.KeepLast < 0 || policy.KeepDaily < 0 || policy.KeepWeekly < 0 || policy.KeepMonthly < 0 {
+		return fmt.Errorf("retention counts must not be negative")
+	}
+	// with nothing to keep, every version but the newest would be purged
+	if policy == (retention_policy{}) {
+		return fmt.Errorf("retention keeps nothing, set at least one count")
+	}
+	return nil
+}
+
+type retention_result struct {
+	Namespace   string           `json:"namespace"`
+	Policy      retention_policy `json:"policy"`
+	Files       int              `json:"files"`
+	Versions    int              `json:"versions"`
+	Kept        int              `json:"kept"`
+	Purged      []catalog_entry  `json:"purged"`
+	PurgedBytes int64            `json:"purged_bytes"`
+}
+
+type retention_report struct {
+	DryRun     bool               `json:"dry_run"`
+	Namespaces []retention_result `json:"namespaces"`
+}
+
+/**
+ * Every entry in the namespace, with the versions of each file together,
+ * newest first.
+ */
+func db_get_namespace_versions(namespace string) ([]catalog_entry, error) {
+	query := `
+		select ` + catalog_columns + `
+		from catalog
+		where namespace = ?
+		order by path, filename, created_at desc, id desc
+	`
+	rows, err := db.Query(query, namespace)
+	if err != nil {
+		return nil, fmt.Errorf("could not list '%s': %v", namespace, err)
+	}
+	defer rows.Close()
+	var entries []catalog_entry
+	for rows.Next() {
+		entry, err := scan_catalog_entry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+/**
+ * The versions of one file, newest first, that the policy does not keep.
+ */
+func retention_purges(policy retention_policy, versions []catalog_entry, now time.Time) []catalog_entry {
+	type rule struct {
+		count  int
+		cutoff int64
+		bucket func(t time.Time) string
+		seen   map[string]bool
+	}
+	rules := []rule{
+		{
+			policy.KeepDaily,
+			now.AddDate(0, 0, -policy.KeepDaily).Unix(),
+			func(t time.Time) string { return t.Format("2006-01-02") },
+			map[string]bool{},
+		},
+		{
+			policy.KeepWeekly,
+			now.AddDate(0, 0, -7*policy.KeepWeekly).Unix(),
+			func(t time.Time) string {
+				year, week := t.ISOWeek()
+				return fmt.Sprintf("%d-%d", year, week)
+			},
+			map[string]bool{},
+		},
+		{
+			policy.KeepMonthly,
+			now.AddDate(0, -policy.KeepMonthly, 0).Unix(),
+			func(t time.Time) string { return t.Format("2006-01") },
+			map[string]bool{},
+		},
+	}
+
+	var purges []catalog_entry
+	ranked := 0
+	for i, version := range versions {
+		if version.Pinned || version.immutable() {
+			continue
+		}
+		keep := i == 0 || ranked < policy.KeepLast
+		ranked++
+		created := time.Unix(version.CreatedAt, 0).UTC()
+		for _, r := range rules {
+			if r.count == 0 || version.CreatedAt < r.cutoff {
+				continue
+			}
+			// the newest version in each bucket is the first one seen
+			bucket := r.bucket(created)
+			if !r.seen[bucket] {
+				r.seen[bucket] = true
+				keep = true
+			}
+		}
+		if !keep {
+			purges = append(purges, version)
+		}
+	}
+	return purges
+}
+
+/**
+ * What the policy purges from the namespace.
+ */
+func retention_plan(namespace string, policy retention_policy, now time.Time) (retention_result, error) {
+	result := retention_result{Namespace: namespace, Policy: policy, Purged: []catalog_entry{}}
+	entries, err := db_get_namespace_versions(namespace)
+	if err != nil {
+		return result, err
+	}
+	result.Versions = len(entries)
+	for start := 0; start < len(entries); {
+		end := start + 1
+		for end < len(entries) &&
+			entries[end].Path == entries[start].Path &&
+			entries[end].Filename == entries[start].Filename {
+			end++
+		}
+		result.Files++
+		result.Purged = append(result.Purged, retention_purges(policy, entries[start:end], now)...)
+		start = end
+	}
+	result.Kept = result.Versions - len(result.Purged)
+	for _, entry := range result.Purged {
+		result.PurgedBytes += entry.Size
+	}
+	return result, nil
+}
+
+/**
+ * Remove the entries, unless a pre-delete hook refuses or they have been
+ * pinned or held since they were planned, and return those that were
+ * removed.
+ */
+func db_purge_catalog_entries(entries []catalog_entry) ([]catalog_entry, error) {
+	// hooks can take a while, so they are run before the writer is taken
+	var allowed []catalog_entry
+	for _, entry := range entries {
+		if err := run_hooks(context.Background(), HOOK_PRE_DELETE, entry, ""); err != nil {
+			log.Printf("kept catalog entry %d: %v", entry.ID, err)
+			continue
+		}
+		allowed = append(allowed, entry)
+	}
+
+	var purged []catalog_entry
+	now := time.Now().Unix()
+	err := db_transaction(func(tx *sql.Tx) error {
+		purged = nil
+		for _, entry := range allowed {
+			result, err := tx.Exec(
+				`
+				delete from catalog
+				where id = ?
+					and not pinned
+					and not (held and (retain_until = 0 or retain_until > ?))
+				`,
+				entry.ID,
+				now,
+			)
+			if err != nil {
+				return err
+			}
+			if n, _ := result.RowsAffected(); n == 0 {
+				continue
+			}
+			if err := db_log_catalog_change(tx, entry.ID); err != nil {
+				return err
+			}
+			purged = append(purged, entry)
+		}
+		return nil
+	})
+	return purged, err
+}
+
+/**
+ * Apply the policy of every namespace that has one. A dry run changes
+ * nothing, and reports what would be purged.
+ */
+func retention_run(dry_run bool) (retention_report, error) {
+	report := retention_report{DryRun: dry_run, Namespaces: []retention_result{}}
+	namespaces := []string{}
+	policies := settings().retention
+	for namespace := range policies {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	now := time.Now()
+	for _, namespace := range namespaces {
+		result, err := retention_plan(namespace, policies[namespace], now)
+		if err != nil {
+			return report, err
+		}
+		if !dry_run && len(result.Purged) > 0 {
+			purged, err := db_purge_catalog_entries(result.Purged)
+			if err != nil {
+				return report, fmt.Errorf("could not purge '%s': %v", namespace, err)
+			}
+			result.Purged = purged
+			result.Kept = result.Versions - len(purged)
+			result.PurgedBytes = 0
+			for _, entry := range purged {
+				result.PurgedBytes += entry.Size
+				purged_entry := entry
+				emit_event(event{
+					Type:     EVENT_CATALOG_PURGED,
+					Hash:     entry.Hash,
+					HashAlgo: entry.HashAlgo,
+					Catalog:  &purged_entry,
+				})
+			}
+			metric_add(
+				"kfs_retention_purged_total",
+				"Catalog entries purged by retention policies.",
+				fmt.Sprintf("namespace=%q", namespace),
+				float64(len(purged)),
+			)
+			log.Printf("retention purged %d versions from '%s'", len(purged), namespace)
+		}
+		report.Namespaces = append(report.Namespaces, result)
+	}
+	return report, nil
+}
+
+func handle_retention(dry_run bool) httprouter.Handle {
+	return func(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+		report, err := retention_run(dry_run)
+		if err != nil {
+			log.Printf("could not apply retention policies: %v", err)
+			write_error(writer, "could not apply retention policies", http.StatusInternalServerError)
+			return
+		}
+		write_json(writer, http.StatusOK, report)
+	}
+}
+
+func retention_loop() {
+	for {
+		time.Sleep(KFS_RETENTION_INTERVAL)
+		if !settings().retention_enforce {
+			continue
+		}
+		if _, err := retention_run(false); err != nil {
+			log.Printf("could not apply retention policies: %v", err)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+/**
+ * In cluster mode, replicas are placed with consistent hashing. Every disk
+ * in the cluster is put on a ring at KFS_RING_VNODES pseudo-random points,
+ * and a blob goes to the disks found walking clockwise from the point its
+ * hash lands on. Adding a disk or a node only takes over the parts of the
+ * ring next to its own points, so only that fraction of blobs would have to
+ * move, rather than nearly all of them.
+ */
+
+var KFS_RING_VNODES = 64
+
+type ring_point struct {
+	token uint64
+	disk  placement
+}
+
+func ring_token(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+/**
+ * The disks' points on the ring, sorted by token.
+ */
+func ring_build(disks []placement) []ring_point {
+	var ring []ring_point
+	for _, disk := range disks {
+		for i := 0; i < KFS_RING_VNODES; i++ {
+			key := fmt.Sprintf("%s#%d", disk, i)
+			ring = append(ring, ring_point{ring_token(key), disk})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].token < ring[j].token
+	})
+	return ring
+}
+
+/**
+ * Every disk on the ring, in the order the blob should be placed on them:
+ * clockwise from the hash, with the first disk of each node ahead of the
+ * rest, so that replicas land on different machines whenever there are
+ * enough of them.
+ */
+func ring_order(ring []ring_point, hash string) []placement {
+	if len(ring) == 0 {
+		return nil
+	}
+	token := ring_token(hash)
+	start := sort.Search(len(ring), func(i int) bool {
+		return ring[i].token >= token
+	})
+
+	var first, rest []placement
+	seen_disks := map[placement]bool{}
+	seen_nodes := map[string]bool{}
+	for i := 0; i < len(ring); i++ {
+		disk := ring[(start+i)%len(ring)].disk
+		if seen_disks[disk] {
+			continue
+		}
+		seen_disks[disk] = true
+		if seen_nodes[disk.node] {
+			rest = append(rest, disk)
+			continue
+		}
+		seen_nodes[disk.node] = true
+		first = append(first, disk)
+	}
+	return append(first, rest...)
+}
+
+/**
+ * The fraction of the ring owned by each disk, which is the fraction of new
+ * blobs it can expect to be given first.
+ */
+func ring_shares(ring []ring_point) map[placement]float64 {
+	shares := map[placement]float64{}
+	for i, point := range ring {
+		var prev uint64
+		if i > 0 {
+			prev = ring[i-1].token
+		} else {
+			prev = ring[len(ring)-1].token
+		}
+		// wraps around for the first point, which is what we want
+		arc := point.token - prev
+		shares[point.disk] += float64(arc) / math.MaxUint64
+	}
+	return shares
+}
+
+type ring_disk struct {
+	Node  string  `json:"node"`
+	Root  string  `json:"root"`
+	Share float64 `json:"share"`
+}
+
+type ring_response struct {
+	VNodes    int         `json:"vnodes"`
+	Disks     []ring_disk `json:"disks"`
+	Placement []string    `json:"placement,omitempty"`
+}
+
+/**
+ * Show the ring, and with ?hash= where a blob with that hash would go, e.g.
+ *     curl 'localhost:8080/ring?hash=...'
+ * Disks that are too full to take anything are not on the ring.
+ */
+func handle_ring(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	disks, err := db_get_live_disks(request.Context(), 0, "")
+	if err != nil {
+		log.Println(err)
+		write_error(writer, "could not list disks", http.StatusInternalServerError)
+		return
+	}
+	ring := ring_build(disks)
+	shares := ring_shares(ring)
+
+	response := ring_response{VNodes: KFS_RING_VNODES, Disks: []ring_disk{}}
+	for _, disk := range disks {
+		node := disk.node
+		if node == "" {
+			node = KFS_NODE_NAME
+		}
+		response.Disks = append(response.Disks, ring_disk{node, disk.root, shares[disk]})
+	}
+	if hash := request.URL.Query().Get("hash"); hash != "" {
+		redundancy := settings().redundancy
+		for i, disk := range ring_order(ring, hash) {
+			if i == redundancy {
+				break
+			}
+			response.Placement = append(response.Placement, disk.String())
+		}
+	}
+	write_json(writer, http.StatusOK, response)
+}
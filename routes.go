@@ -18,18 +18,166 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/julienschmidt/httprouter"
 )
 
+var (
+	// re-hash every download, regardless of the verify query parameter
+	KFS_VERIFY_DOWNLOADS = false
+
+	// replace a replica that fails verification from a healthy one
+	KFS_READ_REPAIR = true
+
+	// seconds an upload turned away while the same content is being
+	// uploaded is told to wait before it tries again
+	KFS_IN_FLIGHT_RETRY_AFTER = 1
+)
+
+/**
+ * What an upload answers with, e.g.
+ *     {"hash": "3f9a...", "hash_algo": "blake2b", "size": 1024,
+ *      "replicas": 2, "dedup": false, "catalog_id": 42}
+ * The hash is the one the blob is stored under, which is not the one the
+ * client gave when it gave a secondary digest, and dedup is set when the
+ * blob was already stored, so nothing was written. The upload ID can be
+ * given to /upload/<id>/status to learn when every replica is written, and
+ * durable is set when that was already so before the upload was answered.
+ */
+type upload_response struct {
+	Hash      string `json:"hash"`
+	HashAlgo  string `json:"hash_algo"`
+	Size      int64  `json:"size"`
+	Replicas  int    `json:"replicas"`
+	Dedup     bool   `json:"dedup"`
+	CatalogID int64  `json:"catalog_id,omitempty"`
+	UploadID  string `json:"upload_id,omitempty"`
+	Durable   bool   `json:"durable,omitempty"`
+}
+
+func write_json(writer http.ResponseWriter, status int, v interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	if err := json.NewEncoder(writer).Encode(v); err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
+/**
+ * Names used for each hash algorithm in the Repr-Digest header, per the
+ * HTTP digest algorithm registry where one exists.
+ */
+var digest_header_names = map[string]string{
+	"sha256":  "sha-256",
+	"blake2b": "blake2b",
+	"blake3":  "blake3",
+}
+
+/**
+ * Format the known digests as a Repr-Digest header value, e.g.
+ * sha-256=:X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=:
+ */
+func format_repr_digest(digests map[string]string) string {
+	var fields []string
+	for algo, digest := range digests {
+		name, ok := digest_header_names[algo]
+		if !ok {
+			continue
+		}
+		raw, err := hex.DecodeString(digest)
+		if err != nil {
+			continue
+		}
+		encoded := base64.StdEncoding.EncodeToString(raw)
+		fields = append(fields, fmt.Sprintf("%s=:%s:", name, encoded))
+	}
+	sort.Strings(fields)
+	return strings.Join(fields, ", ")
+}
+
+/**
+ * Format a Content-Disposition header value for the filename, e.g.
+ *     attachment; filename="taxes-2023.pdf"
+ * Names that cannot be sent as a quoted string are also given in the RFC
+ * 5987 form, which browsers prefer, with an ASCII stand-in for older
+ * clients, e.g.
+ *     attachment; filename="_t_.txt"; filename*=UTF-8''%C3%A9t%C3%A9.txt
+ */
+func content_disposition(kind string, filename string) string {
+	fallback := strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, filename)
+	if fallback == filename {
+		return fmt.Sprintf("%s; filename=\"%s\"", kind, filename)
+	}
+	var encoded strings.Builder
+	for _, b := range []byte(filename) {
+		if is_attr_char(b) {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return fmt.Sprintf("%s; filename=\"%s\"; filename*=UTF-8''%s", kind, fallback, encoded.String())
+}
+
+// the bytes RFC 5987 allows unescaped in an extended parameter value
+func is_attr_char(b byte) bool {
+	switch {
+	case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", b) >= 0
+}
+
+/**
+ * Describe the server, with the hash algorithms it takes, so that a client
+ * can pick one, e.g. one of parallel_hash_algos for files of at least
+ * parallel_hash_min_size bytes, which the server hashes on every core.
+ */
 func index(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
-	fmt.Fprintf(writer, "KFS version: %s\n", KFS_VERSION)
+	if api_unversioned(request) {
+		fmt.Fprintf(writer, "KFS version: %s\n", KFS_VERSION)
+		return
+	}
+	algos := []string{}
+	for algo := range settings().hash_algos {
+		algos = append(algos, algo)
+	}
+	sort.Strings(algos)
+	parallel := []string{}
+	for _, algo := range KFS_PARALLEL_HASH_ALGOS {
+		if valid_hash_algo(algo) {
+			parallel = append(parallel, algo)
+		}
+	}
+	write_json(writer, http.StatusOK, map[string]interface{}{
+		"name":                   "KFS",
+		"version":                KFS_VERSION,
+		"api_version":            strings.TrimPrefix(API_VERSION, "/"),
+		"hash_algos":             algos,
+		"default_hash_algo":      KFS_DEFAULT_HASH_ALGO,
+		"parallel_hash_algos":    parallel,
+		"parallel_hash_min_size": settings().parallel_hash_min_size,
+	})
 }
 
 /**
@@ -37,13 +185,33 @@ func index(writer http.ResponseWriter, request *http.Request, p httprouter.Param
  */
 func handle_exists(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
 	hash := p.ByName("hash")
-	if db_has_hash(hash) {
-		log.Printf("hash: %s exists", hash)
-		fmt.Fprintf(writer, "yes")
-	} else {
-		log.Printf("hash: %s does not exist", hash)
-		fmt.Fprintf(writer, "no")
+	algo := request.URL.Query().Get("hash_algo")
+	if algo == "" {
+		algo = KFS_DEFAULT_HASH_ALGO
+	}
+	if !valid_hash_algo(algo) {
+		write_error(
+			writer,
+			fmt.Sprintf("unsupported hash algorithm: '%s'", algo),
+			http.StatusBadRequest,
+		)
+		return
+	}
+	exists := db_has_hash(hash, algo)
+	log_debug("hash: %s exists: %v", hash, exists)
+	if api_unversioned(request) {
+		if exists {
+			fmt.Fprintf(writer, "yes")
+		} else {
+			fmt.Fprintf(writer, "no")
+		}
+		return
 	}
+	write_json(writer, http.StatusOK, map[string]interface{}{
+		"hash":      hash,
+		"hash_algo": algo,
+		"exists":    exists,
+	})
 }
 
 /**
@@ -57,80 +225,564 @@ func handle_upload(writer http.ResponseWriter, request *http.Request, p httprout
 	// {
 	//     curl \
 	//         -X POST \
-	//         -F "file=@$1" \
 	//         -F "hash=`b2sum $1 | awk '{ print $1 }'`" \
+	//         -F "hash_algo=blake2b" \
+	//         -F "namespace=default" \
 	//         -F "path=`pwd`" \
+	//         -F "file=@$1" \
 	//         localhost:8080/upload
 	// }
-	log.Println("handling upload")
+	// with the file last, so that a duplicate is not sent
+
+	log_debug("handling upload")
+	if !space_check_upload(writer) {
+		return
+	}
+
+	// the session is in the query, since it must be known before the body
+	tracker, ok := progress_start_request(writer, request)
+	if !ok {
+		return
+	}
+	request.Body = &progress_reader{request.Body, tracker}
+
+	if fields, file, filename, size, ok := upload_form_dedup(request); ok {
+		// the rest of the body is never read
+		writer.Header().Set("Connection", "close")
+		file := &rewind_reader{reader: file}
+		fields.unversioned = api_unversioned(request)
+		store_upload(request.Context(), writer, tracker, fields, file, filename, size)
+		return
+	}
 
 	file, header, err := request.FormFile("file")
 	if err != nil {
-		http.Error(
+		tracker.fail(err)
+		write_error(
 			writer,
 			"file upload requires key of 'file'",
 			http.StatusBadRequest,
 		)
-		fmt.Fprintf(writer, "error")
 		return
 	}
 	defer file.Close()
-	client_hash := request.FormValue("hash")
-	client_path := request.FormValue("path")
-	size := header.Size
+	fields := read_upload_fields(request)
+	fields.unversioned = api_unversioned(request)
+	store_upload(request.Context(), writer, tracker, fields, file, header.Filename, header.Size)
+}
+
+/**
+ * What the client says about an upload, besides the file itself.
+ */
+type upload_fields struct {
+	Hash      string `json:"hash"`
+	HashAlgo  string `json:"hash_algo"`
+	Namespace string `json:"namespace"`
+	Path      string `json:"path"`
+	Class     string `json:"class,omitempty"`
+	Durable   bool   `json:"durable,omitempty"`
+
+	// sent to the old /upload, which answers "ok"
+	unversioned bool
+}
+
+func read_upload_fields(request *http.Request) upload_fields {
+	return upload_fields{
+		Hash:      request.FormValue("hash"),
+		HashAlgo:  request.FormValue("hash_algo"),
+		Namespace: request.FormValue("namespace"),
+		Path:      request.FormValue("path"),
+		Class:     request.FormValue("class"),
+		Durable:   request.FormValue("durable") == "true",
+	}
+}
+
+/**
+ * Stage the uploaded file, check it against its hash, and hand it off to be
+ * archived, unless the blob is already stored, in which case only its
+ * catalog entry is added. Returns false when the upload was turned away
+ * to be tried again, in which case the caller keeps what it was sent.
+ */
+func store_upload(ctx context.Context, writer http.ResponseWriter, tracker *progress_tracker, fields upload_fields, file io.ReadSeeker, filename string, size int64) bool {
+	client_hash := fields.Hash
+	client_path := fields.Path
+	namespace := fields.Namespace
+	if namespace == "" {
+		namespace = KFS_DEFAULT_NAMESPACE
+	}
+	algo := fields.HashAlgo
+	if algo == "" {
+		algo = KFS_DEFAULT_HASH_ALGO
+	}
+	if !valid_hash_algo(algo) {
+		msg := fmt.Sprintf("unsupported hash algorithm: '%s'", algo)
+		tracker.fail(fmt.Errorf("%s", msg))
+		write_error(writer, msg, http.StatusBadRequest)
+		return true
+	}
+	durable := fields.Durable || settings().durable_uploads
+	class := fields.Class
+	if class == "" {
+		class = namespace_class(namespace)
+	}
+	if ok, err := db_class_exists(class); err != nil || !ok {
+		msg := fmt.Sprintf("no disks in storage class '%s'", class)
+		tracker.fail(fmt.Errorf("%s", msg))
+		write_error(writer, msg, http.StatusBadRequest)
+		return true
+	}
+	entry := catalog_entry{
+		Namespace: namespace,
+		Path:      client_path,
+		Filename:  filename,
+		HashAlgo:  algo,
+		Size:      size,
+	}
 	fmt.Printf(
-		"got file '%s/%s', size: %d, blake2b hash: %s\n",
+		"got file '%s/%s', size: %d, %s hash: %s\n",
 		client_path,
-		header.Filename,
+		filename,
 		size,
+		algo,
 		client_hash,
 	)
 
-	skip, staging_path, storage_paths, err := db_alloc_storage(client_hash, size, client_path)
+	existing, err := db_find_catalog_entry(namespace, client_path, filename, 0)
+	if err == nil && existing.immutable() {
+		msg := fmt.Sprintf(
+			"'%s/%s' is %s",
+			client_path,
+			filename,
+			existing.hold_description(),
+		)
+		tracker.fail(fmt.Errorf("%s", msg))
+		write_error(writer, msg, http.StatusConflict)
+		return true
+	}
+	if !accept_upload(ctx, writer, tracker, entry, file) {
+		return true
+	}
+
+	blob, err := stage_blob(ctx, writer, tracker, entry, client_hash, file, class)
+	if errors.Is(err, errHashInFlight) {
+		return false
+	}
 	if err != nil {
-		msg := fmt.Sprintf("could not store '%s': %v", header.Filename, err)
-		log.Println(msg)
-		writer.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(writer, "%s", msg)
-		return
+		return true
 	}
-	if skip {
-		log.Printf("skipping, already have hash: %s", client_hash)
+	entry.Hash = blob.hash
+	entry.HashAlgo = blob.algo
+	if blob.dedup {
+		if stored, err := db_get_blob_size(blob.hash, blob.algo); err == nil && stored > 0 {
+			entry.Size = stored
+		}
+		id, err := catalog_add(entry)
+		if err != nil {
+			log.Println(err)
+		}
+		if durable {
+			// as many replicas as the blob should have, not just the first
+			target, err := db_get_blob_target(blob.hash, blob.algo)
+			if err != nil {
+				log.Printf("could not get replica target of %s: %v", blob.hash, err)
+				target = settings().redundancy
+			}
+			if err := durable_sync(ctx, blob.hash, blob.algo, target, KFS_DURABLE_WAIT); err != nil {
+				write_not_durable(writer, tracker, err)
+				return true
+			}
+		}
+		_, roots, _ := db_get_replicas(blob.hash)
+		tracker.update(func(state *progress_state) {
+			state.Stage = STAGE_DONE
+			state.Hash = blob.hash
+			state.HashAlgo = blob.algo
+			state.Replicas = len(roots)
+			state.ReplicasWritten = len(roots)
+		})
+		write_upload_response(writer, fields, upload_response{
+			Hash:      blob.hash,
+			HashAlgo:  blob.algo,
+			Size:      entry.Size,
+			Replicas:  len(roots),
+			Dedup:     true,
+			CatalogID: id,
+			UploadID:  tracker.upload_id(),
+			Durable:   durable,
+		})
+		return true
+	}
+
+	id, err := catalog_add(entry)
+	if err != nil {
+		log.Println(err)
+	}
+	tracker.update(func(state *progress_state) {
+		state.Stage = STAGE_STAGED
+		state.Hash = blob.hash
+		state.HashAlgo = blob.algo
+		state.Replicas = len(blob.disks)
+	})
+	if !durable {
+		go blob.archive()
+	} else {
+		blob.archive()
+		if err := durable_sync(ctx, blob.hash, blob.algo, len(blob.disks), 0); err != nil {
+			write_not_durable(writer, tracker, err)
+			return true
+		}
+	}
+	write_upload_response(writer, fields, upload_response{
+		Hash:      blob.hash,
+		HashAlgo:  blob.algo,
+		Size:      size,
+		Replicas:  len(blob.disks),
+		Dedup:     false,
+		CatalogID: id,
+		UploadID:  tracker.upload_id(),
+		Durable:   durable,
+	})
+	return true
+}
+
+/**
+ * Answer a stored upload, with "ok" at the old /upload, and the
+ * upload_response everywhere else.
+ */
+func write_upload_response(writer http.ResponseWriter, fields upload_fields, response upload_response) {
+	if fields.unversioned {
 		fmt.Fprintf(writer, "ok")
 		return
 	}
-	fmt.Printf("staging: %s, storage: %s\n", staging_path, storage_paths)
+	write_json(writer, http.StatusOK, response)
+}
 
-	output_path := get_output_path(staging_path, header.Filename)
-	outf, err := os.Create(output_path)
+/**
+ * Check an upload against the policies of its namespace and the pre-accept
+ * hooks, before anything is stored. Answers and returns false when it is
+ * refused.
+ */
+func accept_upload(ctx context.Context, writer http.ResponseWriter, tracker *progress_tracker, entry catalog_entry, file io.ReadSeeker) bool {
+	violation, err := check_upload_policy(entry, file)
 	if err != nil {
-		writer.WriteHeader(http.StatusInternalServerError)
-		log.Printf("failed to create output file: %s\n", err)
-		return
+		log.Printf("could not check policy for '%s': %v", entry.Filename, err)
+		tracker.fail(err)
+		write_error(writer, "could not read upload", http.StatusBadRequest)
+		return false
+	}
+	if violation != nil {
+		log.Printf("refused '%s': %s", entry.Filename, violation.Message)
+		tracker.fail(fmt.Errorf("%s", violation.Message))
+		write_json(writer, http.StatusForbidden, violation)
+		return false
 	}
-	defer outf.Close()
-	io.Copy(outf, file)
+	if err := run_hooks(ctx, HOOK_PRE_ACCEPT, entry, ""); err != nil {
+		log.Printf("refused '%s': %v", entry.Filename, err)
+		tracker.fail(err)
+		write_error(writer, err.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+/**
+ * A blob stage_blob took in. Unless it was already stored, it is staged
+ * and archive copies it to its disks.
+ */
+type staged_blob struct {
+	hash    string
+	algo    string
+	dedup   bool
+	disks   []placement
+	archive func()
+}
 
-	hash, err := hash_file(output_path)
+/**
+ * Take in the blob of an upload: reserve its disks, stage it, check it
+ * against its hash, run the post-staging hooks on it, clamd's scan among
+ * them, and ready it to be archived. A blob that is already stored is not
+ * read at all, and comes back as a dedup under the hash it is stored as.
+ * On failure, the answer has been written, the reserved space given back,
+ * and the error is errHashInFlight when the upload may be tried again.
+ */
+func stage_blob(ctx context.Context, writer http.ResponseWriter, tracker *progress_tracker, entry catalog_entry, client_hash string, file io.Reader, class string) (staged_blob, error) {
+	algo := entry.HashAlgo
+	size := entry.Size
+	filename := entry.Filename
+	mode := default_staging_mode()
+	if direct_writes_enabled() {
+		mode = STAGING_NONE
+	}
+	skip, staging_path, disks, err := db_alloc_storage_mode(
+		ctx,
+		client_hash,
+		algo,
+		size,
+		entry.Path,
+		filename,
+		class,
+		mode,
+	)
+	if errors.Is(err, errHashInFlight) {
+		msg := fmt.Sprintf("could not store '%s': %v", filename, err)
+		log.Println(msg)
+		tracker.fail(err)
+		writer.Header().Set("Retry-After", strconv.Itoa(KFS_IN_FLIGHT_RETRY_AFTER))
+		write_error_code(writer, msg, http.StatusConflict, API_IN_FLIGHT)
+		return staged_blob{}, err
+	}
 	if err != nil {
-		log.Printf("failed to hash file: %s\n", err)
-		writer.WriteHeader(http.StatusNotAcceptable)
-		return
+		msg := fmt.Sprintf("could not store '%s': %v", filename, err)
+		log.Println(msg)
+		tracker.fail(err)
+		write_error(writer, msg, http.StatusInsufficientStorage)
+		return staged_blob{}, err
+	}
+	if skip {
+		log_debug("skipping, already have hash: %s", client_hash)
+		primary, primary_algo, err := db_resolve_hash(client_hash, algo)
+		if err != nil {
+			log.Printf("could not resolve %s: %v", client_hash, err)
+			primary, primary_algo = client_hash, algo
+		}
+		return staged_blob{hash: primary, algo: primary_algo, dedup: true}, nil
+	}
+	fmt.Printf("staging: %s, storage: %s\n", staging_path, disks)
+
+	// a direct upload is checked against its first replica
+	var parts []string
+	var output_path string
+	if mode == STAGING_NONE {
+		parts = direct_parts(disks, client_hash, algo)
+		output_path = parts[0]
+	} else {
+		output_path = get_output_path(staging_path, filename)
+	}
+
+	/*
+	 * If the upload fails before it is handed to archiving, e.g. because
+	 * the client went away, remove the partial staging file and give back
+	 * the space reserved for it.
+	 */
+	release := func(reason error) error {
+		log.Printf("upload of '%s' failed: %v", filename, reason)
+		tracker.fail(reason)
+		os.Remove(output_path)
+		for _, part := range parts {
+			os.Remove(part)
+		}
+		db_release_storage(client_hash, algo, size, disks)
+		return reason
+	}
+
+	var hash string
+	if mode == STAGING_NONE {
+		hash, err = direct_receive(ctx, file, parts, algo)
+		if err != nil {
+			write_error(writer, "could not receive upload", http.StatusInternalServerError)
+			return staged_blob{}, release(err)
+		}
+	} else {
+		outf, err := os.Create(output_path)
+		if err != nil {
+			log.Printf("failed to create output file: %s\n", err)
+			write_error(writer, "could not stage upload", http.StatusInternalServerError)
+			return staged_blob{}, release(err)
+		}
+		_, err = io.Copy(outf, &ctx_reader{ctx, file})
+		if err == nil {
+			err = sync_file(outf, FSYNC_PARANOID)
+		}
+		outf.Close()
+		if err != nil {
+			write_error(writer, "could not receive upload", http.StatusInternalServerError)
+			return staged_blob{}, release(err)
+		}
+
+		tracker.set_stage(STAGE_HASHING)
+		hash, err = hash_file_ctx(ctx, output_path, algo)
+		if err != nil {
+			log.Printf("failed to hash file: %s\n", err)
+			write_error(writer, "could not hash upload", http.StatusInternalServerError)
+			return staged_blob{}, release(err)
+		}
 	}
 	if hash != client_hash {
-		fmt.Fprintf(
-			writer,
-			"hashes do not match: you gave me: %s, but I calculated: %s\n",
+		msg := fmt.Sprintf(
+			"hashes do not match: you gave me: %s, but I calculated: %s",
 			client_hash,
 			hash,
 		)
-		writer.WriteHeader(http.StatusNotAcceptable)
+		write_error_code(writer, msg, http.StatusNotAcceptable, API_HASH_MISMATCH)
+		return staged_blob{}, release(fmt.Errorf("hash mismatch"))
+	}
+
+	entry.Hash = hash
+	if err := run_hooks(ctx, HOOK_POST_STAGING, entry, output_path); err != nil {
+		write_error(writer, err.Error(), http.StatusForbidden)
+		return staged_blob{}, release(err)
+	}
+
+	hash_filename := filepath.Join(staging_path, hash+"."+algo)
+	if mode != STAGING_NONE {
+		os.Rename(output_path, hash_filename)
+		if err := sync_dir(hash_filename, FSYNC_PARANOID); err != nil {
+			log.Printf("could not sync '%s': %v", staging_path, err)
+		}
+	}
+	geo_enqueue_blob(hash, algo)
+	blob := staged_blob{hash: hash, algo: algo, disks: disks}
+	blob.archive = func() {
+		if mode == STAGING_NONE {
+			direct_archive(parts, disks, hash, algo, size, tracker)
+		} else {
+			archive_file(staging_path, disks, hash_filename, hash, algo, tracker)
+		}
+	}
+	return blob, nil
+}
+
+/**
+ * Send the blob to the client, falling back to another replica, and queueing
+ * a repair, when one cannot be read. With ?verify=true, each replica is
+ * checked before it is sent, and re-hashed as it streams, and the transfer is
+ * aborted if the bytes do not match the hash, so the client never mistakes a
+ * corrupt download for a good one.
+ *
+ * Range requests are served too, so that a client can fetch a big blob in
+ * parts over several connections, or pick up where a transfer left off. A
+ * part cannot be re-hashed as it streams, so with ?verify=true the replica
+ * is only checked before it is sent.
+ *
+ * The blob is sent as an attachment named after the file it was uploaded
+ * as, so that browsers save it under that name rather than its hash.
+ */
+func handle_download(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	hash := p.ByName("hash")
+	filename, err := db_get_filename(hash)
+	if err == nil && filename != "" {
+		writer.Header().Set("Content-Disposition", content_disposition("attachment", filename))
+	} else if err != nil && err != sql.ErrNoRows {
+		log.Printf("could not look up the filename of %s: %v", hash, err)
+	}
+	serve_blob(writer, request, hash)
+}
+
+/**
+ * Send a single copy of the blob, read from the given disk. Returns false,
+ * without writing anything, if the copy cannot be opened or, when verifying,
+ * does not hash to the expected value, so that the caller can fall back to
+ * another copy. An error once the response has started is returned with
+ * true, and the caller must abort the connection.
+ */
+func serve_file(writer http.ResponseWriter, request *http.Request, hash string, algo string, filename string, disk string, verify bool) (bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if verify && !fs_trusts_checksums(disk) {
+		digest, err := hash_file_algo(filename, algo)
+		if err != nil {
+			return false, err
+		}
+		if disk != KFS_CACHE_PATH {
+			db_record_verify(hash, algo, disk, digest == hash)
+		}
+		if digest != hash {
+			return false, fmt.Errorf("'%s' is corrupt: hashed to %s", filename, digest)
+		}
+	}
+
+	if writer.Header().Get("Content-Type") == "" {
+		writer.Header().Set("Content-Type", "application/octet-stream")
+	}
+	writer.Header().Set("Accept-Ranges", "bytes")
+	writer.Header().Set("X-Kfs-Hash", hash)
+	writer.Header().Set("X-Kfs-Hash-Algo", algo)
+	if digests, err := db_get_digests(hash, algo); err == nil {
+		writer.Header().Set("Repr-Digest", format_repr_digest(digests))
+	}
+	read_done := disk_read_start(disk)
+	fault_delay(filename)
+	if request.Header.Get("Range") != "" {
+		http.ServeContent(writer, request, "", info.ModTime(), f)
+		read_done(0)
+		return true, nil
+	}
+	writer.Header().Set("Content-Length", fmt.Sprintf("%d", info.Size()))
+	digest, err := send_file(writer, f, algo, verify)
+	if err != nil {
+		read_done(0)
+		return true, fmt.Errorf("failed to send '%s': %v", filename, err)
+	}
+	read_done(info.Size())
+
+	// the file changed between being checked and being sent
+	if verify && digest != hash {
+		return true, fmt.Errorf(
+			"'%s' is corrupt: expected %s, but calculated %s",
+			filename,
+			hash,
+			digest,
+		)
+	}
+	return true, nil
+}
+
+func serve_blob(writer http.ResponseWriter, request *http.Request, hash string) {
+	verify := KFS_VERIFY_DOWNLOADS || request.URL.Query().Get("verify") == "true"
+
+	algo, roots, err := db_get_replicas(hash)
+	if err != nil {
+		log.Printf("could not find replicas of %s: %v", hash, err)
+		write_error(writer, "could not look up hash", http.StatusInternalServerError)
+		return
+	}
+	if len(roots) == 0 {
+		if !cluster_serve_blob(writer, request, hash) {
+			write_error(writer, "no such hash", http.StatusNotFound)
+		}
 		return
 	}
 
-	hash_filename := filepath.Join(staging_path, hash+".blake2b")
-	os.Rename(output_path, hash_filename)
-	outf.Close()
-	go archive_file(staging_path, storage_paths, hash_filename, hash)
-	fmt.Fprintf(writer, "ok")
+	if filename, ok := cache_lookup(hash, algo); ok {
+		sent, err := serve_file(writer, request, hash, algo, filename, KFS_CACHE_PATH, verify)
+		if err != nil {
+			log.Printf("cached copy not usable: %v", err)
+			cache_remove(hash, algo)
+		}
+		if sent && err != nil {
+			panic(http.ErrAbortHandler)
+		}
+		if sent {
+			return
+		}
+	}
+
+	for _, root := range order_replicas(roots) {
+		filename := get_blob_path(root, hash, algo)
+		sent, err := serve_file(writer, request, hash, algo, filename, root, verify)
+		if err != nil && !sent {
+			log.Printf("replica not usable: %v", err)
+			enqueue_repair(hash, algo, root, roots)
+		}
+		if sent && err != nil {
+			// most likely the client went away, which says nothing
+			// about the replica
+			panic(http.ErrAbortHandler)
+		}
+		if sent {
+			cache_note_read(hash, algo, filename)
+			return
+		}
+	}
+	if cluster_serve_blob(writer, request, hash) {
+		return
+	}
+	write_error(writer, "no readable replica", http.StatusInternalServerError)
 }
@@ -0,0 +1,271 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+/**
+ * Full-text search of the documents in kfs. Once a text file or PDF is
+ * archived, its text is added to the content_index table, which /search
+ * queries.
+ *
+ * content_index is an FTS5 table when go-sqlite3 is built with
+ *     go build -tags sqlite_fts5
+ * and an FTS4 table otherwise. Either way each document's rowid is the
+ * doc_id of its row in content_docs, which says which blob it came from.
+ */
+
+var KFS_SEARCH_INDEX = false
+
+// only this much of each document is indexed
+var KFS_SEARCH_MAX_BYTES int64 = 10 * 1024 * 1024
+
+// PDFs are only indexed when this is on the PATH
+var KFS_PDFTOTEXT = "pdftotext"
+
+// "fts5" or "fts4", whichever content_index was made with
+var search_module string
+
+/**
+ * Make content_index, unless it exists already, in which case keep using
+ * the module it was made with. Has to run after the schemas are made.
+ */
+func search_init() {
+	var schema string
+	query := `select sql from sqlite_master where name = 'content_index'`
+	err := db.QueryRow(query).Scan(&schema)
+	if err == nil {
+		search_module = "fts4"
+		if strings.Contains(strings.ToLower(schema), "fts5") {
+			search_module = "fts5"
+		}
+		return
+	}
+	if err != sql.ErrNoRows {
+		panic(err)
+	}
+	for _, module := range []string{"fts5", "fts4"} {
+		stmt := `CREATE VIRTUAL TABLE content_index USING ` + module + `(body)`
+		if _, err = db_exec(stmt); err == nil {
+			search_module = module
+			break
+		}
+	}
+	if err != nil {
+		panic(fmt.Errorf("could not make search index: %v", err))
+	}
+	log.Printf("search index uses %s", search_module)
+}
+
+func search_hooks_init() {
+	if !KFS_SEARCH_INDEX {
+		return
+	}
+	KFS_HOOKS[HOOK_POST_ARCHIVE] = append(
+		KFS_HOOKS[HOOK_POST_ARCHIVE],
+		hook_func(search_hook),
+	)
+}
+
+/**
+ * The text of the document, or "" if it is not one that can be indexed.
+ */
+func extract_text(ctx context.Context, filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	mime_type, err := detect_mime_type(f)
+	if err != nil {
+		return "", err
+	}
+
+	var text []byte
+	switch {
+	case strings.HasPrefix(mime_type, "text/"):
+		text, err = io.ReadAll(io.LimitReader(f, KFS_SEARCH_MAX_BYTES))
+	case mime_type == "application/pdf":
+		if _, err := exec.LookPath(KFS_PDFTOTEXT); err != nil {
+			return "", nil
+		}
+		cmd := exec.CommandContext(ctx, KFS_PDFTOTEXT, "-q", filename, "-")
+		text, err = cmd.Output()
+	default:
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if int64(len(text)) > KFS_SEARCH_MAX_BYTES {
+		text = text[:KFS_SEARCH_MAX_BYTES]
+	}
+	return strings.ToValidUTF8(string(text), string(utf8.RuneError)), nil
+}
+
+func db_index_content(hash string, algo string, text string) error {
+	return db_transaction(func(tx *sql.Tx) error {
+		var id int64
+		err := tx.QueryRow(
+			`select doc_id from content_docs where hash = ? and hash_algo = ?`,
+			hash,
+			algo,
+		).Scan(&id)
+		if err == nil {
+			// already indexed
+			return nil
+		}
+		if err != sql.ErrNoRows {
+			return err
+		}
+		result, err := tx.Exec(
+			`insert into content_docs(hash, hash_algo) values(?, ?)`,
+			hash,
+			algo,
+		)
+		if err != nil {
+			return err
+		}
+		if id, err = result.LastInsertId(); err != nil {
+			return err
+		}
+		_, err = tx.Exec(
+			`insert into content_index(rowid, body) values(?, ?)`,
+			id,
+			text,
+		)
+		return err
+	})
+}
+
+func search_hook(ctx context.Context, call hook_call) error {
+	entry := call.Entry
+	if db_is_thumbnail(entry.Hash, entry.HashAlgo) {
+		return nil
+	}
+	text, err := extract_text(ctx, call.File)
+	if err != nil {
+		return fmt.Errorf("could not extract text of %s: %v", entry.Hash, err)
+	}
+	if strings.TrimSpace(text) == "" {
+		return nil
+	}
+	return db_index_content(entry.Hash, entry.HashAlgo, text)
+}
+
+type search_result struct {
+	catalog_entry
+	Snippet string `json:"snippet"`
+}
+
+func db_search_content(namespace string, q string, limit int) ([]search_result, error) {
+	snippet := `snippet(content_index, '[', ']', '...', 0, 16)`
+	order := `content_index.rowid`
+	if search_module == "fts5" {
+		snippet = `snippet(content_index, 0, '[', ']', '...', 16)`
+		order = `content_index.rank`
+	}
+	query := `
+		select ` + catalog_columns + `, ` + snippet + `
+		from content_index
+		join content_docs on content_docs.doc_id = content_index.rowid
+		join catalog using (hash, hash_algo)
+		where content_index match ? and catalog.namespace = ?
+		order by ` + order + `, catalog.id
+		limit ?
+	`
+	rows, err := db.Query(query, q, namespace, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []search_result{}
+	for rows.Next() {
+		var result search_result
+		err := rows.Scan(
+			&result.ID,
+			&result.Namespace,
+			&result.Path,
+			&result.Filename,
+			&result.Hash,
+			&result.HashAlgo,
+			&result.Size,
+			&result.CreatedAt,
+			&result.Pinned,
+			&result.Held,
+			&result.RetainUntil,
+			&result.Snippet,
+		)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+/**
+ * Find the files whose text matches the query, e.g.
+ *     curl 'localhost:8080/search?q=mortgage+2023'
+ * q uses the full-text query syntax of SQLite, e.g. "tax*" or
+ * "invoice NOT paid".
+ */
+func handle_search(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	params := request.URL.Query()
+	q := params.Get("q")
+	if strings.TrimSpace(q) == "" {
+		write_error(writer, "search requires 'q'", http.StatusBadRequest)
+		return
+	}
+	namespace := params.Get("namespace")
+	if namespace == "" {
+		namespace = KFS_DEFAULT_NAMESPACE
+	}
+	limit := KFS_UI_LIST_LIMIT
+	if s := params.Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 {
+			write_error(writer, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	results, err := db_search_content(namespace, q, limit)
+	if err != nil {
+		// most often a query that is not valid full-text syntax
+		log.Printf("could not search for '%s': %v", q, err)
+		write_error(writer, fmt.Sprintf("could not search: %v", err), http.StatusBadRequest)
+		return
+	}
+	write_json(writer, http.StatusOK, results)
+}
@@ -0,0 +1,250 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * Publishes each event to a NATS subject, named after the event type under
+ * subject, e.g. "kfs.blob.archived". NATS speaks a line based text
+ * protocol, so this needs no client library. The connection is made on the
+ * first event, and made again after an error.
+ */
+type nats_sink struct {
+	addr    string
+	subject string
+
+	mutex sync.Mutex
+	conn  net.Conn
+}
+
+func (s *nats_sink) name() string {
+	return "nats://" + s.addr
+}
+
+func (s *nats_sink) connect() error {
+	conn, err := net.DialTimeout("tcp", s.addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	info, err := reader.ReadString('\n')
+	conn.SetReadDeadline(time.Time{})
+	if err != nil || !strings.HasPrefix(info, "INFO") {
+		conn.Close()
+		return fmt.Errorf("did not get INFO from server: %q %v", info, err)
+	}
+	_, err = io.WriteString(conn, `CONNECT {"verbose":false,"pedantic":false,"name":"kfs"}`+"\r\n")
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	s.conn = conn
+	go s.read(conn, reader)
+	return nil
+}
+
+/**
+ * Answer the server's keepalive pings, and drop the connection once it is
+ * closed, so the next event makes a new one.
+ */
+func (s *nats_sink) read(conn net.Conn, reader *bufio.Reader) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			break
+		}
+		if strings.HasPrefix(line, "PING") {
+			s.mutex.Lock()
+			_, err = io.WriteString(conn, "PONG\r\n")
+			s.mutex.Unlock()
+			if err != nil {
+				break
+			}
+		}
+	}
+	s.mutex.Lock()
+	if s.conn == conn {
+		s.conn = nil
+	}
+	s.mutex.Unlock()
+	conn.Close()
+}
+
+func (s *nats_sink) publish(e event, payload []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			return err
+		}
+	}
+	subject := s.subject + "." + e.Type
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "PUB %s %d\r\n", subject, len(payload))
+	msg.Write(payload)
+	msg.WriteString("\r\n")
+	s.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := s.conn.Write(msg.Bytes()); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+/**
+ * Publishes each event to a Kafka topic through a Kafka REST proxy, keyed
+ * by hash so that all the events for a blob land on the same partition, e.g.
+ *     &kafka_sink{proxy: "http://localhost:8082", topic: "kfs-events"}
+ */
+type kafka_sink struct {
+	proxy string
+	topic string
+}
+
+func (s *kafka_sink) name() string {
+	return s.proxy + "/topics/" + s.topic
+}
+
+type kafka_record struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+type kafka_records struct {
+	Records []kafka_record `json:"records"`
+}
+
+func (s *kafka_sink) publish(e event, payload []byte) error {
+	body, err := json.Marshal(kafka_records{[]kafka_record{{e.Hash, payload}}})
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(
+		http.MethodPost,
+		s.proxy+"/topics/"+s.topic,
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	response, err := cluster_client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("got status %d: %s", response.StatusCode, msg)
+	}
+	return nil
+}
+
+/**
+ * Posts each event as JSON to a URL, e.g. a chat or paging service's
+ * incoming webhook,
+ *     &webhook_sink{url: "https://alerts.example.com/kfs", types: []string{EVENT_DISK_LOW_SPACE}}
+ * Only the listed event types are posted, or every event if none are.
+ */
+type webhook_sink struct {
+	url   string
+	types []string
+}
+
+func (s *webhook_sink) name() string {
+	return s.url
+}
+
+func (s *webhook_sink) wants(event_type string) bool {
+	if len(s.types) == 0 {
+		return true
+	}
+	for _, t := range s.types {
+		if t == event_type {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *webhook_sink) publish(e event, payload []byte) error {
+	if !s.wants(e.Type) {
+		return nil
+	}
+	response, err := cluster_client.Post(s.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("got status %d: %s", response.StatusCode, msg)
+	}
+	return nil
+}
+
+/**
+ * A sink as written in the event_sinks config key, e.g.
+ *     {"type": "nats", "addr": "localhost:4222", "subject": "kfs"}
+ *     {"type": "kafka", "proxy": "http://kafka-rest:8082", "topic": "kfs"}
+ *     {"type": "webhook", "url": "https://alerts.example.com/kfs", "types": ["disk.low_space"]}
+ */
+type sink_spec struct {
+	Type    string   `json:"type"`
+	Addr    string   `json:"addr,omitempty"`
+	Subject string   `json:"subject,omitempty"`
+	Proxy   string   `json:"proxy,omitempty"`
+	Topic   string   `json:"topic,omitempty"`
+	URL     string   `json:"url,omitempty"`
+	Types   []string `json:"types,omitempty"`
+}
+
+func (spec sink_spec) sink() (event_sink, error) {
+	switch spec.Type {
+	case "nats":
+		if spec.Addr == "" || spec.Subject == "" {
+			return nil, fmt.Errorf("a nats sink needs addr and subject")
+		}
+		return &nats_sink{addr: spec.Addr, subject: spec.Subject}, nil
+	case "kafka":
+		if spec.Proxy == "" || spec.Topic == "" {
+			return nil, fmt.Errorf("a kafka sink needs proxy and topic")
+		}
+		return &kafka_sink{proxy: spec.Proxy, topic: spec.Topic}, nil
+	case "webhook":
+		if spec.URL == "" {
+			return nil, fmt.Errorf("a webhook sink needs url")
+		}
+		return &webhook_sink{url: spec.URL, types: spec.Types}, nil
+	}
+	return nil, fmt.Errorf("unknown sink type '%s'", spec.Type)
+}
@@ -0,0 +1,275 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"time"
+)
+
+/**
+ * SMART monitoring of the devices behind each disk, using smartctl 7.0 or
+ * later for its JSON output. Reallocated and pending sectors are the early
+ * signs of a dying disk, so an event is raised when either rises past its
+ * threshold, or when the disk fails its own health check.
+ */
+
+var (
+	KFS_SMARTCTL = "smartctl"
+
+	// how often to read SMART attributes, 0 to never
+	KFS_SMART_INTERVAL = time.Hour
+
+	KFS_SMART_TIMEOUT = time.Minute
+
+	// the counts a disk may have without raising an event
+	KFS_SMART_REALLOCATED_MAX int64 = 0
+	KFS_SMART_PENDING_MAX     int64 = 0
+)
+
+const EVENT_DISK_WARNING = "disk.warning"
+
+const (
+	SMART_REALLOCATED_SECTORS = 5
+	SMART_PENDING_SECTORS     = 197
+)
+
+type disk_health struct {
+	Device      string    `json:"device"`
+	Passed      bool      `json:"passed"`
+	Reallocated int64     `json:"reallocated_sectors"`
+	Pending     int64     `json:"pending_sectors"`
+	Temperature int64     `json:"temperature,omitempty"`
+	CheckedAt   time.Time `json:"checked_at"`
+}
+
+// the parts of `smartctl --json` that kfs reads
+type smartctl_output struct {
+	Smartctl struct {
+		ExitStatus int `json:"exit_status"`
+		Messages   []struct {
+			String string `json:"string"`
+		} `json:"messages"`
+	} `json:"smartctl"`
+	SmartStatus *struct {
+		Passed bool `json:"passed"`
+	} `json:"smart_status"`
+	AtaSmartAttributes struct {
+		Table []struct {
+			ID  int `json:"id"`
+			Raw struct {
+				Value int64 `json:"value"`
+			} `json:"raw"`
+		} `json:"table"`
+	} `json:"ata_smart_attributes"`
+	NvmeSmartHealthInformationLog *struct {
+		MediaErrors int64 `json:"media_errors"`
+	} `json:"nvme_smart_health_information_log"`
+	Temperature struct {
+		Current int64 `json:"current"`
+	} `json:"temperature"`
+}
+
+func smart_read(device string) (*disk_health, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), KFS_SMART_TIMEOUT)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, KFS_SMARTCTL, "--json", "-H", "-A", device).Output()
+	var exit_err *exec.ExitError
+	if err != nil && !errors.As(err, &exit_err) {
+		return nil, err
+	}
+
+	// the exit status is a bit mask, and only the lowest two bits mean
+	// smartctl could not read the device at all
+	var out smartctl_output
+	if err := json.Unmarshal(output, &out); err != nil {
+		return nil, fmt.Errorf("could not parse smartctl output: %v", err)
+	}
+	if out.Smartctl.ExitStatus&3 != 0 || out.SmartStatus == nil {
+		msg := "no SMART data"
+		if len(out.Smartctl.Messages) > 0 {
+			msg = out.Smartctl.Messages[0].String
+		}
+		return nil, fmt.Errorf("smartctl %s: %s", device, msg)
+	}
+
+	health := &disk_health{
+		Device:      device,
+		Passed:      out.SmartStatus.Passed,
+		Temperature: out.Temperature.Current,
+		CheckedAt:   time.Now(),
+	}
+	for _, attr := range out.AtaSmartAttributes.Table {
+		switch attr.ID {
+		case SMART_REALLOCATED_SECTORS:
+			health.Reallocated = attr.Raw.Value
+		case SMART_PENDING_SECTORS:
+			health.Pending = attr.Raw.Value
+		}
+	}
+	if nvme := out.NvmeSmartHealthInformationLog; nvme != nil {
+		// NVMe has no sector counts, media errors are the nearest thing
+		health.Reallocated = nvme.MediaErrors
+	}
+	return health, nil
+}
+
+func db_get_disk_health(root string) (*disk_health, error) {
+	query := `
+		select device, passed, reallocated, pending, temperature, checked_at
+		from disk_health
+		where root = ?
+	`
+	var health disk_health
+	var checked_at int64
+	err := db.QueryRow(query, root).Scan(
+		&health.Device,
+		&health.Passed,
+		&health.Reallocated,
+		&health.Pending,
+		&health.Temperature,
+		&checked_at,
+	)
+	if err != nil {
+		return nil, err
+	}
+	health.CheckedAt = time.Unix(checked_at, 0)
+	return &health, nil
+}
+
+func db_set_disk_health(root string, health *disk_health) error {
+	stmt := `
+		INSERT OR REPLACE INTO disk_health(
+			root,
+			device,
+			passed,
+			reallocated,
+			pending,
+			temperature,
+			checked_at
+		) values(?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := db_exec(
+		stmt,
+		root,
+		health.Device,
+		health.Passed,
+		health.Reallocated,
+		health.Pending,
+		health.Temperature,
+		health.CheckedAt.Unix(),
+	)
+	return err
+}
+
+/**
+ * What has gone wrong with the disk since it was last checked, if anything
+ * crossed a threshold.
+ */
+func smart_warnings(before *disk_health, after *disk_health) []string {
+	if before == nil {
+		before = &disk_health{Passed: true}
+	}
+	var warnings []string
+	if before.Passed && !after.Passed {
+		warnings = append(warnings, "failed its SMART health check")
+	}
+	if after.Reallocated > KFS_SMART_REALLOCATED_MAX && after.Reallocated > before.Reallocated {
+		warnings = append(
+			warnings,
+			fmt.Sprintf("%d reallocated sectors, up from %d", after.Reallocated, before.Reallocated),
+		)
+	}
+	if after.Pending > KFS_SMART_PENDING_MAX && after.Pending > before.Pending {
+		warnings = append(
+			warnings,
+			fmt.Sprintf("%d pending sectors, up from %d", after.Pending, before.Pending),
+		)
+	}
+	return warnings
+}
+
+func smart_check(root string) error {
+	device, err := smart_device(root)
+	if err != nil {
+		return err
+	}
+	health, err := smart_read(device)
+	if err != nil {
+		return err
+	}
+	before, err := db_get_disk_health(root)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err := db_set_disk_health(root, health); err != nil {
+		return fmt.Errorf("could not record SMART data: %v", err)
+	}
+
+	labels := fmt.Sprintf("root=%q,device=%q", root, device)
+	passed := 0.0
+	if health.Passed {
+		passed = 1
+	}
+	metric_set("kfs_disk_smart_passed", "Whether the disk passes its SMART health check.", labels, passed)
+	metric_set("kfs_disk_reallocated_sectors", "Sectors the disk has reallocated.", labels, float64(health.Reallocated))
+	metric_set("kfs_disk_pending_sectors", "Sectors the disk is waiting to reallocate.", labels, float64(health.Pending))
+
+	if !health.Passed {
+		if err := disk_fail(root, device+" failed its SMART health check"); err != nil {
+			return err
+		}
+	}
+	for _, warning := range smart_warnings(before, health) {
+		log.Printf("disk '%s' (%s): %s", root, device, warning)
+		emit_event(event{
+			Type:  EVENT_DISK_WARNING,
+			Root:  root,
+			Error: fmt.Sprintf("%s %s", device, warning),
+		})
+	}
+	return nil
+}
+
+func smart_loop() {
+	if KFS_SMART_INTERVAL == 0 {
+		return
+	}
+	if _, err := exec.LookPath(KFS_SMARTCTL); err != nil {
+		log.Printf("not monitoring SMART: %v", err)
+		return
+	}
+	for {
+		disks, err := db_list_disks()
+		if err != nil {
+			log.Println(err)
+		}
+		for _, disk := range disks {
+			if err := smart_check(disk.Root); err != nil {
+				log.Printf("could not check SMART for '%s': %v", disk.Root, err)
+			}
+		}
+		time.Sleep(KFS_SMART_INTERVAL)
+	}
+}
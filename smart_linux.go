@@ -0,0 +1,48 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+/**
+ * The whole device that root is on, e.g. /dev/sda for a root on /dev/sda1,
+ * found through sysfs, since SMART belongs to the device rather than the
+ * partition.
+ */
+func smart_device(root string) (string, error) {
+	var stat unix.Stat_t
+	if err := unix.Stat(root, &stat); err != nil {
+		return "", err
+	}
+	dev := uint64(stat.Dev)
+	sys := fmt.Sprintf("/sys/dev/block/%d:%d", unix.Major(dev), unix.Minor(dev))
+	path, err := filepath.EvalSymlinks(sys)
+	if err != nil {
+		return "", fmt.Errorf("no block device for '%s': %v", root, err)
+	}
+	if _, err := os.Stat(filepath.Join(path, "partition")); err == nil {
+		path = filepath.Dir(path)
+	}
+	return "/dev/" + filepath.Base(path), nil
+}
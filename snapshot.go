@@ -0,0 +1,299 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+/**
+ * A copy of the catalog, and of where every replica is, written to each
+ * storage disk as .kfs/catalog.json.gz once an hour, so that when the disk
+ * holding the database is lost, the names of the files can be recovered
+ * from any disk that survived, e.g.
+ *     zcat /mnt/disk2/.kfs/catalog.json.gz | jq '.catalog[] | .filename'
+ *     curl -X POST localhost:8080/admin/snapshot      write one now
+ * The copy on each disk is replaced whole, so a disk never holds half of
+ * one.
+ */
+
+var KFS_CATALOG_SNAPSHOT_INTERVAL = time.Hour
+
+const KFS_CATALOG_SNAPSHOT_NAME = "catalog.json.gz"
+
+type snapshot_replica struct {
+	Hash      string `json:"hash"`
+	HashAlgo  string `json:"hash_algo"`
+	Node      string `json:"node,omitempty"`
+	Root      string `json:"root"`
+	Size      int64  `json:"size"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type catalog_snapshot struct {
+	Node      string             `json:"node"`
+	WrittenAt int64              `json:"written_at"`
+	Catalog   []catalog_entry    `json:"catalog"`
+	Replicas  []snapshot_replica `json:"replicas"`
+}
+
+type snapshot_report struct {
+	WrittenAt int64    `json:"written_at"`
+	Entries   int      `json:"entries"`
+	Replicas  int      `json:"replicas"`
+	Disks     []string `json:"disks"`
+	Failed    []string `json:"failed"`
+}
+
+func catalog_snapshot_path(root string) string {
+	return filepath.Join(root, ".kfs", KFS_CATALOG_SNAPSHOT_NAME)
+}
+
+/**
+ * Write the array as JSON one element at a time, so that the catalog is
+ * never all in memory.
+ */
+func snapshot_write_array(w io.Writer, name string, rows *sql.Rows, next func() (interface{}, error)) (int, error) {
+	if _, err := fmt.Fprintf(w, ",%q:[", name); err != nil {
+		return 0, err
+	}
+	n := 0
+	for rows.Next() {
+		v, err := next()
+		if err != nil {
+			return n, err
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return n, err
+		}
+		if n > 0 {
+			data = append([]byte{','}, data...)
+		}
+		if _, err := w.Write(data); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return n, err
+	}
+	_, err := io.WriteString(w, "]")
+	return n, err
+}
+
+/**
+ * Write the snapshot, compressed, to filename.
+ */
+func catalog_snapshot_write(filename string, report *snapshot_report) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buffered := bufio.NewWriter(f)
+	compressed := gzip.NewWriter(buffered)
+
+	header, err := json.Marshal(struct {
+		Node      string `json:"node"`
+		WrittenAt int64  `json:"written_at"`
+	}{KFS_NODE_NAME, report.WrittenAt})
+	if err != nil {
+		return err
+	}
+	// the header without its closing brace, so the arrays can follow it
+	if _, err := compressed.Write(header[:len(header)-1]); err != nil {
+		return err
+	}
+
+	rows, err := db.Query(`select ` + catalog_columns + ` from catalog order by id`)
+	if err != nil {
+		return fmt.Errorf("could not read catalog: %v", err)
+	}
+	report.Entries, err = snapshot_write_array(compressed, "catalog", rows, func() (interface{}, error) {
+		return scan_catalog_entry(rows)
+	})
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	rows, err = db.Query(`
+		select hash, hash_algo, node, storage_root, coalesce(size, 0), coalesce(created_at, 0)
+		from files
+		where not pending
+		order by hash, hash_algo
+	`)
+	if err != nil {
+		return fmt.Errorf("could not read replicas: %v", err)
+	}
+	report.Replicas, err = snapshot_write_array(compressed, "replicas", rows, func() (interface{}, error) {
+		var replica snapshot_replica
+		err := rows.Scan(
+			&replica.Hash,
+			&replica.HashAlgo,
+			&replica.Node,
+			&replica.Root,
+			&replica.Size,
+			&replica.CreatedAt,
+		)
+		return replica, err
+	})
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.WriteString(compressed, "}\n"); err != nil {
+		return err
+	}
+	if err := compressed.Close(); err != nil {
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+/**
+ * Put a copy of the snapshot on the disk, in place of the one before.
+ */
+func catalog_snapshot_install(snapshot string, root string) error {
+	dst := catalog_snapshot_path(root)
+	tmp := dst + ".tmp"
+	in, err := os.Open(snapshot)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+/**
+ * Write a snapshot to every healthy local disk.
+ */
+func catalog_snapshot_run() (snapshot_report, error) {
+	report := snapshot_report{
+		WrittenAt: time.Now().Unix(),
+		Disks:     []string{},
+		Failed:    []string{},
+	}
+	snapshot := KFS_DB_PATH + "." + KFS_CATALOG_SNAPSHOT_NAME
+	defer os.Remove(snapshot)
+	if err := catalog_snapshot_write(snapshot, &report); err != nil {
+		return report, fmt.Errorf("could not write catalog snapshot: %v", err)
+	}
+	disks, err := db_list_disks()
+	if err != nil {
+		return report, err
+	}
+	for _, disk := range disks {
+		if disk.Failed {
+			continue
+		}
+		if err := catalog_snapshot_install(snapshot, disk.Root); err != nil {
+			log.Printf("could not write catalog snapshot to '%s': %v", disk.Root, err)
+			report.Failed = append(report.Failed, disk.Root)
+			continue
+		}
+		report.Disks = append(report.Disks, disk.Root)
+	}
+	metric_set(
+		"kfs_catalog_snapshot_time",
+		"When the catalog was last written to the disks, in unix time.",
+		"",
+		float64(report.WrittenAt),
+	)
+	return report, nil
+}
+
+/**
+ * Read a snapshot written by catalog_snapshot_run.
+ */
+func catalog_snapshot_read(filename string) (catalog_snapshot, error) {
+	var snapshot catalog_snapshot
+	f, err := os.Open(filename)
+	if err != nil {
+		return snapshot, err
+	}
+	defer f.Close()
+	decompressed, err := gzip.NewReader(f)
+	if err != nil {
+		return snapshot, fmt.Errorf("could not read '%s': %v", filename, err)
+	}
+	if err := json.NewDecoder(decompressed).Decode(&snapshot); err != nil {
+		return snapshot, fmt.Errorf("could not read '%s': %v", filename, err)
+	}
+	return snapshot, nil
+}
+
+func handle_catalog_snapshot(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	report, err := catalog_snapshot_run()
+	if err != nil {
+		log.Println(err)
+		write_error(writer, "could not write catalog snapshot", http.StatusInternalServerError)
+		return
+	}
+	write_json(writer, http.StatusOK, report)
+}
+
+func catalog_snapshot_loop() {
+	for {
+		time.Sleep(KFS_CATALOG_SNAPSHOT_INTERVAL)
+		report, err := catalog_snapshot_run()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		log_debug("wrote catalog snapshot of %d entries to %d disks", report.Entries, len(report.Disks))
+	}
+}
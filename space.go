@@ -0,0 +1,271 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/**
+ * Warnings for disks, and the pool of all local disks, running low on
+ * space. A disk is low when it is below either the absolute or the
+ * percentage threshold. Each time a disk becomes low, or recovers, it is
+ * logged and an event is raised, which a webhook_sink can pass on. Below
+ * the floor, uploads are turned away until space is freed. Before each
+ * check, the space recorded for each disk is corrected from statfs.
+ */
+
+var (
+	KFS_SPACE_CHECK_INTERVAL = time.Minute
+
+	// a disk is low on space below either of these, 0 to not check
+	KFS_DISK_LOW_BYTES   int64 = 0
+	KFS_DISK_LOW_PERCENT       = 10.0
+
+	// the pool is low on space below either of these, 0 to not check
+	KFS_POOL_LOW_BYTES   int64 = 0
+	KFS_POOL_LOW_PERCENT       = 10.0
+
+	// uploads are refused while the pool is below either of these
+	KFS_POOL_FLOOR_BYTES   int64 = 0
+	KFS_POOL_FLOOR_PERCENT       = 0.0
+)
+
+const (
+	EVENT_DISK_LOW_SPACE       = "disk.low_space"
+	EVENT_DISK_SPACE_RECOVERED = "disk.space_recovered"
+)
+
+// the root given to the pool of all local disks in events and metrics
+const SPACE_POOL = "pool"
+
+var (
+	space_low    = map[string]bool{}
+	space_paused bool
+	space_mutex  sync.Mutex
+)
+
+func space_below(available int64, total int64, bytes int64, percent float64) bool {
+	if bytes > 0 && available < bytes {
+		return true
+	}
+	if percent > 0 && total > 0 && 100*float64(available)/float64(total) < percent {
+		return true
+	}
+	return false
+}
+
+/**
+ * Raise an event if the disk has become low on space, or recovered, since
+ * it was last checked.
+ */
+func space_update(root string, available int64, total int64, low bool) {
+	space_mutex.Lock()
+	was_low := space_low[root]
+	space_low[root] = low
+	space_mutex.Unlock()
+
+	labels := fmt.Sprintf("root=%q", root)
+	metric_set("kfs_disk_available_bytes", "Bytes available on the disk.", labels, float64(available))
+	metric_set("kfs_disk_total_bytes", "Size of the disk in bytes.", labels, float64(total))
+	low_value := 0.0
+	if low {
+		low_value = 1
+	}
+	metric_set("kfs_disk_low_space", "Whether the disk is low on space.", labels, low_value)
+
+	if low == was_low {
+		return
+	}
+	msg := fmt.Sprintf("%s of %s available", format_bytes(available), format_bytes(total))
+	e := event{Root: root, Error: msg}
+	if low {
+		log.Printf("disk '%s' is low on space: %s", root, msg)
+		e.Type = EVENT_DISK_LOW_SPACE
+	} else {
+		log.Printf("disk '%s' has space again: %s", root, msg)
+		e.Type = EVENT_DISK_SPACE_RECOVERED
+	}
+	emit_event(e)
+}
+
+func space_check() error {
+	disks, err := db_list_disks()
+	if err != nil {
+		return err
+	}
+	var pool_available, pool_total int64
+	for _, disk := range disks {
+		pool_available += disk.Available
+		pool_total += disk.Total
+		low := space_below(disk.Available, disk.Total, KFS_DISK_LOW_BYTES, KFS_DISK_LOW_PERCENT)
+		space_update(disk.Root, disk.Available, disk.Total, low)
+	}
+	low := space_below(pool_available, pool_total, KFS_POOL_LOW_BYTES, KFS_POOL_LOW_PERCENT)
+	space_update(SPACE_POOL, pool_available, pool_total, low)
+	staging_check()
+
+	paused := space_below(pool_available, pool_total, KFS_POOL_FLOOR_BYTES, KFS_POOL_FLOOR_PERCENT)
+	space_mutex.Lock()
+	if paused != space_paused {
+		if paused {
+			log.Printf("pausing uploads, only %s available", format_bytes(pool_available))
+		} else {
+			log.Printf("resuming uploads, %s available", format_bytes(pool_available))
+		}
+	}
+	space_paused = paused
+	space_mutex.Unlock()
+	return nil
+}
+
+func space_loop() {
+	for {
+		if err := space_reconcile(); err != nil {
+			log.Printf("could not reconcile disk space: %v", err)
+		}
+		if err := space_check(); err != nil {
+			log.Printf("could not check disk space: %v", err)
+		}
+		time.Sleep(KFS_SPACE_CHECK_INTERVAL)
+	}
+}
+
+/**
+ * Turn away uploads while the pool is below its floor.
+ */
+func space_check_upload(writer http.ResponseWriter) bool {
+	space_mutex.Lock()
+	paused := space_paused
+	space_mutex.Unlock()
+	if !paused {
+		return true
+	}
+	write_error(writer, "uploads are paused, storage is full", http.StatusInsufficientStorage)
+	return false
+}
+
+/**
+ * Space taken from disks.available for uploads that are not on disk yet,
+ * keyed by hash and algo. Once a blob is archived, statfs counts it, so it
+ * is no longer pending. Uploads staged in KFS_STAGING_DIR name it in
+ * staging.
+ */
+type space_reservation struct {
+	disks   []placement
+	size    int64
+	mode    staging_mode
+	staging string
+}
+
+var (
+	space_reservations = map[string]space_reservation{}
+
+	// held for reading while space is reserved, and for writing while it
+	// is reconciled, so no reservation is lost between the two
+	space_reconcile_lock sync.RWMutex
+)
+
+func space_reserve(hash string, algo string, size int64, disks []placement, mode staging_mode) {
+	space_mutex.Lock()
+	key := hash + "." + algo
+	r := space_reservations[key]
+	r.disks = disks
+	r.size = size
+	r.mode = mode
+	space_reservations[key] = r
+	space_mutex.Unlock()
+}
+
+func space_release(hash string, algo string) {
+	space_mutex.Lock()
+	delete(space_reservations, hash+"."+algo)
+	space_mutex.Unlock()
+}
+
+/**
+ * The bytes reserved on each local disk, with the staging copy counting
+ * twice on the first disk when the upload is staged there, as in
+ * db_alloc_storage.
+ */
+func space_pending() map[string]int64 {
+	space_mutex.Lock()
+	defer space_mutex.Unlock()
+	pending := map[string]int64{}
+	for _, r := range space_reservations {
+		for i, disk := range r.disks {
+			if disk.node != "" {
+				continue
+			}
+			if i == 0 && r.mode == STAGING_ON_DISK {
+				pending[disk.root] += 2 * r.size
+			} else {
+				pending[disk.root] += r.size
+			}
+		}
+	}
+	return pending
+}
+
+/**
+ * Correct the space available on each local disk, which is only read at
+ * startup and then counted down, so anything else writing to or deleting
+ * from the disk throws it off. The space still reserved for uploads in
+ * flight is taken off what statfs reports.
+ */
+func space_reconcile() error {
+	space_reconcile_lock.Lock()
+	defer space_reconcile_lock.Unlock()
+	disks, err := db_list_disks()
+	if err != nil {
+		return err
+	}
+	pending := space_pending()
+	for _, disk := range disks {
+		_, free, err := disk_statfs(disk.Root)
+		if err != nil {
+			log.Printf("could not statfs '%s': %v", disk.Root, err)
+			continue
+		}
+		available := int64(free) - pending[disk.Root]
+		if available < 0 {
+			available = 0
+		}
+		if available == disk.Available {
+			continue
+		}
+		log_debug(
+			"available space on '%s' was off by %d bytes",
+			disk.Root,
+			disk.Available-available,
+		)
+		_, err = db_exec(
+			`update disks set available = ? where node = '' and root = ?`,
+			available,
+			disk.Root,
+		)
+		if err != nil {
+			return fmt.Errorf("could not correct available space: %v", err)
+		}
+	}
+	return nil
+}
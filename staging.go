@@ -0,0 +1,162 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+/**
+ * A staging directory on a fast device, e.g. an NVMe drive, that uploads
+ * are written to before being archived, so that ingest is not held back by
+ * the slowest disk. Every replica is then copied out from there. Without
+ * one, an upload is staged on the first local disk it is stored to, and
+ * hard linked into storage there.
+ *
+ * The staging directory is not one of the disks, so it keeps its own
+ * account: an upload is only staged there if statfs shows room for it
+ * after the uploads already staged and not yet archived.
+ */
+
+// directory to stage uploads in, empty to stage on the disks themselves
+var KFS_STAGING_DIR = ""
+
+type staging_mode int
+
+const (
+	// on the first local disk the blob is stored to
+	STAGING_ON_DISK staging_mode = iota
+
+	// in the staging directory
+	STAGING_IN_DIR
+
+	// not staged, but written straight to every disk
+	STAGING_NONE
+)
+
+func default_staging_mode() staging_mode {
+	if settings().staging_dir != "" {
+		return STAGING_IN_DIR
+	}
+	return STAGING_ON_DISK
+}
+
+/**
+ * Create the staging directory, returning it as it is to be used.
+ */
+func staging_prepare(dir string) (string, error) {
+	dir = filepath.Clean(dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	log.Printf("staging uploads in '%s'", dir)
+	return dir, nil
+}
+
+/**
+ * The staging directories that may hold blobs waiting to be archived: the
+ * one on each disk, and the dedicated one if there is one.
+ */
+func staging_dirs() ([]string, error) {
+	disks, err := db_list_disks()
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, disk := range disks {
+		dirs = append(dirs, filepath.Join(disk.Root, ".kfs", "staging"))
+	}
+	if dir := settings().staging_dir; dir != "" {
+		dirs = append(dirs, dir)
+	}
+	return dirs, nil
+}
+
+/**
+ * The bytes free in the staging directory, less what is reserved for
+ * uploads staged there and not yet archived. The caller holds space_mutex.
+ */
+func staging_available(dir string) (int64, error) {
+	_, free, err := disk_statfs(dir)
+	if err != nil {
+		return 0, err
+	}
+	available := int64(free)
+	for _, r := range space_reservations {
+		if r.staging == dir {
+			available -= r.size
+		}
+	}
+	return available, nil
+}
+
+/**
+ * Warn when the staging directory is low on space, as for a disk.
+ */
+func staging_check() {
+	dir := settings().staging_dir
+	if dir == "" {
+		return
+	}
+	total, _, err := disk_statfs(dir)
+	if err != nil {
+		log.Printf("could not statfs '%s': %v", dir, err)
+		return
+	}
+	space_mutex.Lock()
+	available, err := staging_available(dir)
+	space_mutex.Unlock()
+	if err != nil {
+		log.Printf("could not statfs '%s': %v", dir, err)
+		return
+	}
+	low := space_below(available, int64(total), KFS_DISK_LOW_BYTES, KFS_DISK_LOW_PERCENT)
+	space_update(dir, available, int64(total), low)
+}
+
+/**
+ * Reserve room for the upload in the staging directory, returning the
+ * directory, which space_release gives the room back to.
+ */
+func staging_reserve(hash string, algo string, size int64) (string, error) {
+	dir := settings().staging_dir
+	space_mutex.Lock()
+	defer space_mutex.Unlock()
+	available, err := staging_available(dir)
+	if err != nil {
+		return "", fmt.Errorf("could not statfs '%s': %v", dir, err)
+	}
+	if available < size {
+		return "", fmt.Errorf(
+			"not enough space to stage %s, %s available in '%s'",
+			format_bytes(size),
+			format_bytes(available),
+			dir,
+		)
+	}
+	key := hash + "." + algo
+	r := space_reservations[key]
+	r.size = size
+	r.mode = STAGING_IN_DIR
+	r.staging = dir
+	space_reservations[key] = r
+	return dir, nil
+}
@@ -0,0 +1,736 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+/**
+ * Standby copies of each node's database on its peers. The catalog is
+ * already sent to every node as it changes, but a node's database also
+ * holds where its replicas are, in files, and without that the blobs on
+ * its disks cannot be found. So each node streams the changes to files to
+ * its peers as they are made: a trigger notes every row that changes in
+ * files_log, and every KFS_DB_STREAM_INTERVAL the rows noted since a peer
+ * was last sent to are sent to it, as they are now, and the peer writes
+ * them into its copy. The copy starts as a consistent snapshot of the whole
+ * database, which is shipped again every KFS_DB_SHIP_INTERVAL, and whenever
+ * a peer has none, and which brings along the tables that change rarely,
+ * e.g. the disks. A node that starts without a database, e.g. because the
+ * disk holding db.sqlite3 died, restores it from the newest copy a peer
+ * has, which is behind by no more than the changes of the last
+ * KFS_DB_STREAM_INTERVAL, while the peer was reachable.
+ *
+ * A peer only keeps a copy of the node it is signed as coming from, and
+ * only when it arrives from the address that node is polled at, so one
+ * node cannot replace another's standby.
+ */
+
+var (
+	KFS_DB_STREAM_INTERVAL = time.Second
+	KFS_DB_SHIP_INTERVAL   = time.Hour
+
+	// changes to files sent to a peer at once
+	KFS_DB_STREAM_BATCH = 1000
+)
+
+// where the copies of other nodes' databases are kept
+var KFS_DB_STANDBY_DIR = "/home/kyle/.kfs/db/standby"
+
+/**
+ * Write a consistent copy of the database to path. VACUUM INTO only reads
+ * from the database, so writers carry on while it runs.
+ */
+func db_snapshot(path string) error {
+	os.Remove(path)
+	if _, err := db.Exec(`VACUUM INTO ?`, path); err != nil {
+		return fmt.Errorf("could not snapshot database: %v", err)
+	}
+	return nil
+}
+
+/**
+ * Check that the request came from the address of the node it is signed
+ * as. Every node holds the cluster secret, so any of them can sign as any
+ * other, but only the node itself connects from the host it is polled at.
+ */
+func cluster_check_node_addr(request *http.Request, node string) error {
+	base_url, err := db_get_node_url(node)
+	if err != nil {
+		return err
+	}
+	u, err := url.Parse(base_url)
+	if err != nil {
+		return err
+	}
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return err
+	}
+	remote := net.ParseIP(host)
+	addrs, err := net.LookupHost(u.Hostname())
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil && ip.Equal(remote) {
+			return nil
+		}
+	}
+	return fmt.Errorf("node '%s' is at %v, not %s", node, addrs, host)
+}
+
+func standby_path(node string) string {
+	return filepath.Join(KFS_DB_STANDBY_DIR, filepath.Base(node)+".sqlite3")
+}
+
+func standby_loop() {
+	if !cluster_enabled() {
+		return
+	}
+	last_ship := time.Now()
+	for {
+		time.Sleep(KFS_DB_STREAM_INTERVAL)
+		if time.Since(last_ship) >= KFS_DB_SHIP_INTERVAL {
+			last_ship = time.Now()
+			standby_ship(KFS_CLUSTER_PEERS)
+		}
+		var behind []string
+		for _, base_url := range KFS_CLUSTER_PEERS {
+			if err := standby_stream(base_url); err == errStandbyNoCopy {
+				behind = append(behind, base_url)
+			} else if err != nil {
+				log.Printf("could not stream database changes to '%s': %v", base_url, err)
+			}
+		}
+		if len(behind) > 0 {
+			standby_ship(behind)
+		}
+		if err := db_trim_files_log(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+/**
+ * Ship a snapshot to each of the peers, and carry on streaming to each from
+ * the last change in it.
+ */
+func standby_ship(peers []string) {
+	snapshot := KFS_DB_PATH + ".ship"
+	if err := db_snapshot(snapshot); err != nil {
+		log.Println(err)
+		return
+	}
+	defer os.Remove(snapshot)
+	seq, err := standby_snapshot_seq(snapshot)
+	if err != nil {
+		log.Printf("could not read snapshot: %v", err)
+		return
+	}
+
+	for _, base_url := range peers {
+		if err := standby_push(base_url, snapshot); err != nil {
+			log.Printf("could not ship database to '%s': %v", base_url, err)
+			continue
+		}
+		if err := db_set_standby_seq(base_url, seq); err != nil {
+			log.Println(err)
+			continue
+		}
+		metric_set(
+			"kfs_db_ship_last_success_timestamp_seconds",
+			"When the database was last shipped to the peer.",
+			fmt.Sprintf("peer=%q", base_url),
+			float64(time.Now().Unix()),
+		)
+	}
+}
+
+/**
+ * The last change to files that is in the snapshot.
+ */
+func standby_snapshot_seq(snapshot string) (int64, error) {
+	copy_db, err := sql.Open("sqlite3", "file:"+snapshot+"?mode=ro")
+	if err != nil {
+		return 0, err
+	}
+	defer copy_db.Close()
+	return db_files_log_seq(copy_db)
+}
+
+/**
+ * The last change to files logged. Trimmed changes still count, so this
+ * is not max(seq).
+ */
+func db_files_log_seq(from *sql.DB) (int64, error) {
+	var seq int64
+	err := from.QueryRow(
+		`select coalesce(max(seq), 0) from sqlite_sequence where name = 'files_log'`,
+	).Scan(&seq)
+	return seq, err
+}
+
+func standby_push(base_url string, snapshot string) error {
+	f, err := os.Open(snapshot)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	request, err := cluster_request(
+		context.Background(),
+		http.MethodPut,
+		base_url+"/cluster/db",
+		f,
+	)
+	if err != nil {
+		return err
+	}
+	request.ContentLength = info.Size()
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusCreated {
+		return fmt.Errorf("got status %d", response.StatusCode)
+	}
+	return nil
+}
+
+/**
+ * The rows of files with one key, as they are now, and none when they are
+ * gone.
+ */
+type standby_change struct {
+	Hash     string             `json:"hash"`
+	HashAlgo string             `json:"hash_algo"`
+	Node     string             `json:"node"`
+	Root     string             `json:"root"`
+	Rows     []standby_file_row `json:"rows"`
+}
+
+type standby_file_row struct {
+	Path       *string `json:"path"`
+	Filename   *string `json:"filename"`
+	Extension  *string `json:"extension"`
+	Size       *int64  `json:"size"`
+	CreatedAt  *int64  `json:"created_at"`
+	VerifiedAt *int64  `json:"verified_at"`
+	VerifyOK   *int64  `json:"verify_ok"`
+	Pending    int64   `json:"pending"`
+}
+
+var errStandbyNoCopy = errors.New("peer has no copy of this node's database")
+
+func db_get_standby_seq(base_url string) (int64, bool, error) {
+	var seq int64
+	err := db.QueryRow(`select seq from standby_cursors where peer = ?`, base_url).Scan(&seq)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return seq, err == nil, err
+}
+
+func db_set_standby_seq(base_url string, seq int64) error {
+	_, err := db_exec(
+		`insert or replace into standby_cursors(peer, seq) values(?, ?)`,
+		base_url,
+		seq,
+	)
+	if err != nil {
+		return fmt.Errorf("could not record what '%s' has: %v", base_url, err)
+	}
+	return nil
+}
+
+/**
+ * The keys of files changed after seq, each once, with their rows as they
+ * are now, and the last change they cover.
+ */
+func db_list_files_changes(after int64, limit int) ([]standby_change, int64, error) {
+	rows, err := db.Query(
+		`
+		select seq, hash, hash_algo, node, storage_root from files_log
+		where seq > ?
+		order by seq
+		limit ?
+		`,
+		after,
+		limit,
+	)
+	if err != nil {
+		return nil, after, fmt.Errorf("could not list changes to files: %v", err)
+	}
+	type key struct{ hash, algo, node, root string }
+	last := after
+	seen := map[key]bool{}
+	var changes []standby_change
+	for rows.Next() {
+		var change standby_change
+		if err := rows.Scan(&last, &change.Hash, &change.HashAlgo, &change.Node, &change.Root); err != nil {
+			rows.Close()
+			return nil, after, err
+		}
+		k := key{change.Hash, change.HashAlgo, change.Node, change.Root}
+		if !seen[k] {
+			seen[k] = true
+			changes = append(changes, change)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, after, err
+	}
+
+	for i := range changes {
+		change := &changes[i]
+		rows, err := db.Query(
+			`
+			select path, filename, extension, size, created_at,
+				verified_at, verify_ok, pending
+			from files
+			where hash = ? and hash_algo = ? and node = ? and storage_root = ?
+			`,
+			change.Hash,
+			change.HashAlgo,
+			change.Node,
+			change.Root,
+		)
+		if err != nil {
+			return nil, after, err
+		}
+		for rows.Next() {
+			var row standby_file_row
+			err := rows.Scan(
+				&row.Path,
+				&row.Filename,
+				&row.Extension,
+				&row.Size,
+				&row.CreatedAt,
+				&row.VerifiedAt,
+				&row.VerifyOK,
+				&row.Pending,
+			)
+			if err != nil {
+				rows.Close()
+				return nil, after, err
+			}
+			change.Rows = append(change.Rows, row)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, after, err
+		}
+	}
+	return changes, last, nil
+}
+
+/**
+ * Send the peer the changes to files it does not have yet, batch by batch.
+ * Returns errStandbyNoCopy when it needs a snapshot first.
+ */
+func standby_stream(base_url string) error {
+	after, ok, err := db_get_standby_seq(base_url)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errStandbyNoCopy
+	}
+	for {
+		changes, last, err := db_list_files_changes(after, KFS_DB_STREAM_BATCH)
+		if err != nil {
+			return err
+		}
+		if last == after {
+			break
+		}
+		body, err := json.Marshal(changes)
+		if err != nil {
+			return err
+		}
+		request, err := cluster_request(
+			context.Background(),
+			http.MethodPost,
+			base_url+"/cluster/db/changes",
+			bytes.NewReader(body),
+		)
+		if err != nil {
+			return err
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return err
+		}
+		response.Body.Close()
+		if response.StatusCode == http.StatusConflict {
+			return errStandbyNoCopy
+		}
+		if response.StatusCode != http.StatusNoContent {
+			return fmt.Errorf("got status %d", response.StatusCode)
+		}
+		if err := db_set_standby_seq(base_url, last); err != nil {
+			return err
+		}
+		after = last
+	}
+	if latest, err := db_files_log_seq(db); err == nil {
+		metric_set(
+			"kfs_db_stream_behind",
+			"Changes to files not yet sent to the peer.",
+			fmt.Sprintf("peer=%q", base_url),
+			float64(latest-after),
+		)
+	}
+	return nil
+}
+
+/**
+ * Forget the changes every peer has been sent. While a peer has never had
+ * a snapshot, nothing is forgotten, since it is sent one anyway.
+ */
+func db_trim_files_log() error {
+	var oldest int64 = -1
+	for _, base_url := range KFS_CLUSTER_PEERS {
+		seq, ok, err := db_get_standby_seq(base_url)
+		if err != nil || !ok {
+			return err
+		}
+		if oldest < 0 || seq < oldest {
+			oldest = seq
+		}
+	}
+	if oldest <= 0 {
+		return nil
+	}
+	if _, err := db_exec(`delete from files_log where seq <= ?`, oldest); err != nil {
+		return fmt.Errorf("could not trim files log: %v", err)
+	}
+	return nil
+}
+
+var (
+	standby_mutex = &sync.Mutex{}
+	standby_locks = map[string]*sync.Mutex{}
+)
+
+/**
+ * Held while a node's copy is replaced or written to.
+ */
+func standby_lock(node string) *sync.Mutex {
+	standby_mutex.Lock()
+	defer standby_mutex.Unlock()
+	lock, ok := standby_locks[node]
+	if !ok {
+		lock = &sync.Mutex{}
+		standby_locks[node] = lock
+	}
+	return lock
+}
+
+/**
+ * The node a request to store a copy comes from, or "" once it has been
+ * turned away.
+ */
+func standby_request_node(writer http.ResponseWriter, request *http.Request) string {
+	node := request.Header.Get(KFS_CLUSTER_HEADER)
+	if node == "" || node != filepath.Base(node) || node == KFS_NODE_NAME {
+		write_error(writer, "invalid node name", http.StatusBadRequest)
+		return ""
+	}
+	if err := cluster_check_node_addr(request, node); err != nil {
+		log.Printf("refused database from %s: %v", request.RemoteAddr, err)
+		write_error(writer, "forbidden", http.StatusForbidden)
+		return ""
+	}
+	return node
+}
+
+/**
+ * Write changes to files another node streamed into its copy. Answers 409
+ * when there is no copy yet, for the node to ship a snapshot.
+ */
+func handle_cluster_db_changes(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	node := standby_request_node(writer, request)
+	if node == "" {
+		return
+	}
+	var changes []standby_change
+	if err := json.NewDecoder(request.Body).Decode(&changes); err != nil {
+		write_error(writer, "invalid changes", http.StatusBadRequest)
+		return
+	}
+	if _, err := io.Copy(io.Discard, request.Body); err != nil {
+		write_error(writer, "invalid changes", http.StatusBadRequest)
+		return
+	}
+
+	lock := standby_lock(node)
+	lock.Lock()
+	defer lock.Unlock()
+	path := standby_path(node)
+	if _, err := os.Stat(path); err != nil {
+		write_error(writer, "no copy of that node", http.StatusConflict)
+		return
+	}
+	if err := standby_apply(path, changes); err != nil {
+		log.Printf("could not apply database changes from '%s': %v", node, err)
+		write_error(writer, "could not apply changes", http.StatusInternalServerError)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+/**
+ * Make the rows of each key in the copy match the change, in one
+ * transaction. The copy's own trigger notes each row in its files_log,
+ * which is not what the node logged, so those notes are dropped again.
+ */
+func standby_apply(path string, changes []standby_change) error {
+	copy_db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_busy_timeout=5000&_txlock=immediate", path))
+	if err != nil {
+		return err
+	}
+	defer copy_db.Close()
+	tx, err := copy_db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var logged int64
+	if err := tx.QueryRow(`select coalesce(max(seq), 0) from files_log`).Scan(&logged); err != nil {
+		return err
+	}
+	for _, change := range changes {
+		_, err := tx.Exec(
+			`
+			delete from files
+			where hash = ? and hash_algo = ? and node = ? and storage_root = ?
+			`,
+			change.Hash,
+			change.HashAlgo,
+			change.Node,
+			change.Root,
+		)
+		if err != nil {
+			return err
+		}
+		for _, row := range change.Rows {
+			_, err := tx.Exec(
+				`
+				insert into files(
+					hash, hash_algo, node, storage_root, path, filename,
+					extension, size, created_at, verified_at, verify_ok,
+					pending
+				) values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+				`,
+				change.Hash,
+				change.HashAlgo,
+				change.Node,
+				change.Root,
+				row.Path,
+				row.Filename,
+				row.Extension,
+				row.Size,
+				row.CreatedAt,
+				row.VerifiedAt,
+				row.VerifyOK,
+				row.Pending,
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := tx.Exec(`delete from files_log where seq > ?`, logged); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+/**
+ * Keep the snapshot another node shipped, replacing the one before it only
+ * once the new one has arrived in full.
+ */
+func handle_cluster_put_db(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	node := standby_request_node(writer, request)
+	if node == "" {
+		return
+	}
+	if err := os.MkdirAll(KFS_DB_STANDBY_DIR, 0755); err != nil {
+		log.Println(err)
+		write_error(writer, "could not store snapshot", http.StatusInternalServerError)
+		return
+	}
+	path := standby_path(node)
+	outf, err := os.Create(path + ".tmp")
+	if err != nil {
+		log.Println(err)
+		write_error(writer, "could not store snapshot", http.StatusInternalServerError)
+		return
+	}
+	_, err = io.Copy(outf, request.Body)
+	outf.Close()
+	if err == nil {
+		lock := standby_lock(node)
+		lock.Lock()
+		err = os.Rename(path+".tmp", path)
+		lock.Unlock()
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		log.Printf("could not store snapshot from '%s': %v", node, err)
+		write_error(writer, "could not store snapshot", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("stored database snapshot from '%s'", node)
+	writer.WriteHeader(http.StatusCreated)
+}
+
+func handle_cluster_get_db(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	node := p.ByName("node")
+	f, err := os.Open(standby_path(node))
+	if err != nil {
+		write_error(writer, "no snapshot of that node", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		write_error(writer, "no snapshot of that node", http.StatusNotFound)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/vnd.sqlite3")
+	http.ServeContent(writer, request, "", info.ModTime(), f)
+}
+
+/**
+ * Restore this node's database from a peer, if it does not have one. This
+ * has to run before db_init, which would otherwise create an empty one.
+ */
+func standby_restore() {
+	if !cluster_enabled() {
+		return
+	}
+	if _, err := os.Stat(KFS_DB_PATH); err == nil {
+		return
+	}
+
+	var newest time.Time
+	var newest_url string
+	for _, base_url := range KFS_CLUSTER_PEERS {
+		modified, err := standby_fetch(base_url, http.MethodHead, "")
+		if err != nil {
+			log.Printf("no database snapshot on '%s': %v", base_url, err)
+			continue
+		}
+		if modified.After(newest) {
+			newest, newest_url = modified, base_url
+		}
+	}
+	if newest_url == "" {
+		log.Printf("no peer has a snapshot of this node's database")
+		return
+	}
+	if _, err := standby_fetch(newest_url, http.MethodGet, KFS_DB_PATH); err != nil {
+		panic(fmt.Errorf("could not restore database from '%s': %v", newest_url, err))
+	}
+	log.Printf("restored database from '%s', as of %v", newest_url, newest)
+
+	// what the peers were sent is not known any more, so each is sent a
+	// snapshot again
+	restored, err := sql.Open("sqlite3", "file:"+KFS_DB_PATH)
+	if err != nil {
+		panic(fmt.Errorf("could not open restored database: %v", err))
+	}
+	defer restored.Close()
+	if _, err := restored.Exec(`delete from standby_cursors`); err != nil {
+		log.Printf("could not reset standby cursors: %v", err)
+	}
+}
+
+/**
+ * Ask the peer for its snapshot of this node's database, writing it to dst
+ * when it is a GET. Returns when the snapshot was taken.
+ */
+func standby_fetch(base_url string, method string, dst string) (time.Time, error) {
+	request, err := cluster_request(
+		context.Background(),
+		method,
+		base_url+"/cluster/db/"+KFS_NODE_NAME,
+		nil,
+	)
+	if err != nil {
+		return time.Time{}, err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return time.Time{}, fmt.Errorf("got status %d", response.StatusCode)
+	}
+	modified, err := http.ParseTime(response.Header.Get("Last-Modified"))
+	if err != nil {
+		return time.Time{}, err
+	}
+	if method != http.MethodGet {
+		return modified, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return time.Time{}, err
+	}
+	outf, err := os.Create(dst + ".tmp")
+	if err != nil {
+		return time.Time{}, err
+	}
+	_, err = io.Copy(outf, response.Body)
+	outf.Close()
+	if err == nil {
+		err = os.Rename(dst+".tmp", dst)
+	}
+	if err != nil {
+		os.Remove(dst + ".tmp")
+		return time.Time{}, err
+	}
+	return modified, nil
+}
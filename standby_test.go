@@ -0,0 +1,112 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+func TestStandbyStreamChanges(t *testing.T) {
+	disks := test_db(t, 1, 1000)
+	copy_path := filepath.Join(t.TempDir(), "copy.sqlite3")
+	if err := db_snapshot(copy_path); err != nil {
+		t.Fatal(err)
+	}
+	after, err := standby_snapshot_seq(copy_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes := []string{
+		`insert into files(hash, hash_algo, storage_root, path, filename, size, node)
+			values('kept', 'blake2b', ?1, '/', 'a', 1, '')`,
+		`insert into files(hash, hash_algo, storage_root, path, filename, size, node)
+			values('moved', 'blake2b', ?1, '/', 'b', 1, '')`,
+		`insert into files(hash, hash_algo, storage_root, path, filename, size, node)
+			values('gone', 'blake2b', ?1, '/', 'c', 1, '')`,
+		`update files set storage_root = '/elsewhere' where hash = 'moved'`,
+		`update files set verify_ok = 1, verified_at = 5 where hash = 'kept'`,
+		`delete from files where hash = 'gone'`,
+	}
+	for i, change := range changes {
+		if _, err := db_exec(change, disks[0]); err != nil {
+			t.Fatal(err)
+		}
+		// sent in two goes, to check the cursor carries over
+		if i != 2 && i != len(changes)-1 {
+			continue
+		}
+		streamed, last, err := db_list_files_changes(after, KFS_DB_STREAM_BATCH)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := standby_apply(copy_path, streamed); err != nil {
+			t.Fatal(err)
+		}
+		after = last
+	}
+
+	want := test_files_rows(t, db)
+	copy_db, err := sql.Open("sqlite3", "file:"+copy_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer copy_db.Close()
+	got := test_files_rows(t, copy_db)
+	if len(got) != len(want) {
+		t.Fatalf("copy has %v, want %v", got, want)
+	}
+	for row := range want {
+		if !got[row] {
+			t.Errorf("copy is missing %s", row)
+		}
+	}
+	var logged int
+	if err := copy_db.QueryRow(`select count(*) from files_log`).Scan(&logged); err != nil {
+		t.Fatal(err)
+	}
+	if logged != 0 {
+		t.Errorf("applying changes logged %d of its own", logged)
+	}
+}
+
+func test_files_rows(t *testing.T, from *sql.DB) map[string]bool {
+	t.Helper()
+	rows, err := from.Query(
+		`
+		select hash || ' ' || storage_root || ' ' || filename || ' ' ||
+			coalesce(verify_ok, '-') || ' ' || coalesce(verified_at, '-')
+		from files
+		`,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	found := map[string]bool{}
+	for rows.Next() {
+		var row string
+		if err := rows.Scan(&row); err != nil {
+			t.Fatal(err)
+		}
+		found[row] = true
+	}
+	return found
+}
@@ -0,0 +1,230 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+/**
+ * How much is stored, and how much space dedup saves. Logical bytes are
+ * what was uploaded, counting every catalog entry. Unique bytes count each
+ * blob once, and physical bytes count every replica of it, so
+ *     logical / unique is what dedup saves
+ *     physical / unique is what redundancy costs
+ */
+
+// how many days of ingest /stats reports by default
+var KFS_STATS_DAYS = 30
+
+type usage_stats struct {
+	Files         int64   `json:"files"`
+	Blobs         int64   `json:"blobs"`
+	LogicalBytes  int64   `json:"logical_bytes"`
+	UniqueBytes   int64   `json:"unique_bytes"`
+	PhysicalBytes int64   `json:"physical_bytes,omitempty"`
+	DedupSaved    int64   `json:"dedup_saved_bytes"`
+	DedupRatio    float64 `json:"dedup_ratio"`
+}
+
+type ingest_day struct {
+	Day          string `json:"day"`
+	Files        int64  `json:"files"`
+	LogicalBytes int64  `json:"logical_bytes"`
+	UniqueBytes  int64  `json:"unique_bytes"`
+}
+
+type stats_response struct {
+	usage_stats
+	RedundancyRatio float64                `json:"redundancy_ratio"`
+	Namespaces      map[string]usage_stats `json:"namespaces"`
+	Ingest          []ingest_day           `json:"ingest"`
+	Disks           []disk_usage           `json:"disks"`
+}
+
+func (s *usage_stats) finish() {
+	s.DedupSaved = s.LogicalBytes - s.UniqueBytes
+	if s.UniqueBytes > 0 {
+		s.DedupRatio = float64(s.LogicalBytes) / float64(s.UniqueBytes)
+	}
+}
+
+/**
+ * Totals over everything stored.
+ */
+func db_get_usage() (usage_stats, error) {
+	var usage usage_stats
+	query := `
+		select
+			(select count(*) from catalog),
+			(select coalesce(sum(size), 0) from catalog),
+			(select count(*) from blobs),
+			(
+				select coalesce(sum(size), 0)
+				from (
+					select max(coalesce(size, 0)) as size
+					from files
+					group by hash, hash_algo
+				)
+			),
+			(select coalesce(sum(size), 0) from files)
+	`
+	err := db.QueryRow(query).Scan(
+		&usage.Files,
+		&usage.LogicalBytes,
+		&usage.Blobs,
+		&usage.UniqueBytes,
+		&usage.PhysicalBytes,
+	)
+	if err != nil {
+		return usage, fmt.Errorf("could not total usage: %v", err)
+	}
+	usage.finish()
+	return usage, nil
+}
+
+func db_get_stats(days int) (stats_response, error) {
+	var stats stats_response
+	var err error
+	if stats.usage_stats, err = db_get_usage(); err != nil {
+		return stats, err
+	}
+	if stats.UniqueBytes > 0 {
+		stats.RedundancyRatio = float64(stats.PhysicalBytes) / float64(stats.UniqueBytes)
+	}
+
+	stats.Namespaces = map[string]usage_stats{}
+	query := `
+		select
+			namespace,
+			count(*),
+			sum(size),
+			count(distinct hash),
+			(
+				select coalesce(sum(size), 0)
+				from (
+					select max(size) as size
+					from catalog as c
+					where c.namespace = catalog.namespace
+					group by hash, hash_algo
+				)
+			)
+		from catalog
+		group by namespace
+		order by namespace
+	`
+	rows, err := db.Query(query)
+	if err != nil {
+		return stats, fmt.Errorf("could not total namespaces: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var namespace string
+		var ns usage_stats
+		err := rows.Scan(
+			&namespace,
+			&ns.Files,
+			&ns.LogicalBytes,
+			&ns.Blobs,
+			&ns.UniqueBytes,
+		)
+		if err != nil {
+			return stats, err
+		}
+		ns.finish()
+		stats.Namespaces[namespace] = ns
+	}
+	if err := rows.Err(); err != nil {
+		return stats, err
+	}
+
+	/*
+	 * A blob's unique bytes count on the day its first entry was made, so
+	 * a day of re-uploads shows many logical bytes but few unique ones.
+	 */
+	since := time.Now().AddDate(0, 0, -days).Unix()
+	query = `
+		select
+			date(created_at, 'unixepoch') as day,
+			count(*),
+			sum(size),
+			sum(case when first then size else 0 end)
+		from (
+			select
+				created_at,
+				size,
+				row_number() over (
+					partition by hash, hash_algo
+					order by created_at, id
+				) = 1 as first
+			from catalog
+		)
+		where created_at >= ?
+		group by day
+		order by day
+	`
+	day_rows, err := db.Query(query, since)
+	if err != nil {
+		return stats, fmt.Errorf("could not total ingest: %v", err)
+	}
+	defer day_rows.Close()
+	stats.Ingest = []ingest_day{}
+	for day_rows.Next() {
+		var day ingest_day
+		err := day_rows.Scan(&day.Day, &day.Files, &day.LogicalBytes, &day.UniqueBytes)
+		if err != nil {
+			return stats, err
+		}
+		stats.Ingest = append(stats.Ingest, day)
+	}
+	return stats, day_rows.Err()
+}
+
+/**
+ * Report usage and dedup savings, overall and per namespace, with the
+ * daily ingest of the last ?days=30 days, and the space and SMART health of
+ * each disk.
+ */
+func handle_stats(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	days := KFS_STATS_DAYS
+	if s := request.URL.Query().Get("days"); s != "" {
+		var err error
+		if days, err = strconv.Atoi(s); err != nil || days < 1 {
+			write_error(writer, "invalid days", http.StatusBadRequest)
+			return
+		}
+	}
+	stats, err := db_get_stats(days)
+	if err != nil {
+		log.Println(err)
+		write_error(writer, "could not get stats", http.StatusInternalServerError)
+		return
+	}
+	if stats.Disks, err = db_list_disks(); err != nil {
+		log.Println(err)
+		write_error(writer, "could not list disks", http.StatusInternalServerError)
+		return
+	}
+	write_json(writer, http.StatusOK, stats)
+}
@@ -0,0 +1,328 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+/**
+ * Usage over time, rolled up once an hour, so that charts of it need
+ * nothing but kfs, e.g.
+ *     curl 'localhost:8080/stats/history?from=1700000000&to=1700600000'
+ * Each hour has the totals as they were at its end, what was ingested
+ * during it, and how much each disk held. from and to are unix times, and
+ * default to the last week. Hours older than KFS_STATS_HISTORY_DAYS are
+ * dropped.
+ */
+
+var (
+	KFS_STATS_HISTORY_DAYS    = 400
+	KFS_STATS_HISTORY_DEFAULT = 7 * 24 * time.Hour
+)
+
+type stats_hour struct {
+	Time               int64 `json:"time"`
+	Files              int64 `json:"files"`
+	Blobs              int64 `json:"blobs"`
+	LogicalBytes       int64 `json:"logical_bytes"`
+	UniqueBytes        int64 `json:"unique_bytes"`
+	PhysicalBytes      int64 `json:"physical_bytes"`
+	DedupSaved         int64 `json:"dedup_saved_bytes"`
+	IngestFiles        int64 `json:"ingest_files"`
+	IngestLogicalBytes int64 `json:"ingest_logical_bytes"`
+	IngestUniqueBytes  int64 `json:"ingest_unique_bytes"`
+}
+
+type disk_stats_hour struct {
+	Time        int64  `json:"time"`
+	Root        string `json:"root"`
+	StoredBytes int64  `json:"stored_bytes"`
+	Available   int64  `json:"available"`
+	Total       int64  `json:"total"`
+}
+
+type stats_history struct {
+	From  int64             `json:"from"`
+	To    int64             `json:"to"`
+	Hours []stats_hour      `json:"hours"`
+	Disks []disk_stats_hour `json:"disks"`
+}
+
+/**
+ * What was ingested from start until end. As in /stats, a blob's unique
+ * bytes count with its first entry.
+ */
+func db_get_ingest(start int64, end int64, hour *stats_hour) error {
+	query := `
+		select
+			count(*),
+			coalesce(sum(size), 0),
+			coalesce(sum(
+				case when exists(
+					select 1 from catalog as c
+					where c.hash = catalog.hash
+						and c.hash_algo = catalog.hash_algo
+						and (
+							c.created_at < catalog.created_at
+							or (c.created_at = catalog.created_at and c.id < catalog.id)
+						)
+				) then 0 else size end
+			), 0)
+		from catalog
+		where created_at >= ? and created_at < ?
+	`
+	return db.QueryRow(query, start, end).Scan(
+		&hour.IngestFiles,
+		&hour.IngestLogicalBytes,
+		&hour.IngestUniqueBytes,
+	)
+}
+
+/**
+ * Bytes of replicas on each local disk.
+ */
+func db_get_stored_bytes() (map[string]int64, error) {
+	rows, err := db.Query(`
+		select storage_root, coalesce(sum(size), 0) from files
+		where node = ''
+		group by storage_root
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	stored := map[string]int64{}
+	for rows.Next() {
+		var root string
+		var n int64
+		if err := rows.Scan(&root, &n); err != nil {
+			return nil, err
+		}
+		stored[root] = n
+	}
+	return stored, rows.Err()
+}
+
+/**
+ * Record the hour that starts at start, and drop hours that are too old
+ * to keep.
+ */
+func stats_rollup(start time.Time) error {
+	hour := stats_hour{Time: start.Unix()}
+	usage, err := db_get_usage()
+	if err != nil {
+		return err
+	}
+	hour.Files = usage.Files
+	hour.Blobs = usage.Blobs
+	hour.LogicalBytes = usage.LogicalBytes
+	hour.UniqueBytes = usage.UniqueBytes
+	hour.PhysicalBytes = usage.PhysicalBytes
+	hour.DedupSaved = usage.DedupSaved
+	if err := db_get_ingest(hour.Time, start.Add(time.Hour).Unix(), &hour); err != nil {
+		return fmt.Errorf("could not total ingest: %v", err)
+	}
+	disks, err := db_list_disks()
+	if err != nil {
+		return err
+	}
+	stored, err := db_get_stored_bytes()
+	if err != nil {
+		return fmt.Errorf("could not total disks: %v", err)
+	}
+
+	oldest := start.AddDate(0, 0, -KFS_STATS_HISTORY_DAYS).Unix()
+	return db_transaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			`
+			INSERT OR REPLACE INTO stats_hourly(
+				hour,
+				files,
+				blobs,
+				logical_bytes,
+				unique_bytes,
+				physical_bytes,
+				ingest_files,
+				ingest_logical_bytes,
+				ingest_unique_bytes
+			) values(?, ?, ?, ?, ?, ?, ?, ?, ?)
+			`,
+			hour.Time,
+			hour.Files,
+			hour.Blobs,
+			hour.LogicalBytes,
+			hour.UniqueBytes,
+			hour.PhysicalBytes,
+			hour.IngestFiles,
+			hour.IngestLogicalBytes,
+			hour.IngestUniqueBytes,
+		)
+		if err != nil {
+			return err
+		}
+		for _, disk := range disks {
+			_, err := tx.Exec(
+				`
+				INSERT OR REPLACE INTO disk_stats_hourly(
+					hour,
+					root,
+					stored_bytes,
+					available,
+					total
+				) values(?, ?, ?, ?, ?)
+				`,
+				hour.Time,
+				disk.Root,
+				stored[disk.Root],
+				disk.Available,
+				disk.Total,
+			)
+			if err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec(`delete from stats_hourly where hour < ?`, oldest); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`delete from disk_stats_hourly where hour < ?`, oldest)
+		return err
+	})
+}
+
+func db_get_stats_history(from int64, to int64) (stats_history, error) {
+	history := stats_history{From: from, To: to, Hours: []stats_hour{}, Disks: []disk_stats_hour{}}
+	rows, err := db.Query(
+		`
+		select
+			hour,
+			files,
+			blobs,
+			logical_bytes,
+			unique_bytes,
+			physical_bytes,
+			ingest_files,
+			ingest_logical_bytes,
+			ingest_unique_bytes
+		from stats_hourly
+		where hour >= ? and hour <= ?
+		order by hour
+		`,
+		from,
+		to,
+	)
+	if err != nil {
+		return history, fmt.Errorf("could not get stats history: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hour stats_hour
+		err := rows.Scan(
+			&hour.Time,
+			&hour.Files,
+			&hour.Blobs,
+			&hour.LogicalBytes,
+			&hour.UniqueBytes,
+			&hour.PhysicalBytes,
+			&hour.IngestFiles,
+			&hour.IngestLogicalBytes,
+			&hour.IngestUniqueBytes,
+		)
+		if err != nil {
+			return history, err
+		}
+		hour.DedupSaved = hour.LogicalBytes - hour.UniqueBytes
+		history.Hours = append(history.Hours, hour)
+	}
+	if err := rows.Err(); err != nil {
+		return history, err
+	}
+
+	disk_rows, err := db.Query(
+		`
+		select hour, root, stored_bytes, available, total
+		from disk_stats_hourly
+		where hour >= ? and hour <= ?
+		order by hour, root
+		`,
+		from,
+		to,
+	)
+	if err != nil {
+		return history, fmt.Errorf("could not get disk history: %v", err)
+	}
+	defer disk_rows.Close()
+	for disk_rows.Next() {
+		var disk disk_stats_hour
+		err := disk_rows.Scan(&disk.Time, &disk.Root, &disk.StoredBytes, &disk.Available, &disk.Total)
+		if err != nil {
+			return history, err
+		}
+		history.Disks = append(history.Disks, disk)
+	}
+	return history, disk_rows.Err()
+}
+
+func handle_stats_history(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	query := request.URL.Query()
+	to := time.Now().Unix()
+	if s := query.Get("to"); s != "" {
+		var err error
+		if to, err = strconv.ParseInt(s, 10, 64); err != nil {
+			write_error(writer, "invalid to", http.StatusBadRequest)
+			return
+		}
+	}
+	from := to - int64(KFS_STATS_HISTORY_DEFAULT.Seconds())
+	if s := query.Get("from"); s != "" {
+		var err error
+		if from, err = strconv.ParseInt(s, 10, 64); err != nil || from > to {
+			write_error(writer, "invalid from", http.StatusBadRequest)
+			return
+		}
+	}
+	history, err := db_get_stats_history(from, to)
+	if err != nil {
+		log.Println(err)
+		write_error(writer, "could not get stats history", http.StatusInternalServerError)
+		return
+	}
+	write_json(writer, http.StatusOK, history)
+}
+
+/**
+ * Roll up each hour once it is over, starting with the one before the
+ * server started.
+ */
+func stats_loop() {
+	for {
+		now := time.Now()
+		start := now.Truncate(time.Hour).Add(-time.Hour)
+		if err := stats_rollup(start); err != nil {
+			log.Printf("could not roll up stats: %v", err)
+		}
+		time.Sleep(time.Until(now.Truncate(time.Hour).Add(time.Hour)))
+	}
+}
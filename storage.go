@@ -18,13 +18,18 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	uuid "github.com/satori/go.uuid"
 )
@@ -37,48 +42,500 @@ func get_output_path(staging_path string, input_filename string) string {
 	return output_path
 }
 
+func get_storage_path(root string) string {
+	return fmt.Sprintf("%s/.kfs/storage/", root)
+}
+
+func get_blob_path(root string, hash string, algo string) string {
+	return filepath.Join(get_storage_path(root), blob_shard(hash), hash+"."+algo)
+}
+
+/**
+ * A reader that stops with the context's error once it is cancelled.
+ */
+type ctx_reader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r *ctx_reader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
+
+// how copy_file copied the data, in logs and metrics
+const (
+	COPY_REFLINK    = "reflink"
+	COPY_FILE_RANGE = "copy_file_range"
+	COPY_STREAM     = "stream"
+)
+
+/**
+ * Copy the file, letting the filesystem do it when it can, and streaming
+ * the data through kfs when it cannot.
+ */
 func copy_file(src string, dst string) error {
-	cmd := exec.Command("cp", src, dst)
-	err := cmd.Run()
+	fault_delay(dst)
+	if err := fault_error(FAULT_COPY_ERROR, dst); err != nil {
+		return err
+	}
+	in, err := os.Open(src)
 	if err != nil {
 		return err
 	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	method, err := copy_fast(out, in, info.Size())
+	if err == nil && method == COPY_STREAM {
+		_, err = io.Copy(out, in)
+	}
+	if err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	log_debug("copied '%s' to '%s' with %s", src, dst, method)
+	labels := fmt.Sprintf("method=%q", method)
+	metric_add("kfs_copies_total", "Files copied, by how they were copied.", labels, 1)
+	metric_add("kfs_copied_bytes_total", "Bytes copied, by how they were copied.", labels, float64(info.Size()))
 	return nil
 }
 
+/**
+ * Command line tool used to compute each supported hash algorithm.
+ * blake2b is the default, and is used when the client does not specify one.
+ * The hash_tools config key points these elsewhere, e.g. at gb2sum from
+ * Homebrew's coreutils on macOS, or at b2sum.exe on Windows.
+ */
+var KFS_HASH_ALGOS = map[string]string{
+	"blake2b": "b2sum",
+	"sha256":  "sha256sum",
+	"blake3":  "b3sum",
+}
+
+const KFS_DEFAULT_HASH_ALGO = "blake2b"
+
+/**
+ * Algorithms whose tool hashes a file on every core. b3sum hashes the
+ * chunks of the BLAKE3 tree in parallel, and gets the same digest as a
+ * single pass would, so the client may compute it either way. One core of
+ * blake2b cannot keep up with a 10GbE link, so GET / tells clients to hash
+ * files of at least KFS_PARALLEL_HASH_MIN_SIZE with one of these.
+ */
+var KFS_PARALLEL_HASH_ALGOS = []string{"blake3"}
+
+var KFS_PARALLEL_HASH_MIN_SIZE int64 = 256 << 20
+
+func parallel_hash_algo(algo string) bool {
+	for _, parallel := range KFS_PARALLEL_HASH_ALGOS {
+		if algo == parallel {
+			return true
+		}
+	}
+	return false
+}
+
+// hard link blobs into storage when staging is on the same filesystem
+var KFS_HARD_LINKS = true
+
+// re-hash each replica once it is written, rather than only check its size
+var KFS_VERIFY_REPLICAS = true
+
+func valid_hash_algo(algo string) bool {
+	_, ok := settings().hash_algos[algo]
+	return ok
+}
+
 func hash_file(filename string) (string, error) {
-	output, err := exec.Command("b2sum", filename).Output()
+	return hash_file_algo(filename, KFS_DEFAULT_HASH_ALGO)
+}
+
+func hash_file_algo(filename string, algo string) (string, error) {
+	return hash_file_ctx(context.Background(), filename, algo)
+}
+
+/**
+ * Hash the file, killing the hash tool if ctx is cancelled first.
+ */
+func hash_file_ctx(ctx context.Context, filename string, algo string) (string, error) {
+	tool, ok := settings().hash_algos[algo]
+	if !ok {
+		return "", fmt.Errorf("unsupported hash algorithm: '%s'", algo)
+	}
+	output, err := exec.CommandContext(ctx, tool, filename).Output()
 	if err != nil {
 		return "", fmt.Errorf("failed to hash '%s': %s", filename, err)
 	}
 
 	output_str := string(output)
-	hash := strings.Fields(output_str)[0]
+	hash := fault_digest(filename, strings.Fields(output_str)[0])
 	log.Printf("hash = %s\n", hash)
 	return hash, nil
 }
 
-func store_file(filename string, hash string, storage_path string) {
+/**
+ * Copy the file to the writer. When verify is set, the bytes are also piped
+ * through the hash tool as they are written, and the resulting digest is
+ * returned once the whole file has been sent.
+ */
+func send_file(writer io.Writer, f *os.File, algo string, verify bool) (string, error) {
+	if !verify {
+		_, err := io.Copy(writer, f)
+		return "", err
+	}
+	return tee_hash(writer, f, algo, f.Name())
+}
+
+/**
+ * Copy the reader to the writer, piping the bytes through the hash tool as
+ * they go, and return the digest. name is only used in errors.
+ */
+func tee_hash(writer io.Writer, reader io.Reader, algo string, name string) (string, error) {
+	tool, ok := settings().hash_algos[algo]
+	if !ok {
+		return "", fmt.Errorf("unsupported hash algorithm: '%s'", algo)
+	}
+	var output bytes.Buffer
+	cmd := exec.Command(tool)
+	cmd.Stdout = &output
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return "", err
+	}
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("failed to start %s: %v", tool, err)
+	}
+
+	_, copy_err := io.Copy(io.MultiWriter(writer, stdin), reader)
+	stdin.Close()
+	wait_err := cmd.Wait()
+	if copy_err != nil {
+		return "", copy_err
+	}
+	if wait_err != nil {
+		return "", fmt.Errorf("failed to hash '%s': %s", name, wait_err)
+	}
+	fields := strings.Fields(output.String())
+	if len(fields) == 0 {
+		return "", fmt.Errorf("no output from %s", tool)
+	}
+	return fault_digest(name, fields[0]), nil
+}
+
+/**
+ * The replica on the disk of the same content stored under another hash
+ * algorithm, found through the secondary digests of either blob, or "" if
+ * the disk has none.
+ */
+func db_find_twin(root string, hash string, algo string) (string, error) {
+	query := `
+		select files.hash, files.hash_algo
+		from digests join files on files.hash = digests.hash
+		where digests.digest = ? and digests.algo = ?
+			and files.hash_algo != ?
+			and files.node = '' and files.storage_root = ?
+			and not files.pending
+		union all
+		select files.hash, files.hash_algo
+		from digests join files
+			on files.hash = digests.digest and files.hash_algo = digests.algo
+		where digests.hash = ? and digests.algo != ?
+			and files.node = '' and files.storage_root = ?
+			and not files.pending
+		limit 1
+	`
+	var twin, twin_algo string
+	err := db.QueryRow(query, hash, algo, algo, root, hash, algo, root).Scan(&twin, &twin_algo)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return get_blob_path(root, twin, twin_algo), nil
+}
+
+/**
+ * Whether the replica's data can also be reached by another name, a staged
+ * copy or a twin, so that removing it gives no space back.
+ */
+func blob_shared(path string) bool {
+	links, err := disk_link_count(path)
+	return err == nil && links > 1
+}
+
+/**
+ * Put the file into the disk's storage directory. If the disk already holds
+ * the blob, nothing is written. If the disk holds the same content under
+ * another hash algorithm, that is used instead of the file, as is the file
+ * when it is staged on the same disk. Either is hard linked, so the data is
+ * neither copied nor stored twice, and when it cannot be, copy_file reflinks
+ * it if the filesystem can. Anything else is copied. Links are never made
+ * between different disks, even if they share a filesystem, since that
+ * would quietly turn two replicas into one.
+ */
+func link_or_copy_file(filename string, root string, hash string, algo string) error {
+	dst, err := make_blob_path(root, hash, algo)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(dst); err == nil {
+		log.Printf("'%s' already exists, not storing again\n", dst)
+		return nil
+	}
+	src := filename
+	same_disk := filepath.Dir(filepath.Dir(filename)) ==
+		filepath.Join(root, ".kfs")
+	if !same_disk {
+		twin, err := db_find_twin(root, hash, algo)
+		if err != nil {
+			log.Printf("could not look for %s under other hashes: %v", hash, err)
+		}
+		if _, err := os.Stat(twin); twin != "" && err == nil {
+			log.Printf("'%s' already holds %s", twin, hash)
+			src = twin
+			same_disk = true
+		}
+	}
+	if KFS_HARD_LINKS && same_disk {
+		err := os.Link(src, dst)
+		if err == nil {
+			log.Printf("linked: '%s' to '%s'\n", src, dst)
+			return nil
+		}
+		log.Printf("could not link '%s', copying instead: %v\n", src, err)
+	}
+	return copy_file(src, dst)
+}
+
+/**
+ * Check the replica just written to the disk: that it is as big as the
+ * blob, and, with KFS_VERIFY_REPLICAS, that it hashes to what it is stored
+ * under, unless the disk checksums its blocks itself. The outcome is
+ * recorded against the replica, as it is when a download is verified.
+ */
+func verify_replica(root string, hash string, algo string, size int64) error {
+	replica := get_blob_path(root, hash, algo)
+	info, err := os.Stat(replica)
+	if err != nil {
+		return err
+	}
+	if info.Size() != size {
+		db_record_verify(hash, algo, root, false)
+		return fmt.Errorf("'%s' is %d bytes, not %d", replica, info.Size(), size)
+	}
+	if !settings().verify_replicas || fs_trusts_checksums(root) {
+		return nil
+	}
+	digest, err := hash_file_algo(replica, algo)
+	if err != nil {
+		return err
+	}
+	db_record_verify(hash, algo, root, digest == hash)
+	if digest != hash {
+		return fmt.Errorf("'%s' is corrupt: hashed to %s", replica, digest)
+	}
+	return nil
+}
+
+/**
+ * Store the file on the disk, and check what was written. A replica that
+ * does not check out is removed, so that it is not mistaken for a good one.
+ */
+func store_file(filename string, hash string, algo string, root string) error {
 	log.Printf("storing: %s\n", filename)
-	copy_file(filename, storage_path)
+	start := time.Now()
+	storage_path := get_storage_path(root)
+	labels := fmt.Sprintf("root=%q", root)
+	var info os.FileInfo
+	err := link_or_copy_file(filename, root, hash, algo)
+	if err == nil {
+		if info, err = os.Stat(filename); err == nil {
+			err = verify_replica(root, hash, algo, info.Size())
+		}
+		if err == nil {
+			err = replica_sync(root, hash, algo)
+		}
+		if err != nil {
+			os.Remove(get_blob_path(root, hash, algo))
+		}
+	}
+	if err != nil {
+		log.Printf("failed to store '%s' to '%s': %v\n", filename, storage_path, err)
+		db_add_archive_failure(hash, storage_path, err)
+		metric_add("kfs_disk_write_errors_total", "Replicas that could not be written to the disk.", labels, 1)
+		return err
+	}
 	log.Printf("stored: '%s' to '%s'\n", filename, storage_path)
-	// TODO: communicate errors to error queue
+	metric_add("kfs_disk_writes_total", "Replicas written to the disk.", labels, 1)
+	metric_add("kfs_disk_written_bytes_total", "Bytes of replicas written to the disk.", labels, float64(info.Size()))
+	metric_add(
+		"kfs_disk_write_seconds_total",
+		"Time spent writing and checking replicas on the disk.",
+		labels,
+		time.Since(start).Seconds(),
+	)
+	return nil
 }
 
-func archive_file(staging_path string, storage_paths []string, hash_filename string, hash string) {
+/**
+ * Compute every other supported digest of the blob so that clients which
+ * speak a different hash algorithm can still find it.
+ */
+func store_secondary_digests(filename string, hash string, algo string) {
+	for other := range settings().hash_algos {
+		if other == algo {
+			continue
+		}
+		digest, err := hash_file_algo(filename, other)
+		if err != nil {
+			log.Printf("could not compute %s digest: %v\n", other, err)
+			continue
+		}
+		db_add_digest(hash, other, digest)
+	}
+}
+
+/**
+ * Check that the file still hashes to what it is stored under.
+ */
+func verify_file(filename string, hash string, algo string) error {
+	digest, err := hash_file_algo(filename, algo)
+	if err != nil {
+		return err
+	}
+	if digest != hash {
+		return fmt.Errorf("'%s' is corrupt: hashed to %s", filename, digest)
+	}
+	return nil
+}
+
+/**
+ * Give up on archiving a staged blob that no longer matches its hash. When
+ * no other disk holds the blob, the upload is undone, so that it can be
+ * uploaded again. Otherwise the disks it was meant for are forgotten, and
+ * replicas_loop copies it to others from a good replica. The staged copy
+ * is set aside, for a look at what went wrong.
+ */
+func archive_abandon(hash_filename string, disks []placement, hash string, algo string, size int64, reason error, tracker *progress_tracker) {
+	log.Printf("not archiving '%s': %v", hash_filename, reason)
+	metric_add(
+		"kfs_staging_corrupt_total",
+		"Staged blobs that no longer matched their hash when archived.",
+		"",
+		1,
+	)
+	db_add_archive_failure(hash, filepath.Dir(hash_filename), reason)
+	tracker.fail(reason)
+	if err := os.Rename(hash_filename, hash_filename+".corrupt"); err != nil {
+		log.Printf("could not set aside '%s': %v", hash_filename, err)
+	}
+
+	targets := map[placement]bool{}
+	for _, disk := range disks {
+		targets[disk] = true
+		db_clear_intent(hash, algo, disk)
+	}
+	placements, err := db_get_placements(hash, algo)
+	if err != nil {
+		log.Printf("could not look up replicas of %s: %v", hash, err)
+		space_release(hash, algo)
+		return
+	}
+	others := 0
+	for _, disk := range placements {
+		if !targets[disk] {
+			others++
+		}
+	}
+	if others == 0 {
+		db_release_storage(hash, algo, size, disks)
+		return
+	}
+	space_release(hash, algo)
+	for _, disk := range disks {
+		if err := db_remove_replica(hash, algo, disk, size); err != nil {
+			log.Printf("could not forget %s on '%s': %v", hash, disk, err)
+		}
+	}
+	replicas_trigger()
+}
+
+func archive_file(staging_path string, disks []placement, hash_filename string, hash string, algo string, tracker *progress_tracker) {
+	tracker.set_stage(STAGE_ARCHIVING)
+	var size int64
+	if info, err := os.Stat(hash_filename); err == nil {
+		size = info.Size()
+	}
+
+	/*
+	 * Nothing has read the staged blob since it was hashed, so check it
+	 * again before it is copied everywhere, rather than spread a copy that
+	 * went bad in staging to every replica.
+	 */
+	if err := verify_file(hash_filename, hash, algo); err != nil {
+		archive_abandon(hash_filename, disks, hash, algo, size, err, tracker)
+		return
+	}
+	if err := db_add_intents(hash, algo, hash_filename, disks); err != nil {
+		log.Printf("could not journal archive of %s: %v", hash, err)
+	}
 	var wg sync.WaitGroup
-	for _, storage_path := range storage_paths {
-		log.Printf("path: %s\n", storage_path)
+	for _, disk := range disks {
+		log_debug("disk: %s", disk)
 		wg.Add(1)
-		go func(storage_path string, hash_filename string, hash string) {
+		go func(disk placement, hash_filename string, hash string) {
 			defer wg.Done()
-			store_file(hash_filename, hash, storage_path)
-		}(storage_path, hash_filename, hash)
+			var err error
+			if disk.node == "" {
+				err = store_file(hash_filename, hash, algo, disk.root)
+			} else {
+				err = cluster_store_file(hash_filename, hash, algo, disk)
+			}
+			// the staged copy is kept, so a replica that failed is
+			// written again on recovery
+			if err != nil {
+				return
+			}
+			db_replica_stored(hash, algo, disk)
+			tracker.update(func(state *progress_state) {
+				state.ReplicasWritten++
+			})
+		}(disk, hash_filename, hash)
 	}
 
 	wg.Wait()
 
+	store_secondary_digests(hash_filename, hash, algo)
+	emit_event(event{Type: EVENT_BLOB_ARCHIVED, Hash: hash, HashAlgo: algo})
+	entry := catalog_entry{Hash: hash, HashAlgo: algo, Size: size}
+	run_post_hooks(HOOK_POST_ARCHIVE, entry, hash_filename)
+	tracker.set_stage(STAGE_DONE)
+	space_release(hash, algo)
+
+	// keep the staged copy until every replica is written, so it can be retried
+	n, err := db_count_intents(hash, algo)
+	if err != nil {
+		log.Printf("keeping '%s': %v", hash_filename, err)
+		return
+	}
+	if n > 0 {
+		log.Printf("keeping '%s' until every replica is written", hash_filename)
+		return
+	}
+
 	// TODO: check error
 	os.Remove(hash_filename)
-	log.Printf("removed file: %s", hash_filename)
+	log_debug("removed file: %s", hash_filename)
 }
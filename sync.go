@@ -0,0 +1,686 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	uuid "github.com/satori/go.uuid"
+)
+
+/**
+ * Manifest-first syncs, so that a client backing up a whole tree needs no
+ * round trip per file. The client posts every file it has,
+ *     curl -X POST -d '{
+ *             "namespace": "laptop",
+ *             "entries": [{"path": "/home/kyle/a.txt", "hash": "...", "size": 12}]
+ *         }' localhost:8080/sync
+ * and is told exactly which hashes the server needs. It sends only those,
+ *     curl -X POST -F blob=@a.txt -F hash=... localhost:8080/sync/<id>/blob
+ * then commits:
+ *     curl -X POST localhost:8080/sync/<id>/commit
+ * The commit adds the whole manifest to the catalog in one transaction, or
+ * nothing if a blob is still missing. Every entry gets the same creation
+ * time, so the sync is a snapshot that can be read back with
+ *     curl 'localhost:8080/path/laptop/home/kyle/a.txt?at=<committed_at>'
+ * An entry may also give the file's "mode" and "mtime", which are kept with
+ * the sync, not the catalog, so that kfs restore can put them back.
+ * Files matching the namespace's filters, or the sync's own "exclude"
+ * rules, are left out of the manifest, and only counted.
+ * Syncs that are never committed are forgotten after KFS_SYNC_EXPIRY.
+ */
+
+var (
+	KFS_SYNC_MAX_ENTRIES = 1000000
+	KFS_SYNC_EXPIRY      = 24 * time.Hour
+)
+
+type sync_entry struct {
+	Path      string `json:"path"`
+	Hash      string `json:"hash"`
+	Size      int64  `json:"size"`
+	Mode      uint32 `json:"mode,omitempty"`
+	ModTime   int64  `json:"mtime,omitempty"`
+	CatalogID int64  `json:"catalog_id,omitempty"`
+}
+
+type sync_manifest struct {
+	Namespace string       `json:"namespace"`
+	HashAlgo  string       `json:"hash_algo"`
+	Class     string       `json:"class"`
+	Exclude   []string     `json:"exclude"`
+	Entries   []sync_entry `json:"entries"`
+}
+
+type sync_session struct {
+	ID          string       `json:"id"`
+	Namespace   string       `json:"namespace"`
+	HashAlgo    string       `json:"hash_algo"`
+	Class       string       `json:"class,omitempty"`
+	CreatedAt   int64        `json:"created_at"`
+	CommittedAt int64        `json:"committed_at,omitempty"`
+	Files       int          `json:"files"`
+	Size        int64        `json:"size"`
+	Need        []string     `json:"need"`
+	Excluded    int          `json:"excluded,omitempty"`
+	Entries     []sync_entry `json:"entries,omitempty"`
+}
+
+func sync_split_path(full_path string) (string, string) {
+	dir, filename := path.Split(path.Clean(full_path))
+	return path.Clean(dir), filename
+}
+
+func db_add_sync_session(session sync_session, entries []sync_entry) error {
+	return db_transaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			`
+			insert into sync_sessions(id, namespace, hash_algo, class, created_at)
+			values(?, ?, ?, ?, ?)
+			`,
+			session.ID,
+			session.Namespace,
+			session.HashAlgo,
+			session.Class,
+			session.CreatedAt,
+		)
+		if err != nil {
+			return err
+		}
+		stmt, err := tx.Prepare(`
+			insert into sync_entries(session_id, path, filename, hash, size, mode, mtime)
+			values(?, ?, ?, ?, ?, ?, ?)
+		`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, entry := range entries {
+			dir, filename := sync_split_path(entry.Path)
+			_, err := stmt.Exec(
+				session.ID,
+				dir,
+				filename,
+				entry.Hash,
+				entry.Size,
+				entry.Mode,
+				entry.ModTime,
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func db_get_sync_session(id string) (sync_session, error) {
+	session := sync_session{ID: id, Need: []string{}}
+	var committed_at sql.NullInt64
+	query := `
+		select
+			sync_sessions.namespace,
+			sync_sessions.hash_algo,
+			sync_sessions.class,
+			sync_sessions.created_at,
+			sync_sessions.committed_at,
+			count(sync_entries.hash),
+			coalesce(sum(sync_entries.size), 0)
+		from sync_sessions
+		left join sync_entries on sync_entries.session_id = sync_sessions.id
+		where sync_sessions.id = ?
+		group by sync_sessions.id
+	`
+	err := db.QueryRow(query, id).Scan(
+		&session.Namespace,
+		&session.HashAlgo,
+		&session.Class,
+		&session.CreatedAt,
+		&committed_at,
+		&session.Files,
+		&session.Size,
+	)
+	session.CommittedAt = committed_at.Int64
+	return session, err
+}
+
+func db_list_sync_entries(id string) ([]sync_entry, error) {
+	query := `
+		select path, filename, hash, size, mode, mtime, coalesce(catalog_id, 0)
+		from sync_entries
+		where session_id = ?
+		order by path, filename
+	`
+	rows, err := db.Query(query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []sync_entry{}
+	for rows.Next() {
+		var entry sync_entry
+		var dir, filename string
+		err := rows.Scan(
+			&dir,
+			&filename,
+			&entry.Hash,
+			&entry.Size,
+			&entry.Mode,
+			&entry.ModTime,
+			&entry.CatalogID,
+		)
+		if err != nil {
+			return nil, err
+		}
+		entry.Path = path.Join(dir, filename)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+/**
+ * The hashes of the manifest that the server does not have yet.
+ */
+func db_sync_need(session sync_session) ([]string, error) {
+	rows, err := db.Query(
+		`select distinct hash from sync_entries where session_id = ? order by hash`,
+		session.ID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	need := []string{}
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		if !db_has_hash(hash, session.HashAlgo) {
+			need = append(need, hash)
+		}
+	}
+	return need, rows.Err()
+}
+
+/**
+ * Add every entry of the manifest to the catalog, created at the same time,
+ * and mark the sync committed, all in one transaction. Returns the ids of
+ * the new catalog entries.
+ */
+func db_commit_sync(session sync_session, entries []catalog_entry, committed_at int64) ([]int64, error) {
+	var ids []int64
+	err := db_transaction(func(tx *sql.Tx) error {
+		ids = nil
+		for _, entry := range entries {
+			entry.CreatedAt = committed_at
+			id, err := db_insert_catalog_entry(tx, entry)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(
+				`
+				update sync_entries set catalog_id = ?
+				where session_id = ? and path = ? and filename = ?
+				`,
+				id,
+				session.ID,
+				entry.Path,
+				entry.Filename,
+			)
+			if err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		_, err := tx.Exec(
+			`update sync_sessions set committed_at = ? where id = ?`,
+			committed_at,
+			session.ID,
+		)
+		return err
+	})
+	return ids, err
+}
+
+/**
+ * Forget a sync that was never committed. The blobs it received stay, as
+ * any other upload's would.
+ */
+func db_remove_sync_session(id string) error {
+	return db_transaction(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`delete from sync_entries where session_id = ?`, id); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`delete from sync_sessions where id = ?`, id)
+		return err
+	})
+}
+
+/**
+ * Look up the sync named in the route, writing an error response and
+ * returning false if there is none.
+ */
+func lookup_sync_session(writer http.ResponseWriter, p httprouter.Params) (sync_session, bool) {
+	session, err := db_get_sync_session(p.ByName("id"))
+	if err == sql.ErrNoRows {
+		write_error(writer, "no such sync", http.StatusNotFound)
+		return session, false
+	}
+	if err != nil {
+		log.Printf("could not get sync: %v", err)
+		write_error(writer, "could not get sync", http.StatusInternalServerError)
+		return session, false
+	}
+	return session, true
+}
+
+/**
+ * Take the client's manifest and answer with the hashes it has to send.
+ */
+func handle_sync_start(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	if !space_check_upload(writer) {
+		return
+	}
+	var manifest sync_manifest
+	if err := json.NewDecoder(request.Body).Decode(&manifest); err != nil {
+		write_error(writer, "invalid manifest", http.StatusBadRequest)
+		return
+	}
+	if len(manifest.Entries) == 0 {
+		write_error(writer, "manifest has no entries", http.StatusBadRequest)
+		return
+	}
+	if len(manifest.Entries) > KFS_SYNC_MAX_ENTRIES {
+		msg := fmt.Sprintf("manifest has more than %d entries", KFS_SYNC_MAX_ENTRIES)
+		write_error(writer, msg, http.StatusRequestEntityTooLarge)
+		return
+	}
+	session := sync_session{
+		ID:        uuid.Must(uuid.NewV4(), nil).String(),
+		Namespace: manifest.Namespace,
+		HashAlgo:  manifest.HashAlgo,
+		Class:     manifest.Class,
+		CreatedAt: time.Now().Unix(),
+	}
+	if session.Namespace == "" {
+		session.Namespace = KFS_DEFAULT_NAMESPACE
+	}
+	if session.HashAlgo == "" {
+		session.HashAlgo = KFS_DEFAULT_HASH_ALGO
+	}
+	if !valid_hash_algo(session.HashAlgo) {
+		msg := fmt.Sprintf("unsupported hash algorithm: '%s'", session.HashAlgo)
+		write_error(writer, msg, http.StatusBadRequest)
+		return
+	}
+	if session.Class == "" {
+		session.Class = namespace_class(session.Namespace)
+	}
+	if ok, err := db_class_exists(session.Class); err != nil || !ok {
+		msg := fmt.Sprintf("no disks in storage class '%s'", session.Class)
+		write_error(writer, msg, http.StatusBadRequest)
+		return
+	}
+
+	rules, err := sync_filter_rules(session.Namespace, manifest.Exclude)
+	if err != nil {
+		write_error(writer, fmt.Sprintf("invalid exclude rule: %v", err), http.StatusBadRequest)
+		return
+	}
+	var kept []sync_entry
+	for _, entry := range manifest.Entries {
+		if filter_excluded(rules, entry.Path) {
+			session.Excluded++
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	if len(kept) == 0 {
+		write_error(writer, "every entry of the manifest is excluded", http.StatusBadRequest)
+		return
+	}
+	session.Files = len(kept)
+
+	seen := map[string]bool{}
+	for _, entry := range kept {
+		dir, filename := sync_split_path(entry.Path)
+		if entry.Hash == "" || entry.Size < 0 || filename == "" || filename == "/" {
+			msg := fmt.Sprintf("invalid entry for '%s'", entry.Path)
+			write_error(writer, msg, http.StatusBadRequest)
+			return
+		}
+		full_path := path.Join(dir, filename)
+		if seen[full_path] {
+			msg := fmt.Sprintf("'%s' is in the manifest more than once", full_path)
+			write_error(writer, msg, http.StatusBadRequest)
+			return
+		}
+		seen[full_path] = true
+		session.Size += entry.Size
+
+		catalog := catalog_entry{
+			Namespace: session.Namespace,
+			Path:      dir,
+			Filename:  filename,
+			HashAlgo:  session.HashAlgo,
+			Size:      entry.Size,
+		}
+		if err := run_hooks(request.Context(), HOOK_PRE_ACCEPT, catalog, ""); err != nil {
+			log.Printf("refused '%s': %v", full_path, err)
+			write_error(writer, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	if err := db_add_sync_session(session, kept); err != nil {
+		log.Printf("could not start sync: %v", err)
+		write_error(writer, "could not start sync", http.StatusInternalServerError)
+		return
+	}
+	need, err := db_sync_need(session)
+	if err != nil {
+		log.Printf("could not start sync: %v", err)
+		write_error(writer, "could not start sync", http.StatusInternalServerError)
+		return
+	}
+	session.Need = need
+	log_debug(
+		"started sync %s of %d files, %d excluded, %d blobs needed",
+		session.ID,
+		session.Files,
+		session.Excluded,
+		len(need),
+	)
+	write_json(writer, http.StatusCreated, session)
+}
+
+/**
+ * Show the sync, with the hashes still needed, and with ?entries=true, its
+ * manifest.
+ */
+func handle_sync_get(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	session, ok := lookup_sync_session(writer, p)
+	if !ok {
+		return
+	}
+	var err error
+	if session.CommittedAt == 0 {
+		session.Need, err = db_sync_need(session)
+	}
+	if err == nil && request.URL.Query().Get("entries") == "true" {
+		session.Entries, err = db_list_sync_entries(session.ID)
+	}
+	if err != nil {
+		log.Printf("could not get sync %s: %v", session.ID, err)
+		write_error(writer, "could not get sync", http.StatusInternalServerError)
+		return
+	}
+	write_json(writer, http.StatusOK, session)
+}
+
+/**
+ * Receive one of the blobs the manifest needs.
+ */
+func handle_sync_blob(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	if !space_check_upload(writer) {
+		return
+	}
+	session, ok := lookup_sync_session(writer, p)
+	if !ok {
+		return
+	}
+	if session.CommittedAt != 0 {
+		write_error(writer, "sync is already committed", http.StatusConflict)
+		return
+	}
+	file, header, err := request.FormFile("blob")
+	if err != nil {
+		write_error(writer, "sync requires key of 'blob'", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	hash := request.FormValue("hash")
+
+	var entry catalog_entry
+	query := `
+		select path, filename, size
+		from sync_entries
+		where session_id = ? and hash = ?
+		limit 1
+	`
+	err = db.QueryRow(query, session.ID, hash).Scan(&entry.Path, &entry.Filename, &entry.Size)
+	if err == sql.ErrNoRows {
+		write_error(writer, "hash is not in the manifest", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("could not get sync %s: %v", session.ID, err)
+		write_error(writer, "could not get sync", http.StatusInternalServerError)
+		return
+	}
+	if header.Size != entry.Size {
+		msg := fmt.Sprintf("blob is %d bytes, the manifest says %d", header.Size, entry.Size)
+		write_error(writer, msg, http.StatusBadRequest)
+		return
+	}
+	entry.Namespace = session.Namespace
+	entry.HashAlgo = session.HashAlgo
+
+	violation, err := check_upload_policy(entry, file)
+	if err != nil {
+		log.Printf("could not check policy for '%s': %v", entry.Filename, err)
+		write_error(writer, "could not read blob", http.StatusBadRequest)
+		return
+	}
+	if violation != nil {
+		log.Printf("refused '%s': %s", entry.Filename, violation.Message)
+		write_json(writer, http.StatusForbidden, violation)
+		return
+	}
+
+	// the pre-accept hooks ran on the whole manifest when the sync started
+	tracker, ok := progress_start_request(writer, request)
+	if !ok {
+		return
+	}
+	blob, err := stage_blob(request.Context(), writer, tracker, entry, hash, file, session.Class)
+	if err != nil {
+		log.Printf("could not store blob of sync %s: %v", session.ID, err)
+		return
+	}
+	replicas := len(blob.disks)
+	if blob.dedup {
+		_, roots, _ := db_get_replicas(blob.hash)
+		replicas = len(roots)
+		tracker.update(func(state *progress_state) {
+			state.Stage = STAGE_DONE
+			state.Hash = blob.hash
+			state.HashAlgo = blob.algo
+			state.Replicas = replicas
+			state.ReplicasWritten = replicas
+		})
+	} else {
+		tracker.update(func(state *progress_state) {
+			state.Stage = STAGE_STAGED
+			state.Hash = blob.hash
+			state.HashAlgo = blob.algo
+			state.Replicas = replicas
+		})
+		go blob.archive()
+	}
+	write_json(writer, http.StatusOK, upload_response{
+		Hash:     blob.hash,
+		HashAlgo: blob.algo,
+		Size:     header.Size,
+		Replicas: replicas,
+		Dedup:    blob.dedup,
+		UploadID: tracker.upload_id(),
+	})
+}
+
+/**
+ * Add the whole manifest to the catalog, once every blob is here. Committing
+ * again answers with the snapshot, so a client that lost the first answer
+ * can safely retry.
+ */
+func handle_sync_commit(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	session, ok := lookup_sync_session(writer, p)
+	if !ok {
+		return
+	}
+	if session.CommittedAt != 0 {
+		write_json(writer, http.StatusOK, session)
+		return
+	}
+	need, err := db_sync_need(session)
+	if err != nil {
+		log.Printf("could not commit sync %s: %v", session.ID, err)
+		write_error(writer, "could not commit sync", http.StatusInternalServerError)
+		return
+	}
+	if len(need) > 0 {
+		session.Need = need
+		write_json(writer, http.StatusConflict, session)
+		return
+	}
+
+	manifest, err := db_list_sync_entries(session.ID)
+	if err != nil {
+		log.Printf("could not commit sync %s: %v", session.ID, err)
+		write_error(writer, "could not commit sync", http.StatusInternalServerError)
+		return
+	}
+	resolved := map[string]catalog_entry{}
+	entries := make([]catalog_entry, 0, len(manifest))
+	for _, item := range manifest {
+		dir, filename := sync_split_path(item.Path)
+		existing, err := db_find_catalog_entry(session.Namespace, dir, filename, 0)
+		if err == nil && existing.immutable() {
+			msg := fmt.Sprintf("'%s' is %s", item.Path, existing.hold_description())
+			write_error(writer, msg, http.StatusConflict)
+			return
+		}
+
+		blob, ok := resolved[item.Hash]
+		if !ok {
+			blob.Hash, blob.HashAlgo, err = db_resolve_hash(item.Hash, session.HashAlgo)
+			if err != nil {
+				blob.Hash, blob.HashAlgo = item.Hash, session.HashAlgo
+			}
+			resolved[item.Hash] = blob
+		}
+		entry := catalog_entry{
+			Namespace: session.Namespace,
+			Path:      dir,
+			Filename:  filename,
+			Hash:      blob.Hash,
+			HashAlgo:  blob.HashAlgo,
+			Size:      item.Size,
+		}
+		worm_apply(&entry)
+		entries = append(entries, entry)
+	}
+
+	committed_at := time.Now().Unix()
+	ids, err := db_commit_sync(session, entries, committed_at)
+	if err != nil {
+		log.Printf("could not commit sync %s: %v", session.ID, err)
+		write_error(writer, "could not commit sync", http.StatusInternalServerError)
+		return
+	}
+	for _, id := range ids {
+		catalog_added(id)
+	}
+	session.CommittedAt = committed_at
+	log.Printf(
+		"committed sync %s of %d files to '%s'",
+		session.ID,
+		session.Files,
+		session.Namespace,
+	)
+	metric_add("kfs_syncs_committed_total", "Manifest syncs committed to the catalog.", "", 1)
+	write_json(writer, http.StatusOK, session)
+}
+
+func handle_sync_abort(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	session, ok := lookup_sync_session(writer, p)
+	if !ok {
+		return
+	}
+	if session.CommittedAt != 0 {
+		write_error(writer, "sync is already committed", http.StatusConflict)
+		return
+	}
+	if err := db_remove_sync_session(session.ID); err != nil {
+		log.Printf("could not remove sync %s: %v", session.ID, err)
+		write_error(writer, "could not remove sync", http.StatusInternalServerError)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+/**
+ * Forget the syncs that were started too long ago to still be wanted.
+ */
+func sync_expire() error {
+	cutoff := time.Now().Add(-KFS_SYNC_EXPIRY).Unix()
+	rows, err := db.Query(
+		`select id from sync_sessions where committed_at is null and created_at < ?`,
+		cutoff,
+	)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		log.Printf("removing sync %s, it was never committed", id)
+		if err := db_remove_sync_session(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sync_loop() {
+	for {
+		if err := sync_expire(); err != nil {
+			log.Printf("could not expire syncs: %v", err)
+		}
+		time.Sleep(time.Hour)
+	}
+}
@@ -0,0 +1,141 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+/**
+ * Running under systemd, as in systemd/kfs.service. kfs takes its listening
+ * socket from systemd when started by kfs.socket, tells systemd once it is
+ * ready to serve, and pings the watchdog for as long as it is healthy, so
+ * that systemd restarts it if it wedges.
+ */
+
+var KFS_LISTEN_ADDR = "0.0.0.0:8080"
+
+// the first file descriptor systemd passes, see sd_listen_fds(3)
+const SD_LISTEN_FDS_START = 3
+
+/**
+ * The socket systemd passed, or a new one on KFS_LISTEN_ADDR when kfs was
+ * not socket activated.
+ */
+func systemd_listener() (net.Listener, error) {
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	fds, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if pid != os.Getpid() || fds < 1 {
+		return net.Listen("tcp", KFS_LISTEN_ADDR)
+	}
+	if fds > 1 {
+		log.Printf("systemd passed %d sockets, only using the first", fds)
+	}
+	f := os.NewFile(SD_LISTEN_FDS_START, "LISTEN_FD_3")
+	listener, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("could not use socket from systemd: %v", err)
+	}
+	log.Printf("listening on %s from systemd", listener.Addr())
+	return listener, nil
+}
+
+/**
+ * Send the state to systemd, e.g. "READY=1", when it is watching for it.
+ */
+func sd_notify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	if addr[0] == '@' {
+		// abstract socket
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+/**
+ * How often systemd expects a watchdog ping, or 0 if it does not.
+ */
+func sd_watchdog_interval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+/**
+ * Whether kfs can still do its work. The database is where a wedged kfs
+ * gets stuck, e.g. behind a writer that never finishes, so check that both
+ * connection pools still answer.
+ */
+func healthy(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var one int
+	if err := db.QueryRowContext(ctx, `select 1`).Scan(&one); err != nil {
+		return fmt.Errorf("database reader: %v", err)
+	}
+	if err := db_writer.QueryRowContext(ctx, `select 1`).Scan(&one); err != nil {
+		return fmt.Errorf("database writer: %v", err)
+	}
+	return nil
+}
+
+/**
+ * Ping the systemd watchdog at half the interval it expects, skipping the
+ * ping whenever kfs is not healthy, so systemd restarts it if it stays
+ * that way.
+ */
+func sd_watchdog_loop() {
+	interval := sd_watchdog_interval()
+	if interval == 0 {
+		return
+	}
+	for {
+		time.Sleep(interval / 2)
+		if err := healthy(interval / 2); err != nil {
+			log.Printf("not pinging watchdog: %v", err)
+			continue
+		}
+		if err := sd_notify("WATCHDOG=1"); err != nil {
+			log.Printf("could not ping watchdog: %v", err)
+		}
+	}
+}
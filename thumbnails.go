@@ -0,0 +1,291 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+/**
+ * Thumbnails of uploaded images. Once an image is archived, it is scaled
+ * down to each of KFS_THUMB_SIZES, and each thumbnail is stored as a blob
+ * of its own, linked to the image in the thumbnails table, so it is
+ * replicated, repaired and deduplicated like any other blob.
+ */
+
+// the longest side of each thumbnail, in pixels, none to turn thumbnails off
+var KFS_THUMB_SIZES = []int{256, 1024}
+
+var KFS_THUMB_QUALITY = 85
+
+// images larger than this are not decoded, to bound memory use
+var KFS_THUMB_MAX_PIXELS = 100 * 1000 * 1000
+
+func thumbnails_init() {
+	if len(KFS_THUMB_SIZES) == 0 {
+		return
+	}
+	KFS_HOOKS[HOOK_POST_ARCHIVE] = append(
+		[]hook{hook_func(thumbnail_hook)},
+		KFS_HOOKS[HOOK_POST_ARCHIVE]...,
+	)
+}
+
+func db_is_thumbnail(hash string, algo string) bool {
+	var n int
+	query := `
+		select count(*) from thumbnails where thumb_hash = ? and thumb_algo = ?
+	`
+	if err := db.QueryRow(query, hash, algo).Scan(&n); err != nil {
+		log.Println(err)
+	}
+	return n > 0
+}
+
+func db_get_thumbnail(hash string, size int) (string, error) {
+	var thumb_hash string
+	query := `select thumb_hash from thumbnails where hash = ? and size = ?`
+	err := db.QueryRow(query, hash, size).Scan(&thumb_hash)
+	return thumb_hash, err
+}
+
+func db_add_thumbnail(hash string, algo string, size int, thumb_hash string, thumb_algo string, bounds image.Rectangle) error {
+	stmt := `
+		INSERT OR REPLACE INTO thumbnails(
+			hash,
+			hash_algo,
+			size,
+			thumb_hash,
+			thumb_algo,
+			width,
+			height
+		) values(?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := db_exec(
+		stmt,
+		hash,
+		algo,
+		size,
+		thumb_hash,
+		thumb_algo,
+		bounds.Dx(),
+		bounds.Dy(),
+	)
+	return err
+}
+
+/**
+ * Scale the image down so its longest side is size, averaging each box of
+ * pixels that becomes one pixel of the thumbnail. Images already that
+ * small are left as they are.
+ */
+func scale_image(src *image.RGBA, size int) *image.RGBA {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= size && height <= size {
+		return src
+	}
+	dst_width, dst_height := size, height*size/width
+	if height > width {
+		dst_width, dst_height = width*size/height, size
+	}
+	if dst_width < 1 {
+		dst_width = 1
+	}
+	if dst_height < 1 {
+		dst_height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dst_width, dst_height))
+	for y := 0; y < dst_height; y++ {
+		y0, y1 := y*height/dst_height, (y+1)*height/dst_height
+		for x := 0; x < dst_width; x++ {
+			x0, x1 := x*width/dst_width, (x+1)*width/dst_width
+			var r, g, b, a, n int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					px := row[sx*4 : sx*4+4]
+					r += int(px[0])
+					g += int(px[1])
+					b += int(px[2])
+					a += int(px[3])
+					n++
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = uint8(r / n)
+			dst.Pix[i+1] = uint8(g / n)
+			dst.Pix[i+2] = uint8(b / n)
+			dst.Pix[i+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+/**
+ * Encode the thumbnail next to the staged image, and store it as a blob.
+ * The thumbnail is linked to its image before it is archived, so that it
+ * is not itself taken for an image in need of thumbnails.
+ */
+func store_thumbnail(ctx context.Context, thumb *image.RGBA, staging_dir string, link func(hash string, algo string) error) error {
+	outf, err := os.CreateTemp(staging_dir, "thumb")
+	if err != nil {
+		return err
+	}
+	tmp := outf.Name()
+	err = jpeg.Encode(outf, thumb, &jpeg.Options{Quality: KFS_THUMB_QUALITY})
+	outf.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	defer os.Remove(tmp)
+
+	algo := KFS_DEFAULT_HASH_ALGO
+	hash, err := hash_file_algo(tmp, algo)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(tmp)
+	if err != nil {
+		return err
+	}
+	skip, staging_path, disks, err := db_alloc_storage(ctx, hash, algo, info.Size(), "", "", "")
+	if err != nil {
+		return err
+	}
+	if skip {
+		return link(hash, algo)
+	}
+	hash_filename := filepath.Join(staging_path, hash+"."+algo)
+	if err := os.Rename(tmp, hash_filename); err != nil {
+		if err := copy_file(tmp, hash_filename); err != nil {
+			db_release_storage(hash, algo, info.Size(), disks)
+			return err
+		}
+	}
+	if err := link(hash, algo); err != nil {
+		db_release_storage(hash, algo, info.Size(), disks)
+		os.Remove(hash_filename)
+		return err
+	}
+	archive_file(staging_path, disks, hash_filename, hash, algo, nil)
+	return nil
+}
+
+func thumbnail_hook(ctx context.Context, call hook_call) error {
+	entry := call.Entry
+	if db_is_thumbnail(entry.Hash, entry.HashAlgo) {
+		return nil
+	}
+	f, err := os.Open(call.File)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		// not an image
+		return nil
+	}
+	if config.Width*config.Height > KFS_THUMB_MAX_PIXELS {
+		log.Printf("%s is too large to thumbnail", entry.Hash)
+		return nil
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return err
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return fmt.Errorf("could not decode image %s: %v", entry.Hash, err)
+	}
+	src := image.NewRGBA(img.Bounds().Sub(img.Bounds().Min))
+	draw.Draw(src, src.Bounds(), img, img.Bounds().Min, draw.Src)
+
+	for _, size := range KFS_THUMB_SIZES {
+		thumb := scale_image(src, size)
+		link := func(thumb_hash string, thumb_algo string) error {
+			return db_add_thumbnail(
+				entry.Hash,
+				entry.HashAlgo,
+				size,
+				thumb_hash,
+				thumb_algo,
+				thumb.Bounds(),
+			)
+		}
+		err := store_thumbnail(ctx, thumb, filepath.Dir(call.File), link)
+		if err != nil {
+			return fmt.Errorf("could not store %dpx thumbnail of %s: %v", size, entry.Hash, err)
+		}
+	}
+	log.Printf("made thumbnails of %s", entry.Hash)
+	return nil
+}
+
+/**
+ * Serve a thumbnail of an image, e.g.
+ *     GET /thumb/:hash?size=256
+ */
+func handle_thumb(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	if len(KFS_THUMB_SIZES) == 0 {
+		write_error(writer, "thumbnails are turned off", http.StatusNotFound)
+		return
+	}
+	size := KFS_THUMB_SIZES[0]
+	if s := request.URL.Query().Get("size"); s != "" {
+		var err error
+		size, err = strconv.Atoi(s)
+		if err != nil {
+			write_error(writer, "invalid size", http.StatusBadRequest)
+			return
+		}
+	}
+	thumb_hash, err := db_get_thumbnail(p.ByName("hash"), size)
+	if err == sql.ErrNoRows {
+		write_error(
+			writer,
+			fmt.Sprintf("no %dpx thumbnail, sizes are %v", size, KFS_THUMB_SIZES),
+			http.StatusNotFound,
+		)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		write_error(writer, "could not look up thumbnail", http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "image/jpeg")
+	writer.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	serve_blob(writer, request, thumb_hash)
+}
@@ -0,0 +1,272 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+/**
+ * The state of each upload, kept in the database so that a backup client
+ * can learn that a file is durable, with every replica written and
+ * verified, rather than trusting the 200 it got once the file was staged.
+ * An upload moves through
+ *     receiving -> verifying -> staged -> archiving -> durable
+ * and can become failed before it is staged. A direct upload is hashed as
+ * it is received, so it goes from receiving to staged. An upload stays
+ * archiving until recovery or repair writes the replicas it is missing.
+ */
+
+const (
+	UPLOAD_RECEIVING = "receiving"
+	UPLOAD_VERIFYING = "verifying"
+	UPLOAD_STAGED    = "staged"
+	UPLOAD_ARCHIVING = "archiving"
+	UPLOAD_DURABLE   = "durable"
+	UPLOAD_FAILED    = "failed"
+)
+
+// how long the state of an upload is kept after it last changed
+var KFS_UPLOAD_STATE_DAYS = 30
+
+var upload_stage_states = map[string]string{
+	STAGE_RECEIVING: UPLOAD_RECEIVING,
+	STAGE_HASHING:   UPLOAD_VERIFYING,
+	STAGE_STAGED:    UPLOAD_STAGED,
+	STAGE_ARCHIVING: UPLOAD_ARCHIVING,
+	STAGE_FAILED:    UPLOAD_FAILED,
+}
+
+type upload_status struct {
+	ID              string    `json:"id"`
+	State           string    `json:"state"`
+	Hash            string    `json:"hash,omitempty"`
+	HashAlgo        string    `json:"hash_algo,omitempty"`
+	Size            int64     `json:"size"`
+	Replicas        int       `json:"replicas"`
+	ReplicasWritten int       `json:"replicas_written"`
+	Error           string    `json:"error,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+/**
+ * The blob of an upload is durable once none of its replicas are still
+ * being written, and at least as many are stored as the upload was given.
+ */
+const upload_durable_cond = `
+	not exists (
+		select 1 from files
+		where files.hash = uploads.hash
+			and files.hash_algo = uploads.hash_algo
+			and files.pending
+	)
+	and (
+		select count(*) from files
+		where files.hash = uploads.hash
+			and files.hash_algo = uploads.hash_algo
+	) >= uploads.replicas
+`
+
+var errUploadIDTaken = errors.New("upload id is already in use")
+
+/**
+ * Record a new upload. An id is never reused, so that one upload cannot
+ * take over the state of another, and errUploadIDTaken is returned for
+ * one that is already recorded.
+ */
+func upload_state_start(id string, size int64) error {
+	now := time.Now().Unix()
+	_, err := db_exec(
+		`
+		insert into uploads(id, state, size, created_at, updated_at)
+		values(?, ?, ?, ?, ?)
+		`,
+		id,
+		UPLOAD_RECEIVING,
+		size,
+		now,
+		now,
+	)
+	var sqlite_err sqlite3.Error
+	if errors.As(err, &sqlite_err) && sqlite_err.Code == sqlite3.ErrConstraint {
+		return errUploadIDTaken
+	}
+	if err != nil {
+		log.Printf("could not record upload %s: %v", id, err)
+	}
+	return nil
+}
+
+/**
+ * Forget the state of an upload that failed, so that its id can be used
+ * again for another attempt at it.
+ */
+func upload_state_forget_failed(id string) {
+	_, err := db_exec(`delete from uploads where id = ? and state = ?`, id, UPLOAD_FAILED)
+	if err != nil {
+		log.Printf("could not forget upload %s: %v", id, err)
+	}
+}
+
+/**
+ * Record the stage an upload has reached. An upload that is done is only
+ * durable if its blob is, and is otherwise still archiving.
+ */
+func upload_state_save(id string, state progress_state) {
+	stmt := `
+		update uploads set
+			state = ?,
+			hash = ?,
+			hash_algo = ?,
+			replicas = ?,
+			replicas_written = ?,
+			error = ?,
+			updated_at = ?
+		where id = ?
+	`
+	upload_state := upload_stage_states[state.Stage]
+	if state.Stage == STAGE_DONE {
+		upload_state = UPLOAD_ARCHIVING
+	}
+	_, err := db_exec(
+		stmt,
+		upload_state,
+		state.Hash,
+		state.HashAlgo,
+		state.Replicas,
+		state.ReplicasWritten,
+		state.Error,
+		time.Now().Unix(),
+		id,
+	)
+	if err == nil && state.Stage == STAGE_DONE {
+		_, err = db_exec(
+			`update uploads set state = ? where id = ? and `+upload_durable_cond,
+			UPLOAD_DURABLE,
+			id,
+		)
+	}
+	if err != nil {
+		log.Printf("could not record state of upload %s: %v", id, err)
+	}
+}
+
+/**
+ * Mark the uploads of a blob durable if the replica just written was the
+ * last one they were waiting on.
+ */
+func upload_state_settle(hash string, algo string) {
+	stmt := `
+		update uploads set state = ?, updated_at = ?
+		where hash = ? and hash_algo = ? and state = ? and
+	` + upload_durable_cond
+	_, err := db_exec(stmt, UPLOAD_DURABLE, time.Now().Unix(), hash, algo, UPLOAD_ARCHIVING)
+	if err != nil {
+		log.Printf("could not settle uploads of %s: %v", hash, err)
+	}
+}
+
+/**
+ * Fail the uploads that a restart cut off before they were handed to
+ * archiving, since nothing will ever finish them.
+ */
+func upload_state_recover() {
+	_, err := db_exec(
+		`
+		update uploads set state = ?, error = ?, updated_at = ?
+		where state in (?, ?, ?) and created_at < ?
+		`,
+		UPLOAD_FAILED,
+		"interrupted by a restart",
+		time.Now().Unix(),
+		UPLOAD_RECEIVING,
+		UPLOAD_VERIFYING,
+		UPLOAD_STAGED,
+		recover_started.Unix(),
+	)
+	if err != nil {
+		log.Printf("could not fail interrupted uploads: %v", err)
+	}
+}
+
+func db_get_upload_status(id string) (upload_status, error) {
+	var status upload_status
+	var created_at, updated_at int64
+	err := db.QueryRow(
+		`
+		select id, state, hash, hash_algo, size, replicas,
+			replicas_written, error, created_at, updated_at
+		from uploads where id = ?
+		`,
+		id,
+	).Scan(
+		&status.ID,
+		&status.State,
+		&status.Hash,
+		&status.HashAlgo,
+		&status.Size,
+		&status.Replicas,
+		&status.ReplicasWritten,
+		&status.Error,
+		&created_at,
+		&updated_at,
+	)
+	status.CreatedAt = time.Unix(created_at, 0)
+	status.UpdatedAt = time.Unix(updated_at, 0)
+	return status, err
+}
+
+/**
+ * Report how far an upload has got, by the upload_id it was answered with,
+ * or the session it was started with, e.g.
+ *     curl localhost:8080/upload/<id>/status
+ */
+func handle_upload_status(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	status, err := db_get_upload_status(p.ByName("id"))
+	if err == sql.ErrNoRows {
+		write_error(writer, "no such upload", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("could not get status of upload %s: %v", p.ByName("id"), err)
+		write_error(writer, "could not get upload status", http.StatusInternalServerError)
+		return
+	}
+	write_json(writer, http.StatusOK, status)
+}
+
+/**
+ * Forget the state of uploads that have not changed in a long while.
+ */
+func upload_state_loop() {
+	for {
+		cutoff := time.Now().AddDate(0, 0, -KFS_UPLOAD_STATE_DAYS).Unix()
+		if _, err := db_exec(`delete from uploads where updated_at < ?`, cutoff); err != nil {
+			log.Printf("could not expire upload states: %v", err)
+		}
+		time.Sleep(time.Hour)
+	}
+}
@@ -0,0 +1,150 @@
+/*
+ *     Copyright (C) 2021 Kyle Kloberdanz
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+/**
+ * Write-once entries, so that a compromised client cannot rename, move or
+ * replace what it backed up. A held entry keeps its namespace, path and
+ * filename, and no new version can be uploaded over it, until its retention
+ * date passes, or forever if it has none. There is no way to lift a hold
+ * early: it can only be extended.
+ *
+ * Entries are held either one at a time with POST /catalog/:id/hold, or
+ * as they are added to, or moved into, a namespace with a worm_policy.
+ */
+
+type worm_policy struct {
+	// how long each entry is held for, 0 to hold it forever
+	RetentionDays int `json:"retention_days"`
+}
+
+/**
+ * The namespaces whose entries are held as they are created, e.g.
+ *     "backups": {RetentionDays: 365},
+ * Taking a namespace out of this only stops new entries being held.
+ */
+var KFS_WORM_NAMESPACES = map[string]worm_policy{}
+
+/**
+ * Whether the entry is write-once right now.
+ */
+func (entry catalog_entry) immutable() bool {
+	return entry.Held && (entry.RetainUntil == 0 || time.Now().Unix() < entry.RetainUntil)
+}
+
+func (entry catalog_entry) hold_description() string {
+	if entry.RetainUntil == 0 {
+		return "held forever"
+	}
+	return "held until " + time.Unix(entry.RetainUntil, 0).UTC().Format(time.RFC3339)
+}
+
+/**
+ * Hold the entry if its namespace is write-once, as it is when it is added
+ * to the namespace or moved into it.
+ */
+func worm_apply(entry *catalog_entry) {
+	policy, ok := settings().worm_namespaces[entry.Namespace]
+	if !ok || entry.immutable() {
+		return
+	}
+	entry.Held = true
+	entry.RetainUntil = 0
+	if policy.RetentionDays > 0 {
+		entry.RetainUntil = time.Now().AddDate(0, 0, policy.RetentionDays).Unix()
+	}
+}
+
+/**
+ * An error unless the change from old to entry leaves a held entry where it
+ * is.
+ */
+func worm_check_update(old catalog_entry, entry catalog_entry) error {
+	if !old.immutable() {
+		return nil
+	}
+	if entry.Namespace != old.Namespace || entry.Path != old.Path || entry.Filename != old.Filename {
+		return fmt.Errorf("catalog entry %d is %s", old.ID, old.hold_description())
+	}
+	if !entry.Held || (old.RetainUntil == 0 && entry.RetainUntil != 0) ||
+		(entry.RetainUntil != 0 && entry.RetainUntil < old.RetainUntil) {
+		return fmt.Errorf("the hold on catalog entry %d can only be extended", old.ID)
+	}
+	return nil
+}
+
+/**
+ * Turn away a change to a held entry, writing an error response and
+ * returning false.
+ */
+func check_mutable(writer http.ResponseWriter, entry catalog_entry) bool {
+	if !entry.immutable() {
+		return true
+	}
+	write_error(
+		writer,
+		fmt.Sprintf("catalog entry %d is %s", entry.ID, entry.hold_description()),
+		http.StatusForbidden,
+	)
+	return false
+}
+
+/**
+ * Make an entry write-once, until the given unix time or forever, e.g.
+ *     curl -X POST -F until=1893456000 localhost:8080/catalog/42/hold
+ * A hold can be extended, but never shortened or lifted, so it takes the
+ * admin token.
+ */
+func handle_catalog_hold(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	entry, ok := lookup_catalog_entry(writer, p)
+	if !ok {
+		return
+	}
+	var until int64
+	if s := request.FormValue("until"); s != "" {
+		var err error
+		until, err = strconv.ParseInt(s, 10, 64)
+		if err != nil || until <= time.Now().Unix() {
+			write_error(writer, "'until' must be a unix time in the future", http.StatusBadRequest)
+			return
+		}
+	}
+	old := entry
+	entry.Held = true
+	entry.RetainUntil = until
+	if err := worm_check_update(old, entry); err != nil {
+		write_error(writer, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := catalog_update(old, entry); err != nil {
+		log.Println(err)
+		write_error(writer, "could not hold", http.StatusInternalServerError)
+		return
+	}
+	write_json(writer, http.StatusOK, entry)
+}